@@ -5,9 +5,15 @@ IMAGE_NAME="shem-orchestrator"
 VERSION="$1"
 ARCH="$2"
 
+# build information shown by --version; the commit time keeps builds reproducible
+COMMIT="$(git rev-parse --short HEAD 2>/dev/null || true)"
+BUILD_TIME="$(git log -1 --format=%cI 2>/dev/null || true)"
+
 podman build \
     --platform linux/${ARCH} \
     --build-arg VERSION=${VERSION} \
+    --build-arg COMMIT=${COMMIT} \
+    --build-arg BUILD_TIME=${BUILD_TIME} \
     -t "${IMAGE_NAME}:${VERSION}-${ARCH}" \
     -f ../Containerfile \
     ../..
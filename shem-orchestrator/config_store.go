@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ConfigStore holds the configuration files of all modules
+// The orchestrator stores them in $SHEM_HOME/modules (see fileConfigStore); tests can use an
+// in-memory implementation instead.
+type ConfigStore interface {
+	// ModuleNames returns the names of all module directories
+	ModuleNames() ([]string, error)
+	// ModuleExists reports whether the module directory exists
+	ModuleExists(moduleName string) bool
+	// CreateModule creates the module directory; creating an existing module is not an error
+	CreateModule(moduleName string) error
+	// InstallModule creates a module with the given config files at once, so that it is never seen
+	// without some of them; installing an existing module is an error
+	InstallModule(moduleName string, files map[string][]byte) error
+	// Exists reports whether a config file exists
+	Exists(moduleName, key string) bool
+	// Read returns the content of a config file; the error matches fs.ErrNotExist if it is missing
+	Read(moduleName, key string) ([]byte, error)
+	// Write replaces the content of a config file, so that readers never see partial content
+	Write(moduleName, key string, data []byte) error
+	// Remove removes a config file; removing a missing file is not an error
+	Remove(moduleName, key string) error
+}
+
+// fileConfigStore stores each config value in the file $SHEM_HOME/modules/[module_name]/[key]
+// Module names and keys that are not a single file name are rejected, so that they cannot refer
+// to files outside of the module's directory.
+type fileConfigStore struct {
+	shemHome string
+}
+
+// errInvalidPathElement is returned for module names and keys like "../x" that are not a file name
+var errInvalidPathElement = errors.New("must be a file name without path separators")
+
+// checkPathElement checks that name can be used as a single element of a path
+func checkPathElement(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return errInvalidPathElement
+	}
+	return nil
+}
+
+func (s fileConfigStore) moduleDir(moduleName string) (string, error) {
+	if err := checkPathElement(moduleName); err != nil {
+		return "", fmt.Errorf("invalid module name %q: %w", moduleName, err)
+	}
+	return filepath.Join(s.shemHome, "modules", moduleName), nil
+}
+
+func (s fileConfigStore) path(moduleName, key string) (string, error) {
+	dir, err := s.moduleDir(moduleName)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPathElement(key); err != nil {
+		return "", fmt.Errorf("invalid config key %q: %w", key, err)
+	}
+	return filepath.Join(dir, key), nil
+}
+
+func (s fileConfigStore) ModuleNames() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.shemHome, "modules"))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		// directories of modules that are being installed are hidden, see InstallModule
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s fileConfigStore) ModuleExists(moduleName string) bool {
+	dir, err := s.moduleDir(moduleName)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+func (s fileConfigStore) CreateModule(moduleName string) error {
+	dir, err := s.moduleDir(moduleName)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// InstallModule writes the config files to a temporary directory next to the module directory and
+// renames it to the module directory
+func (s fileConfigStore) InstallModule(moduleName string, files map[string][]byte) error {
+	dir, err := s.moduleDir(moduleName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("module %s: %w", moduleName, fs.ErrExist)
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dir), "."+moduleName+".tmp-*")
+	if err != nil {
+		return err
+	}
+	for key, data := range files {
+		if err = checkPathElement(key); err != nil {
+			err = fmt.Errorf("invalid config key %q: %w", key, err)
+			break
+		}
+		if err = os.WriteFile(filepath.Join(tmpDir, key), data, 0644); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = os.Chmod(tmpDir, 0755)
+	}
+	if err == nil {
+		err = os.Rename(tmpDir, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	return nil
+}
+
+func (s fileConfigStore) Exists(moduleName, key string) bool {
+	path, err := s.path(moduleName, key)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func (s fileConfigStore) Read(moduleName, key string) ([]byte, error) {
+	path, err := s.path(moduleName, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (s fileConfigStore) Write(moduleName, key string, data []byte) error {
+	path, err := s.path(moduleName, key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+func (s fileConfigStore) Remove(moduleName, key string) error {
+	path, err := s.path(moduleName, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// retryingConfigStore retries reads that fail with a transient error, e.g. on a busy filesystem, so
+// that a module is not skipped for a whole reconciliation. Missing files, missing permissions and
+// invalid names are reported right away.
+type retryingConfigStore struct {
+	ConfigStore
+	attempts int           // reads per call, at least 1
+	delay    time.Duration // pause between two reads
+}
+
+func (s retryingConfigStore) Read(moduleName, key string) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		data, err := s.ConfigStore.Read(moduleName, key)
+		if err == nil || attempt >= s.attempts || !transientReadError(err) {
+			return data, err
+		}
+		time.Sleep(s.delay)
+	}
+}
+
+// transientReadError reports whether reading a config file again may succeed
+func transientReadError(err error) bool {
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) &&
+		!errors.Is(err, errInvalidPathElement)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it to path
+// The temporary file has a unique name, so that concurrent writers do not overwrite each other's
+// data before it is renamed.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
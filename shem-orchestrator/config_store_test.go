@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memoryConfigStore is a ConfigStore that keeps all config files in memory
+type memoryConfigStore struct {
+	modules map[string]map[string]string
+	mu      sync.Mutex
+}
+
+// newMemoryConfigManager returns a config manager backed by a memoryConfigStore that contains the
+// given modules and their config files
+func newMemoryConfigManager(t *testing.T, modules map[string]map[string]string) (*ConfigManager, *memoryConfigStore) {
+	t.Helper()
+	store := &memoryConfigStore{modules: make(map[string]map[string]string)}
+	for name, files := range modules {
+		store.modules[name] = maps.Clone(files)
+		if store.modules[name] == nil {
+			store.modules[name] = make(map[string]string)
+		}
+	}
+	return NewConfigManagerWithStore(t.TempDir(), store), store
+}
+
+func (s *memoryConfigStore) ModuleNames() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(maps.Keys(s.modules)), nil
+}
+
+func (s *memoryConfigStore) ModuleExists(moduleName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.modules[moduleName]
+	return ok
+}
+
+func (s *memoryConfigStore) CreateModule(moduleName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.modules[moduleName]; !ok {
+		s.modules[moduleName] = make(map[string]string)
+	}
+	return nil
+}
+
+func (s *memoryConfigStore) InstallModule(moduleName string, files map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.modules[moduleName]; ok {
+		return fmt.Errorf("%s: %w", moduleName, fs.ErrExist)
+	}
+	s.modules[moduleName] = make(map[string]string)
+	for key, data := range files {
+		s.modules[moduleName][key] = string(data)
+	}
+	return nil
+}
+
+func (s *memoryConfigStore) Exists(moduleName, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.modules[moduleName][key]
+	return ok
+}
+
+func (s *memoryConfigStore) Read(moduleName, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.modules[moduleName][key]
+	if !ok {
+		return nil, fmt.Errorf("%s/%s: %w", moduleName, key, fs.ErrNotExist)
+	}
+	return []byte(value), nil
+}
+
+func (s *memoryConfigStore) Write(moduleName, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, ok := s.modules[moduleName]
+	if !ok {
+		return fmt.Errorf("%s: %w", moduleName, fs.ErrNotExist)
+	}
+	files[key] = string(data)
+	return nil
+}
+
+func (s *memoryConfigStore) Remove(moduleName, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.modules[moduleName], key)
+	return nil
+}
+
+// get returns the content of a config file or "" if it does not exist
+func (s *memoryConfigStore) get(moduleName, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.modules[moduleName][key]
+}
+
+func TestMemoryConfigStore(t *testing.T) {
+	cm, store := newMemoryConfigManager(t, map[string]map[string]string{
+		"meter":   {"image": "localhost/meter", "current_version": "1.0.0\n"},
+		"storage": nil, // a directory without image is not a module
+	})
+
+	modules, err := cm.ListModules()
+	if err != nil || !slices.Equal(modules, []string{"meter"}) {
+		t.Fatalf("expected [meter], got %v (%v)", modules, err)
+	}
+
+	mc, err := cm.NewModuleConfig("meter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := mc.GetString("current_version", ""); version != "1.0.0" {
+		t.Errorf("expected version 1.0.0, got %q", version)
+	}
+	if value, err := mc.GetInt("missing", 7); err != nil || value != 7 {
+		t.Errorf("expected default for missing key, got %d (%v)", value, err)
+	}
+	if err := mc.AddToBlacklist("0.9.0"); err != nil {
+		t.Fatal(err)
+	}
+	if content := store.get("meter", "blacklist"); content != "0.9.0\n" {
+		t.Errorf("unexpected blacklist %q", content)
+	}
+
+	if _, err := cm.NewModuleConfig("unknown"); err == nil {
+		t.Error("expected error for unknown module")
+	}
+}
+
+func TestConfigPathTraversal(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	secret := filepath.Join(cm.shemHome, "secret")
+	if err := os.WriteFile(secret, []byte("password"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../..", "..", ".", "", "../../etc/passwd", "meter/../..", `..\meter`} {
+		if _, err := cm.NewModuleConfig(name); err == nil {
+			t.Errorf("expected module name %q to be rejected", name)
+		}
+		if cm.store.ModuleExists(name) || cm.store.CreateModule(name) == nil {
+			t.Errorf("expected module directory %q to be rejected", name)
+		}
+	}
+
+	mc, _ := cm.NewModuleConfig("meter")
+	for _, key := range []string{"../../secret", "../../../etc/passwd", "..", "", "storage/../../../secret"} {
+		if value, err := mc.GetString(key, "default"); !errors.Is(err, errInvalidPathElement) || value != "default" {
+			t.Errorf("expected reading key %q to be rejected, got %q, %v", key, value, err)
+		}
+		if mc.KeyExists(key) {
+			t.Errorf("expected key %q not to exist", key)
+		}
+		if err := mc.SetString(key, "overwritten"); !errors.Is(err, errInvalidPathElement) {
+			t.Errorf("expected writing key %q to be rejected, got %v", key, err)
+		}
+		if err := mc.RemoveKey(key); !errors.Is(err, errInvalidPathElement) {
+			t.Errorf("expected removing key %q to be rejected, got %v", key, err)
+		}
+	}
+	if content, err := os.ReadFile(secret); err != nil || string(content) != "password" {
+		t.Errorf("expected file outside of the module directory to be unchanged, got %q, %v", content, err)
+	}
+
+	// the module's own files are still accessible
+	if image, err := mc.GetString("image", ""); err != nil || image != "localhost/meter" {
+		t.Errorf("unexpected image %q, %v", image, err)
+	}
+}
+
+func TestWriteFileAtomicConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "current_version")
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Go(func() {
+			errs <- writeFileAtomic(path, []byte(fmt.Sprintf("1.0.%d\n", i)), 0644)
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || len(content) < len("1.0.0\n") || string(content[:4]) != "1.0." {
+		t.Errorf("expected the content of one of the writers, got %q, %v", content, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("expected mode 0644, got %v", info.Mode())
+	}
+	if tmp, _ := filepath.Glob(path + ".tmp-*"); len(tmp) != 0 {
+		t.Errorf("expected no temporary files to be left behind, got %v", tmp)
+	}
+}
+
+// The in-memory store allows driving the module manager without any config files on disk
+func TestReconcileWithMemoryConfig(t *testing.T) {
+	cm, _ := newMemoryConfigManager(t, map[string]map[string]string{
+		"meter":     {"image": "localhost/meter", "current_version": "1.0.0", "disabled": ""},
+		"optimizer": {"image": "localhost/optimizer"}, // no version installed yet
+	})
+	mm := NewModuleManager(cm)
+	var runs, exitCode int
+	fakePodman(t, mm, &runs, &exitCode)
+
+	mm.reconcileModules()
+	waitForModulesToExit(t, mm)
+	if runs != 0 {
+		t.Errorf("expected disabled module and module without version not to be started, got %d runs", runs)
+	}
+}
+
+// flakyConfigStore fails the next reads of some config files with a transient error
+type flakyConfigStore struct {
+	ConfigStore
+	failures map[string]int // remaining failures per key
+	mu       sync.Mutex
+}
+
+func (s *flakyConfigStore) Read(moduleName, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures[key] > 0 {
+		s.failures[key]--
+		return nil, &fs.PathError{Op: "read", Path: key, Err: syscall.EIO}
+	}
+	return s.ConfigStore.Read(moduleName, key)
+}
+
+func TestReconcileRetriesTransientReadErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		expectedRuns int
+		leftFailures int
+	}{
+		{"transient", configReadAttempts - 1, 1, 0},
+		{"persistent", configReadAttempts + 2, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory, _ := newMemoryConfigManager(t, map[string]map[string]string{
+				"meter": {"image": "localhost/meter", "current_version": "1.0.0"},
+			})
+			store := &flakyConfigStore{ConfigStore: memory.store, failures: map[string]int{"image": tt.failures}}
+			mm := NewModuleManager(NewConfigManagerWithStore(memory.shemHome, store))
+			var runs, exitCode int
+			fakePodman(t, mm, &runs, &exitCode)
+
+			mm.reconcileModules()
+			waitForModulesToExit(t, mm)
+			if runs != tt.expectedRuns {
+				t.Errorf("expected %d runs, got %d", tt.expectedRuns, runs)
+			}
+			if store.failures["image"] != tt.leftFailures {
+				t.Errorf("expected %d failures to be left, got %d", tt.leftFailures, store.failures["image"])
+			}
+		})
+	}
+
+	// missing files are not read again
+	memory, _ := newMemoryConfigManager(t, nil)
+	store := &flakyConfigStore{ConfigStore: memory.store}
+	cm := NewConfigManagerWithStore(memory.shemHome, store).withReadRetries(configReadAttempts, time.Hour)
+	start := time.Now()
+	if _, err := cm.store.Read("meter", "image"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected missing file, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read of missing file was retried, took %v", elapsed)
+	}
+}
+
+func TestHandleFailedModuleWithMemoryConfig(t *testing.T) {
+	cm, store := newMemoryConfigManager(t, map[string]map[string]string{
+		"meter": {"image": "localhost/meter", "current_version": "1.1.0", "fallback_version": "1.0.0"},
+	})
+	mm := NewModuleManager(cm)
+	mc, _ := cm.NewModuleConfig("meter")
+
+	mm.health["meter"] = -3
+	mm.handleFailedModule("meter", mc)
+
+	if version := store.get("meter", "current_version"); version != "1.0.0" {
+		t.Errorf("expected rollback to 1.0.0, got %q", version)
+	}
+	if mc.KeyExists("fallback_version") {
+		t.Error("expected fallback_version to be removed")
+	}
+	if blacklisted, _ := mc.IsVersionBlacklisted("1.1.0"); !blacklisted {
+		t.Error("expected failed version to be blacklisted")
+	}
+	if mm.health["meter"] != 0 {
+		t.Errorf("expected health to be reset, got %v", mm.health["meter"])
+	}
+}
+
+func TestCheckAndScheduleUpdatesWithMemoryConfig(t *testing.T) {
+	cm, _ := newMemoryConfigManager(t, map[string]map[string]string{
+		"orchestrator": {"image": "quay.io/shem/shem-orchestrator"},
+		// without public key, modules are not checked for updates, so podman is never called
+		"meter": {"image": "localhost/meter", "current_version": "1.1.0", "fallback_version": "1.0.0"},
+	})
+	um := NewUpdateManager(cm, false)
+
+	if err := um.checkAndScheduleUpdates(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// an update that has not been confirmed yet gets a new confirmation timer
+	confirmTime, ok := um.confirmationTimes["meter"]
+	if !ok {
+		t.Fatal("expected confirmation timer for meter")
+	}
+	if until := time.Until(confirmTime); until < 9*time.Minute || until > 10*time.Minute {
+		t.Errorf("expected confirmation in about 10 minutes, got %v", until)
+	}
+	if _, ok := um.confirmationTimes["orchestrator"]; ok {
+		t.Error("expected no confirmation timer for orchestrator")
+	}
+}
@@ -9,16 +9,37 @@ import (
 	"time"
 )
 
+// Defaults for retrying a heartbeat that could not be sent
+const (
+	defaultHeartbeatRetries    = 2           // additional attempts within an interval
+	defaultHeartbeatRetryDelay = time.Second // at most a tenth of the interval
+)
+
+// heartbeatEscalation is the number of intervals in a row without a heartbeat after which the
+// failure is reported as a broken notify socket
+const heartbeatEscalation = 2
+
+// minHeartbeatInterval is the shortest interval between heartbeats, so that a misconfigured
+// WatchdogSec does not make the orchestrator send heartbeats in a busy loop
+const minHeartbeatInterval = 100 * time.Millisecond
+
 type HeartbeatService struct {
 	logger       *Logger
 	notifySocket string
 	interval     time.Duration
+	retries      int                        // additional attempts if sending a heartbeat fails
+	retryDelay   time.Duration              // delay between two attempts
+	send         func(message []byte) error // sends to the notify socket, replaced in tests
+	failures     int                        // intervals in a row in which no heartbeat could be sent
 }
 
 // NewHeartbeatService creates a new systemd heartbeat service
 func NewHeartbeatService() (*HeartbeatService, error) {
-	logger := NewLogger("orchestrator-heartbeat")
+	return newHeartbeatService(NewLogger("orchestrator-heartbeat"))
+}
 
+// newHeartbeatService creates a heartbeat service that logs to logger
+func newHeartbeatService(logger *Logger) (*HeartbeatService, error) {
 	// Check if systemd watchdog is enabled
 	notifySocket := os.Getenv("NOTIFY_SOCKET")
 	if notifySocket == "" {
@@ -38,11 +59,18 @@ func NewHeartbeatService() (*HeartbeatService, error) {
 
 	// Calculate heartbeat interval (half of watchdog timeout for safety)
 	interval := time.Duration(watchdogUsec/2) * time.Microsecond
+	if interval < minHeartbeatInterval {
+		logger.Warn("heartbeat interval %v (half of WATCHDOG_USEC=%s) is too short, using %v; the watchdog may restart the orchestrator, check WatchdogSec",
+			interval, watchdogUsecStr, minHeartbeatInterval)
+		interval = minHeartbeatInterval
+	}
 
 	return &HeartbeatService{
 		logger:       logger,
 		notifySocket: notifySocket,
 		interval:     interval,
+		retries:      defaultHeartbeatRetries,
+		retryDelay:   min(defaultHeartbeatRetryDelay, interval/10),
 	}, nil
 }
 
@@ -50,23 +78,23 @@ func NewHeartbeatService() (*HeartbeatService, error) {
 func (hs *HeartbeatService) Run(ctx context.Context) {
 	hs.logger.Info("starting systemd heartbeat service with %v interval", hs.interval)
 
-	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
-	if err != nil {
-		hs.logger.Error("failed to create heartbeat socket: %v", err)
-		return
-	}
-	defer syscall.Close(fd)
+	if hs.send == nil {
+		fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+		if err != nil {
+			hs.logger.Error("failed to create heartbeat socket: %v", err)
+			return
+		}
+		defer syscall.Close(fd)
 
-	addr := &syscall.SockaddrUnix{Name: hs.notifySocket}
-	message := []byte("WATCHDOG=1")
+		addr := &syscall.SockaddrUnix{Name: hs.notifySocket}
+		hs.send = func(message []byte) error {
+			return syscall.Sendto(fd, message, 0, addr)
+		}
+	}
 
 	// immediately send first heartbeat (if this is a verification run, the last hearbeat might
 	// have been some time ago)
-	if err := syscall.Sendto(fd, message, 0, addr); err != nil {
-		hs.logger.Error("failed to send heartbeat: %v", err)
-	} else {
-		hs.logger.Debug("sent heartbeat to systemd watchdog")
-	}
+	hs.sendHeartbeat(ctx)
 
 	ticker := time.NewTicker(hs.interval)
 	defer ticker.Stop()
@@ -74,14 +102,50 @@ func (hs *HeartbeatService) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ticker.C:
-			if err := syscall.Sendto(fd, message, 0, addr); err != nil {
-				hs.logger.Error("failed to send heartbeat: %v", err)
-			} else {
-				hs.logger.Debug("sent heartbeat to systemd watchdog")
-			}
+			hs.sendHeartbeat(ctx)
 		case <-ctx.Done():
 			hs.logger.Info("stopping heartbeat service")
 			return
 		}
 	}
 }
+
+// sendHeartbeat sends a heartbeat, retrying a failed attempt up to hs.retries times
+// A heartbeat that cannot be sent in several intervals in a row is reported as a broken notify
+// socket, because the watchdog will restart the orchestrator soon. Returns false if the heartbeat
+// could not be sent.
+func (hs *HeartbeatService) sendHeartbeat(ctx context.Context) bool {
+	var err error
+	for attempt := 0; attempt <= hs.retries; attempt++ {
+		if attempt > 0 {
+			hs.logger.Warn("failed to send heartbeat (attempt %d of %d): %v", attempt, hs.retries+1, err)
+			select {
+			case <-time.After(hs.retryDelay):
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if err = hs.send([]byte("WATCHDOG=1")); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		hs.failures++
+		if hs.failures >= heartbeatEscalation {
+			hs.logger.Error("no heartbeat sent for %d intervals in a row, the systemd watchdog will restart the orchestrator; check the notify socket %s: %v",
+				hs.failures, hs.notifySocket, err)
+		} else {
+			hs.logger.Error("failed to send heartbeat: %v", err)
+		}
+		return false
+	}
+
+	if hs.failures > 0 {
+		hs.logger.Info("sent heartbeat again after %d failed intervals", hs.failures)
+		hs.failures = 0
+	} else {
+		hs.logger.Debug("sent heartbeat to systemd watchdog")
+	}
+	return true
+}
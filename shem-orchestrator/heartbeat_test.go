@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSendHeartbeatRetries(t *testing.T) {
+	// each entry is the outcome of one attempt to write to the notify socket
+	results := []error{
+		nil,                       // interval 1: sent
+		syscall.ECONNREFUSED, nil, // interval 2: sent on retry
+		syscall.ECONNREFUSED, syscall.ECONNREFUSED, syscall.ECONNREFUSED, // interval 3: failed
+		syscall.ENOENT, syscall.ENOENT, syscall.ENOENT, // interval 4: failed, escalated
+		syscall.ECONNREFUSED, nil, // interval 5: sent again
+	}
+	attempts := 0
+	hs := &HeartbeatService{
+		logger:       NewLogger("test"),
+		notifySocket: "/run/systemd/notify",
+		retries:      2,
+		send: func(message []byte) error {
+			if string(message) != "WATCHDOG=1" {
+				t.Errorf("unexpected message %q", message)
+			}
+			err := results[attempts]
+			attempts++
+			return err
+		},
+	}
+
+	expected := []struct {
+		sent     bool
+		attempts int
+		failures int
+	}{
+		{true, 1, 0},
+		{true, 3, 0},
+		{false, 6, 1},
+		{false, 9, 2},
+		{true, 11, 0},
+	}
+	for i, want := range expected {
+		sent := hs.sendHeartbeat(context.Background())
+		if sent != want.sent || attempts != want.attempts || hs.failures != want.failures {
+			t.Errorf("interval %d: expected sent=%v after %d attempts with %d failures, got sent=%v, %d attempts, %d failures",
+				i+1, want.sent, want.attempts, want.failures, sent, attempts, hs.failures)
+		}
+	}
+}
+
+func TestSendHeartbeatCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hs := &HeartbeatService{
+		logger:     NewLogger("test"),
+		retries:    2,
+		retryDelay: time.Hour,
+		send:       func([]byte) error { return errors.New("socket is broken") },
+	}
+	if hs.sendHeartbeat(ctx) {
+		t.Error("expected heartbeat not to be sent")
+	}
+}
+
+func TestHeartbeatIntervalFloor(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+	tests := []struct {
+		watchdogUsec string
+		want         time.Duration
+		warning      bool
+	}{
+		{watchdogUsec: "30000000", want: 15 * time.Second},
+		{watchdogUsec: "200000", want: 100 * time.Millisecond},
+		{watchdogUsec: "10", want: minHeartbeatInterval, warning: true},
+		{watchdogUsec: "0", want: minHeartbeatInterval, warning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.watchdogUsec, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.watchdogUsec)
+			logger := NewLogger("orchestrator-heartbeat")
+			output := captureLogger(&logger)
+			hs, err := newHeartbeatService(logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hs.interval != tt.want {
+				t.Errorf("expected interval %v, got %v", tt.want, hs.interval)
+			}
+			if warned := strings.Contains(output.String(), "too short"); warned != tt.warning {
+				t.Errorf("expected warning %v, got log %q", tt.warning, output)
+			}
+		})
+	}
+}
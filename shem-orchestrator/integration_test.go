@@ -0,0 +1,135 @@
+//go:build integration
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// The integration tests run the reference module shem_testmodule under the module manager and
+// check the whole message path from the module's stdout to a subscriber. They are only built with
+// the integration tag:
+//
+//	go test -tags integration -run Integration ./...
+//
+// By default, the module is built from ../shem_testmodule and run directly instead of in a
+// container, so neither podman nor a registry is needed. With SHEM_TESTMODULE_IMAGE and
+// SHEM_TESTMODULE_VERSION set (e.g. quay.io/shem/shem_testmodule and 0.0.1), the image is run
+// with podman instead; note that the module manager removes all other shem-module-* containers.
+
+// integrationHarness wires a ConfigManager and a ModuleManager to a runtime that launches the
+// reference module
+type integrationHarness struct {
+	t  *testing.T
+	cm *ConfigManager
+	mm *ModuleManager
+}
+
+func newIntegrationHarness(t *testing.T) *integrationHarness {
+	t.Helper()
+	shemHome := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(shemHome, "modules"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cm := NewConfigManager(shemHome)
+	h := &integrationHarness{t: t, cm: cm, mm: NewModuleManager(cm)}
+	t.Cleanup(h.mm.stopAllModules)
+
+	image, version := os.Getenv("SHEM_TESTMODULE_IMAGE"), os.Getenv("SHEM_TESTMODULE_VERSION")
+	if image == "" || version == "" {
+		image, version = "localhost/shem_testmodule", "0.0.0"
+		h.mm.podman = directRuntime(buildTestModule(t))
+	}
+	setConfig(t, cm, "testmodule", "image", image)
+	setConfig(t, cm, "testmodule", "current_version", version)
+	return h
+}
+
+// buildTestModule builds a working shem_testmodule and returns the path of the binary
+func buildTestModule(t *testing.T) string {
+	t.Helper()
+	binary := filepath.Join(t.TempDir(), "shem_testmodule")
+	cmd := exec.Command("go", "build", "-ldflags", "-X main.broken=false", "-o", binary, ".")
+	cmd.Dir = filepath.Join("..", "shem_testmodule")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build shem_testmodule: %v\n%s", err, output)
+	}
+	return binary
+}
+
+// directRuntime returns a replacement for podman that runs binary instead of starting a container
+// Other podman commands do nothing, as there are no containers to list or remove.
+func directRuntime(binary string) func(args ...string) *exec.Cmd {
+	return func(args ...string) *exec.Cmd {
+		if args[0] == "run" {
+			return exec.Command(binary)
+		}
+		return exec.Command("true")
+	}
+}
+
+// subscribe registers a subscriber like a module with the given inputs and returns a reader for
+// the messages routed to it
+func (h *integrationHarness) subscribe(name string, inputs ...string) *shemmsg.Reader {
+	r, w := io.Pipe()
+	h.t.Cleanup(func() { r.Close() })
+	h.mm.router.AddSubscriber(name, mustParseSubscriptions(h.t, inputs...), w, NewLogger("module-"+name))
+	return shemmsg.NewReader(r)
+}
+
+// next returns the next message read by reader, failing the test after timeout
+func (h *integrationHarness) next(reader *shemmsg.Reader, timeout time.Duration) shemmsg.Message {
+	h.t.Helper()
+	type result struct {
+		msg shemmsg.Message
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msg, err := reader.Read()
+		results <- result{msg, err}
+	}()
+	select {
+	case r := <-results:
+		if r.err != nil {
+			h.t.Fatalf("failed to read routed message: %v", r.err)
+		}
+		return r.msg
+	case <-time.After(timeout):
+		h.t.Fatalf("no message routed within %v", timeout)
+		return shemmsg.Message{}
+	}
+}
+
+func TestIntegrationTestModule(t *testing.T) {
+	h := newIntegrationHarness(t)
+	values := h.subscribe("sink", "testmodule.test_power")
+
+	h.mm.reconcile()
+	if state := h.mm.ModuleState("testmodule"); state != ModuleRunning {
+		t.Fatalf("expected test module to be %s, got %s (last stop reason %q)", ModuleRunning, state, h.mm.LastStopReason("testmodule"))
+	}
+
+	// the module sends the seconds of the current time right after it was started
+	msg := h.next(values, 30*time.Second)
+	value, ok := msg.Payload.(shemmsg.PointValue)
+	if msg.Name != "testmodule.test_power" || !ok || value.Value.IsMissing() || value.Value.Float64() < 0 || value.Value.Float64() >= 60 {
+		t.Fatalf("unexpected message %s", msg.Encode())
+	}
+	if _, ok := h.mm.router.LastValues()["testmodule.test_power"]; !ok {
+		t.Error("expected the value to be cached by the router")
+	}
+
+	// the module exits when it is asked to
+	h.mm.stopAllModules()
+	if reason := h.mm.LastStopReason("testmodule"); reason != StopReasonShutdown {
+		t.Errorf("expected stop reason %q, got %q", StopReasonShutdown, reason)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+)
+
+// generateSigningKey creates an Ed25519 keypair for signing module images, saves the private key to
+// path and writes the base64 public key to out, in the form expected by the public_key file
+// The private key is saved as PKCS #8 PEM file, which openssl pkeyutl can sign with, and only the
+// owner may read it. An existing file is never overwritten.
+func generateSigningKey(out io.Writer, path string) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create private key file: %w", err)
+	}
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+
+	_, err = fmt.Fprintln(out, base64.StdEncoding.EncodeToString(publicKey))
+	return err
+}
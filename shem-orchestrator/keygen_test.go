@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGenerateSigningKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing-key.pem")
+	var out bytes.Buffer
+	if err := generateSigningKey(&out, path); err != nil {
+		t.Fatal(err)
+	}
+	publicKey := strings.TrimSpace(out.String())
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected private key to be readable by the owner only, got %v", info.Mode().Perm())
+	}
+	data, _ := os.ReadFile(path)
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("expected PEM private key, got %q", data)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		t.Fatalf("expected Ed25519 key, got %T", key)
+	}
+
+	// the public key is accepted in a public_key file and verifies signatures of the private key
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "public_key": publicKey + "\n"})
+	mc, _ := cm.NewModuleConfig("meter")
+	keys, err := mc.GetPublicKeys()
+	if err != nil || !slices.Equal(keys, []string{publicKey}) {
+		t.Fatalf("expected public key to be valid, got %v, %v", keys, err)
+	}
+	const digest = "sha256:0123456789abcdef"
+	signature := ed25519.Sign(privateKey, []byte("localhost/meter:1.1.0-amd64 "+digest))
+	sigData := &SignatureData{Digest: digest, PublicKey: publicKey, Signature: base64.StdEncoding.EncodeToString(signature)}
+	um := NewUpdateManager(cm, false)
+	if err := um.verifySignature("localhost/meter", "1.1.0-amd64", sigData, keys); err != nil {
+		t.Errorf("expected signature to be verified, got %v", err)
+	}
+	if err := um.verifySignature("localhost/meter", "1.2.0-amd64", sigData, keys); err == nil {
+		t.Error("expected signature of another version to be rejected")
+	}
+
+	// an existing key is never overwritten
+	if err := generateSigningKey(&out, path); err == nil {
+		t.Error("expected existing key file to be kept")
+	}
+	if kept, _ := os.ReadFile(path); !bytes.Equal(kept, data) {
+		t.Error("expected existing key file to be unchanged")
+	}
+}
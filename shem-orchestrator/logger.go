@@ -2,12 +2,14 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 )
 
 // Very simple logger that depends on systemd to add a timestamp and interpret the log level
 type Logger struct {
 	component string
+	out       io.Writer // receives all entries instead of stdout and stderr if set, e.g. in tests
 }
 
 func NewLogger(component string) *Logger {
@@ -16,28 +18,44 @@ func NewLogger(component string) *Logger {
 	}
 }
 
+// stdout returns the writer for debug and info entries
+func (l *Logger) stdout() io.Writer {
+	if l.out != nil {
+		return l.out
+	}
+	return os.Stdout
+}
+
+// stderr returns the writer for warnings, errors and entries passed on by Log
+func (l *Logger) stderr() io.Writer {
+	if l.out != nil {
+		return l.out
+	}
+	return os.Stderr
+}
+
 func (l *Logger) Debug(format string, args ...any) {
-	fmt.Fprintf(os.Stdout, "<7>[%s] %s\n", l.component, fmt.Sprintf(format, args...))
+	fmt.Fprintf(l.stdout(), "<7>[%s] %s\n", l.component, fmt.Sprintf(format, args...))
 }
 
 func (l *Logger) Info(format string, args ...any) {
-	fmt.Fprintf(os.Stdout, "<6>[%s] %s\n", l.component, fmt.Sprintf(format, args...))
+	fmt.Fprintf(l.stdout(), "<6>[%s] %s\n", l.component, fmt.Sprintf(format, args...))
 }
 
 func (l *Logger) Warn(format string, args ...any) {
-	fmt.Fprintf(os.Stderr, "<4>[%s] %s\n", l.component, fmt.Sprintf(format, args...))
+	fmt.Fprintf(l.stderr(), "<4>[%s] %s\n", l.component, fmt.Sprintf(format, args...))
 }
 
 func (l *Logger) Error(format string, args ...any) {
-	fmt.Fprintf(os.Stderr, "<3>[%s] %s\n", l.component, fmt.Sprintf(format, args...))
+	fmt.Fprintf(l.stderr(), "<3>[%s] %s\n", l.component, fmt.Sprintf(format, args...))
 }
 
 // Log does not add a log level, but keeps it if it is provided in its arguments
 func (l *Logger) Log(format string, args ...any) {
 	msg := fmt.Sprintf(format, args...)
 	if len(msg) >= 3 && msg[0] == '<' && msg[1] >= '0' && msg[1] <= '7' && msg[2] == '>' {
-		fmt.Fprintf(os.Stderr, "%s[%s] %s\n", msg[:3], l.component, msg[3:])
+		fmt.Fprintf(l.stderr(), "%s[%s] %s\n", msg[:3], l.component, msg[3:])
 	} else {
-		fmt.Fprintf(os.Stderr, "[%s] %s\n", l.component, msg)
+		fmt.Fprintf(l.stderr(), "[%s] %s\n", l.component, msg)
 	}
 }
@@ -1,20 +1,46 @@
 package main
 
 import (
+	"cmp"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 // inject version number with ldflags="-X main.Version=0.0.0"
 var Version = "undefined"
 
+// optional build information, injected like Version (see build/build.sh); empty if unknown
+var (
+	Commit    = ""
+	BuildTime = "" // time of the commit, which keeps builds reproducible
+)
+
+// printVersion writes the version line, which scripts can rely on, followed by "key: value" lines
+// with build information for support requests
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "shem-orchestrator version %s on %s\n", Version, runtime.GOARCH)
+	fmt.Fprintf(w, "os: %s\n", runtime.GOOS)
+	fmt.Fprintf(w, "go: %s\n", runtime.Version())
+	if Commit != "" {
+		fmt.Fprintf(w, "commit: %s\n", Commit)
+	}
+	if BuildTime != "" {
+		fmt.Fprintf(w, "build time: %s\n", BuildTime)
+	}
+}
+
 func main() {
 	logger := NewLogger("orchestrator-main")
 
@@ -28,11 +54,40 @@ func main() {
 	var (
 		verificationRun = flag.Bool("verification-run", false, "Used during self-update.")
 		version         = flag.Bool("version", false, "Print version and exit.")
+		selftest        = flag.Bool("selftest", false, "Run offline self-test and exit.")
+		listVersions    = flag.Bool("list-versions", false, "List installed orchestrator binaries and exit.")
+		pendingUpdates  = flag.Bool("pending-updates", false, "List module updates that are scheduled but not applied yet and exit.")
+		modules         = flag.Bool("modules", false, "List the modules with their version and the title, protocol version and description of their images, and exit.")
+		describe        = flag.String("describe", "", "Print the podman command that starts the given module and exit.")
+		wiring          = flag.Bool("wiring", false, "List variables nobody subscribes to and subscriptions that never match, and exit.")
+		keygen          = flag.String("keygen", "", "Generate a keypair for signing module images, save the private key to the given file, print the public key and exit.")
+		sign            = flag.String("sign", "", "Sign the image:tag and digest given as arguments with the private key in the given file, print the Containerfile of the signature container and exit.")
 	)
 	flag.Parse()
 
 	if *version {
-		fmt.Printf("shem-orchestrator version %s on %s\n", Version, runtime.GOARCH)
+		printVersion(os.Stdout)
+		os.Exit(0)
+	} else if *selftest {
+		if !runSelfTest(os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	} else if *keygen != "" {
+		if err := generateSigningKey(os.Stdout, *keygen); err != nil {
+			logger.Error("failed to generate signing key: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	} else if *sign != "" {
+		if flag.NArg() != 2 {
+			logger.Error("usage: shem-orchestrator -sign signing-key.pem image:tag digest")
+			os.Exit(2)
+		}
+		if err := writeSignatureContainerfile(os.Stdout, *sign, flag.Arg(0), flag.Arg(1)); err != nil {
+			logger.Error("failed to sign image: %v", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	} else {
 		logger.Info("shem-orchestrator version %s on %s\n", Version, runtime.GOARCH)
@@ -62,17 +117,64 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *listVersions {
+		orchestratorConfig, _ := NewConfigManager(shemHome).NewModuleConfig("orchestrator")
+		if err := listOrchestratorVersions(os.Stdout, binDir, orchestratorConfig); err != nil {
+			logger.Error("failed to list orchestrator versions: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *pendingUpdates {
+		if err := listPendingUpdates(os.Stdout, NewConfigManager(shemHome)); err != nil {
+			logger.Error("failed to list pending updates: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *modules {
+		configManager := NewConfigManager(shemHome)
+		if err := listModules(os.Stdout, configManager, cliPodman(configManager)); err != nil {
+			logger.Error("failed to list modules: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *wiring {
+		if err := printWiring(os.Stdout, NewConfigManager(shemHome)); err != nil {
+			logger.Error("failed to analyze wiring: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *describe != "" {
+		configManager := NewConfigManager(shemHome)
+		if err := describeModule(os.Stdout, configManager, cliPodman(configManager), *describe); err != nil {
+			logger.Error("failed to describe module %s: %v", *describe, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if !*verificationRun {
 		// Initialize config manager to access orchestrator blacklist
 		configManager := NewConfigManager(shemHome)
 		orchestratorConfig, err := configManager.NewModuleConfig("orchestrator")
 		if err != nil {
-			logger.Error("failed to load orchestrator config: %v", err)
-			os.Exit(1)
+			// A minimal install may not have an orchestrator config; without it, there is no
+			// blacklist to record a verification run in, and all options keep their defaults
+			logger.Info("no orchestrator config, skipping check for newer orchestrator versions: %v", err)
 		}
 
 		// Check for newer orchestrator versions that need verification
-		newestVersion := findNewestOrchestratorVersion(logger, binDir, orchestratorConfig)
+		newestVersion := ""
+		if err == nil {
+			newestVersion = findNewestOrchestratorVersion(logger, binDir, orchestratorConfig)
+		}
 		if newestVersion != "" && compareVersions(newestVersion, Version) > 0 {
 			logger.Info("found newer orchestrator binary with version %s", newestVersion)
 			if err := orchestratorConfig.AddToBlacklist(newestVersion); err != nil {
@@ -84,6 +186,18 @@ func main() {
 				// Note: executeVerificationRun does not return but calls os.Exit()
 			}
 		}
+
+		// Repair the symlink if its target has been removed, so that systemd can start the
+		// orchestrator again
+		var blacklist map[string]struct{}
+		if err == nil {
+			blacklist, _ = orchestratorConfig.GetBlacklistedVersions()
+		}
+		if version, err := repairOrchestratorSymlink(binDir, blacklist); err != nil {
+			logger.Error("shem-orchestrator symlink does not point to an executable binary and cannot be repaired: %v", err)
+		} else if version != "" {
+			logger.Warn("shem-orchestrator symlink did not point to an executable binary, pointed it to version %s", version)
+		}
 	}
 
 	// Initialize orchestrator
@@ -107,7 +221,7 @@ func findNewestOrchestratorVersion(logger *Logger, binDir string, orchestratorCo
 	}
 
 	// Read bin directory for available binaries
-	entries, err := os.ReadDir(binDir)
+	versions, err := installedOrchestratorVersions(binDir)
 	if err != nil {
 		logger.Error("failed to read bin directory: %v", err)
 		return ""
@@ -115,38 +229,183 @@ func findNewestOrchestratorVersion(logger *Logger, binDir string, orchestratorCo
 
 	newestVersion := ""
 
+	for _, version := range versions {
+		// Skip if version is blacklisted
+		if _, isBlacklisted := blacklist[version]; isBlacklisted {
+			logger.Debug("skipping blacklisted version %s", version)
+			continue
+		}
+
+		// Compare with current newest candidate
+		if newestVersion == "" || compareVersions(version, newestVersion) > 0 {
+			newestVersion = version
+		}
+	}
+
+	return newestVersion
+}
+
+// installedOrchestratorVersions returns the versions of all orchestrator binaries
+// (shem-orchestrator-x.y.z) in binDir in ascending order
+func installedOrchestratorVersions(binDir string) ([]string, error) {
+	entries, err := os.ReadDir(binDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
 
-		name := entry.Name()
-
 		// Look for orchestrator binaries: shem-orchestrator-x.y.z
-		if !strings.HasPrefix(name, "shem-orchestrator-") {
+		version, found := strings.CutPrefix(entry.Name(), "shem-orchestrator-")
+		if !found {
 			continue
 		}
 
-		version := strings.TrimPrefix(name, "shem-orchestrator-")
-
 		// Skip if not a valid version format
 		if _, _, _, err := parseVersion(version); err != nil {
 			continue
 		}
 
-		// Skip if version is blacklisted
-		if _, isBlacklisted := blacklist[version]; isBlacklisted {
-			logger.Debug("skipping blacklisted version %s", version)
+		versions = append(versions, version)
+	}
+
+	slices.SortFunc(versions, compareVersions)
+	return versions, nil
+}
+
+// listOrchestratorVersions prints all installed orchestrator binaries together with their
+// blacklist status and whether the shem-orchestrator symlink points to them
+func listOrchestratorVersions(out io.Writer, binDir string, orchestratorConfig *ModuleConfig) error {
+	versions, err := installedOrchestratorVersions(binDir)
+	if err != nil {
+		return fmt.Errorf("failed to read bin directory: %w", err)
+	}
+
+	blacklist, err := orchestratorConfig.GetBlacklistedVersions()
+	if err != nil {
+		return err
+	}
+
+	// the symlink may be missing or point to a binary outside of binDir
+	activeBinary := ""
+	if target, err := os.Readlink(filepath.Join(binDir, "shem-orchestrator")); err == nil {
+		activeBinary = filepath.Base(target)
+	}
+
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tBLACKLISTED\tACTIVE")
+	for _, version := range versions {
+		_, blacklisted := blacklist[version]
+		active := activeBinary == "shem-orchestrator-"+version
+		fmt.Fprintf(w, "%s\t%s\t%s\n", version, yesNo[blacklisted], yesNo[active])
+	}
+	return w.Flush()
+}
+
+// listPendingUpdates writes a table of the modules that have an update waiting for its random
+// delay, as recorded in their pending_update files by the running orchestrator
+func listPendingUpdates(out io.Writer, configManager *ConfigManager) error {
+	moduleNames, err := configManager.ListModules()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tCURRENT\tPENDING\tDUE")
+	for _, moduleName := range moduleNames {
+		moduleConfig, _ := configManager.NewModuleConfig(moduleName)
+		pending, ok, err := moduleConfig.GetPendingUpdate()
+		if err != nil {
+			return err
+		}
+		if !ok {
 			continue
 		}
+		currentVersion, _ := moduleConfig.GetString("current_version", "")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", moduleName, currentVersion, pending.Version, pending.Due.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
 
-		// Compare with current newest candidate
-		if newestVersion == "" || compareVersions(version, newestVersion) > 0 {
-			newestVersion = version
+// cliPodman returns a function that creates podman commands with the storage options of the
+// orchestrator, for the command line options that inspect modules without running them
+func cliPodman(configManager *ConfigManager) func(args ...string) *exec.Cmd {
+	orchestratorConfig, _ := configManager.NewModuleConfig("orchestrator")
+	config, _ := LoadOrchestratorConfig(orchestratorConfig)
+	return func(args ...string) *exec.Cmd {
+		return podmanCommand(append(config.podmanStorageArgs(), args...)...)
+	}
+}
+
+// listModules writes a table of the modules with the metadata of the images of their current
+// versions; the columns of images that cannot be inspected are shown as "-"
+func listModules(out io.Writer, configManager *ConfigManager, podman func(args ...string) *exec.Cmd) error {
+	moduleNames, err := configManager.ListModules()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tVERSION\tPROTOCOL\tTITLE\tDESCRIPTION")
+	for _, moduleName := range moduleNames {
+		moduleConfig, _ := configManager.NewModuleConfig(moduleName)
+		currentVersion, _ := moduleConfig.GetString("current_version", "")
+		protocol, title, description := "-", "-", "-"
+		fullImage, err := currentImageRef(configManager, moduleName)
+		if err == nil {
+			var metadata ModuleMetadata
+			if metadata, err = inspectImageMetadata(podman, fullImage); err == nil {
+				protocol = strconv.Itoa(metadata.Protocol)
+				title = cmp.Or(metadata.Title, "-")
+				description = cmp.Or(strings.Join(strings.Fields(metadata.Description), " "), "-")
+			}
 		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", moduleName, cmp.Or(currentVersion, "-"), protocol, title, description)
 	}
+	return w.Flush()
+}
 
-	return newestVersion
+// printWiring writes the unused variables and the subscriptions that can never match, one per line
+func printWiring(out io.Writer, configManager *ConfigManager) error {
+	report, err := configManager.AnalyzeWiring()
+	if err != nil {
+		return err
+	}
+	for _, name := range report.Unused {
+		fmt.Fprintf(out, "unused: no module subscribes to %s\n", name)
+	}
+	for _, problem := range report.Dangling {
+		fmt.Fprintf(out, "dangling: %s\n", problem)
+	}
+	return nil
+}
+
+// describeModule writes the podman command that starts a module as a shell command line, see
+// ModuleManager.DescribeCommand
+func describeModule(out io.Writer, configManager *ConfigManager, podman func(args ...string) *exec.Cmd, name string) error {
+	fullImage, err := currentImageRef(configManager, name)
+	if err != nil {
+		return err
+	}
+	orchestratorConfig, _ := configManager.NewModuleConfig("orchestrator")
+	config, _ := LoadOrchestratorConfig(orchestratorConfig)
+	runArgs, err := podmanRunArgs(configManager, config, NewLogger("orchestrator-main"), name, moduleContainerName(name), fullImage)
+	if err != nil {
+		return err
+	}
+	args := podman(runArgs...).Args
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`*?[]{}()<>|&;#~") {
+			args[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	_, err = fmt.Fprintln(out, strings.Join(args, " "))
+	return err
 }
 
 // executeVerificationRun executes a newer orchestrator binary with verification run
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestBinDir creates a bin directory with empty orchestrator binaries for the given versions
+func newTestBinDir(t *testing.T, shemHome string, versions ...string) string {
+	t.Helper()
+	binDir := filepath.Join(shemHome, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range versions {
+		if err := os.WriteFile(filepath.Join(binDir, "shem-orchestrator-"+version), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return binDir
+}
+
+func TestInstalledOrchestratorVersions(t *testing.T) {
+	binDir := newTestBinDir(t, t.TempDir(), "0.0.10", "0.0.2", "invalid", "0.1")
+	if err := os.Mkdir(filepath.Join(binDir, "shem-orchestrator-0.0.99"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := installedOrchestratorVersions(binDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"0.0.2", "0.0.10"}; !slices.Equal(versions, expected) {
+		t.Errorf("expected %v, got %v", expected, versions)
+	}
+}
+
+func TestListOrchestratorVersions(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{"blacklist": "0.0.9\n"})
+	binDir := newTestBinDir(t, cm.shemHome, "0.0.7", "0.0.8", "0.0.9")
+	if err := os.Symlink(filepath.Join(binDir, "shem-orchestrator-0.0.8"), filepath.Join(binDir, "shem-orchestrator")); err != nil {
+		t.Fatal(err)
+	}
+	orchestratorConfig, _ := cm.NewModuleConfig("orchestrator")
+
+	var out bytes.Buffer
+	if err := listOrchestratorVersions(&out, binDir, orchestratorConfig); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "VERSION  BLACKLISTED  ACTIVE\n" +
+		"0.0.7    no           no\n" +
+		"0.0.8    no           yes\n" +
+		"0.0.9    yes          no\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	var out bytes.Buffer
+	printVersion(&out)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	// the first line, which includes the architecture, is kept unchanged for scripts
+	if expected := "shem-orchestrator version " + Version + " on " + runtime.GOARCH; lines[0] != expected {
+		t.Errorf("expected first line %q, got %q", expected, lines[0])
+	}
+	if !slices.Contains(lines, "go: "+runtime.Version()) {
+		t.Errorf("expected go version line in output:\n%s", out.String())
+	}
+}
+
+func TestListModules(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "current_version": "1.0.0"})
+	setConfig(t, cm, "forecast", "image", "localhost/forecast")
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	var inspected []string
+	podman := func(args ...string) *exec.Cmd {
+		inspected = append(inspected, args[len(args)-1])
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0")
+		cmd.Env = append(os.Environ(), `HELPER_OUTPUT={"`+labelTitle+`":"Smart Meter","`+labelDescription+`":"Reads the\nmeter"}`)
+		return cmd
+	}
+
+	var out bytes.Buffer
+	if err := listModules(&out, cm, podman); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "MODULE    VERSION  PROTOCOL  TITLE        DESCRIPTION\n" +
+		"forecast  -        -         -            -\n" +
+		"meter     1.0.0    1         Smart Meter  Reads the meter\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+	if !slices.Equal(inspected, []string{"localhost/meter:1.0.0-" + runtime.GOARCH}) {
+		t.Errorf("expected only the image of meter to be inspected, got %v", inspected)
+	}
+}
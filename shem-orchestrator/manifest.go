@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// Manifest describes the modules of a freshly provisioned device, read from $SHEM_HOME/manifest.json
+//
+//	{"modules": {"meter": {"image": "quay.io/shem/meter", "public_key": "...", "inputs": ["optimizer.*"]}}}
+type Manifest struct {
+	Modules map[string]ManifestModule `json:"modules"`
+}
+
+// ManifestModule holds the config files that are created for a module
+type ManifestModule struct {
+	Image     string   `json:"image"`
+	PublicKey string   `json:"public_key,omitempty"` // several keys are separated by newlines
+	Inputs    []string `json:"inputs,omitempty"`     // lines of the inputs file
+}
+
+// ReadManifest reads and checks a manifest file
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(manifest.Modules)) {
+		module := manifest.Modules[name]
+		if err := shemmsg.ValidateNamePart(name); err != nil {
+			errs = append(errs, fmt.Errorf("module %q: %w", name, err))
+		}
+		if module.Image == "" || strings.ContainsAny(module.Image, " \t\n") {
+			errs = append(errs, fmt.Errorf("module %s: invalid image %q", name, module.Image))
+		}
+		for i, key := range strings.Fields(module.PublicKey) {
+			if err := checkPublicKey(key); err != nil {
+				errs = append(errs, fmt.Errorf("module %s: public key %d %w", name, i+1, err))
+			}
+		}
+		for _, line := range module.Inputs {
+			if _, err := parseSubscription(line); err != nil {
+				errs = append(errs, fmt.Errorf("module %s: %w", name, err))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// ApplyManifest creates the modules of the manifest at path that do not exist yet and returns their
+// names; existing modules are left unchanged, so the manifest can be applied at every start. Without
+// a manifest file, nothing is done. An invalid manifest is rejected as a whole.
+func (cm *ConfigManager) ApplyManifest(path string) ([]string, error) {
+	manifest, err := ReadManifest(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var created []string
+	for _, name := range slices.Sorted(maps.Keys(manifest.Modules)) {
+		if cm.store.ModuleExists(name) {
+			continue
+		}
+		if err := cm.createModule(name, manifest.Modules[name]); err != nil {
+			return created, err
+		}
+		created = append(created, name)
+	}
+	return created, nil
+}
+
+// createModule creates the directory and config files of a module
+// All files appear at once, so that a module is never started without its public key or inputs,
+// also if the orchestrator is stopped while it creates the module.
+func (cm *ConfigManager) createModule(name string, module ManifestModule) error {
+	files := map[string][]byte{"image": []byte(module.Image)}
+	if module.PublicKey != "" {
+		files["public_key"] = []byte(module.PublicKey)
+	}
+	if len(module.Inputs) > 0 {
+		files["inputs"] = []byte(strings.Join(module.Inputs, "\n") + "\n")
+	}
+	if err := cm.store.InstallModule(name, files); err != nil {
+		return fmt.Errorf("failed to create module %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeManifest writes a manifest.json to the SHEM_HOME of cm and returns its path
+func writeManifest(t *testing.T, cm *ConfigManager, content string) string {
+	t.Helper()
+	path := filepath.Join(cm.shemHome, "manifest.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyManifest(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "current_version": "1.0.0"})
+	path := writeManifest(t, cm, `{"modules": {
+		"meter": {"image": "quay.io/shem/meter", "public_key": "`+testPublicKey+`"},
+		"optimizer": {"image": "quay.io/shem/optimizer", "public_key": "`+testPublicKey+`", "inputs": ["meter.net_power", "forecast.*"]},
+		"forecast": {"image": "quay.io/shem/forecast"}
+	}}`)
+
+	created, err := cm.ApplyManifest(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(created, []string{"forecast", "optimizer"}) {
+		t.Errorf("expected forecast and optimizer to be created, got %v", created)
+	}
+
+	optimizer, err := cm.NewModuleConfig("optimizer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, _ := optimizer.GetString("image", ""); image != "quay.io/shem/optimizer" {
+		t.Errorf("unexpected image %q", image)
+	}
+	if keys, _ := optimizer.GetPublicKeys(); !slices.Equal(keys, []string{testPublicKey}) {
+		t.Errorf("unexpected public keys %v", keys)
+	}
+	if inputs, err := optimizer.GetInputs(); err != nil || len(inputs) != 2 {
+		t.Errorf("expected two subscriptions, got %v, %v", inputs, err)
+	}
+	if problems := cm.ValidateModule("optimizer"); len(problems) != 0 {
+		t.Errorf("expected valid module, got %v", problems)
+	}
+	forecast, _ := cm.NewModuleConfig("forecast")
+	if forecast.KeyExists("public_key") || forecast.KeyExists("inputs") {
+		t.Error("expected no public_key or inputs file for forecast")
+	}
+
+	// modules are created without leaving temporary directories behind
+	entries, _ := os.ReadDir(filepath.Join(cm.shemHome, "modules"))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("unexpected temporary directory %s", entry.Name())
+		}
+	}
+
+	// existing modules are not changed
+	meter, _ := cm.NewModuleConfig("meter")
+	if image, _ := meter.GetString("image", ""); image != "localhost/meter" || meter.KeyExists("public_key") {
+		t.Errorf("expected existing module to be kept, got image %q", image)
+	}
+
+	// applying it again changes nothing
+	optimizer.SetString("inputs", "meter.*\n")
+	if created, err := cm.ApplyManifest(path); err != nil || len(created) != 0 {
+		t.Errorf("expected no modules to be created again, got %v, %v", created, err)
+	}
+	if inputs, _ := optimizer.GetString("inputs", ""); inputs != "meter.*" {
+		t.Errorf("expected changed inputs to be kept, got %q", inputs)
+	}
+}
+
+func TestApplyManifestWithoutFile(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	created, err := cm.ApplyManifest(filepath.Join(cm.shemHome, "manifest.json"))
+	if err != nil || created != nil {
+		t.Errorf("expected nothing to happen without manifest, got %v, %v", created, err)
+	}
+}
+
+func TestApplyManifestInvalid(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"syntax", `{"modules": `},
+		{"module name", `{"modules": {"my-meter": {"image": "localhost/meter"}}}`},
+		{"missing image", `{"modules": {"meter": {"public_key": "` + testPublicKey + `"}}}`},
+		{"inputs", `{"modules": {"meter": {"image": "localhost/meter", "inputs": ["optimizer..x"]}}}`},
+		{"public key", `{"modules": {"meter": {"image": "localhost/meter", "public_key": "` + testPublicKey + `\nAAAA"}}}`},
+		// one invalid module keeps the valid ones from being created
+		{"partly invalid", `{"modules": {"meter": {"image": "localhost/meter"}, "optimizer": {"image": ""}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestModule(t, "orchestrator", nil)
+			path := writeManifest(t, cm, tt.content)
+			if created, err := cm.ApplyManifest(path); err == nil || len(created) != 0 {
+				t.Errorf("expected manifest to be rejected, got %v, %v", created, err)
+			}
+			if modules, _ := cm.ListModules(); len(modules) != 0 {
+				t.Errorf("expected no modules, got %v", modules)
+			}
+		})
+	}
+}
+
+func TestInstallModule(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	store := fileConfigStore{shemHome: cm.shemHome}
+	if err := store.InstallModule("meter", map[string][]byte{"image": []byte("localhost/other")}); err == nil {
+		t.Error("expected an existing module not to be replaced")
+	}
+	if err := store.InstallModule("optimizer", map[string][]byte{"image": nil, "../x": nil}); err == nil {
+		t.Error("expected an invalid key to be rejected")
+	}
+
+	// a module that is being installed is not listed
+	if err := os.Mkdir(filepath.Join(cm.shemHome, "modules", ".optimizer.tmp-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := store.ModuleNames(); !slices.Equal(names, []string{"meter"}) {
+		t.Errorf("expected only meter to be listed, got %v", names)
+	}
+}
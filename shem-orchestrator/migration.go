@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configMigration changes the module configs from the previous config schema version to version
+// Migrations must be idempotent: if the orchestrator stops in the middle of one, it is run again
+// at the next start.
+type configMigration struct {
+	version     int
+	description string
+	migrate     func(cm *ConfigManager) error
+}
+
+// configMigrations are the migrations of the config schema in ascending order of version; the last
+// version is the one this orchestrator reads. Append new migrations, never change existing ones.
+// As a rolled back orchestrator keeps the migrated configs, a migration should leave configs that
+// older versions still understand where possible.
+var configMigrations = []configMigration{}
+
+// latestConfigVersion returns the config schema version after all migrations, 0 without any
+func latestConfigVersion(migrations []configMigration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// configVersionPath returns the path of the file that holds the config schema version
+func (cm *ConfigManager) configVersionPath() string {
+	return filepath.Join(cm.shemHome, "config_version")
+}
+
+// ConfigVersion returns the config schema version in $SHEM_HOME/config_version, 0 without the file
+func (cm *ConfigManager) ConfigVersion() (int, error) {
+	content, err := os.ReadFile(cm.configVersionPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid config version %q in %s", strings.TrimSpace(string(content)), cm.configVersionPath())
+	}
+	return version, nil
+}
+
+// MigrateConfig applies the migrations that are newer than the config schema version in order and
+// returns the descriptions of those applied. The version is recorded after each migration, so that
+// an interrupted migration is resumed with the migration that did not complete. A config version
+// newer than the last migration (e.g. after a rollback of the orchestrator) is left unchanged.
+func (cm *ConfigManager) MigrateConfig(migrations []configMigration) ([]string, error) {
+	version, err := cm.ConfigVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []string
+	for _, migration := range migrations {
+		if migration.version <= version {
+			continue
+		}
+		if err := migration.migrate(cm); err != nil {
+			return applied, fmt.Errorf("migration to config version %d (%s) failed: %w", migration.version, migration.description, err)
+		}
+		version = migration.version
+		if err := writeFileAtomic(cm.configVersionPath(), []byte(strconv.Itoa(version)+"\n"), 0644); err != nil {
+			return applied, fmt.Errorf("failed to record config version %d: %w", version, err)
+		}
+		applied = append(applied, migration.description)
+	}
+	return applied, nil
+}
+
+// renameKey returns a migration function that renames the config file oldKey of all modules to
+// newKey; modules that already have a newKey file keep it, and their oldKey file is removed
+func renameKey(oldKey, newKey string) func(cm *ConfigManager) error {
+	return func(cm *ConfigManager) error {
+		names, err := cm.store.ModuleNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !cm.store.Exists(name, oldKey) {
+				continue
+			}
+			if !cm.store.Exists(name, newKey) {
+				content, err := cm.store.Read(name, oldKey)
+				if err != nil {
+					return err
+				}
+				if err := cm.store.Write(name, newKey, content); err != nil {
+					return err
+				}
+			}
+			if err := cm.store.Remove(name, oldKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
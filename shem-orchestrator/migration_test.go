@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "update_delay": "2"})
+	setConfig(t, cm, "forecast", "image", "localhost/forecast")
+	setConfig(t, cm, "forecast", "update_delay", "3")
+	setConfig(t, cm, "forecast", "update_delay_max_hours", "5") // already migrated by hand
+
+	migrations := []configMigration{
+		{1, "rename update_delay to update_delay_max_hours", renameKey("update_delay", "update_delay_max_hours")},
+	}
+	if version, err := cm.ConfigVersion(); err != nil || version != 0 {
+		t.Fatalf("expected version 0 without config_version file, got %d, %v", version, err)
+	}
+	applied, err := cm.MigrateConfig(migrations)
+	if err != nil || len(applied) != 1 {
+		t.Fatalf("expected one migration, got %v, %v", applied, err)
+	}
+	if version, err := cm.ConfigVersion(); err != nil || version != 1 {
+		t.Errorf("expected version 1, got %d, %v", version, err)
+	}
+	meter, _ := cm.NewModuleConfig("meter")
+	forecast, _ := cm.NewModuleConfig("forecast")
+	if hours, _ := meter.GetString("update_delay_max_hours", ""); hours != "2" || meter.KeyExists("update_delay") {
+		t.Errorf("expected update_delay to be renamed, got %q", hours)
+	}
+	if hours, _ := forecast.GetString("update_delay_max_hours", ""); hours != "5" || forecast.KeyExists("update_delay") {
+		t.Errorf("expected existing update_delay_max_hours to be kept, got %q", hours)
+	}
+
+	// migrations are applied only once
+	setConfig(t, cm, "meter", "update_delay", "7")
+	if applied, err := cm.MigrateConfig(migrations); err != nil || len(applied) != 0 {
+		t.Errorf("expected no migration, got %v, %v", applied, err)
+	}
+	if !meter.KeyExists("update_delay") {
+		t.Error("expected migration not to run again")
+	}
+}
+
+func TestMigrateConfigResumes(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	var runs []int
+	failing := true
+	migration := func(version int) func(*ConfigManager) error {
+		return func(*ConfigManager) error {
+			runs = append(runs, version)
+			if version == 2 && failing {
+				return errors.New("disk full")
+			}
+			return nil
+		}
+	}
+	migrations := []configMigration{{1, "one", migration(1)}, {2, "two", migration(2)}, {3, "three", migration(3)}}
+
+	applied, err := cm.MigrateConfig(migrations)
+	if err == nil || !slices.Equal(applied, []string{"one"}) {
+		t.Fatalf("expected second migration to fail, got %v, %v", applied, err)
+	}
+	if version, _ := cm.ConfigVersion(); version != 1 {
+		t.Errorf("expected version 1 after failed migration, got %d", version)
+	}
+
+	// the next start resumes with the failed migration
+	failing = false
+	if applied, err := cm.MigrateConfig(migrations); err != nil || !slices.Equal(applied, []string{"two", "three"}) {
+		t.Errorf("expected remaining migrations, got %v, %v", applied, err)
+	}
+	if !slices.Equal(runs, []int{1, 2, 2, 3}) {
+		t.Errorf("unexpected migration runs %v", runs)
+	}
+
+	// a newer config version is kept, e.g. after a rollback
+	os.WriteFile(filepath.Join(cm.shemHome, "config_version"), []byte("5\n"), 0644)
+	if applied, err := cm.MigrateConfig(migrations); err != nil || len(applied) != 0 {
+		t.Errorf("expected no migration, got %v, %v", applied, err)
+	}
+	if version, _ := cm.ConfigVersion(); version != 5 {
+		t.Errorf("expected version 5 to be kept, got %d", version)
+	}
+
+	os.WriteFile(filepath.Join(cm.shemHome, "config_version"), []byte("two\n"), 0644)
+	if _, err := cm.MigrateConfig(migrations); err == nil {
+		t.Error("expected error for invalid config version")
+	}
+}
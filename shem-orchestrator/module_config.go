@@ -2,67 +2,310 @@ package main
 
 import (
 	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// maxMessageBytesCeiling is the highest message size limit that can be granted to a module
+const maxMessageBytesCeiling = 1000000
+
+// Resource limits of modules that do not request other limits in their memory_mb and cpus files
+const (
+	defaultMemoryMB = 100
+	defaultCPUs     = 0.1
 )
 
 // ConfigManager manages module configurations
 type ConfigManager struct {
 	shemHome string
+	store    ConfigStore
 }
 
-// NewConfigManager creates a new configuration manager
+// NewConfigManager creates a new configuration manager for the config files below shemHome
 func NewConfigManager(shemHome string) *ConfigManager {
 	return &ConfigManager{
 		shemHome: shemHome,
+		store:    fileConfigStore{shemHome},
 	}
 }
 
+// NewConfigManagerWithStore creates a configuration manager that keeps the configuration in store
+// shemHome is still used for everything that is not configuration, like binaries and mounts
+func NewConfigManagerWithStore(shemHome string, store ConfigStore) *ConfigManager {
+	return &ConfigManager{
+		shemHome: shemHome,
+		store:    store,
+	}
+}
+
+// withReadRetries returns a ConfigManager for the same config whose reads are tried up to attempts
+// times if they fail with a transient error
+func (cm *ConfigManager) withReadRetries(attempts int, delay time.Duration) *ConfigManager {
+	return &ConfigManager{
+		shemHome: cm.shemHome,
+		store:    retryingConfigStore{ConfigStore: cm.store, attempts: attempts, delay: delay},
+	}
+}
+
+// Paused reports whether the file $SHEM_HOME/paused exists, which stops all modules without
+// changing their config, e.g. during maintenance of the site
+func (cm *ConfigManager) Paused() bool {
+	_, err := os.Stat(filepath.Join(cm.shemHome, "paused"))
+	return err == nil
+}
+
 // ListModules returns all configured module names
 func (cm *ConfigManager) ListModules() ([]string, error) {
-	modulesDir := filepath.Join(cm.shemHome, "modules")
-
-	entries, err := os.ReadDir(modulesDir)
+	names, err := cm.store.ModuleNames()
 	if err != nil {
 		return []string{}, fmt.Errorf("failed to read modules directory: %w", err)
 	}
 
 	var modules []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			// Verify it's a valid module by checking for required 'image' file
-			imagePath := filepath.Join(modulesDir, entry.Name(), "image")
-			if _, err := os.Stat(imagePath); err == nil {
-				modules = append(modules, entry.Name())
-			}
+	for _, name := range names {
+		// Verify it's a valid module by checking for required 'image' file
+		if cm.store.Exists(name, "image") {
+			modules = append(modules, name)
 		}
 	}
 
 	return modules, nil
 }
 
+// IncompleteModules returns the names of module directories that lack the required image file and
+// are therefore ignored by ListModules
+func (cm *ConfigManager) IncompleteModules() ([]string, error) {
+	names, err := cm.store.ModuleNames()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read modules directory: %w", err)
+	}
+
+	var incomplete []string
+	for _, name := range names {
+		if !cm.store.Exists(name, "image") {
+			incomplete = append(incomplete, name)
+		}
+	}
+	return incomplete, nil
+}
+
+// ConfigProblem describes a config file of a module that is missing or invalid
+type ConfigProblem struct {
+	Key     string
+	Problem string
+}
+
+func (p ConfigProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Key, p.Problem)
+}
+
+// ValidateModule checks the config files of a module and returns a problem for each file that is
+// required but missing or that has an invalid value (see modules.md, "Module Configuration")
+// Returns nil if no problems were found.
+func (cm *ConfigManager) ValidateModule(moduleName string) []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(key string, err error) {
+		problems = append(problems, ConfigProblem{Key: key, Problem: err.Error()})
+	}
+
+	mc, err := cm.NewModuleConfig(moduleName)
+	if err != nil {
+		return []ConfigProblem{{Key: "", Problem: err.Error()}}
+	}
+
+	if !mc.KeyExists("image") {
+		add("image", errors.New("required file is missing"))
+	} else if image, err := mc.GetString("image", ""); err != nil {
+		add("image", err)
+	} else if image == "" {
+		add("image", errors.New("file is empty"))
+	} else if strings.ContainsAny(image, " \t\n") {
+		add("image", fmt.Errorf("invalid image name %q", image))
+	} else if _, lastPart := path.Split(image); strings.ContainsAny(lastPart, ":@") {
+		add("image", fmt.Errorf("image %q must not contain a tag or digest", image))
+	} else if _, err := signatureImage(image); err != nil {
+		add("image", err)
+	}
+
+	if version, _ := mc.GetString("current_version", ""); version != "" {
+		if _, _, _, err := parseVersion(version); err != nil {
+			add("current_version", err)
+		}
+	}
+	if _, err := mc.GetMaxMessageBytes(); err != nil {
+		add("max_message_bytes", err)
+	}
+	if _, err := mc.GetInputs(); err != nil {
+		add("inputs", err)
+	}
+	if _, err := mc.GetProducedVariables(); err != nil {
+		add("produces", err)
+	}
+	if _, err := mc.GetPublicKeys(); err != nil {
+		add("public_key", err)
+	}
+	if _, err := mc.GetValueTTLs(); err != nil {
+		add("value_ttl", err)
+	}
+	if _, err := mc.GetMergePolicies(); err != nil {
+		add("merge_policy", err)
+	}
+	if _, err := mc.GetReadyTimeout(); err != nil {
+		add("ready_timeout", err)
+	}
+	if _, err := mc.GetRestartPolicy(); err != nil {
+		add("restart_policy", err)
+	}
+	if _, err := mc.GetUpdateDelayMaxHours(DefaultOrchestratorConfig().UpdateDelayMaxHours); err != nil {
+		add("update_delay_max_hours", err)
+	}
+	if _, err := mc.GetUpdateCohort(); err != nil {
+		add("update_cohort", err)
+	}
+	if _, err := mc.GetMemoryMB(); err != nil {
+		add("memory_mb", err)
+	}
+	if _, err := mc.GetCPUs(); err != nil {
+		add("cpus", err)
+	}
+	if _, err := mc.GetInt("start_priority", 0); err != nil {
+		add("start_priority", err)
+	}
+	if mc.KeyExists("schedule") {
+		spec, _ := mc.GetString("schedule", "")
+		if _, err := parseSchedule(spec); err != nil {
+			add("schedule", err)
+		}
+	}
+	devices, _ := mc.GetLines("devices")
+	for _, device := range devices {
+		if err := validateDevice(device); err != nil {
+			add("devices", err)
+		}
+	}
+	capabilities, _ := mc.GetLines("capabilities")
+	for _, capability := range capabilities {
+		if _, err := normalizeCapability(capability); err != nil {
+			add("capabilities", err)
+		}
+	}
+
+	return problems
+}
+
 // NewModuleConfig creates a new module configuration accessor
 func (cm *ConfigManager) NewModuleConfig(moduleName string) (*ModuleConfig, error) {
 	mc := &ModuleConfig{
-		shemHome:   cm.shemHome,
+		store:      cm.store,
 		moduleName: moduleName,
 	}
 
-	modulePath := filepath.Join(cm.shemHome, "modules", moduleName)
-	if _, err := os.Stat(modulePath); os.IsNotExist(err) {
+	if err := checkPathElement(moduleName); err != nil {
+		return mc, fmt.Errorf("invalid module name %q: %w", moduleName, err)
+	}
+	if !cm.store.ModuleExists(moduleName) {
 		return mc, fmt.Errorf("module %s does not exist", moduleName)
 	}
 
 	return mc, nil
 }
 
+// ReplaceModule switches an existing module to a different image and public key while keeping its
+// storage, module-config and inputs, and restarts it. Version information and the blacklist refer
+// to the old image and are removed, so the running module is stopped, and the update manager
+// installs the newest version of the new image, which the module manager then starts.
+// The replacement is recorded in the replacement file first, which is written atomically, and then
+// applied. If the orchestrator is interrupted in between, the module manager completes it in its
+// next reconciliation, so the module directory is never left with parts of both modules.
+func (cm *ConfigManager) ReplaceModule(moduleName, newImage, newPublicKey string) error {
+	if moduleName == "orchestrator" {
+		return fmt.Errorf("the orchestrator module cannot be replaced")
+	}
+	if newImage == "" || strings.ContainsAny(newImage, " \n") {
+		return fmt.Errorf("invalid image %q for module %s", newImage, moduleName)
+	}
+
+	mc, err := cm.NewModuleConfig(moduleName)
+	if err != nil {
+		return err
+	}
+
+	replacement := "image " + newImage + "\n"
+	for line := range strings.Lines(newPublicKey) {
+		if line = strings.TrimSpace(line); line != "" {
+			replacement += "public_key " + line + "\n"
+		}
+	}
+	if err := mc.SetString("replacement", replacement); err != nil {
+		return err
+	}
+	return mc.CompleteReplacement()
+}
+
+// CompleteReplacement applies the replacement file written by ReplaceModule and removes it; it
+// does nothing if the module has none. All steps can be repeated, so an interrupted replacement
+// is completed by calling it again.
+// The public key is removed first and written last, so that one publisher's image is never
+// verified against another publisher's key in between.
+func (mc *ModuleConfig) CompleteReplacement() error {
+	content, err := mc.GetString("replacement", "")
+	if err != nil || content == "" {
+		return err
+	}
+	var image string
+	var publicKeys []string
+	for line := range strings.Lines(content) {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch key {
+		case "image":
+			image = value
+		case "public_key":
+			publicKeys = append(publicKeys, value)
+		}
+	}
+	if image == "" {
+		return fmt.Errorf("invalid replacement file of module %s: no image", mc.moduleName)
+	}
+
+	if err := mc.RemoveKey("public_key"); err != nil {
+		return err
+	}
+	if err := mc.SetString("image", image); err != nil {
+		return err
+	}
+	for _, key := range []string{"current_version", "fallback_version", "blacklist", "pending_update", "apply_update"} {
+		if err := mc.RemoveKey(key); err != nil {
+			return err
+		}
+	}
+	if len(publicKeys) > 0 {
+		if err := mc.SetString("public_key", strings.Join(publicKeys, "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+	// the restart file also lifts a quarantine of the old image
+	if err := mc.SetString("restart", ""); err != nil {
+		return err
+	}
+	return mc.RemoveKey("replacement")
+}
+
 // ModuleConfig provides access to a specific module's configuration
 type ModuleConfig struct {
-	shemHome   string
+	store      ConfigStore
 	moduleName string
 }
 
@@ -70,13 +313,12 @@ type ModuleConfig struct {
 // a missing file is ignored, all other errors are returned together with the default value
 // Reads from file $SHEM_HOME/modules/[module_name]/[key]
 func (mc *ModuleConfig) GetString(key string, defaultValue string) (string, error) {
-	filePath := filepath.Join(mc.shemHome, "modules", mc.moduleName, key)
-	content, err := os.ReadFile(filePath)
+	content, err := mc.store.Read(mc.moduleName, key)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return defaultValue, nil
 		} else {
-			return defaultValue, fmt.Errorf("failed to read configuration file %s: %w", filePath, err)
+			return defaultValue, fmt.Errorf("failed to read configuration file %s of module %s: %w", key, mc.moduleName, err)
 		}
 	}
 	return strings.TrimSpace(string(content)), nil
@@ -144,52 +386,392 @@ func (mc *ModuleConfig) GetBool(key string, defaultValue bool) (bool, error) {
 
 // KeyExists checks whether a configuration file exists
 func (mc *ModuleConfig) KeyExists(key string) bool {
-	filePath := filepath.Join(mc.shemHome, "modules", mc.moduleName, key)
-	_, err := os.Stat(filePath)
-	return err == nil
+	return mc.store.Exists(mc.moduleName, key)
 }
 
 // RemoveKey removes a configuration file
 func (mc *ModuleConfig) RemoveKey(key string) error {
-	filePath := filepath.Join(mc.shemHome, "modules", mc.moduleName, key)
-	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+	if err := mc.store.Remove(mc.moduleName, key); err != nil {
 		return fmt.Errorf("failed to remove config key %s for module %s: %w", key, mc.moduleName, err)
 	}
 	return nil
 }
 
 // SetString sets a configuration value by writing to the corresponding file
+// The file is written to a temporary file first and renamed, so readers never see partial content
 func (mc *ModuleConfig) SetString(key, value string) error {
-	filePath := filepath.Join(mc.shemHome, "modules", mc.moduleName, key)
-	err := os.WriteFile(filePath, []byte(value), 0644)
-	if err != nil {
+	if err := mc.store.Write(mc.moduleName, key, []byte(value)); err != nil {
 		return fmt.Errorf("failed to write %s file for module %s: %w", key, mc.moduleName, err)
 	}
 	return nil
 }
 
-// GetBlacklistedVersions returns all blacklisted versions for this module as a map
-func (mc *ModuleConfig) GetBlacklistedVersions() (map[string]struct{}, error) {
-	blacklist := make(map[string]struct{})
-	blacklistPath := filepath.Join(mc.shemHome, "modules", mc.moduleName, "blacklist")
-	content, err := os.ReadFile(blacklistPath)
-	if os.IsNotExist(err) {
+// SetPendingUpdate records an update that has been scheduled but not applied yet in the
+// pending_update file as "version due-time" (RFC 3339), so that operators can see it
+func (mc *ModuleConfig) SetPendingUpdate(pending PendingUpdate) error {
+	return mc.SetString("pending_update", pending.Version+" "+pending.Due.UTC().Format(time.RFC3339))
+}
+
+// GetPendingUpdate returns the update recorded by SetPendingUpdate; false if there is none
+func (mc *ModuleConfig) GetPendingUpdate() (PendingUpdate, bool, error) {
+	content, err := mc.GetString("pending_update", "")
+	if err != nil || content == "" {
+		return PendingUpdate{}, false, err
+	}
+	version, dueString, _ := strings.Cut(content, " ")
+	due, err := time.Parse(time.RFC3339, dueString)
+	if err != nil {
+		return PendingUpdate{}, false, fmt.Errorf("invalid pending_update file of module %s: %q", mc.moduleName, content)
+	}
+	return PendingUpdate{Version: version, Due: due}, true, nil
+}
+
+// ApplyVersion switches the module to version, e.g. when an update is applied. The current version
+// is kept as fallback_version unless there is one already (the last confirmed version), and the
+// pending_update and apply_update markers of updates that are satisfied by version are removed.
+// Each file is replaced atomically and current_version is written only after fallback_version, so
+// an interruption never leaves a new version without its fallback; a marker that is left behind
+// only refers to a version that is not newer anymore and is rejected when applied.
+func (mc *ModuleConfig) ApplyVersion(version string) error {
+	currentVersion, err := mc.GetString("current_version", "")
+	if err != nil {
+		return err
+	}
+	fallback, err := mc.GetString("fallback_version", "")
+	if err != nil {
+		return err
+	}
+	if fallback == "" && currentVersion != "" && currentVersion != version {
+		if err := mc.SetString("fallback_version", currentVersion); err != nil {
+			return err
+		}
+	}
+
+	if err := mc.SetString("current_version", version); err != nil {
+		return err
+	}
+
+	if pending, ok, err := mc.GetPendingUpdate(); err == nil && ok && satisfiedBy(pending.Version, version) {
+		if err := mc.RemoveKey("pending_update"); err != nil {
+			return err
+		}
+	}
+	if requested, _ := mc.GetString("apply_update", ""); satisfiedBy(requested, version) {
+		if err := mc.RemoveKey("apply_update"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// satisfiedBy reports whether marked is a valid version that is not newer than version
+func satisfiedBy(marked, version string) bool {
+	_, _, _, err := parseVersion(marked)
+	return err == nil && compareVersions(marked, version) <= 0
+}
+
+// GetUpdateDelayMaxHours returns the maximum random delay before an update of the module is
+// applied, as set in the update_delay_max_hours file; it is checked like the orchestrator option
+// UpdateDelayMaxHours. Without the file, or if its value is invalid, defaultHours is returned;
+// invalid values are also reported as error.
+func (mc *ModuleConfig) GetUpdateDelayMaxHours(defaultHours float64) (float64, error) {
+	value, err := mc.GetFloat("update_delay_max_hours", defaultHours)
+	if err != nil {
+		return defaultHours, err
+	}
+	config := OrchestratorConfig{UpdateDelayMaxHours: defaultHours}
+	option := config.option("UpdateDelayMaxHours")
+	option.key = "update_delay_max_hours"
+	return option.check(value)
+}
+
+// GetUpdateCohort returns the cohort of this device in staged rollouts of orchestrator versions, as
+// set in the update_cohort file (0-100). Without the file, or if its value is invalid, 100 is
+// returned, so that the device only receives versions that are rolled out completely; invalid
+// values are also reported as error.
+func (mc *ModuleConfig) GetUpdateCohort() (int, error) {
+	value, err := mc.GetInt("update_cohort", 100)
+	if err != nil {
+		return 100, err
+	}
+	if value < 0 || value > 100 {
+		return 100, fmt.Errorf("update_cohort must be between 0 and 100, got %d", value)
+	}
+	return value, nil
+}
+
+// GetMaxMessageBytes returns the maximum size of messages the module may send, as set in the
+// max_message_bytes file. Without the file, or if its value is invalid, shemmsg.MaxMessageBytes is
+// returned; invalid values are also reported as error.
+func (mc *ModuleConfig) GetMaxMessageBytes() (int, error) {
+	value, err := mc.GetInt("max_message_bytes", shemmsg.MaxMessageBytes)
+	if err != nil {
+		return shemmsg.MaxMessageBytes, err
+	}
+	if value < 1 || value > maxMessageBytesCeiling {
+		return shemmsg.MaxMessageBytes, fmt.Errorf("max_message_bytes must be between 1 and %d, got %d", maxMessageBytesCeiling, value)
+	}
+	return value, nil
+}
+
+// GetMemoryMB returns the memory limit in megabytes requested in the memory_mb file. Without the
+// file, or if its value is invalid, defaultMemoryMB is returned; invalid values are also reported as
+// error. The orchestrator option MaxModuleMemory is not applied here.
+func (mc *ModuleConfig) GetMemoryMB() (int, error) {
+	value, err := mc.GetInt("memory_mb", defaultMemoryMB)
+	if err != nil {
+		return defaultMemoryMB, err
+	}
+	if value < 6 { // the smallest limit podman accepts
+		return defaultMemoryMB, fmt.Errorf("memory_mb must be at least 6, got %d", value)
+	}
+	return value, nil
+}
+
+// GetCPUs returns the number of CPUs requested in the cpus file, like GetMemoryMB
+func (mc *ModuleConfig) GetCPUs() (float64, error) {
+	value, err := mc.GetFloat("cpus", defaultCPUs)
+	if err != nil {
+		return defaultCPUs, err
+	}
+	if !(value >= 0.01) {
+		return defaultCPUs, fmt.Errorf("cpus must be at least 0.01, got %g", value)
+	}
+	return value, nil
+}
+
+// GetInputs returns the subscriptions from the module's inputs file
+// A missing or empty file means that the module does not receive any messages
+func (mc *ModuleConfig) GetInputs() ([]Subscription, error) {
+	content, err := mc.GetString("inputs", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []Subscription
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		subscription, err := parseSubscription(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inputs file for module %s: %w", mc.moduleName, err)
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, scanner.Err()
+}
+
+// GetProducedVariables returns the unqualified names of the variables the module declares in its
+// produces file, one per line. Without the file, nil is returned: the module has not declared its
+// variables and is not checked (an empty file declares that it produces nothing).
+func (mc *ModuleConfig) GetProducedVariables() ([]string, error) {
+	if !mc.KeyExists("produces") {
+		return nil, nil
+	}
+	lines, err := mc.GetLines("produces")
+	if err != nil {
+		return nil, err
+	}
+	variables := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if err := shemmsg.ValidateNamePart(line); err != nil {
+			return nil, fmt.Errorf("invalid produces file for module %s: %w", mc.moduleName, err)
+		}
+		variables = append(variables, line)
+	}
+	return variables, nil
+}
+
+// GetValueTTLs returns the time after which the cached values of this module's variables are stale,
+// by variable name; "*" applies to all variables without an entry of their own
+// Each line of the value_ttl file has the form "variable duration", e.g. "net_power 5m".
+func (mc *ModuleConfig) GetValueTTLs() (map[string]time.Duration, error) {
+	lines, err := mc.GetLines("value_ttl")
+	if err != nil {
+		return nil, err
+	}
+
+	ttls := make(map[string]time.Duration, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid value_ttl line %q, expected 'variable duration'", line)
+		}
+		if fields[0] != "*" {
+			if err := shemmsg.ValidateNamePart(fields[0]); err != nil {
+				return nil, fmt.Errorf("invalid value_ttl line %q: %w", line, err)
+			}
+		}
+		ttl, err := time.ParseDuration(fields[1])
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid value_ttl line %q, expected a positive duration like 15m", line)
+		}
+		ttls[fields[0]] = ttl
+	}
+	return ttls, nil
+}
+
+// GetMergePolicies returns how timeseries of this module's variables are merged with the previous
+// timeseries of the same variable, by variable name; "*" applies to all variables without an entry
+// of their own. Variables without a policy are not merged, each timeseries replaces the last one.
+// Each line of the merge_policy file has the form "variable policy", e.g. "pv_forecast keep-existing".
+func (mc *ModuleConfig) GetMergePolicies() (map[string]shemmsg.MergePolicy, error) {
+	lines, err := mc.GetLines("merge_policy")
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]shemmsg.MergePolicy, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid merge_policy line %q, expected 'variable policy'", line)
+		}
+		if fields[0] != "*" {
+			if err := shemmsg.ValidateNamePart(fields[0]); err != nil {
+				return nil, fmt.Errorf("invalid merge_policy line %q: %w", line, err)
+			}
+		}
+		policy, err := shemmsg.ParseMergePolicy(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid merge_policy line %q: %w", line, err)
+		}
+		policies[fields[0]] = policy
+	}
+	return policies, nil
+}
+
+// GetReadyTimeout returns the time within which the module must send its first valid message to be
+// considered ready, as set in the ready_timeout file (e.g. "30s"). Without the file, or if it is
+// empty or invalid, 0 is returned: the module is ready as soon as it has been started. Invalid
+// values are also reported as error.
+func (mc *ModuleConfig) GetReadyTimeout() (time.Duration, error) {
+	value, err := mc.GetString("ready_timeout", "")
+	if err != nil || value == "" {
+		return 0, err
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid ready_timeout %q, expected a positive duration like 30s", value)
+	}
+	return timeout, nil
+}
+
+// RestartPolicy decides whether a module is started again after it has exited by itself
+type RestartPolicy string
+
+const (
+	RestartAlways    RestartPolicy = "always"     // restart after every exit (default)
+	RestartOnFailure RestartPolicy = "on-failure" // restart only after a non-zero exit
+	RestartNever     RestartPolicy = "never"      // do not restart until the config changes
+)
+
+// GetRestartPolicy returns the policy in the restart_policy file, RestartAlways without the file
+// Invalid values are reported as error, together with RestartAlways.
+func (mc *ModuleConfig) GetRestartPolicy() (RestartPolicy, error) {
+	value, err := mc.GetString("restart_policy", "")
+	if err != nil || value == "" {
+		return RestartAlways, err
+	}
+	switch policy := RestartPolicy(value); policy {
+	case RestartAlways, RestartOnFailure, RestartNever:
+		return policy, nil
+	}
+	return RestartAlways, fmt.Errorf("invalid restart_policy %q, must be %s, %s or %s", value, RestartAlways, RestartOnFailure, RestartNever)
+}
+
+// GetPublicKeys returns the base64 encoded Ed25519 public keys in the public_key file, one per
+// line; several keys allow the publisher to change keys without breaking updates. Returns nil if
+// the file is missing or empty, and an error if any key is malformed.
+func (mc *ModuleConfig) GetPublicKeys() ([]string, error) {
+	keys, err := mc.GetLines("public_key")
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if err := checkPublicKey(key); err != nil {
+			return nil, fmt.Errorf("public key %d of module %s %w", i+1, mc.moduleName, err)
+		}
+	}
+	return keys, nil
+}
+
+// checkPublicKey checks that key is a base64 encoded Ed25519 public key
+func checkPublicKey(key string) error {
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("is not valid base64: %w", err)
+	}
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return fmt.Errorf("has %d bytes, expected %d", len(keyBytes), ed25519.PublicKeySize)
+	}
+	return nil
+}
+
+// GetLines returns the non-empty lines of a configuration file with surrounding whitespace removed
+// A missing file results in an empty list
+func (mc *ModuleConfig) GetLines(key string) ([]string, error) {
+	content, err := mc.GetString(key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for line := range strings.Lines(content) {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// readBlacklist returns the entries of the blacklist file that have not expired, with the time they
+// expire; the time is zero for permanent entries
+// Each line contains a version, optionally followed by the time the entry expires (RFC 3339). Lines
+// without a valid time are permanent, which keeps hand-written blacklists working.
+func (mc *ModuleConfig) readBlacklist() (map[string]time.Time, error) {
+	blacklist := make(map[string]time.Time)
+	content, err := mc.store.Read(mc.moduleName, "blacklist")
+	if errors.Is(err, fs.ErrNotExist) {
 		return blacklist, nil
 	}
 	if err != nil {
 		return blacklist, fmt.Errorf("failed to read blacklist file for module %s: %w", mc.moduleName, err)
 	}
 
+	now := time.Now()
 	scanner := bufio.NewScanner(strings.NewReader(string(content)))
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			blacklist[line] = struct{}{}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var until time.Time
+		if len(fields) > 1 {
+			until, _ = time.Parse(time.RFC3339, fields[1])
+		}
+		if !until.IsZero() && !now.Before(until) {
+			continue // expired
 		}
+		blacklist[fields[0]] = until
 	}
 	return blacklist, scanner.Err()
 }
 
+// GetBlacklistedVersions returns all blacklisted versions for this module as a map
+// Versions whose entry has expired are not included.
+func (mc *ModuleConfig) GetBlacklistedVersions() (map[string]struct{}, error) {
+	entries, err := mc.readBlacklist()
+	blacklist := make(map[string]struct{}, len(entries))
+	for version := range entries {
+		blacklist[version] = struct{}{}
+	}
+	return blacklist, err
+}
+
 // IsVersionBlacklisted checks if a specific version is blacklisted
 func (mc *ModuleConfig) IsVersionBlacklisted(version string) (bool, error) {
 	blacklist, err := mc.GetBlacklistedVersions()
@@ -200,42 +782,52 @@ func (mc *ModuleConfig) IsVersionBlacklisted(version string) (bool, error) {
 	return exists, nil
 }
 
-// writeBlacklistFile writes the blacklist versions to file in ascending order
-func (mc *ModuleConfig) writeBlacklistFile(versions map[string]struct{}) error {
-	// Convert map to slice
-	var versionSlice []string
-	for v := range versions {
-		versionSlice = append(versionSlice, v)
-	}
-
+// writeBlacklistFile writes the blacklist versions to file in ascending order, each with the time
+// it expires unless it is permanent
+func (mc *ModuleConfig) writeBlacklistFile(entries map[string]time.Time) error {
 	// Sort versions in ascending order
-	sort.Slice(versionSlice, func(i, j int) bool {
-		return compareVersions(versionSlice[i], versionSlice[j]) < 0
-	})
+	versions := slices.SortedFunc(maps.Keys(entries), compareVersions)
 
 	// Write to file
-	blacklistPath := filepath.Join(mc.shemHome, "modules", mc.moduleName, "blacklist")
-	content := strings.Join(versionSlice, "\n")
-	if len(versionSlice) > 0 {
-		content += "\n"
+	var content strings.Builder
+	for _, version := range versions {
+		content.WriteString(version)
+		if until := entries[version]; !until.IsZero() {
+			content.WriteString(" " + until.UTC().Format(time.RFC3339))
+		}
+		content.WriteByte('\n')
 	}
 
-	if err := os.WriteFile(blacklistPath, []byte(content), 0644); err != nil {
+	if err := mc.store.Write(mc.moduleName, "blacklist", []byte(content.String())); err != nil {
 		return fmt.Errorf("failed to write blacklist file for module %s: %w", mc.moduleName, err)
 	}
 
 	return nil
 }
 
-// AddToBlacklist adds a version to the module's blacklist
+// AddToBlacklist adds a version to the module's blacklist permanently
 func (mc *ModuleConfig) AddToBlacklist(version string) error {
-	blacklist, err := mc.GetBlacklistedVersions()
+	return mc.addToBlacklist(version, time.Time{})
+}
+
+// AddToBlacklistUntil adds a version to the module's blacklist until the given time, after which
+// the entry expires and the version is tried again; an entry that lasts longer is kept
+func (mc *ModuleConfig) AddToBlacklistUntil(version string, until time.Time) error {
+	return mc.addToBlacklist(version, until)
+}
+
+// addToBlacklist adds a version to the module's blacklist until the given time, or permanently if
+// it is zero
+func (mc *ModuleConfig) addToBlacklist(version string, until time.Time) error {
+	blacklist, err := mc.readBlacklist()
 	if err != nil {
 		return fmt.Errorf("failed to read blacklist for module %s: %w", mc.moduleName, err)
 	}
 
-	// Add the version to the blacklist
-	blacklist[version] = struct{}{}
+	// Add the version to the blacklist; a permanent entry stays permanent
+	if previous, found := blacklist[version]; !found || !previous.IsZero() && (until.IsZero() || until.After(previous)) {
+		blacklist[version] = until
+	}
 
 	// Write updated blacklist back to file
 	return mc.writeBlacklistFile(blacklist)
@@ -243,7 +835,7 @@ func (mc *ModuleConfig) AddToBlacklist(version string) error {
 
 // RemoveFromBlacklist removes a version from the module's blacklist
 func (mc *ModuleConfig) RemoveFromBlacklist(version string) error {
-	blacklist, err := mc.GetBlacklistedVersions()
+	blacklist, err := mc.readBlacklist()
 	if err != nil {
 		return fmt.Errorf("failed to read blacklist for module %s: %w", mc.moduleName, err)
 	}
@@ -259,3 +851,41 @@ func (mc *ModuleConfig) RemoveFromBlacklist(version string) error {
 	// Write updated blacklist back to file
 	return mc.writeBlacklistFile(blacklist)
 }
+
+// wiring reads the inputs and produces files of the given modules; produces only has an entry for
+// modules that declare their variables. Invalid files are ignored, they are reported by
+// ValidateModule.
+func (cm *ConfigManager) wiring(moduleNames []string) (inputs map[string][]Subscription, produces map[string][]string) {
+	inputs = make(map[string][]Subscription, len(moduleNames))
+	produces = make(map[string][]string)
+	for _, name := range moduleNames {
+		moduleConfig, _ := cm.NewModuleConfig(name)
+		inputs[name], _ = moduleConfig.GetInputs()
+		if variables, err := moduleConfig.GetProducedVariables(); err == nil && variables != nil {
+			produces[name] = variables
+		}
+	}
+	return inputs, produces
+}
+
+// WiringReport lists the problems of the message graph found by AnalyzeWiring
+type WiringReport struct {
+	Unused   []string // qualified names of variables nobody subscribes to, "module.*" for modules without produces file
+	Dangling []string // descriptions of subscriptions that can never match
+}
+
+// AnalyzeWiring checks the inputs and produces files of all modules for producers whose variables
+// no module subscribes to and for subscriptions that can never match (see wiringProblems)
+// The orchestrator itself sends no variables and is not reported as unused producer.
+func (cm *ConfigManager) AnalyzeWiring() (WiringReport, error) {
+	moduleNames, err := cm.ListModules()
+	if err != nil {
+		return WiringReport{}, err
+	}
+	inputs, produces := cm.wiring(moduleNames)
+	producers := slices.DeleteFunc(slices.Clone(moduleNames), func(name string) bool { return name == "orchestrator" })
+	return WiringReport{
+		Unused:   unusedVariables(producers, inputs, produces),
+		Dangling: wiringProblems(moduleNames, inputs, produces),
+	}, nil
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// newTestModule creates a module directory below a temporary SHEM_HOME and writes the given
+// config files into it
+func newTestModule(t *testing.T, moduleName string, files map[string]string) *ConfigManager {
+	t.Helper()
+	shemHome := t.TempDir()
+	moduleDir := filepath.Join(shemHome, "modules", moduleName)
+	if err := os.MkdirAll(moduleDir, 0755); err != nil {
+		t.Fatalf("failed to create module directory: %v", err)
+	}
+	for key, value := range files {
+		if err := os.WriteFile(filepath.Join(moduleDir, key), []byte(value), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", key, err)
+		}
+	}
+	return NewConfigManager(shemHome)
+}
+
+func TestReplaceModule(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":            "quay.io/vendor_a/meter",
+		"public_key":       "keyA",
+		"current_version":  "2.0.0",
+		"fallback_version": "1.9.0",
+		"blacklist":        "1.8.0\n",
+		"inputs":           "optimizer.setpoint\n",
+	})
+	storageFile := filepath.Join(cm.shemHome, "modules", "meter", "storage", "state")
+	if err := os.MkdirAll(filepath.Dir(storageFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(storageFile, []byte("persisted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cm.ReplaceModule("meter", "quay.io/vendor_b/meter", "keyB"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mc, _ := cm.NewModuleConfig("meter")
+	if image, _ := mc.GetString("image", ""); image != "quay.io/vendor_b/meter" {
+		t.Errorf("expected new image, got %q", image)
+	}
+	if key, _ := mc.GetString("public_key", ""); key != "keyB" {
+		t.Errorf("expected new public key, got %q", key)
+	}
+	for _, key := range []string{"current_version", "fallback_version", "blacklist", "replacement"} {
+		if mc.KeyExists(key) {
+			t.Errorf("expected %s to be removed", key)
+		}
+	}
+	if !mc.KeyExists("restart") {
+		t.Error("expected the module to be restarted")
+	}
+	if inputs, _ := mc.GetString("inputs", ""); inputs != "optimizer.setpoint" {
+		t.Errorf("expected inputs to be kept, got %q", inputs)
+	}
+	content, err := os.ReadFile(storageFile)
+	if err != nil || string(content) != "persisted" {
+		t.Errorf("expected storage to survive the replace, got %q (%v)", content, err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(cm.shemHome, "modules", "meter", "*.tmp-*")); len(tmp) != 0 {
+		t.Errorf("expected no temporary file to be left behind, got %v", tmp)
+	}
+}
+
+func TestReplaceModuleWithoutPublicKey(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":      "quay.io/vendor_a/meter",
+		"public_key": "keyA",
+	})
+
+	if err := cm.ReplaceModule("meter", "localhost/meter", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mc, _ := cm.NewModuleConfig("meter")
+	if mc.KeyExists("public_key") {
+		t.Error("expected public key to be removed")
+	}
+	if mc.KeyExists("current_version") {
+		t.Error("expected the update manager to select the version")
+	}
+}
+
+func TestReplaceModuleInterrupted(t *testing.T) {
+	// the orchestrator stopped after the image had been written
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":           "quay.io/vendor_b/meter",
+		"current_version": "2.0.0",
+		"blacklist":       "1.8.0\n",
+		"replacement":     "image quay.io/vendor_b/meter\npublic_key keyB\npublic_key keyC\n",
+	})
+	mm := NewModuleManager(cm)
+	mm.podman = func(args ...string) *exec.Cmd { return exec.Command("false") }
+	mm.reconcileModules()
+
+	mc, _ := cm.NewModuleConfig("meter")
+	if mc.KeyExists("current_version") {
+		t.Error("expected the version of the old image to be removed")
+	}
+	if keys, _ := mc.GetLines("public_key"); !slices.Equal(keys, []string{"keyB", "keyC"}) {
+		t.Errorf("expected new public keys, got %v", keys)
+	}
+	if mc.KeyExists("blacklist") || mc.KeyExists("replacement") {
+		t.Error("expected the replacement to be completed")
+	}
+}
+
+func TestReplaceModuleRejected(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{"image": "quay.io/shem/shem-orchestrator"})
+
+	if err := cm.ReplaceModule("orchestrator", "quay.io/other/orchestrator", "key"); err == nil {
+		t.Error("expected replacing the orchestrator to fail")
+	}
+	if err := cm.ReplaceModule("unknown", "quay.io/other/module", "key"); err == nil {
+		t.Error("expected replacing a missing module to fail")
+	}
+}
+
+func TestGetInputs(t *testing.T) {
+	cm := newTestModule(t, "optimizer", map[string]string{
+		"image":  "localhost/optimizer",
+		"inputs": "meter.net_power\n\n   \noptimizer.device_2_setpoint setpoint\n*.temperature\n",
+	})
+	mc, _ := cm.NewModuleConfig("optimizer")
+
+	subscriptions, err := mc.GetInputs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(subscriptions) != 3 {
+		t.Fatalf("expected 3 subscriptions, got %d", len(subscriptions))
+	}
+	if subscriptions[1].Alias != "setpoint" {
+		t.Errorf("expected alias 'setpoint', got %q", subscriptions[1].Alias)
+	}
+
+	if err := mc.SetString("inputs", "meter.net_power\nnot qualified at all\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.GetInputs(); err == nil {
+		t.Error("expected error for invalid inputs file")
+	}
+
+	if err := mc.RemoveKey("inputs"); err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions, err := mc.GetInputs(); err != nil || len(subscriptions) != 0 {
+		t.Errorf("expected no subscriptions without inputs file, got %v (%v)", subscriptions, err)
+	}
+}
+
+func TestGetMaxMessageBytes(t *testing.T) {
+	cm := newTestModule(t, "forecast", map[string]string{"image": "localhost/forecast"})
+	mc, _ := cm.NewModuleConfig("forecast")
+
+	tests := []struct {
+		content  string
+		expected int
+		wantErr  bool
+	}{
+		{"", shemmsg.MaxMessageBytes, false},
+		{"50000", 50000, false},
+		{"1000000", 1000000, false},
+		{"1000001", shemmsg.MaxMessageBytes, true},
+		{"0", shemmsg.MaxMessageBytes, true},
+		{"large", shemmsg.MaxMessageBytes, true},
+	}
+	for _, tt := range tests {
+		if err := mc.SetString("max_message_bytes", tt.content); err != nil {
+			t.Fatal(err)
+		}
+		value, err := mc.GetMaxMessageBytes()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: unexpected error state: %v", tt.content, err)
+		}
+		if value != tt.expected {
+			t.Errorf("%q: expected %d, got %d", tt.content, tt.expected, value)
+		}
+	}
+}
+
+func TestGetValueTTLs(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	mc, _ := cm.NewModuleConfig("meter")
+
+	ttls, err := mc.GetValueTTLs()
+	if err != nil || len(ttls) != 0 {
+		t.Errorf("expected no TTLs without value_ttl file, got %v, %v", ttls, err)
+	}
+
+	setConfig(t, cm, "meter", "value_ttl", "net_power 5m\n\n*  1h30m\n")
+	ttls, err = mc.GetValueTTLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ttls) != 2 || ttls["net_power"] != 5*time.Minute || ttls["*"] != 90*time.Minute {
+		t.Errorf("unexpected TTLs %v", ttls)
+	}
+
+	for _, content := range []string{"net_power", "net_power 0s", "net_power -5m", "net_power soon", "net.power 5m", "net_power 5m extra"} {
+		setConfig(t, cm, "meter", "value_ttl", content)
+		if _, err := mc.GetValueTTLs(); err == nil {
+			t.Errorf("%q: expected error", content)
+		}
+	}
+}
+
+func TestGetMergePolicies(t *testing.T) {
+	cm := newTestModule(t, "forecast", map[string]string{"image": "localhost/forecast"})
+	mc, _ := cm.NewModuleConfig("forecast")
+
+	policies, err := mc.GetMergePolicies()
+	if err != nil || len(policies) != 0 {
+		t.Errorf("expected no policies without merge_policy file, got %v, %v", policies, err)
+	}
+
+	setConfig(t, cm, "forecast", "merge_policy", "pv_power keep-existing\n\n* error-on-conflict\n")
+	policies, err = mc.GetMergePolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies["pv_power"] != shemmsg.MergeKeepExisting || policies["*"] != shemmsg.MergeErrorOnConflict {
+		t.Errorf("unexpected policies %v", policies)
+	}
+
+	for _, content := range []string{"pv_power", "pv_power oldest-wins", "pv.power newer-wins", "pv_power newer-wins extra"} {
+		setConfig(t, cm, "forecast", "merge_policy", content)
+		if _, err := mc.GetMergePolicies(); err == nil {
+			t.Errorf("%q: expected error", content)
+		}
+	}
+}
+
+// failingConfigStore is a memoryConfigStore on which writing or removing one file fails, as if
+// the orchestrator was interrupted at this point
+type failingConfigStore struct {
+	*memoryConfigStore
+	failKey string
+}
+
+func (s failingConfigStore) Write(moduleName, key string, data []byte) error {
+	if key == s.failKey {
+		return errors.New("interrupted")
+	}
+	return s.memoryConfigStore.Write(moduleName, key, data)
+}
+
+func (s failingConfigStore) Remove(moduleName, key string) error {
+	if key == s.failKey {
+		return errors.New("interrupted")
+	}
+	return s.memoryConfigStore.Remove(moduleName, key)
+}
+
+func TestApplyVersion(t *testing.T) {
+	files := map[string]string{"image": "localhost/meter", "current_version": "1.0.0", "apply_update": "1.1.0",
+		"pending_update": "1.1.0 2026-10-18T03:12:45Z"}
+
+	t.Run("combined update", func(t *testing.T) {
+		cm, store := newMemoryConfigManager(t, map[string]map[string]string{"meter": files})
+		mc, _ := cm.NewModuleConfig("meter")
+		if err := mc.ApplyVersion("1.1.0"); err != nil {
+			t.Fatal(err)
+		}
+		if store.get("meter", "current_version") != "1.1.0" || store.get("meter", "fallback_version") != "1.0.0" ||
+			mc.KeyExists("apply_update") || mc.KeyExists("pending_update") {
+			t.Errorf("unexpected config %v", store.modules["meter"])
+		}
+
+		// the last confirmed version stays the fallback, and markers for a newer version are kept
+		store.Write("meter", "apply_update", []byte("1.3.0"))
+		store.Write("meter", "pending_update", []byte("1.3.0 2026-10-18T03:12:45Z"))
+		if err := mc.ApplyVersion("1.2.0"); err != nil {
+			t.Fatal(err)
+		}
+		if store.get("meter", "current_version") != "1.2.0" || store.get("meter", "fallback_version") != "1.0.0" ||
+			store.get("meter", "apply_update") != "1.3.0" || !mc.KeyExists("pending_update") {
+			t.Errorf("unexpected config %v", store.modules["meter"])
+		}
+	})
+
+	// whichever write is interrupted, the module either keeps its version or has a fallback
+	for _, failKey := range []string{"fallback_version", "current_version", "pending_update", "apply_update"} {
+		t.Run("interrupted at "+failKey, func(t *testing.T) {
+			_, store := newMemoryConfigManager(t, map[string]map[string]string{"meter": files})
+			cm := NewConfigManagerWithStore(t.TempDir(), failingConfigStore{store, failKey})
+			mc, _ := cm.NewModuleConfig("meter")
+			if err := mc.ApplyVersion("1.1.0"); err == nil {
+				t.Fatal("expected error")
+			}
+
+			switch current, fallback := store.get("meter", "current_version"), store.get("meter", "fallback_version"); {
+			case current == "1.0.0" && (fallback == "" || fallback == "1.0.0"):
+			case current == "1.1.0" && fallback == "1.0.0":
+			default:
+				t.Errorf("inconsistent config: current_version %q, fallback_version %q", current, fallback)
+			}
+			if (failKey == "pending_update" || failKey == "apply_update") && store.get("meter", "current_version") != "1.1.0" {
+				t.Errorf("expected new version to be applied before removing %s", failKey)
+			}
+		})
+	}
+}
+
+func TestGetProducedVariables(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	mc, _ := cm.NewModuleConfig("meter")
+
+	if variables, err := mc.GetProducedVariables(); err != nil || variables != nil {
+		t.Errorf("expected no declaration without produces file, got %v, %v", variables, err)
+	}
+
+	setConfig(t, cm, "meter", "produces", "")
+	if variables, err := mc.GetProducedVariables(); err != nil || variables == nil || len(variables) != 0 {
+		t.Errorf("expected empty declaration, got %v, %v", variables, err)
+	}
+
+	setConfig(t, cm, "meter", "produces", "net_power\n\n  total_energy \n")
+	if variables, err := mc.GetProducedVariables(); err != nil || !slices.Equal(variables, []string{"net_power", "total_energy"}) {
+		t.Errorf("unexpected declaration %v, %v", variables, err)
+	}
+
+	setConfig(t, cm, "meter", "produces", "meter.net_power")
+	if _, err := mc.GetProducedVariables(); err == nil {
+		t.Error("expected error for qualified name")
+	}
+}
+
+func TestGetPublicKeys(t *testing.T) {
+	const key1 = "cQyjQftwIlSGYvWjfDMzpr0B5/Lr/S8jDFfVW3hOBk0="
+	const key2 = "AAAAQftwIlSGYvWjfDMzpr0B5/Lr/S8jDFfVW3hOBk0="
+	tests := []struct {
+		name     string
+		content  string
+		expected []string // nil if the file must be rejected or is empty
+		valid    bool
+	}{
+		{"empty", "\n", nil, true},
+		{"one key", key1 + "\n", []string{key1}, true},
+		{"two keys", key1 + "\n\n " + key2 + " \n", []string{key1, key2}, true},
+		{"typo", strings.Replace(key1, "/", "!", 1), nil, false},
+		{"truncated", key1[:40] + "=", nil, false},
+		{"too long", "AAAA" + key1, nil, false},
+		{"second key invalid", key1 + "\nkey", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestModule(t, "meter", map[string]string{"public_key": tt.content})
+			mc, _ := cm.NewModuleConfig("meter")
+			keys, err := mc.GetPublicKeys()
+			if (err == nil) != tt.valid || !slices.Equal(keys, tt.expected) {
+				t.Errorf("expected %v (valid %v), got %v, %v", tt.expected, tt.valid, keys, err)
+			}
+		})
+	}
+}
+
+func TestBlacklistExpiry(t *testing.T) {
+	now := time.Now().UTC()
+	past := now.Add(-time.Hour).Format(time.RFC3339)
+	future := now.Add(time.Hour).Format(time.RFC3339)
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":     "localhost/meter",
+		"blacklist": "1.0.0\n1.1.0 " + past + "\n1.2.0 " + future + "\n1.3.0 not-a-time\n",
+	})
+	mc, _ := cm.NewModuleConfig("meter")
+
+	// entries with a time expire at that time; plain versions and invalid times are permanent
+	blacklist, err := mc.GetBlacklistedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions := slices.Sorted(maps.Keys(blacklist)); !slices.Equal(versions, []string{"1.0.0", "1.2.0", "1.3.0"}) {
+		t.Errorf("expected 1.1.0 to have expired, got %v", versions)
+	}
+	if blacklisted, _ := mc.IsVersionBlacklisted("1.1.0"); blacklisted {
+		t.Error("expected expired version not to be blacklisted")
+	}
+
+	// permanent entries stay permanent, temporary ones are only extended, and expired entries are
+	// dropped from the file
+	until := now.Add(24 * time.Hour)
+	for _, version := range []string{"1.0.0", "1.2.0", "2.0.0"} {
+		if err := mc.AddToBlacklistUntil(version, until); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mc.AddToBlacklistUntil("2.0.0", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.AddToBlacklist("3.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := mc.GetLines("blacklist")
+	expected := []string{"1.0.0", "1.2.0 " + until.Format(time.RFC3339), "1.3.0", "2.0.0 " + until.Format(time.RFC3339), "3.0.0"}
+	if !slices.Equal(content, expected) {
+		t.Errorf("expected blacklist file %q, got %q", expected, content)
+	}
+
+	// a permanent entry replaces a temporary one
+	if err := mc.AddToBlacklist("2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := mc.GetLines("blacklist"); content[3] != "2.0.0" {
+		t.Errorf("expected 2.0.0 to be blacklisted permanently, got %q", content)
+	}
+}
+
+func TestValidateModule(t *testing.T) {
+	keys := func(problems []ConfigProblem) []string {
+		var keys []string
+		for _, problem := range problems {
+			keys = append(keys, problem.Key)
+		}
+		return keys
+	}
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected []string
+	}{
+		{"valid", map[string]string{"image": "localhost/meter\n", "current_version": "1.0.0"}, nil},
+		{"missing image", map[string]string{"current_version": "1.0.0"}, []string{"image"}},
+		{"empty image", map[string]string{"image": "\n"}, []string{"image"}},
+		{"image with tag", map[string]string{"image": "localhost/meter:1.0.0-amd64"}, []string{"image"}},
+		{"unqualified image", map[string]string{"image": "shem/meter"}, []string{"image"}},
+		{"invalid values", map[string]string{
+			"image":                  "localhost/meter",
+			"current_version":        "latest",
+			"max_message_bytes":      "huge",
+			"public_key":             "keyA",
+			"merge_policy":           "* oldest-wins",
+			"start_priority":         "high",
+			"ready_timeout":          "soon",
+			"restart_policy":         "sometimes",
+			"update_delay_max_hours": "-1",
+			"update_cohort":          "101",
+			"memory_mb":              "5",
+			"cpus":                   "0",
+			"schedule":               "sometimes",
+			"devices":                "/dev/ttyUSB0\n/etc/passwd",
+		}, []string{"current_version", "max_message_bytes", "public_key", "merge_policy", "ready_timeout", "restart_policy", "update_delay_max_hours", "update_cohort", "memory_mb", "cpus", "start_priority", "schedule", "devices"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestModule(t, "meter", tt.files)
+			problems := cm.ValidateModule("meter")
+			if got := keys(problems); !slices.Equal(got, tt.expected) {
+				t.Errorf("expected problems with %v, got %v", tt.expected, problems)
+			}
+		})
+	}
+}
+
+func TestIncompleteModules(t *testing.T) {
+	cm, _ := newMemoryConfigManager(t, map[string]map[string]string{
+		"meter":    {"image": "localhost/meter"},
+		"forecast": {"current_version": "1.0.0"},
+		"tariff":   {"image": ""},
+	})
+
+	incomplete, err := cm.IncompleteModules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(incomplete, []string{"forecast"}) {
+		t.Errorf("expected only forecast to be incomplete, got %v", incomplete)
+	}
+
+	// an empty image file does not make a module incomplete, but it is reported by ValidateModule
+	if problems := cm.ValidateModule("tariff"); len(problems) != 1 || problems[0].Key != "image" {
+		t.Errorf("expected a problem with the empty image file, got %v", problems)
+	}
+}
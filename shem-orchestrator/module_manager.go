@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"maps"
@@ -20,13 +23,99 @@ import (
 
 // ModuleManager manages the lifecycle of SHEM modules
 type ModuleManager struct {
-	configManager *ConfigManager
-	logger        *Logger
-	modules       map[string]*ModuleInstance // only contains running modules
-	health        map[string]float64         // exponential decay health indicator per module
-	mu            sync.Mutex
+	configManager  *ConfigManager
+	config         OrchestratorConfig // orchestrator options read by the last reloadConfig, guarded by mu
+	storageArgs    []string           // podman arguments that select the container storage, see podmanStorageArgs, guarded by mu
+	router         *Router
+	logger         *Logger
+	modules        map[string]*ModuleInstance // only contains running modules
+	instances      map[string]*ModuleInstance // most recent instance of each module, also after it has stopped
+	health         map[string]float64         // exponential decay health indicator per module
+	failureTimes   map[string][]time.Time     // recent failures per module, see recordFailure, used by reconcileModules only
+	lastStop       map[string]StopReason      // why each module stopped the last time
+	schedules      map[string]*scheduleState  // state of scheduled modules, guarded by mu
+	held           map[string]string          // image:version of modules not restarted because of their restart_policy, guarded by mu
+	pending        map[string]bool            // modules not started by the last reconciliation because of MaxConcurrentModules, guarded by mu
+	metadata       map[string]ModuleMetadata  // metadata by image reference, see imageMetadata, guarded by mu
+	incomplete     map[string]bool            // module directories without image file that have been reported
+	restarts       map[string]time.Time       // when a restart file was last taken per module, see takeRestartRequest, used by reconcileModules only
+	configured     int                        // number of modules found by the last reconciliation, -1 before the first one
+	paused         bool                       // whether the last reconciliation found the pause marker, to log changes only
+	valueTTLErrors map[string]string          // last error reading the value_ttl file per module, to log changes only
+	securityErrors map[string]string          // why securityArgs rejected each module, to log changes only
+	wiring         map[string]bool            // subscriptions reported by checkWiring, to log changes only
+	observers      []*observerQueue           // see AddObserver, guarded by mu
+	reload         chan struct{}              // requests an immediate reconciliation, see Reload
+	now            func() time.Time           // clock, replaced in tests
+	podman         func(args ...string) *exec.Cmd
+	podmanFailures int           // consecutive failures to list containers
+	degradedUntil  time.Time     // while podman is unavailable: when to check again, zero otherwise
+	degradedDelay  time.Duration // current delay between availability checks
+	lastCleanup    time.Time     // when orphaned containers were last looked for
+	cleanupNeeded  bool          // a module was asked to stop or exited since then, guarded by mu
+	mu             sync.Mutex
+}
+
+// scheduleState tracks the runs of a module that has a schedule file
+type scheduleState struct {
+	spec      string    // content of the schedule file
+	schedule  Schedule  // nil if spec is invalid
+	next      time.Time // when the module is run next; zero if never
+	lastStart time.Time
+	failures  int // number of failed runs in a row
 }
 
+// restartDebounce is the minimum time between two restarts requested by the restart file of a
+// module; requests within this time are coalesced into one restart at its end
+const restartDebounce = 30 * time.Second
+
+// podmanFailureThreshold is the number of consecutive failures to reach podman after which the
+// module manager pauses reconciliation until podman is available again
+const podmanFailureThreshold = 3
+
+// Delays between checks whether podman is available again
+const (
+	minDegradedDelay = 20 * time.Second
+	maxDegradedDelay = 5 * time.Minute
+)
+
+// orphanCleanupInterval is the longest time between two checks for orphaned containers while no
+// module is stopped; removing containers competes with other podman operations on a busy system
+const orphanCleanupInterval = 5 * time.Minute
+
+// shutdownTimeout is the time all modules together get to exit when the orchestrator shuts down,
+// over all stages of the stop order, before their containers are removed
+const shutdownTimeout = 5 * time.Second
+
+// shutdownMessageTimeout limits how long sending the shutdown command may delay closing the stdin
+// of a module that does not read its input
+const shutdownMessageTimeout = time.Second
+
+// partialMessageTimeout is the time after which a module that stopped writing in the middle of a
+// message is reported as stuck
+const partialMessageTimeout = time.Minute
+
+// Config reads during reconciliation are tried configReadAttempts times if they fail with a
+// transient error, so that a busy filesystem does not make a module skip a reconciliation
+const (
+	configReadAttempts   = 3
+	configReadRetryDelay = 20 * time.Millisecond
+)
+
+// startupFailurePenalty is the additional health penalty for restarting a module that stopped
+// before it was ready
+const startupFailurePenalty = 0.5
+
+// maxScheduleBackoff is the longest delay before a failed run of a scheduled module is retried
+const maxScheduleBackoff = time.Hour
+
+// A module is reported as sending malformed messages if at least parseErrorThreshold of the last
+// parseErrorWindow messages it wrote could not be parsed
+const (
+	parseErrorWindow    = 100
+	parseErrorThreshold = 0.1
+)
+
 // ModuleInstance represents a running module
 type ModuleInstance struct {
 	name          string
@@ -37,56 +126,374 @@ type ModuleInstance struct {
 	stdin         io.WriteCloser
 	stdout        io.ReadCloser
 	stderr        io.ReadCloser
+	reader        *shemmsg.Reader // reads messages from stdout
 	logger        *Logger
+	parseOptions  shemmsg.ParseOptions           // limits for messages sent by the module
+	stuck         bool                           // reported as stuck in the middle of a message
+	started       time.Time                      // when the container was started
+	readyTimeout  time.Duration                  // time within which the first valid message is expected, 0 if ready when started
+	restartPolicy RestartPolicy                  // restart_policy file when started
+	state         ModuleState                    // see ModuleState, guarded by ModuleManager.mu
+	inputsError   string                         // last error reading the inputs file, to log changes only
+	produces      []string                       // variables declared in the produces file when started, nil if none
+	undeclared    map[string]bool                // undeclared variables that have been reported, used by readMessages only
+	maxHorizon    time.Duration                  // maximum time span of a timeseries (MaxTimeSeriesHours when started), 0 if unlimited
+	overHorizon   map[string]bool                // timeseries that have been reported as too long, used by readMessages only
+	mergePolicies map[string]shemmsg.MergePolicy // merge_policy file when started, nil if timeseries are not merged
+	lastSeries    map[string]shemmsg.TimeSeries  // last merged timeseries by variable, used by readMessages only
+	parseStats    ParseStats                     // messages read since the start, guarded by ModuleManager.mu
+	handshake     *shemmsg.Handshake             // capabilities sent by the module, nil if none, guarded by ModuleManager.mu
+	window        ParseStats                     // messages read in the current window of parseErrorWindow messages, used by readMessages only
+	malformed     bool                           // reported as sending malformed messages, used by readMessages only
+	done          chan struct{}                  // closed when the module has exited
+	stopReason    StopReason                     // why the module was asked to stop, guarded by ModuleManager.mu
+}
+
+// moduleStdin serializes the messages written to a module's stdin by the router and by
+// signalShutdown. Close does not wait for a pending write, so that it also unblocks a write to a
+// module that does not read its input.
+type moduleStdin struct {
+	w  io.WriteCloser
+	mu sync.Mutex
+}
+
+func (s *moduleStdin) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *moduleStdin) Close() error {
+	return s.w.Close()
 }
 
+// StopReason describes why a module stopped
+type StopReason string
+
+const (
+	StopReasonCrashed       StopReason = "crashed" // exited without being asked to stop
+	StopReasonDisabled      StopReason = "disabled"
+	StopReasonRestart       StopReason = "restart requested"
+	StopReasonConfigChanged StopReason = "config changed"
+	StopReasonUpdated       StopReason = "updated"
+	StopReasonRemoved       StopReason = "removed from config"
+	StopReasonShutdown      StopReason = "orchestrator shutdown"
+	StopReasonPaused        StopReason = "paused"                // $SHEM_HOME/paused was created
+	StopReasonCompleted     StopReason = "completed"             // scheduled module or module with restart_policy finished its run
+	StopReasonNotReady      StopReason = "not ready"             // no valid message within ready_timeout
+	StopReasonQuarantined   StopReason = "quarantined"           // failed file was created
+	StopReasonStartupFailed StopReason = "failed during startup" // crashed before it was ready
+)
+
 // NewModuleManager creates a new module manager
 func NewModuleManager(configManager *ConfigManager) *ModuleManager {
-	return &ModuleManager{
-		configManager: configManager,
-		logger:        NewLogger("orchestrator-modulemanager"),
-		modules:       make(map[string]*ModuleInstance),
-		health:        make(map[string]float64),
+	mm := &ModuleManager{
+		configManager:  configManager.withReadRetries(configReadAttempts, configReadRetryDelay),
+		router:         NewRouter(),
+		logger:         NewLogger("orchestrator-modulemanager"),
+		modules:        make(map[string]*ModuleInstance),
+		instances:      make(map[string]*ModuleInstance),
+		health:         make(map[string]float64),
+		failureTimes:   make(map[string][]time.Time),
+		lastStop:       make(map[string]StopReason),
+		schedules:      make(map[string]*scheduleState),
+		held:           make(map[string]string),
+		metadata:       make(map[string]ModuleMetadata),
+		incomplete:     make(map[string]bool),
+		restarts:       make(map[string]time.Time),
+		configured:     -1,
+		valueTTLErrors: make(map[string]string),
+		securityErrors: make(map[string]string),
+		wiring:         make(map[string]bool),
+		reload:         make(chan struct{}, 1),
+		now:            time.Now,
+	}
+	mm.podman = func(args ...string) *exec.Cmd {
+		return podmanCommand(append(mm.podmanStorageArgs(), args...)...)
 	}
+	mm.reloadConfig()
+	mm.reloadStorageArgs()
+	return mm
+}
+
+// podmanCommand returns a command that runs podman with the given arguments
+func podmanCommand(args ...string) *exec.Cmd {
+	return exec.Command("podman", args...)
+}
+
+// reloadConfig re-reads the orchestrator options, so that changes take effect without a restart
+// Invalid options keep their default value; they are reported by the update manager.
+func (mm *ModuleManager) reloadConfig() {
+	orchestratorConfig, _ := mm.configManager.NewModuleConfig("orchestrator")
+	config, _ := LoadOrchestratorConfig(orchestratorConfig)
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.config = config
+}
+
+// currentConfig returns the orchestrator options read by the last call to reloadConfig
+func (mm *ModuleManager) currentConfig() OrchestratorConfig {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.config
+}
+
+// reloadStorageArgs takes the podman storage arguments from the current orchestrator options
+// (option PodmanStorageOptions). This is only done at construction and by Reload, so that a changed
+// option does not make podman look for the running containers in a different storage.
+func (mm *ModuleManager) reloadStorageArgs() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.storageArgs = mm.config.podmanStorageArgs()
+}
+
+// podmanStorageArgs returns the podman arguments that select the container storage
+func (mm *ModuleManager) podmanStorageArgs() []string {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.storageArgs
 }
 
 // Run runs the module manager reconciliation loop until ctx is canceled
 func (mm *ModuleManager) Run(ctx context.Context) {
 	mm.logger.Info("starting module manager")
 
-	// Run reconciliation immediately, then every 10 seconds
+	// Run reconciliation immediately, then at the configured interval
 	mm.reconcile()
 
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	timer := time.NewTimer(mm.reconcileInterval())
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			mm.reconcile()
+			timer.Reset(mm.reconcileInterval())
+		case <-mm.reload:
+			mm.reconcile()
+			timer.Reset(mm.reconcileInterval())
 		case <-ctx.Done():
 			mm.stopAllModules()
+			mm.closeObservers()
+			mm.router.Close()
 			mm.logger.Info("module manager stopped")
 			return
 		}
 	}
 }
 
+// Reload re-reads the orchestrator options, including the podman storage options, and requests a
+// reconciliation without waiting for the reconcile interval, so that changed module configs take
+// effect immediately
+func (mm *ModuleManager) Reload() {
+	mm.reloadConfig()
+	mm.reloadStorageArgs()
+	select {
+	case mm.reload <- struct{}{}:
+	default: // a reconciliation is already pending
+	}
+}
+
+// reconcileInterval returns the interval between two reconciliations (orchestrator option
+// ReconcileIntervalSeconds)
+func (mm *ModuleManager) reconcileInterval() time.Duration {
+	return time.Duration(mm.currentConfig().ReconcileIntervalSeconds * float64(time.Second))
+}
+
+// activeModules returns the number of modules whose container is starting, running or stopping
+func (mm *ModuleManager) activeModules() int {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	active := 0
+	for _, instance := range mm.instances {
+		if instance.state == ModuleStarting || instance.state == ModuleRunning || instance.state == ModuleStopping {
+			active++
+		}
+	}
+	return active
+}
+
+// byStartPriority sorts module names so that modules with a higher start_priority are started
+// first; modules with the same priority keep their order
+func (mm *ModuleManager) byStartPriority(moduleNames []string) []string {
+	priorities := make(map[string]int, len(moduleNames))
+	for _, name := range moduleNames {
+		moduleConfig, _ := mm.configManager.NewModuleConfig(name)
+		priorities[name], _ = moduleConfig.GetInt("start_priority", 0) // invalid values are reported by ValidateModule
+	}
+	sorted := slices.Clone(moduleNames)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		return cmp.Compare(priorities[b], priorities[a])
+	})
+	return sorted
+}
+
 // reconcile compares desired module state (config on disk) with actual state and acts
+// If podman cannot be reached, modules are neither started nor removed; after repeated failures,
+// the module manager enters degraded mode and only checks with increasing delays whether podman is
+// available again.
 func (mm *ModuleManager) reconcile() {
-	// First step: remove orphaned containers (containers might be asked to stop in the second and
-	// third step; if they have not stopped running when this function is called again ten
-	// seconds later, they will be removed here)
-	mm.cleanupOrphanedContainers()
+	now := mm.now()
+	if mm.Degraded() && now.Before(mm.degradedUntil) {
+		return
+	}
+	mm.reloadConfig()
 
+	// First step: list the containers, which tells whether podman is available, and remove orphaned
+	// containers (containers might be asked to stop in the second and third step; if they have not
+	// stopped running when this function is called again, they will be removed here)
+	due := mm.cleanupDue(now)
+	containers, err := mm.listContainers()
+	if err != nil {
+		mm.podmanUnavailable(now, err)
+		return
+	}
+	if mm.Degraded() {
+		mm.logger.Info("podman is available again, resuming reconciliation")
+	}
+	mm.mu.Lock()
+	mm.podmanFailures = 0
+	mm.degradedUntil = time.Time{}
+	mm.degradedDelay = 0
+	if due {
+		mm.lastCleanup = now
+	}
+	mm.mu.Unlock()
+	if due {
+		if err := mm.removeOrphanedContainers(containers); err != nil {
+			mm.logger.Error("%v", err)
+		}
+	}
+
+	mm.reconcileModules()
+}
+
+// cleanupDue reports whether reconcile has to remove orphaned containers: after a module was
+// asked to stop or exited, while podman is failing, and otherwise every orphanCleanupInterval
+// Clears the record of stopped modules, so that modules stopping during the cleanup are not missed.
+func (mm *ModuleManager) cleanupDue(now time.Time) bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if !mm.cleanupNeeded && mm.podmanFailures == 0 && now.Sub(mm.lastCleanup) < orphanCleanupInterval {
+		return false
+	}
+	mm.cleanupNeeded = false
+	return true
+}
+
+// podmanUnavailable records a failure to reach podman and enters or stays in degraded mode
+func (mm *ModuleManager) podmanUnavailable(now time.Time, err error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	mm.podmanFailures++
+	switch {
+	case mm.podmanFailures < podmanFailureThreshold:
+		mm.logger.Error("failed to list containers, skipping reconciliation: %v", err)
+		return
+	case mm.podmanFailures == podmanFailureThreshold:
+		mm.logger.Warn("podman is unavailable, pausing reconciliation until it is back: %v", err)
+		mm.degradedDelay = minDegradedDelay
+	default:
+		mm.logger.Debug("podman is still unavailable: %v", err)
+		mm.degradedDelay = min(2*mm.degradedDelay, maxDegradedDelay)
+	}
+	mm.degradedUntil = now.Add(mm.degradedDelay)
+}
+
+// Degraded reports whether reconciliation is paused because podman is unavailable
+func (mm *ModuleManager) Degraded() bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return !mm.degradedUntil.IsZero()
+}
+
+// reportIncompleteModules warns once about each module directory that is ignored because it has no
+// image file, which usually means that provisioning the module went wrong
+func (mm *ModuleManager) reportIncompleteModules() {
+	names, err := mm.configManager.IncompleteModules()
+	if err != nil {
+		return
+	}
+
+	incomplete := make(map[string]bool)
+	for _, name := range names {
+		incomplete[name] = true
+		if mm.incomplete[name] {
+			continue
+		}
+		var problems []string
+		for _, problem := range mm.configManager.ValidateModule(name) {
+			problems = append(problems, problem.String())
+		}
+		mm.logger.Warn("ignoring module directory %s: %s", name, strings.Join(problems, "; "))
+	}
+	mm.incomplete = incomplete
+}
+
+// reportConfiguredModules records the number of configured modules (without the orchestrator)
+// An operator looking at a fresh install learns once why nothing is happening.
+func (mm *ModuleManager) reportConfiguredModules(moduleNames []string) {
+	count := len(moduleNames)
+	if slices.Contains(moduleNames, "orchestrator") {
+		count--
+	}
+
+	mm.mu.Lock()
+	previous := mm.configured
+	mm.configured = count
+	mm.mu.Unlock()
+
+	if count == 0 && previous != 0 {
+		mm.logger.Info("no modules configured in %s, waiting for modules to be added",
+			filepath.Join(mm.configManager.shemHome, "modules"))
+	}
+}
+
+// ConfiguredModules returns the number of modules found by the last reconciliation, not counting
+// the orchestrator itself, or -1 if there has been no reconciliation yet
+func (mm *ModuleManager) ConfiguredModules() int {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.configured
+}
+
+// reconcileModules starts, stops and restarts modules according to their config
+func (mm *ModuleManager) reconcileModules() {
 	// Second step: reconcile desired state
 	moduleNames, err := mm.configManager.ListModules()
 	if err != nil {
 		mm.logger.Error("failed to list modules: %v", err)
 		return
 	}
+	mm.reportIncompleteModules()
+	mm.reportConfiguredModules(moduleNames)
+	mm.reloadValueTTLs(moduleNames)
+	config := mm.currentConfig()
+	mm.router.SetTrimTrailingMissing(config.TrimTrailingMissing)
+	mm.checkWiring(moduleNames)
+	if mm.checkPaused() {
+		return
+	}
 
-	for _, name := range moduleNames {
+	// Starting many modules at once causes a load spike, so starts can be spread over several
+	// reconciliations, starting modules with a higher priority first
+	maxStarts := config.MaxStartsPerReconcile
+	starts := 0
+
+	// On small devices, the number of modules that run at the same time can be limited; modules
+	// with a higher priority get the capacity first, the others wait until modules stop
+	maxConcurrent := config.MaxConcurrentModules
+	active := mm.activeModules()
+	pending := make(map[string]bool)
+	defer func() {
+		mm.mu.Lock()
+		mm.pending = pending
+		mm.mu.Unlock()
+	}()
+
+	for _, name := range mm.byStartPriority(moduleNames) {
 		if name == "orchestrator" {
 			continue
 		}
@@ -100,27 +507,52 @@ func (mm *ModuleManager) reconcile() {
 
 		moduleConfig, _ := mm.configManager.NewModuleConfig(name)
 
+		// Complete a replacement that was interrupted, see ConfigManager.ReplaceModule
+		if moduleConfig.KeyExists("replacement") {
+			mm.logger.Info("completing replacement of module %s", name)
+			if err := moduleConfig.CompleteReplacement(); err != nil {
+				mm.logger.Error("failed to complete replacement of module %s: %v", name, err)
+				continue
+			}
+		}
+
 		// Handle disabled file
 		if moduleConfig.KeyExists("disabled") {
 			if instance != nil {
 				mm.logger.Info("module %s is disabled, stopping", name)
-				mm.requestStop(instance)
+				mm.requestStop(instance, StopReasonDisabled)
 			}
+			mm.release(name)
 			continue
 		}
 
 		// Handle restart file
-		if moduleConfig.KeyExists("restart") {
-			moduleConfig.RemoveKey("restart")
+		released := false
+		if mm.takeRestartRequest(name, moduleConfig) {
+			released = mm.release(name)
+			if moduleConfig.KeyExists("failed") {
+				mm.logger.Info("quarantine of module %s lifted", name)
+				moduleConfig.RemoveKey("failed")
+				mm.health[name] = 0
+				delete(mm.failureTimes, name)
+			}
 			if instance != nil {
 				mm.logger.Info("restart requested for module %s", name)
-				mm.requestStop(instance)
+				mm.requestStop(instance, StopReasonRestart)
 				continue
 			} else {
 				mm.logger.Info("restart requested for module %s, but it is not running", name)
 			}
 		}
 
+		// Quarantined modules are not started until a restart is requested
+		if moduleConfig.KeyExists("failed") {
+			if instance != nil {
+				mm.requestStop(instance, StopReasonQuarantined)
+			}
+			continue
+		}
+
 		// If module is running, check if config changed
 		if instance != nil {
 			version, err := moduleConfig.GetString("current_version", "")
@@ -136,11 +568,22 @@ func (mm *ModuleManager) reconcile() {
 			}
 
 			if instance.image == image && instance.version == version {
-				continue // up to date, nothing to do
+				if !mm.checkReady(instance) {
+					continue
+				}
+				mm.reloadInputs(instance, moduleConfig)
+				mm.checkPartialMessage(instance)
+				continue // up to date, nothing else to do
+			}
+
+			if instance.image == image {
+				mm.logger.Info("version of module %s changed from %s to %s, restarting", name, instance.version, version)
+				mm.requestStop(instance, StopReasonUpdated)
+				continue
 			}
 
 			mm.logger.Info("config changed for module %s, restarting", name)
-			mm.requestStop(instance)
+			mm.requestStop(instance, StopReasonConfigChanged)
 			continue
 		}
 
@@ -157,19 +600,82 @@ func (mm *ModuleManager) reconcile() {
 			continue
 		}
 
-		// Apply health penalty for restart
-		mm.health[name] -= 1.0
-		mm.logger.Info("module %s restarting, health: %.2f", name, mm.health[name])
+		// Modules requesting devices or capabilities that are not allowed are not started
+		if _, err := securityArgs(mm.configManager, name); err != nil {
+			if err.Error() != mm.securityErrors[name] {
+				mm.logger.Error("module %s is not started: %v", name, err)
+				mm.securityErrors[name] = err.Error()
+			}
+			continue
+		}
+		delete(mm.securityErrors, name)
+
+		// Modules that exited under restart_policy on-failure or never stay stopped until their
+		// config changes
+		held, changed := mm.restartHeld(name, image, version, moduleConfig)
+		if held {
+			continue
+		}
+		released = released || changed
+
+		// Scheduled modules are only started when their next run is due
+		scheduled, due := mm.scheduledRunDue(name, moduleConfig)
+		if scheduled && !due {
+			continue
+		}
+
+		if maxConcurrent > 0 && active >= maxConcurrent {
+			pending[name] = true
+			mm.mu.Lock()
+			reported := mm.pending[name]
+			mm.mu.Unlock()
+			if !reported {
+				mm.logger.Info("module %s is not started, %d modules are running (MaxConcurrentModules)", name, active)
+			}
+			continue
+		}
 
-		// Check if module is failing too much
-		if mm.health[name] < -2.7 {
-			mm.handleFailedModule(name, moduleConfig)
+		if maxStarts > 0 && starts >= maxStarts {
+			mm.logger.Debug("start of module %s deferred to next reconciliation", name)
 			continue
 		}
+		starts++
+
+		// Apply health penalty for restart; runs of scheduled modules only count after a failure,
+		// and modules released by their restart policy start afresh
+		// Modules that failed before they were ready get an additional penalty, so that a version
+		// that cannot even start is rolled back sooner than one that crashes now and then
+		if (!scheduled || mm.scheduleFailures(name) > 0) && !released {
+			mm.health[name] -= 1.0
+			if reason := mm.LastStopReason(name); reason == StopReasonNotReady || reason == StopReasonStartupFailed {
+				mm.health[name] -= startupFailurePenalty
+			}
+			mm.logger.Info("module %s restarting, health: %.2f", name, mm.health[name])
+
+			// Check if module is failing too much: a module with a fallback version is rolled back
+			// when its health is low, the others are quarantined after too many failures
+			var failing bool
+			if fallback, _ := moduleConfig.GetString("fallback_version", ""); fallback != "" {
+				failing = mm.health[name] < -2.7
+			} else {
+				failing = mm.recordFailure(name)
+			}
+			if failing {
+				mm.handleFailedModule(name, moduleConfig)
+				continue
+			}
+		}
 
 		if err := mm.startModule(name, image, version); err != nil {
 			mm.logger.Error("failed to start module %s: %v", name, err)
+			if scheduled {
+				mm.mu.Lock()
+				mm.scheduledRunFinished(name, false)
+				mm.mu.Unlock()
+			}
+			continue
 		}
+		active++
 	}
 
 	// Third step: stop modules no longer in config
@@ -189,15 +695,241 @@ func (mm *ModuleManager) reconcile() {
 
 	for _, instance := range toStop {
 		mm.logger.Info("module %s removed from config, stopping", instance.name)
-		mm.requestStop(instance)
+		mm.requestStop(instance, StopReasonRemoved)
+	}
+	mm.forgetRemovedModules(desired)
+}
+
+// forgetRemovedModules drops the state kept per module for modules that are no longer in config, so
+// that it does not pile up and a module added again under the same name starts afresh. The most
+// recent instance and its stop reason are kept, as they are still reported.
+func (mm *ModuleManager) forgetRemovedModules(desired map[string]struct{}) {
+	deleteRemoved(mm.health, desired)
+	deleteRemoved(mm.failureTimes, desired)
+	deleteRemoved(mm.restarts, desired)
+	deleteRemoved(mm.valueTTLErrors, desired)
+	deleteRemoved(mm.securityErrors, desired)
+	mm.mu.Lock()
+	deleteRemoved(mm.schedules, desired)
+	deleteRemoved(mm.held, desired)
+	mm.mu.Unlock()
+}
+
+// deleteRemoved deletes the entries of modules that are not in desired from m
+func deleteRemoved[V any](m map[string]V, desired map[string]struct{}) {
+	maps.DeleteFunc(m, func(name string, _ V) bool {
+		_, ok := desired[name]
+		return !ok
+	})
+}
+
+// checkPaused stops all running modules while $SHEM_HOME/paused exists and reports whether modules
+// are paused; once the file is removed, the modules are started again by the reconciliation
+func (mm *ModuleManager) checkPaused() bool {
+	paused := mm.configManager.Paused()
+	if paused != mm.paused {
+		if paused {
+			mm.logger.Info("%s exists, stopping all modules until it is removed", filepath.Join(mm.configManager.shemHome, "paused"))
+		} else {
+			mm.logger.Info("pause ended, starting modules again")
+		}
+		mm.paused = paused
+	}
+	if !paused {
+		return false
+	}
+
+	mm.mu.Lock()
+	running := slices.Collect(maps.Values(mm.modules))
+	mm.pending = nil // no module waits for capacity while all are stopped
+	mm.mu.Unlock()
+	for _, instance := range running {
+		mm.requestStop(instance, StopReasonPaused)
+	}
+	return true
+}
+
+// reloadValueTTLs passes the value_ttl files of all modules to the router; invalid files are
+// logged once and ignored
+func (mm *ModuleManager) reloadValueTTLs(moduleNames []string) {
+	ttls := make(map[string]map[string]time.Duration)
+	for _, name := range moduleNames {
+		moduleConfig, _ := mm.configManager.NewModuleConfig(name)
+		moduleTTLs, err := moduleConfig.GetValueTTLs()
+		if err != nil {
+			if err.Error() != mm.valueTTLErrors[name] {
+				mm.logger.Error("ignoring value_ttl file of module %s: %v", name, err)
+				mm.valueTTLErrors[name] = err.Error()
+			}
+			continue
+		}
+		delete(mm.valueTTLErrors, name)
+		if len(moduleTTLs) > 0 {
+			ttls[name] = moduleTTLs
+		}
+	}
+	mm.router.SetValueTTLs(ttls)
+}
+
+// checkWiring warns about subscriptions that can never match because the producing module or
+// variable does not exist (see wiringProblems); each problem is logged once
+func (mm *ModuleManager) checkWiring(moduleNames []string) {
+	inputs, produces := mm.configManager.wiring(moduleNames)
+	current := make(map[string]bool)
+	for _, problem := range wiringProblems(moduleNames, inputs, produces) {
+		if !mm.wiring[problem] {
+			mm.logger.Warn("%s", problem)
+		}
+		current[problem] = true
+	}
+	mm.wiring = current
+}
+
+// checkPartialMessage reports a running module that has written part of a message but not its end
+// for longer than partialMessageTimeout, which is different from a module that has nothing to send
+func (mm *ModuleManager) checkPartialMessage(instance *ModuleInstance) {
+	if instance.reader == nil {
+		return
 	}
+	since, pending := instance.reader.PendingSince()
+	stuck := pending && mm.now().Sub(since) >= partialMessageTimeout
+	if stuck && !instance.stuck {
+		instance.logger.Warn("stuck in the middle of a message since %s", since.Format(time.TimeOnly))
+	} else if !stuck && instance.stuck {
+		instance.logger.Info("no longer stuck in the middle of a message")
+	}
+	instance.stuck = stuck
+}
+
+// reloadInputs re-reads the inputs file of a running module and updates its subscriptions, so that
+// changes take effect without restarting the module. If the file is invalid, the previous
+// subscriptions are kept.
+func (mm *ModuleManager) reloadInputs(instance *ModuleInstance, moduleConfig *ModuleConfig) {
+	subscriptions, err := moduleConfig.GetInputs()
+	if err != nil {
+		if err.Error() != instance.inputsError {
+			instance.logger.Error("keeping previous subscriptions: %v", err)
+			instance.inputsError = err.Error()
+		}
+		return
+	}
+	instance.inputsError = ""
+	mm.router.UpdateSubscriptions(instance.name, subscriptions)
+}
+
+// scheduledRunDue reports whether the module has a schedule file and, if so, whether its next run
+// is due. A new or changed schedule takes effect immediately: interval schedules run the module
+// right away, cron schedules at the next matching time.
+func (mm *ModuleManager) scheduledRunDue(name string, moduleConfig *ModuleConfig) (scheduled, due bool) {
+	spec, _ := moduleConfig.GetString("schedule", "")
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	if spec == "" {
+		delete(mm.schedules, name)
+		return false, false
+	}
+
+	now := mm.now()
+	state := mm.schedules[name]
+	if state == nil || state.spec != spec {
+		schedule, err := parseSchedule(spec)
+		state = &scheduleState{spec: spec, schedule: schedule}
+		mm.schedules[name] = state
+		if err != nil {
+			mm.logger.Error("module %s is not started: %v", name, err)
+			return true, false
+		}
+
+		if _, isInterval := schedule.(intervalSchedule); isInterval {
+			state.next = now
+		} else {
+			state.next = schedule.Next(now)
+		}
+		if state.next.IsZero() {
+			mm.logger.Error("module %s is not started: schedule %q never matches", name, spec)
+		} else {
+			mm.logger.Info("module %s is scheduled, next run at %s", name, state.next.Format(time.RFC3339))
+		}
+	}
+
+	if state.schedule == nil || state.next.IsZero() || now.Before(state.next) {
+		return true, false
+	}
+	state.lastStart = now
+	return true, true
+}
+
+// scheduleFailures returns the number of failed runs in a row of a scheduled module
+func (mm *ModuleManager) scheduleFailures(name string) int {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if state := mm.schedules[name]; state != nil {
+		return state.failures
+	}
+	return 0
+}
+
+// scheduledRunFinished determines the next run of a scheduled module after a run has ended
+// Failed runs are retried with exponential backoff. Must be called with mm.mu held.
+func (mm *ModuleManager) scheduledRunFinished(name string, success bool) {
+	state := mm.schedules[name]
+	if state == nil || state.schedule == nil {
+		return
+	}
+
+	now := mm.now()
+	if success {
+		state.failures = 0
+		state.next = state.schedule.Next(state.lastStart)
+		if state.next.Before(now) {
+			state.next = state.schedule.Next(now)
+		}
+	} else {
+		state.failures++
+		backoff := maxScheduleBackoff
+		if state.failures <= 6 {
+			backoff = min(time.Minute<<(state.failures-1), maxScheduleBackoff)
+		}
+		state.next = now.Add(backoff)
+	}
+	mm.logger.Info("next run of module %s at %s", name, state.next.Format(time.RFC3339))
+}
+
+// restartHeld reports whether a module that exited is kept from being restarted by its
+// restart_policy, and whether it has just been released: a new image or version, or a policy that
+// now allows the restart, releases the module
+func (mm *ModuleManager) restartHeld(name, image, version string, moduleConfig *ModuleConfig) (held, released bool) {
+	mm.mu.Lock()
+	ref, ok := mm.held[name]
+	mm.mu.Unlock()
+	if !ok {
+		return false, false
+	}
+	policy, _ := moduleConfig.GetRestartPolicy()
+	if ref == moduleImageRef(image, version) && policy != RestartAlways {
+		return true, false
+	}
+	mm.logger.Info("config of module %s changed, starting it again", name)
+	return false, mm.release(name)
+}
+
+// release allows a module that was held by its restart_policy to be started again and reports
+// whether it was held
+func (mm *ModuleManager) release(name string) bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	_, held := mm.held[name]
+	delete(mm.held, name)
+	return held
 }
 
 // handleFailedModule handles a module whose health has dropped below the threshold
 func (mm *ModuleManager) handleFailedModule(name string, moduleConfig *ModuleConfig) {
 	fallback, _ := moduleConfig.GetString("fallback_version", "")
 	if fallback == "" {
-		mm.logger.Warn("module %s health critical (%.2f) but no fallback_version available", name, mm.health[name])
+		mm.quarantine(name, moduleConfig)
 		return
 	}
 
@@ -224,19 +956,71 @@ func (mm *ModuleManager) handleFailedModule(name string, moduleConfig *ModuleCon
 
 	// Reset health for fresh start with fallback version
 	mm.health[name] = 0
+	delete(mm.failureTimes, name)
+}
+
+// recordFailure records that a module is started again after it failed, i.e. crashed or did not
+// become ready, and reports whether it has failed QuarantineFailures times within
+// QuarantineWindowMinutes (orchestrator options). Restarts after other stop reasons, e.g. a
+// requested restart or an update, are not failures.
+func (mm *ModuleManager) recordFailure(name string) bool {
+	switch mm.LastStopReason(name) {
+	case StopReasonCrashed, StopReasonNotReady, StopReasonStartupFailed:
+	default:
+		return false
+	}
+	config := mm.currentConfig()
+	window := time.Duration(config.QuarantineWindowMinutes * float64(time.Minute))
+
+	now := mm.now()
+	recent := mm.failureTimes[name][:0]
+	for _, t := range mm.failureTimes[name] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	mm.failureTimes[name] = append(recent, now)
+	return len(mm.failureTimes[name]) >= config.QuarantineFailures
+}
+
+// quarantine stops trying to start a module that keeps failing and has no fallback version left,
+// by creating its failed file; the module stays quarantined until a restart file is created
+func (mm *ModuleManager) quarantine(name string, moduleConfig *ModuleConfig) {
+	currentVersion, _ := moduleConfig.GetString("current_version", "")
+	reason := fmt.Sprintf("version %s failed %d times within QuarantineWindowMinutes and there is no fallback_version", currentVersion, len(mm.failureTimes[name]))
+	mm.logger.Error("module %s is quarantined: %s; create its restart file to try again", name, reason)
+	if err := moduleConfig.SetString("failed", mm.now().Format(time.RFC3339)+" "+reason); err != nil {
+		mm.logger.Error("failed to create failed file for %s: %v", name, err)
+	}
 }
 
 // cleanupOrphanedContainers finds and removes any shem-module-* containers
 // that are not tracked by the module manager
-func (mm *ModuleManager) cleanupOrphanedContainers() {
-	out, err := exec.Command("podman", "ps", "-a",
+// If the containers cannot be listed, nothing is removed and the error is returned
+func (mm *ModuleManager) cleanupOrphanedContainers() error {
+	containers, err := mm.listContainers()
+	if err != nil {
+		return err
+	}
+	return mm.removeOrphanedContainers(containers)
+}
+
+// listContainers returns the names and states of all shem-module-* containers, one container per
+// line, as listed by podman ps
+func (mm *ModuleManager) listContainers() ([]byte, error) {
+	out, err := mm.podman("ps", "-a",
 		"--filter", "name=shem-module-",
-		"--format", "{{.Names}}").Output()
+		"--format", "{{.Names}} {{.State}}").Output()
 	if err != nil {
-		mm.logger.Error("failed to list containers: %v", err)
-		return
+		return nil, fmt.Errorf("failed to list containers: %w", err)
 	}
+	return out, nil
+}
 
+// removeOrphanedContainers removes the containers listed by listContainers that are not tracked by
+// the module manager
+// Exited containers of modules with keep_container are left for debugging; running ones are removed.
+func (mm *ModuleManager) removeOrphanedContainers(containers []byte) error {
 	// Build set of expected container names
 	mm.mu.Lock()
 	expected := make(map[string]struct{})
@@ -246,42 +1030,162 @@ func (mm *ModuleManager) cleanupOrphanedContainers() {
 	mm.mu.Unlock()
 
 	// Remove orphaned containers
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	scanner := bufio.NewScanner(bytes.NewReader(containers))
 	for scanner.Scan() {
-		name := strings.TrimSpace(scanner.Text())
-		if name == "" {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
 			continue
 		}
+		name := fields[0]
 		if _, ok := expected[name]; !ok {
+			// kept for debugging, replaced when the module is started again
+			exited := len(fields) > 1 && fields[1] == "exited"
+			if moduleConfig, _ := mm.configManager.NewModuleConfig(strings.TrimPrefix(name, "shem-module-")); exited && moduleConfig.KeyExists("keep_container") {
+				continue
+			}
 			mm.logger.Warn("removing orphaned container: %s", name)
-			if err := exec.Command("podman", "rm", "-fi", name).Run(); err != nil {
+			if err := mm.podman("rm", "-fi", name).Run(); err != nil {
 				mm.logger.Error("failed to remove container %s: %v", name, err)
 			}
 		}
 	}
+	return scanner.Err()
 }
 
-// requestStop initiates a graceful stop by closing stdin and removes the
+// takeRestartRequest reports whether the restart file of a module requests a restart, and removes
+// it. A request within restartDebounce after the previous one is left in place until then, so that
+// a file that is created over and over restarts the module at most once per restartDebounce. The
+// file is removed before the module is stopped, so that a request written in the meantime is kept
+// for the next restart; if it cannot be removed, the request is ignored, as it would otherwise
+// restart the module in every reconciliation.
+func (mm *ModuleManager) takeRestartRequest(name string, moduleConfig *ModuleConfig) bool {
+	if !moduleConfig.KeyExists("restart") {
+		return false
+	}
+	now := mm.now()
+	if last, ok := mm.restarts[name]; ok && now.Sub(last) < restartDebounce {
+		mm.logger.Debug("restart of module %s requested again, deferred until %s", name, last.Add(restartDebounce).Format(time.RFC3339))
+		return false
+	}
+	if err := moduleConfig.RemoveKey("restart"); err != nil {
+		mm.logger.Error("ignoring restart request: %v", err)
+		return false
+	}
+	mm.restarts[name] = now
+	return true
+}
+
+// requestStop initiates a graceful stop by signaling shutdown and removes the
 // instance from the map. The container becomes an orphan and will be cleaned
 // up by cleanupOrphanedContainers on the next reconcile tick if it hasn't
 // exited by then.
-func (mm *ModuleManager) requestStop(instance *ModuleInstance) {
-	instance.logger.Info("closing stdin to request shutdown")
-	instance.stdin.Close()
+func (mm *ModuleManager) requestStop(instance *ModuleInstance, reason StopReason) {
+	mm.mu.Lock()
+	err := instance.setState(ModuleStopping)
+	if err == nil {
+		instance.stopReason = reason
+	}
+	mm.mu.Unlock()
+	if err != nil {
+		// the module has already exited or is being stopped
+		instance.logger.Debug("not stopping module (%s): %v", reason, err)
+		return
+	}
+
+	// A module that does not read its input would delay the reconciliation until the shutdown
+	// command times out
+	instance.logger.Info("closing stdin to request shutdown (%s)", reason)
+	go signalShutdown(instance)
 
 	mm.mu.Lock()
 	delete(mm.modules, instance.name)
+	mm.cleanupNeeded = true
 	mm.mu.Unlock()
 }
 
+// signalShutdown sends the shutdown command to a module, giving it a chance to save its state, and
+// then closes its stdin. Modules that ignore the command still see stdin being closed.
+func signalShutdown(instance *ModuleInstance) {
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		msg := shemmsg.Message{Name: shemmsg.ShutdownCommand, Payload: shemmsg.Command{}}
+		if err := shemmsg.NewWriter(instance.stdin).Write(msg); err != nil {
+			instance.logger.Debug("failed to send shutdown command: %v", err)
+		}
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(shutdownMessageTimeout):
+		instance.logger.Debug("module does not read its input, closing stdin without shutdown command")
+	}
+	instance.stdin.Close()
+}
+
+// moduleExited logs why a module has stopped and records the reason
+// err is the error returned by waiting for the module's process
+func (mm *ModuleManager) moduleExited(instance *ModuleInstance, err error) {
+	mm.mu.Lock()
+	reason := instance.stopReason
+	if reason == "" && mm.schedules[instance.name] != nil {
+		// scheduled modules are expected to exit by themselves
+		if err == nil {
+			reason = StopReasonCompleted
+		}
+		mm.scheduledRunFinished(instance.name, err == nil)
+	} else if reason == "" && (instance.restartPolicy == RestartOnFailure || instance.restartPolicy == RestartNever) {
+		// modules with a restart policy may exit by themselves, and are only restarted on failure
+		if err == nil {
+			reason = StopReasonCompleted
+		}
+		if err == nil || instance.restartPolicy == RestartNever {
+			mm.held[instance.name] = moduleImageRef(instance.image, instance.version)
+			instance.logger.Info("not restarting module (restart policy %s) until its config changes", instance.restartPolicy)
+		}
+	}
+	state := ModuleStopped
+	if reason == "" {
+		reason = StopReasonCrashed
+		if instance.state == ModuleStarting {
+			reason = StopReasonStartupFailed
+		}
+		state = ModuleCrashed
+	}
+	if err := instance.setState(state); err != nil {
+		instance.logger.Error("%v", err)
+	}
+	mm.lastStop[instance.name] = reason
+	mm.cleanupNeeded = true
+	mm.mu.Unlock()
+
+	if err != nil {
+		instance.logger.Error("module stopped (%s) with error: %v", reason, err)
+	} else if reason == StopReasonCrashed || reason == StopReasonStartupFailed {
+		instance.logger.Warn("module exited without being asked to stop")
+	} else {
+		instance.logger.Info("module stopped (%s)", reason)
+	}
+}
+
+// LastStopReason returns why a module stopped the last time, or "" if it has not stopped yet
+func (mm *ModuleManager) LastStopReason(name string) StopReason {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.lastStop[name]
+}
+
 // startModule starts a single module with the given image and version
 func (mm *ModuleManager) startModule(moduleName, image, version string) error {
-	containerName := fmt.Sprintf("shem-module-%s", moduleName)
-	fullImage := fmt.Sprintf("%s:%s-%s", image, version, runtime.GOARCH)
+	containerName := moduleContainerName(moduleName)
+	fullImage := moduleImageRef(image, version)
 
 	mm.logger.Info("starting module %s (image: %s)", moduleName, fullImage)
 
-	cmd := mm.buildPodmanCommand(moduleName, containerName, fullImage)
+	cmd, err := mm.buildPodmanCommand(moduleName, containerName, fullImage)
+	if err != nil {
+		return err
+	}
 
 	// Set up pipes
 	stdin, err := cmd.StdinPipe()
@@ -303,22 +1207,81 @@ func (mm *ModuleManager) startModule(moduleName, image, version string) error {
 		version:       version,
 		containerName: containerName,
 		cmd:           cmd,
-		stdin:         stdin,
+		stdin:         &moduleStdin{w: stdin},
 		stdout:        stdout,
 		stderr:        stderr,
 		logger:        NewLogger(fmt.Sprintf("module-%s", moduleName)),
+		done:          make(chan struct{}),
+	}
+
+	moduleConfig, _ := mm.configManager.NewModuleConfig(moduleName)
+	maxMessageBytes, err := moduleConfig.GetMaxMessageBytes()
+	if err != nil {
+		instance.logger.Warn("%v, using default %d", err, shemmsg.MaxMessageBytes)
+	}
+	instance.parseOptions.MaxMessageBytes = maxMessageBytes
+	instance.parseOptions.WideNumbers = moduleConfig.KeyExists("wide_numbers")
+	instance.produces, err = moduleConfig.GetProducedVariables()
+	if err != nil {
+		instance.logger.Warn("%v, variables are not checked", err)
+	}
+	instance.reader = shemmsg.NewReaderWithOptions(stdout, instance.parseOptions)
+	instance.readyTimeout, err = moduleConfig.GetReadyTimeout()
+	if err != nil {
+		instance.logger.Warn("%v, module is ready when started", err)
+	}
+	instance.restartPolicy, err = moduleConfig.GetRestartPolicy()
+	if err != nil {
+		instance.logger.Warn("%v, using default %s", err, RestartAlways)
+	}
+	instance.mergePolicies, err = moduleConfig.GetMergePolicies()
+	if err != nil {
+		instance.logger.Warn("%v, timeseries are not merged", err)
+	}
+	instance.maxHorizon = time.Duration(mm.currentConfig().MaxTimeSeriesHours * float64(time.Hour))
+	if metadata, err := mm.imageMetadata(fullImage); err != nil {
+		instance.logger.Debug("no image metadata: %v", err)
+	} else {
+		if metadata.Title != "" {
+			instance.logger.Info("module: %s", metadata.Title)
+		}
+		if metadata.Protocol > shemmsg.ProtocolVersion {
+			instance.logger.Warn("image requires protocol version %d, supported up to %d", metadata.Protocol, shemmsg.ProtocolVersion)
+		}
 	}
 
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start container: %w", err)
 	}
+	instance.started = mm.now()
 
 	instance.logger.Info("started container %s", containerName)
 
 	mm.mu.Lock()
+	instance.setState(ModuleStarting)
+	if instance.readyTimeout == 0 {
+		instance.setState(ModuleRunning)
+	}
 	mm.modules[moduleName] = instance
+	mm.instances[moduleName] = instance
 	mm.mu.Unlock()
 
+	// Advertise the protocol capabilities before any other message is delivered
+	if moduleConfig.KeyExists("handshake") {
+		msg := shemmsg.Message{Name: shemmsg.HandshakeName, Payload: shemmsg.NewHandshake()}
+		if err := shemmsg.NewWriter(instance.stdin).Write(msg); err != nil {
+			instance.logger.Warn("failed to send handshake: %v", err)
+		}
+	}
+
+	// Deliver messages from other modules according to the inputs file
+	subscriptions, err := moduleConfig.GetInputs()
+	if err != nil {
+		instance.logger.Error("module will not receive any messages: %v", err)
+		instance.inputsError = err.Error()
+	}
+	mm.router.AddSubscriber(moduleName, subscriptions, instance.stdin, instance.logger)
+
 	go mm.watchModule(instance)
 
 	return nil
@@ -327,41 +1290,19 @@ func (mm *ModuleManager) startModule(moduleName, image, version string) error {
 // watchModule reads stdout/stderr and waits for the process to exit
 func (mm *ModuleManager) watchModule(instance *ModuleInstance) {
 	defer func() {
+		mm.router.RemoveSubscriber(instance.name)
 		mm.mu.Lock()
 		delete(mm.modules, instance.name)
 		mm.mu.Unlock()
+		close(instance.done)
 	}()
 
 	// Read and parse stdout messages
 	stdoutDone := make(chan struct{})
 	go func() {
 		defer close(stdoutDone)
-		if instance.stdout == nil {
-			return
-		}
-		reader := shemmsg.NewReader(instance.stdout)
-		for {
-			msg, err := reader.Read()
-			if err == io.EOF {
-				return
-			}
-			if err != nil {
-				instance.logger.Warn("invalid message: %v", err)
-				continue
-			}
-
-			// Validate that the name is unqualified (no dots)
-			if err := shemmsg.ValidateNamePart(msg.Name); err != nil {
-				instance.logger.Warn("invalid variable name %q: %v", msg.Name, err)
-				continue
-			}
-
-			// Qualify the variable name with the module name
-			msg = msg.WithName(instance.name + "." + msg.Name)
-
-			instance.logger.Info("received %s %s", msg.Type(), msg.Name)
-
-			// TODO: route message to subscribing modules
+		if instance.stdout != nil {
+			mm.readMessages(instance)
 		}
 	}()
 
@@ -378,64 +1319,477 @@ func (mm *ModuleManager) watchModule(instance *ModuleInstance) {
 		}
 	}()
 
+	// Wait for stdout and stderr to be fully read; Wait closes the pipes, so it must not be called
+	// before (modules that exit by themselves would otherwise lose output or cause read errors)
+	<-stdoutDone
+	<-stderrDone
+
 	// Wait for the process to exit
 	err := instance.cmd.Wait()
 
-	// Wait for stdout and stderr to be fully read
-	<-stdoutDone
-	<-stderrDone
+	mm.moduleExited(instance, err)
+}
+
+// readMessages reads the messages a module writes to stdout and routes them until stdout is closed
+func (mm *ModuleManager) readMessages(instance *ModuleInstance) {
+	for {
+		msg, err := instance.reader.Read()
+		if err == io.EOF {
+			return
+		}
+		mm.countParseResult(instance, err)
+		if err != nil {
+			instance.logger.Warn("invalid message: %v", err)
+			continue
+		}
+
+		// Queries are answered by the orchestrator itself
+		if query, ok := msg.Payload.(shemmsg.Query); ok {
+			mm.answerQuery(instance, msg.Name, query)
+			continue
+		}
+
+		// Commands are reserved for the orchestrator
+		if _, ok := msg.Payload.(shemmsg.Command); ok {
+			instance.logger.Warn("dropping command %s, modules must not send commands", msg.Name)
+			continue
+		}
+
+		// Responses only go from the orchestrator to modules
+		if _, ok := msg.Payload.(shemmsg.Response); ok {
+			instance.logger.Warn("dropping response %s, modules must not send responses", msg.Name)
+			continue
+		}
+
+		// A handshake tells which messages the module understands; it is not routed
+		if handshake, ok := msg.Payload.(shemmsg.Handshake); ok {
+			instance.logger.Info("module understands protocol version %d, message types %s",
+				handshake.Protocol, strings.Join(handshake.Types, " "))
+			mm.mu.Lock()
+			instance.handshake = &handshake
+			mm.mu.Unlock()
+			continue
+		}
+
+		// Validate that the name is unqualified (no dots)
+		if err := shemmsg.ValidateNamePart(msg.Name); err != nil {
+			instance.logger.Warn("invalid variable name %q: %v", msg.Name, err)
+			continue
+		}
+
+		// Qualify the variable name with the module name
+		qualifiedName, err := qualifyName(instance.name, msg.Name)
+		if err != nil {
+			instance.logger.Error("dropping message: %v", err)
+			continue
+		}
+		msg = msg.WithName(qualifiedName)
+
+		instance.logger.Info("received %s %s", msg.Type(), msg.Name)
+		mm.checkDeclared(instance, msg.Name)
+		msg, err = mm.mergeTimeSeries(instance, msg)
+		if err != nil {
+			instance.logger.Warn("dropping timeseries %s: %v", msg.Name, err)
+			continue
+		}
+		msg = mm.limitHorizon(instance, msg)
+
+		mm.markReady(instance)
+		mm.observe(msg)
+		mm.router.Route(msg)
+	}
+}
+
+// ModuleHandshake returns the handshake sent by the most recent instance of a module. Returns false
+// if the module has not sent one; it is then assumed to understand protocol version 1.
+func (mm *ModuleManager) ModuleHandshake(name string) (shemmsg.Handshake, bool) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if instance := mm.instances[name]; instance != nil && instance.handshake != nil {
+		return *instance.handshake, true
+	}
+	return shemmsg.Handshake{}, false
+}
+
+// ParseStats counts the messages a module wrote and how many of them could not be parsed
+type ParseStats struct {
+	Messages int
+	Errors   int
+}
+
+// ParseStats returns the parse statistics of the most recent instance of a module
+func (mm *ModuleManager) ParseStats(name string) ParseStats {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if instance := mm.instances[name]; instance != nil {
+		return instance.parseStats
+	}
+	return ParseStats{}
+}
 
+// countParseResult counts a message read by readMessages and reports the module once its parse
+// error rate reaches parseErrorThreshold, and again when it has dropped below
+func (mm *ModuleManager) countParseResult(instance *ModuleInstance, err error) {
+	mm.mu.Lock()
+	instance.parseStats.Messages++
 	if err != nil {
-		instance.logger.Error("module exited with error: %v", err)
-	} else {
-		instance.logger.Info("module exited")
+		instance.parseStats.Errors++
+	}
+	mm.mu.Unlock()
+
+	instance.window.Messages++
+	if err != nil {
+		instance.window.Errors++
+	}
+	if instance.window.Messages < parseErrorWindow {
+		return
+	}
+	broken := float64(instance.window.Errors) >= parseErrorThreshold*float64(instance.window.Messages)
+	if broken && !instance.malformed {
+		instance.logger.Error("%d of the last %d messages could not be parsed, the module sends malformed messages",
+			instance.window.Errors, instance.window.Messages)
+	} else if !broken && instance.malformed {
+		instance.logger.Info("only %d of the last %d messages could not be parsed", instance.window.Errors, instance.window.Messages)
+	}
+	instance.malformed = broken
+	instance.window = ParseStats{}
+}
+
+// checkDeclared warns once per variable if a module that declares its variables in a produces
+// file sends a variable that is not declared; the message is routed nevertheless
+func (mm *ModuleManager) checkDeclared(instance *ModuleInstance, qualifiedName string) {
+	_, variable := shemmsg.SplitName(qualifiedName)
+	if instance.produces == nil || slices.Contains(instance.produces, variable) || instance.undeclared[variable] {
+		return
+	}
+	if instance.undeclared == nil {
+		instance.undeclared = make(map[string]bool)
+	}
+	instance.undeclared[variable] = true
+	instance.logger.Warn("sends %s, which is not declared in its produces file", qualifiedName)
+}
+
+// mergeTimeSeries merges a timeseries with the last one of the same variable according to the
+// merge_policy file of the instance; the merged series starts with the new one, as older values
+// are past. Variables without a policy are passed unchanged. Only conflicting values reject a
+// timeseries, which is then not stored; a timeseries that cannot be merged otherwise, e.g. because
+// it arrives after a gap too long for a single series, replaces the last one.
+func (mm *ModuleManager) mergeTimeSeries(instance *ModuleInstance, msg shemmsg.Message) (shemmsg.Message, error) {
+	ts, ok := msg.Payload.(shemmsg.TimeSeries)
+	if !ok {
+		return msg, nil
+	}
+	_, variable := shemmsg.SplitName(msg.Name)
+	policy, ok := instance.mergePolicies[variable]
+	if !ok {
+		if policy, ok = instance.mergePolicies["*"]; !ok {
+			return msg, nil
+		}
+	}
+
+	if last, ok := instance.lastSeries[variable]; ok {
+		merged, err := last.MergeWithPolicy(ts, policy)
+		if errors.Is(err, shemmsg.ErrConflict) {
+			return msg, err
+		}
+		if err != nil {
+			instance.logger.Debug("replacing timeseries %s instead of merging: %v", msg.Name, err)
+			merged = ts
+		}
+		if skip := int(ts.StartTime.Sub(merged.StartTime) / (shemmsg.TimeStepMinutes * time.Minute)); skip > 0 {
+			merged.Values = merged.Values[skip:]
+			merged.StartTime = ts.StartTime
+		}
+		ts = merged
+	}
+	if instance.lastSeries == nil {
+		instance.lastSeries = make(map[string]shemmsg.TimeSeries)
+	}
+	instance.lastSeries[variable] = ts
+	msg.Payload = ts
+	return msg, nil
+}
+
+// limitHorizon truncates a timeseries whose time span exceeds the maximum horizon of the instance
+// to the values within the horizon, and warns once per variable. At least one value is kept.
+func (mm *ModuleManager) limitHorizon(instance *ModuleInstance, msg shemmsg.Message) shemmsg.Message {
+	ts, ok := msg.Payload.(shemmsg.TimeSeries)
+	if !ok || instance.maxHorizon == 0 || ts.Duration() <= instance.maxHorizon {
+		return msg
+	}
+	n := max(1, int(instance.maxHorizon/(shemmsg.TimeStepMinutes*time.Minute)))
+	if !instance.overHorizon[msg.Name] {
+		if instance.overHorizon == nil {
+			instance.overHorizon = make(map[string]bool)
+		}
+		instance.overHorizon[msg.Name] = true
+		instance.logger.Warn("timeseries %s spans %s, more than the maximum of %s, keeping the first %d of %d values",
+			msg.Name, ts.Duration(), instance.maxHorizon, n, len(ts.Values))
 	}
+	msg.Payload = shemmsg.TimeSeries{StartTime: ts.StartTime, Values: ts.Values[:n]}
+	return msg
+}
+
+// markReady marks a module as ready when it has sent its first valid message
+func (mm *ModuleManager) markReady(instance *ModuleInstance) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if instance.state == ModuleStarting {
+		instance.setState(ModuleRunning)
+		instance.logger.Info("module is ready after %s", mm.now().Sub(instance.started).Round(time.Millisecond))
+	}
+}
+
+// checkReady stops a module that has not sent a valid message within its ready_timeout
+// Returns false if the module is being stopped.
+func (mm *ModuleManager) checkReady(instance *ModuleInstance) bool {
+	mm.mu.Lock()
+	starting := instance.state == ModuleStarting
+	mm.mu.Unlock()
+	if !starting || mm.now().Sub(instance.started) < instance.readyTimeout {
+		return true
+	}
+	instance.logger.Warn("module did not become ready within %s, stopping", instance.readyTimeout)
+	mm.requestStop(instance, StopReasonNotReady)
+	return false
+}
+
+// qualifyName prefixes a variable name with the name of the module that produced it
+// The result must lie in the module's own namespace, so that a module can never publish variables
+// of another module. ValidateNamePart already guarantees this; the check guards against callers
+// that skip the validation.
+func qualifyName(moduleName, name string) (string, error) {
+	qualifiedName := moduleName + "." + name
+	if owner, variable, _ := strings.Cut(qualifiedName, "."); owner != moduleName || strings.Contains(variable, ".") {
+		return "", fmt.Errorf("module %s must not publish %s, which is outside its namespace", moduleName, qualifiedName)
+	}
+	return qualifiedName, nil
 }
 
 // stopAllModules stops all module containers and if necessary kills them
+// Producers are stopped before the modules subscribing to them, so that messages which are still
+// in flight reach subscribers that are still running. If the subscriptions contain a cycle, all
+// modules are stopped at once.
 func (mm *ModuleManager) stopAllModules() {
 	mm.logger.Info("stopping all modules")
 
 	mm.mu.Lock()
-	instances := slices.Collect(maps.Values(mm.modules))
+	instances := maps.Clone(mm.modules)
 	mm.mu.Unlock()
 
-	// First, signal graceful shutdown by closing stdin
-	for _, instance := range instances {
-		instance.logger.Info("closing stdin to request shutdown")
-		instance.stdin.Close()
+	names := slices.Sorted(maps.Keys(instances))
+	inputs := make(map[string][]Subscription, len(names))
+	for _, name := range names {
+		moduleConfig, _ := mm.configManager.NewModuleConfig(name)
+		subscriptions, err := moduleConfig.GetInputs()
+		if err != nil {
+			mm.logger.Warn("failed to read inputs of module %s: %v", name, err)
+		}
+		inputs[name] = subscriptions
 	}
 
-	// Give modules time to shut down gracefully
-	time.Sleep(5 * time.Second)
+	stages, ok := stopOrder(names, inputs)
+	if !ok {
+		mm.logger.Warn("module subscriptions contain a cycle, stopping all modules at once")
+		stages = [][]string{names}
+	}
+
+	deadline := time.Now().Add(shutdownTimeout)
+	for _, stage := range stages {
+		// Signal graceful shutdown by closing stdin
+		var stopping []*ModuleInstance
+		var wg sync.WaitGroup
+		for _, name := range stage {
+			instance := instances[name]
+			mm.mu.Lock()
+			err := instance.setState(ModuleStopping)
+			if err == nil {
+				instance.stopReason = StopReasonShutdown
+			}
+			mm.mu.Unlock()
+			if err != nil {
+				// already exited
+				continue
+			}
+			instance.logger.Info("closing stdin to request shutdown")
+			wg.Go(func() {
+				signalShutdown(instance)
+			})
+			stopping = append(stopping, instance)
+		}
+		wg.Wait()
+
+		// Give modules time to shut down gracefully; once the deadline has passed, the remaining
+		// stages are only signaled
+		waitForExit(stopping, deadline)
+	}
 
 	// Force-remove any containers that are still running
 	mm.mu.Lock()
 	clear(mm.modules)
 	mm.mu.Unlock()
 
-	mm.cleanupOrphanedContainers()
+	if err := mm.cleanupOrphanedContainers(); err != nil {
+		mm.logger.Error("%v", err)
+	}
+}
+
+// waitForExit waits until all instances have exited or the deadline has passed
+func waitForExit(instances []*ModuleInstance, deadline time.Time) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for _, instance := range instances {
+		select {
+		case <-instance.done:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// stopOrder sorts the given modules into stages so that every module is stopped in an earlier
+// stage than the modules subscribing to it. Modules within a stage can be stopped in parallel.
+// A wildcard module in a subscription makes every other module a producer. Returns false if the
+// subscriptions between the given modules contain a cycle.
+func stopOrder(names []string, inputs map[string][]Subscription) ([][]string, bool) {
+	// consumers[p] lists the modules that subscribe to messages from p
+	consumers := make(map[string][]string)
+	pending := make(map[string]int) // number of producers not yet stopped per module
+	for _, consumer := range names {
+		for _, producer := range names {
+			if producer == consumer {
+				continue
+			}
+			for _, subscription := range inputs[consumer] {
+				if subscription.Module == "*" || subscription.Module == producer {
+					consumers[producer] = append(consumers[producer], consumer)
+					pending[consumer]++
+					break
+				}
+			}
+		}
+	}
+
+	var stages [][]string
+	var stage []string
+	for _, name := range names {
+		if pending[name] == 0 {
+			stage = append(stage, name)
+		}
+	}
+
+	stopped := 0
+	for len(stage) > 0 {
+		stages = append(stages, stage)
+		stopped += len(stage)
+
+		var next []string
+		for _, producer := range stage {
+			for _, consumer := range consumers[producer] {
+				pending[consumer]--
+				if pending[consumer] == 0 {
+					next = append(next, consumer)
+				}
+			}
+		}
+		slices.Sort(next)
+		stage = next
+	}
+
+	return stages, stopped == len(names)
+}
+
+// moduleContainerName returns the name of the container of a module
+func moduleContainerName(moduleName string) string {
+	return fmt.Sprintf("shem-module-%s", moduleName)
+}
+
+// moduleImageRef returns the image reference of a module version for the current architecture
+func moduleImageRef(image, version string) string {
+	return fmt.Sprintf("%s:%s-%s", image, version, runtime.GOARCH)
+}
+
+// currentImageRef returns the image reference of the current version of a module
+func currentImageRef(configManager *ConfigManager, name string) (string, error) {
+	moduleConfig, err := configManager.NewModuleConfig(name)
+	if err != nil {
+		return "", err
+	}
+	image, _ := moduleConfig.GetString("image", "")
+	version, _ := moduleConfig.GetString("current_version", "")
+	if image == "" || version == "" {
+		return "", fmt.Errorf("module %s has no image or current_version", name)
+	}
+	return moduleImageRef(image, version), nil
+}
+
+// DescribeCommand returns the podman command line that would start the current version of a
+// module now, including its mounts, limits and the devices and capabilities it is granted, so
+// that the sandbox of a module can be audited without reading the code
+func (mm *ModuleManager) DescribeCommand(name string) ([]string, error) {
+	fullImage, err := currentImageRef(mm.configManager, name)
+	if err != nil {
+		return nil, err
+	}
+	args, err := mm.podmanRunArgs(name, moduleContainerName(name), fullImage)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat([]string{"podman"}, mm.podmanStorageArgs(), args), nil
 }
 
 // buildPodmanCommand constructs the podman run command for a module
-func (mm *ModuleManager) buildPodmanCommand(moduleName, containerName, image string) *exec.Cmd {
-	moduleDir := filepath.Join(mm.configManager.shemHome, "modules", moduleName)
+// It fails if the module requests devices or capabilities that are not allowed.
+func (mm *ModuleManager) buildPodmanCommand(moduleName, containerName, image string) (*exec.Cmd, error) {
+	args, err := mm.podmanRunArgs(moduleName, containerName, image)
+	if err != nil {
+		return nil, err
+	}
+	cmd := mm.podman(args...)
+
+	// Filter out NOTIFY_SOCKET from the environment so podman does not
+	// send sd_notify messages to systemd
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "NOTIFY_SOCKET=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+
+	return cmd, nil
+}
+
+// podmanRunArgs returns the arguments of the podman run command for a module
+func (mm *ModuleManager) podmanRunArgs(moduleName, containerName, image string) ([]string, error) {
+	return podmanRunArgs(mm.configManager, mm.currentConfig(), mm.logger, moduleName, containerName, image)
+}
+
+// podmanRunArgs returns the arguments of the podman run command for a module with the given
+// orchestrator options; warnings about its resource requests are written to logger
+func podmanRunArgs(configManager *ConfigManager, config OrchestratorConfig, logger *Logger, moduleName, containerName, image string) ([]string, error) {
+	moduleDir := filepath.Join(configManager.shemHome, "modules", moduleName)
 	configDir := filepath.Join(moduleDir, "module-config")
 	storageDir := filepath.Join(moduleDir, "storage")
 
 	args := []string{
 		"run",
 		"-i",                    // interactive: keep stdin open for communication
-		"--rm",                  // remove container when it exits
 		"--replace",             // replace any existing container with the same name
 		"--name", containerName, // container name
 		"--pull", "never", // do not pull the image, only use it if locally available
 		"--network", "none", // no network access
-		"--memory", "100m", // memory limit
-		"--cpus", "0.1", // CPU limit
 		"--read-only",                         // read-only root filesystem
 		"--security-opt", "no-new-privileges", // container cannot gain additional privileges
-		"--log-driver", "none", // disable container logging, we read via pipes
+	}
+	moduleConfig, _ := configManager.NewModuleConfig(moduleName)
+	args = append(args, resourceArgs(moduleConfig, config, logger)...) // memory and CPU limits
+
+	// For debugging, the container of a module with a keep_container file is kept after it exits,
+	// together with its log, until the module is started again
+	if !moduleConfig.KeyExists("keep_container") {
+		args = append(args,
+			"--rm",                 // remove container when it exits
+			"--log-driver", "none", // disable container logging, we read via pipes
+		)
 	}
 
 	// Mount module-config directory if it exists
@@ -448,18 +1802,15 @@ func (mm *ModuleManager) buildPodmanCommand(moduleName, containerName, image str
 		args = append(args, "-v", fmt.Sprintf("%s:/storage", storageDir))
 	}
 
+	// Grant the requested devices and capabilities
+	security, err := securityArgs(configManager, moduleName)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, security...)
+
 	// Add image name
 	args = append(args, image)
 
-	cmd := exec.Command("podman", args...)
-
-	// Filter out NOTIFY_SOCKET from the environment so podman does not
-	// send sd_notify messages to systemd
-	for _, env := range os.Environ() {
-		if !strings.HasPrefix(env, "NOTIFY_SOCKET=") {
-			cmd.Env = append(cmd.Env, env)
-		}
-	}
-
-	return cmd
+	return args, nil
 }
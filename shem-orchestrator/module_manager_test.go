@@ -0,0 +1,1532 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+func mustParseSubscriptions(t *testing.T, lines ...string) []Subscription {
+	t.Helper()
+	var subscriptions []Subscription
+	for _, line := range lines {
+		subscription, err := parseSubscription(line)
+		if err != nil {
+			t.Fatalf("failed to parse subscription %q: %v", line, err)
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+func TestStopOrder(t *testing.T) {
+	t.Run("producer consumer chain", func(t *testing.T) {
+		inputs := map[string][]Subscription{
+			"optimizer": mustParseSubscriptions(t, "meter.net_power", "prices.price"),
+			"battery":   mustParseSubscriptions(t, "optimizer.setpoint setpoint"),
+		}
+		stages, ok := stopOrder([]string{"battery", "meter", "optimizer", "prices"}, inputs)
+		if !ok {
+			t.Fatal("unexpected cycle")
+		}
+		expected := [][]string{{"meter", "prices"}, {"optimizer"}, {"battery"}}
+		if !slices.EqualFunc(stages, expected, slices.Equal) {
+			t.Errorf("expected %v, got %v", expected, stages)
+		}
+	})
+
+	t.Run("wildcard subscriber is stopped last", func(t *testing.T) {
+		inputs := map[string][]Subscription{
+			"logger":    mustParseSubscriptions(t, "*.*"),
+			"optimizer": mustParseSubscriptions(t, "meter.net_power"),
+		}
+		stages, ok := stopOrder([]string{"logger", "meter", "optimizer"}, inputs)
+		if !ok {
+			t.Fatal("unexpected cycle")
+		}
+		expected := [][]string{{"meter"}, {"optimizer"}, {"logger"}}
+		if !slices.EqualFunc(stages, expected, slices.Equal) {
+			t.Errorf("expected %v, got %v", expected, stages)
+		}
+	})
+
+	t.Run("subscriptions to stopped modules are ignored", func(t *testing.T) {
+		inputs := map[string][]Subscription{
+			"optimizer": mustParseSubscriptions(t, "meter.net_power", "optimizer.setpoint"),
+		}
+		stages, ok := stopOrder([]string{"optimizer"}, inputs)
+		if !ok || len(stages) != 1 {
+			t.Errorf("expected a single stage, got %v (ok: %v)", stages, ok)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		inputs := map[string][]Subscription{
+			"a": mustParseSubscriptions(t, "b.x"),
+			"b": mustParseSubscriptions(t, "a.y"),
+		}
+		if _, ok := stopOrder([]string{"a", "b", "c"}, inputs); ok {
+			t.Error("expected cycle to be detected")
+		}
+	})
+}
+
+func TestWaitForExit(t *testing.T) {
+	exited := &ModuleInstance{done: make(chan struct{})}
+	close(exited.done)
+	running := &ModuleInstance{done: make(chan struct{})}
+
+	// returns immediately if all instances have exited
+	waitForExit([]*ModuleInstance{exited}, time.Now().Add(time.Hour))
+
+	start := time.Now()
+	waitForExit([]*ModuleInstance{exited, running}, start.Add(50*time.Millisecond))
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned after %v before deadline", elapsed)
+	}
+
+	// later stages of the stop order do not wait once the deadline has passed
+	start = time.Now()
+	waitForExit([]*ModuleInstance{running}, start.Add(-time.Second))
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("waited %v after the deadline", elapsed)
+	}
+}
+
+// newTestInstance creates a module instance that is not backed by a container
+func newTestInstance(name, image, version string) *ModuleInstance {
+	stdinReader, stdin := io.Pipe()
+	go io.Copy(io.Discard, stdinReader)
+	return &ModuleInstance{
+		name:    name,
+		image:   image,
+		version: version,
+		stdin:   stdin,
+		logger:  NewLogger("module-" + name),
+		done:    make(chan struct{}),
+		state:   ModuleRunning,
+	}
+}
+
+// newTestModuleManager creates a module manager for a temporary SHEM_HOME with a running module
+// "meter" that uses image localhost/meter in version 1.0.0
+func newTestModuleManager(t *testing.T) (*ModuleManager, *ModuleInstance) {
+	t.Helper()
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":           "localhost/meter",
+		"current_version": "1.0.0",
+	})
+	mm := NewModuleManager(cm)
+	instance := newTestInstance("meter", "localhost/meter", "1.0.0")
+	mm.modules["meter"] = instance
+	return mm, instance
+}
+
+func TestStopReasons(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(t *testing.T, moduleDir string)
+		expected StopReason
+	}{
+		{"disabled", func(t *testing.T, moduleDir string) {
+			os.WriteFile(filepath.Join(moduleDir, "disabled"), nil, 0644)
+		}, StopReasonDisabled},
+		{"restart", func(t *testing.T, moduleDir string) {
+			os.WriteFile(filepath.Join(moduleDir, "restart"), nil, 0644)
+		}, StopReasonRestart},
+		{"updated", func(t *testing.T, moduleDir string) {
+			os.WriteFile(filepath.Join(moduleDir, "current_version"), []byte("1.0.1"), 0644)
+		}, StopReasonUpdated},
+		{"config changed", func(t *testing.T, moduleDir string) {
+			os.WriteFile(filepath.Join(moduleDir, "image"), []byte("localhost/other_meter"), 0644)
+		}, StopReasonConfigChanged},
+		{"removed", func(t *testing.T, moduleDir string) {
+			os.RemoveAll(moduleDir)
+		}, StopReasonRemoved},
+		{"paused", func(t *testing.T, moduleDir string) {
+			os.WriteFile(filepath.Join(moduleDir, "..", "..", "paused"), nil, 0644)
+		}, StopReasonPaused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm, instance := newTestModuleManager(t)
+			tt.change(t, filepath.Join(mm.configManager.shemHome, "modules", "meter"))
+
+			mm.reconcileModules()
+
+			if _, running := mm.modules["meter"]; running {
+				t.Fatal("expected module to be stopped")
+			}
+			mm.moduleExited(instance, nil)
+			if reason := mm.LastStopReason("meter"); reason != tt.expected {
+				t.Errorf("expected stop reason %q, got %q", tt.expected, reason)
+			}
+		})
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		mm, _ := newTestModuleManager(t)
+		mm.reconcileModules()
+		if _, running := mm.modules["meter"]; !running {
+			t.Fatal("expected module to keep running")
+		}
+		if reason := mm.LastStopReason("meter"); reason != "" {
+			t.Errorf("expected no stop reason, got %q", reason)
+		}
+	})
+
+	t.Run("crashed", func(t *testing.T) {
+		mm, instance := newTestModuleManager(t)
+		mm.moduleExited(instance, errors.New("exit status 1"))
+		if reason := mm.LastStopReason("meter"); reason != StopReasonCrashed {
+			t.Errorf("expected stop reason %q, got %q", StopReasonCrashed, reason)
+		}
+	})
+}
+
+func TestModuleMessageSizeLimit(t *testing.T) {
+	forecast := "timeseries forecast\n2025-12-06T08:00" + strings.Repeat("\n1.234", 3000) + "\n\n"
+	small := "pointvalue net_power\n1\n\n"
+
+	tests := []struct {
+		name            string
+		maxMessageBytes int
+		expected        []string
+	}{
+		{"default limit", 0, []string{"meter.net_power"}},
+		{"raised limit", 20000, []string{"meter.forecast", "meter.net_power"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm, instance := newTestModuleManager(t)
+			instance.parseOptions.MaxMessageBytes = tt.maxMessageBytes
+			instance.reader = shemmsg.NewReaderWithOptions(strings.NewReader(forecast+small), instance.parseOptions)
+
+			pr, pw := io.Pipe()
+			defer pr.Close()
+			mm.router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.*"), pw, NewLogger("test"))
+			defer mm.router.RemoveSubscriber("optimizer")
+
+			mm.readMessages(instance)
+
+			messages := readMessagesWithOptions(t, pr, len(tt.expected), instance.parseOptions)
+			for i, msg := range messages {
+				if msg.Name != tt.expected[i] {
+					t.Errorf("expected %s, got %s", tt.expected[i], msg.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestQualifyName(t *testing.T) {
+	tests := []struct {
+		module, name string
+		expected     string
+		wantErr      bool
+	}{
+		{"meter", "net_power", "meter.net_power", false},
+		{"meter", "inverter.net_power", "", true},
+		{"meter", "optimizer.setpoint", "", true},
+		{"meter.inverter", "net_power", "", true},
+	}
+	for _, tt := range tests {
+		qualifiedName, err := qualifyName(tt.module, tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("qualifyName(%q, %q): unexpected error state: %v", tt.module, tt.name, err)
+		}
+		if qualifiedName != tt.expected {
+			t.Errorf("qualifyName(%q, %q) = %q, expected %q", tt.module, tt.name, qualifiedName, tt.expected)
+		}
+	}
+}
+
+func TestReloadInputs(t *testing.T) {
+	mm, _ := newTestModuleManager(t)
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mm.router.AddSubscriber("meter", nil, pw, NewLogger("test"))
+	defer mm.router.RemoveSubscriber("meter")
+
+	moduleConfig, _ := mm.configManager.NewModuleConfig("meter")
+	if err := moduleConfig.SetString("inputs", "optimizer.setpoint\n"); err != nil {
+		t.Fatal(err)
+	}
+	mm.reconcileModules()
+	if _, running := mm.modules["meter"]; !running {
+		t.Fatal("expected module to keep running")
+	}
+
+	mm.router.Route(testMessage(t, "optimizer.setpoint", 42))
+	messages := readMessages(t, pr, 1)
+	if messages[0].Name != "optimizer.setpoint" {
+		t.Errorf("expected optimizer.setpoint, got %s", messages[0].Name)
+	}
+
+	// an invalid file keeps the previous subscriptions
+	if err := moduleConfig.SetString("inputs", "not qualified\n"); err != nil {
+		t.Fatal(err)
+	}
+	mm.reconcileModules()
+	mm.router.Route(testMessage(t, "optimizer.setpoint", 43))
+	readMessages(t, pr, 1)
+}
+
+// fakeClock is a clock for tests that only advances when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestHelperProcess is run as fake podman by fakePodman; it exits with the code given after "--",
+// optionally after sleeping for the duration given as second argument, or, if that is "stdin",
+// after its stdin has been closed; with "echo", it also copies stdin to stdout. It writes
+// HELPER_OUTPUT to stdout first.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Print(os.Getenv("HELPER_OUTPUT"))
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	code, _ := strconv.Atoi(args[1])
+	if len(args) > 2 && args[2] == "stdin" {
+		io.Copy(io.Discard, os.Stdin)
+	} else if len(args) > 2 && args[2] == "echo" {
+		io.Copy(os.Stdout, os.Stdin)
+	} else if len(args) > 2 {
+		delay, _ := time.ParseDuration(args[2])
+		time.Sleep(delay)
+	}
+	os.Exit(code)
+}
+
+// fakePodman replaces podman for mm. Each "podman run" exits with *exitCode and increments *runs.
+func fakePodman(t *testing.T, mm *ModuleManager, runs, exitCode *int) {
+	t.Helper()
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	mm.podman = func(args ...string) *exec.Cmd {
+		if args[0] == "run" {
+			*runs++
+		}
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", strconv.Itoa(*exitCode))
+	}
+}
+
+// waitForModulesToExit waits until no module is running anymore
+func waitForModulesToExit(t *testing.T, mm *ModuleManager) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		mm.mu.Lock()
+		running := len(mm.modules)
+		mm.mu.Unlock()
+		if running == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for modules to exit")
+		}
+	}
+}
+
+func TestScheduledModuleInterval(t *testing.T) {
+	cm := newTestModule(t, "tariffs", map[string]string{
+		"image":           "localhost/tariffs",
+		"current_version": "1.0.0",
+		"schedule":        "1h",
+	})
+	mm := NewModuleManager(cm)
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mm.now = clock.Now
+	var runs, exitCode int
+	fakePodman(t, mm, &runs, &exitCode)
+
+	// advance moves the clock forward, reconciles and checks the number of runs so far
+	advance := func(d time.Duration, expectedRuns int) {
+		t.Helper()
+		clock.Advance(d)
+		mm.reconcileModules()
+		waitForModulesToExit(t, mm)
+		if runs != expectedRuns {
+			t.Fatalf("at %s: expected %d runs, got %d", clock.Now().Format(time.TimeOnly), expectedRuns, runs)
+		}
+	}
+
+	// an interval schedule runs the module right away, then once per interval
+	advance(0, 1)
+	if reason := mm.LastStopReason("tariffs"); reason != StopReasonCompleted {
+		t.Errorf("expected stop reason %q, got %q", StopReasonCompleted, reason)
+	}
+	advance(30*time.Minute, 1)
+	advance(30*time.Minute, 2)
+
+	// failed runs are retried after 1, 2, 4, ... minutes
+	exitCode = 1
+	advance(time.Hour, 3)
+	if reason := mm.LastStopReason("tariffs"); reason != StopReasonCrashed {
+		t.Errorf("expected stop reason %q, got %q", StopReasonCrashed, reason)
+	}
+	advance(30*time.Second, 3)
+	advance(30*time.Second, 4)
+	advance(time.Minute, 4)
+	exitCode = 0
+	advance(time.Minute, 5)
+
+	// after a successful run, the regular interval applies again
+	advance(59*time.Minute, 5)
+	advance(time.Minute, 6)
+}
+
+func TestScheduledModuleInvalidSchedule(t *testing.T) {
+	cm := newTestModule(t, "tariffs", map[string]string{
+		"image":           "localhost/tariffs",
+		"current_version": "1.0.0",
+		"schedule":        "every now and then",
+	})
+	mm := NewModuleManager(cm)
+	var runs, exitCode int
+	fakePodman(t, mm, &runs, &exitCode)
+
+	mm.reconcileModules()
+	waitForModulesToExit(t, mm)
+	if runs != 0 {
+		t.Errorf("expected module with invalid schedule not to run, got %d runs", runs)
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		exitCode int
+		restart  bool
+	}{
+		{"", 0, true},
+		{"", 1, true},
+		{"always", 0, true},
+		{"always", 1, true},
+		{"on-failure", 0, false},
+		{"on-failure", 1, true},
+		{"never", 0, false},
+		{"never", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s exit %d", tt.policy, tt.exitCode), func(t *testing.T) {
+			files := map[string]string{"image": "localhost/tariffs", "current_version": "1.0.0"}
+			if tt.policy != "" {
+				files["restart_policy"] = tt.policy
+			}
+			cm := newTestModule(t, "tariffs", files)
+			mm := NewModuleManager(cm)
+			runs, exitCode := 0, tt.exitCode
+			fakePodman(t, mm, &runs, &exitCode)
+
+			mm.reconcileModules()
+			waitForModulesToExit(t, mm)
+			mm.reconcileModules()
+			waitForModulesToExit(t, mm)
+			if restarted := runs == 2; restarted != tt.restart {
+				t.Fatalf("expected restart %v, got %d runs", tt.restart, runs)
+			}
+			if tt.exitCode == 0 && !tt.restart {
+				if reason := mm.LastStopReason("tariffs"); reason != StopReasonCompleted {
+					t.Errorf("expected stop reason %q, got %q", StopReasonCompleted, reason)
+				}
+			}
+			if tt.restart {
+				return
+			}
+
+			// a held module stays stopped until its config changes
+			mm.reconcileModules()
+			waitForModulesToExit(t, mm)
+			setConfig(t, cm, "tariffs", "current_version", "1.0.1")
+			mm.reconcileModules()
+			waitForModulesToExit(t, mm)
+			if runs != 2 {
+				t.Errorf("expected module to be started once more after update, got %d runs", runs)
+			}
+			setConfig(t, cm, "tariffs", "restart", "")
+			mm.reconcileModules()
+			waitForModulesToExit(t, mm)
+			if runs != 3 {
+				t.Errorf("expected module to be started once more after restart request, got %d runs", runs)
+			}
+		})
+	}
+}
+
+func TestPause(t *testing.T) {
+	cm := newTestModule(t, "tariffs", map[string]string{"image": "localhost/tariffs", "current_version": "1.0.0"})
+	mm := NewModuleManager(cm)
+	var runs, exitCode int
+	fakePodman(t, mm, &runs, &exitCode)
+	pauseFile := filepath.Join(cm.shemHome, "paused")
+	if err := os.WriteFile(pauseFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// no module is started while paused
+	for range 3 {
+		mm.reconcileModules()
+		waitForModulesToExit(t, mm)
+	}
+	if runs != 0 {
+		t.Fatalf("expected no module to be started while paused, got %d runs", runs)
+	}
+
+	// removing the file starts the modules again, with their config unchanged
+	os.Remove(pauseFile)
+	mm.reconcileModules()
+	waitForModulesToExit(t, mm)
+	if runs != 1 {
+		t.Errorf("expected module to be started after the pause, got %d runs", runs)
+	}
+	if mc, _ := cm.NewModuleConfig("tariffs"); mc.KeyExists("disabled") {
+		t.Error("expected module config to be unchanged")
+	}
+}
+
+func TestDegradedModeWhilePodmanIsUnavailable(t *testing.T) {
+	cm, _ := newMemoryConfigManager(t, map[string]map[string]string{
+		"meter": {"image": "localhost/meter", "current_version": "1.0.0"},
+	})
+	mm := NewModuleManager(cm)
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mm.now = clock.Now
+	var runs int
+	exitCode := 125 // podman fails for every command
+	fakePodman(t, mm, &runs, &exitCode)
+
+	reconcile := func(d time.Duration) {
+		t.Helper()
+		clock.Advance(d)
+		mm.reconcile()
+		waitForModulesToExit(t, mm)
+	}
+
+	for range podmanFailureThreshold - 1 {
+		reconcile(10 * time.Second)
+		if mm.Degraded() {
+			t.Fatal("expected single failures not to enter degraded mode")
+		}
+	}
+	reconcile(10 * time.Second)
+	if !mm.Degraded() {
+		t.Fatal("expected degraded mode after repeated failures")
+	}
+	if runs != 0 {
+		t.Fatalf("expected no module starts while podman is unavailable, got %d", runs)
+	}
+	if health := mm.health["meter"]; health != 0 {
+		t.Errorf("expected no health penalty while podman is unavailable, got %v", health)
+	}
+
+	// podman comes back, but it is only checked again after the delay
+	exitCode = 0
+	reconcile(10 * time.Second)
+	if !mm.Degraded() || runs != 0 {
+		t.Fatalf("expected to stay degraded until the next check (degraded: %v, runs: %d)", mm.Degraded(), runs)
+	}
+	reconcile(minDegradedDelay)
+	if mm.Degraded() {
+		t.Fatal("expected degraded mode to end once podman is available")
+	}
+	if runs != 1 {
+		t.Errorf("expected module to be started after podman is back, got %d runs", runs)
+	}
+}
+
+func TestOrphanCleanupInterval(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mm.now = clock.Now
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	listed, cleanups := 0, 0
+	mm.podman = func(args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0")
+		switch args[0] {
+		case "ps":
+			listed++
+			cmd.Env = append(os.Environ(), "HELPER_OUTPUT=shem-module-orphan exited\n")
+		case "rm":
+			cleanups++
+		}
+		return cmd
+	}
+
+	reconciles := 0
+	reconcile := func(d time.Duration) {
+		clock.Advance(d)
+		mm.reconcile()
+		reconciles++
+	}
+	for range 10 {
+		reconcile(10 * time.Second)
+	}
+	if cleanups != 1 {
+		t.Fatalf("expected orphans to be removed once in %d reconciliations without changes, got %d", reconciles, cleanups)
+	}
+	// podman is checked in every reconciliation
+	if listed != reconciles {
+		t.Fatalf("expected containers to be listed in each of %d reconciliations, got %d", reconciles, listed)
+	}
+	reconcile(orphanCleanupInterval)
+	if cleanups != 2 {
+		t.Fatalf("expected orphans to be removed again after %v, got %d", orphanCleanupInterval, cleanups)
+	}
+
+	// a stopped module may leave its container behind
+	setConfig(t, mm.configManager, "meter", "disabled", "")
+	reconcile(10 * time.Second)
+	mm.moduleExited(instance, nil)
+	reconcile(10 * time.Second)
+	if cleanups != 3 {
+		t.Fatalf("expected orphans to be removed after the module was stopped, got %d", cleanups)
+	}
+	reconcile(10 * time.Second)
+	if cleanups != 3 {
+		t.Fatalf("expected no cleanup without changes, got %d", cleanups)
+	}
+}
+
+func TestPodmanFailureDetectedWithoutCleanup(t *testing.T) {
+	mm, _ := newTestModuleManager(t)
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mm.now = clock.Now
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	exitCode := 0
+	mm.podman = func(args ...string) *exec.Cmd {
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", strconv.Itoa(exitCode))
+	}
+
+	mm.reconcile()
+	exitCode = 125
+	for range podmanFailureThreshold {
+		clock.Advance(10 * time.Second)
+		mm.reconcile()
+	}
+	if !mm.Degraded() {
+		t.Error("expected podman failures to be detected between cleanups")
+	}
+}
+
+func TestDegradedModeBackoff(t *testing.T) {
+	cm, _ := newMemoryConfigManager(t, nil)
+	mm := NewModuleManager(cm)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	expected := []time.Duration{0, 0, minDegradedDelay, 2 * minDegradedDelay, 4 * minDegradedDelay}
+	for _, delay := range expected {
+		mm.podmanUnavailable(now, fmt.Errorf("connection refused"))
+		if mm.degradedDelay != delay {
+			t.Errorf("after %d failures: expected delay %v, got %v", mm.podmanFailures, delay, mm.degradedDelay)
+		}
+	}
+	for range 20 {
+		mm.podmanUnavailable(now, fmt.Errorf("connection refused"))
+	}
+	if mm.degradedDelay != maxDegradedDelay {
+		t.Errorf("expected delay to be capped at %v, got %v", maxDegradedDelay, mm.degradedDelay)
+	}
+}
+
+func TestReconcileInterval(t *testing.T) {
+	cm, store := newMemoryConfigManager(t, map[string]map[string]string{"orchestrator": nil})
+	mm := NewModuleManager(cm)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 10 * time.Second}, // not set
+		{"30", 30 * time.Second},
+		{"2.5", 2500 * time.Millisecond},
+		{"1", 10 * time.Second}, // below the minimum, the default is used
+	}
+	for _, tt := range tests {
+		if tt.value == "" {
+			store.Remove("orchestrator", "ReconcileIntervalSeconds")
+		} else {
+			store.Write("orchestrator", "ReconcileIntervalSeconds", []byte(tt.value))
+		}
+		mm.reloadConfig()
+		if interval := mm.reconcileInterval(); interval != tt.expected {
+			t.Errorf("ReconcileIntervalSeconds=%q: expected %v, got %v", tt.value, tt.expected, interval)
+		}
+	}
+}
+
+func TestShutdownCommandPrecedesStdinClose(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	stdinReader, stdin := io.Pipe()
+	instance.stdin = &moduleStdin{w: stdin}
+
+	received := make(chan []shemmsg.Message)
+	go func() {
+		var messages []shemmsg.Message
+		reader := shemmsg.NewReader(stdinReader)
+		for {
+			msg, err := reader.Read()
+			if err != nil {
+				// io.EOF: stdin has been closed
+				received <- messages
+				return
+			}
+			messages = append(messages, msg)
+		}
+	}()
+
+	mm.requestStop(instance, StopReasonDisabled)
+
+	select {
+	case messages := <-received:
+		if len(messages) != 1 || messages[0].Type() != "command" || messages[0].Name != shemmsg.ShutdownCommand {
+			t.Errorf("expected only the shutdown command before stdin was closed, got %+v", messages)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stdin was not closed")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "current_version": "1.0.0", "handshake": ""})
+	setConfig(t, cm, "legacy", "image", "localhost/legacy")
+	setConfig(t, cm, "legacy", "current_version", "1.0.0")
+	mm := NewModuleManager(cm)
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	mm.podman = func(args ...string) *exec.Cmd {
+		// the modules echo what they receive, so the handshake comes back as the module's own
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "echo")
+	}
+	t.Cleanup(mm.stopAllModules)
+	mm.reconcileModules()
+
+	var handshake shemmsg.Handshake
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		var ok bool
+		if handshake, ok = mm.ModuleHandshake("meter"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake received from meter")
+		}
+	}
+	if expected := shemmsg.NewHandshake(); handshake.Protocol != expected.Protocol || !slices.Equal(handshake.Types, expected.Types) {
+		t.Errorf("expected the orchestrator's handshake to be echoed, got %+v", handshake)
+	}
+	if stats := mm.ParseStats("meter"); stats.Errors != 0 {
+		t.Errorf("expected the handshake to parse, got %d errors", stats.Errors)
+	}
+
+	// modules without a handshake file get none; once stopped, all their output has been read
+	mm.stopAllModules()
+	if _, ok := mm.ModuleHandshake("legacy"); ok {
+		t.Error("expected no handshake for legacy module")
+	}
+}
+
+func TestShutdownModuleNotReadingStdin(t *testing.T) {
+	instance := newTestInstance("meter", "localhost/meter", "1.0.0")
+	stdinReader, stdin := io.Pipe()
+	instance.stdin = &moduleStdin{w: stdin}
+
+	start := time.Now()
+	signalShutdown(instance)
+	if elapsed := time.Since(start); elapsed > shutdownMessageTimeout+time.Second {
+		t.Errorf("closing stdin took %v", elapsed)
+	}
+	if _, err := stdinReader.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected stdin to be closed, got %v", err)
+	}
+}
+
+func TestRequestStopDoesNotWaitForStdin(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	stdinReader, stdin := io.Pipe()
+	instance.stdin = &moduleStdin{w: stdin}
+
+	start := time.Now()
+	mm.requestStop(instance, StopReasonDisabled)
+	if elapsed := time.Since(start); elapsed >= shutdownMessageTimeout {
+		t.Errorf("requesting the stop took %v", elapsed)
+	}
+	mm.mu.Lock()
+	_, running := mm.modules["meter"]
+	mm.mu.Unlock()
+	if running {
+		t.Error("expected the module to be removed from the running modules")
+	}
+
+	// the shutdown command is still sent, and stdin closed
+	done := make(chan error)
+	go func() {
+		_, err := io.ReadAll(stdinReader)
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownMessageTimeout + 5*time.Second):
+		t.Fatal("stdin was not closed")
+	}
+}
+
+func TestNoModulesConfigured(t *testing.T) {
+	cm, store := newMemoryConfigManager(t, map[string]map[string]string{
+		"orchestrator": {"image": "quay.io/shem/shem-orchestrator"},
+	})
+	mm := NewModuleManager(cm)
+	var runs int
+	exitCode := 0
+	fakePodman(t, mm, &runs, &exitCode)
+
+	if n := mm.ConfiguredModules(); n != -1 {
+		t.Errorf("expected -1 before the first reconciliation, got %d", n)
+	}
+	mm.reconcile()
+	if n := mm.ConfiguredModules(); n != 0 {
+		t.Errorf("expected no configured modules, got %d", n)
+	}
+	if runs != 0 {
+		t.Errorf("expected nothing to be started, got %d runs", runs)
+	}
+
+	store.mu.Lock()
+	store.modules["meter"] = map[string]string{"image": "localhost/meter", "current_version": "1.0.0"}
+	store.mu.Unlock()
+	mm.reconcile()
+	waitForModulesToExit(t, mm)
+	if n := mm.ConfiguredModules(); n != 1 {
+		t.Errorf("expected 1 configured module, got %d", n)
+	}
+}
+
+func TestStartPriorityAndLimit(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{"MaxStartsPerReconcile": "2"})
+	modules := map[string]string{"battery": "", "inverter": "10", "meter": "20", "tariffs": "-5", "weather": ""}
+	for name, priority := range modules {
+		setConfig(t, cm, name, "image", "localhost/"+name)
+		setConfig(t, cm, name, "current_version", "1.0.0")
+		if priority != "" {
+			setConfig(t, cm, name, "start_priority", priority)
+		}
+	}
+	mm := NewModuleManager(cm)
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	var started []string
+	mm.podman = func(args ...string) *exec.Cmd {
+		if args[0] == "run" {
+			image := args[len(args)-1]
+			started = append(started, strings.TrimPrefix(image[:strings.Index(image, ":")], "localhost/"))
+		}
+		// keep the modules running until they are stopped
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "stdin")
+	}
+	t.Cleanup(mm.stopAllModules)
+
+	expected := [][]string{
+		{"meter", "inverter"},
+		{"meter", "inverter", "battery", "weather"}, // same priority: order of ListModules
+		{"meter", "inverter", "battery", "weather", "tariffs"},
+		{"meter", "inverter", "battery", "weather", "tariffs"},
+	}
+	for i, want := range expected {
+		mm.reconcileModules()
+		if !slices.Equal(started, want) {
+			t.Fatalf("after reconciliation %d: expected starts %v, got %v", i+1, want, started)
+		}
+	}
+}
+
+func TestMaxConcurrentModules(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{"MaxConcurrentModules": "2"})
+	for name, priority := range map[string]string{"inverter": "10", "meter": "20", "tariffs": "-5"} {
+		setConfig(t, cm, name, "image", "localhost/"+name)
+		setConfig(t, cm, name, "current_version", "1.0.0")
+		setConfig(t, cm, name, "start_priority", priority)
+	}
+	mm := NewModuleManager(cm)
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	runs := 0
+	mm.podman = func(args ...string) *exec.Cmd {
+		if args[0] == "run" {
+			runs++
+		}
+		// keep the modules running until they are stopped
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "stdin")
+	}
+	t.Cleanup(mm.stopAllModules)
+
+	// the modules with the highest priority are started, the others wait
+	for range 2 {
+		mm.reconcileModules()
+	}
+	if runs != 2 || mm.ModuleState("meter") != ModuleRunning || mm.ModuleState("inverter") != ModuleRunning {
+		t.Fatalf("expected meter and inverter to be started, got %d runs", runs)
+	}
+	if state := mm.ModuleState("tariffs"); state != ModulePendingCapacity {
+		t.Errorf("expected tariffs to be %s, got %s", ModulePendingCapacity, state)
+	}
+
+	// a module that has been stopped still counts until it has exited
+	setConfig(t, cm, "inverter", "disabled", "")
+	mm.mu.Lock()
+	inverter := mm.modules["inverter"]
+	mm.mu.Unlock()
+	mm.reconcileModules()
+	<-inverter.done
+	if runs != 2 {
+		t.Fatalf("expected no start before inverter has exited, got %d runs", runs)
+	}
+
+	// once it has exited, the pending module is started
+	mm.reconcileModules()
+	if runs != 3 || mm.ModuleState("tariffs") != ModuleRunning {
+		t.Errorf("expected tariffs to be started, got %d runs and state %s", runs, mm.ModuleState("tariffs"))
+	}
+}
+
+func TestPendingCapacityClearedWhenPaused(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{"MaxConcurrentModules": "1"})
+	for _, name := range []string{"meter", "tariffs"} {
+		setConfig(t, cm, name, "image", "localhost/"+name)
+		setConfig(t, cm, name, "current_version", "1.0.0")
+	}
+	mm := NewModuleManager(cm)
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	mm.podman = func(args ...string) *exec.Cmd {
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "stdin")
+	}
+	t.Cleanup(mm.stopAllModules)
+
+	mm.reconcileModules()
+	if mm.ModuleState("meter") != ModulePendingCapacity && mm.ModuleState("tariffs") != ModulePendingCapacity {
+		t.Fatal("expected one module to wait for capacity")
+	}
+
+	if err := os.WriteFile(filepath.Join(cm.shemHome, "paused"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mm.reconcileModules()
+	for _, name := range []string{"meter", "tariffs"} {
+		if state := mm.ModuleState(name); state == ModulePendingCapacity {
+			t.Errorf("expected %s not to wait for capacity while paused", name)
+		}
+	}
+}
+
+func TestModuleNeverReady(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":           "localhost/meter",
+		"current_version": "1.0.0",
+		"ready_timeout":   "1m",
+	})
+	mm := NewModuleManager(cm)
+	clock := &fakeClock{now: time.Now()}
+	mm.now = clock.Now
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	runs := 0
+	mm.podman = func(args ...string) *exec.Cmd {
+		if args[0] == "run" {
+			runs++
+		}
+		// runs until it is stopped, but never sends a message
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "stdin")
+	}
+	t.Cleanup(mm.stopAllModules)
+
+	mm.reconcileModules()
+	mm.reconcileModules()
+	if runs != 1 || mm.LastStopReason("meter") != "" {
+		t.Fatalf("expected module to keep running within ready_timeout, got %d runs, stop reason %q", runs, mm.LastStopReason("meter"))
+	}
+
+	mm.mu.Lock()
+	instance := mm.modules["meter"]
+	mm.mu.Unlock()
+	clock.Advance(2 * time.Minute)
+	mm.reconcileModules()
+	select {
+	case <-instance.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("module not stopped")
+	}
+	if reason := mm.LastStopReason("meter"); reason != StopReasonNotReady {
+		t.Fatalf("expected stop reason %q, got %q", StopReasonNotReady, reason)
+	}
+
+	// the restart is penalized more than after a crash of a module that was ready
+	mm.reconcileModules()
+	if runs != 2 {
+		t.Fatalf("expected module to be restarted, got %d runs", runs)
+	}
+	expected := -1.0
+	for range 3 {
+		expected *= 0.974
+	}
+	expected -= 1.0 + startupFailurePenalty
+	if math.Abs(mm.health["meter"]-expected) > 1e-9 {
+		t.Errorf("expected health %.3f, got %.3f", expected, mm.health["meter"])
+	}
+}
+
+func TestUndeclaredVariables(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	instance.produces = []string{"net_power"}
+	instance.reader = shemmsg.NewReader(strings.NewReader(
+		"pointvalue net_power\n1\n\npointvalue power\n1\n\npointvalue power\n2\n\npointvalue voltage\n230\n\n"))
+	mm.readMessages(instance)
+	mm.router.flush()
+
+	if !maps.Equal(instance.undeclared, map[string]bool{"power": true, "voltage": true}) {
+		t.Errorf("expected power and voltage to be reported once, got %v", instance.undeclared)
+	}
+	if _, ok := mm.router.LastValues()["meter.power"]; !ok {
+		t.Error("expected undeclared variables to be routed")
+	}
+
+	// modules without produces file are not checked
+	instance.produces, instance.undeclared = nil, nil
+	instance.reader = shemmsg.NewReader(strings.NewReader("pointvalue power\n3\n\n"))
+	mm.readMessages(instance)
+	if len(instance.undeclared) != 0 {
+		t.Errorf("expected no check without produces file, got %v", instance.undeclared)
+	}
+}
+
+func TestTimeSeriesHorizon(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	instance.maxHorizon = 30 * time.Minute
+	instance.reader = shemmsg.NewReader(strings.NewReader(
+		"timeseries short\n2025-12-06T08:00\n1\n2\n3\n4\n5\n6\n\n" +
+			"timeseries long\n2025-12-06T08:00\n1\n2\n3\n4\n5\n6\n7\n8\n\n" +
+			"timeseries long\n2025-12-06T08:05\n1\n2\n3\n4\n5\n6\n7\n\n"))
+	mm.readMessages(instance)
+	mm.router.flush()
+
+	values := mm.router.LastValues()
+	if ts := values["meter.short"].Message.Payload.(shemmsg.TimeSeries); len(ts.Values) != 6 {
+		t.Errorf("expected timeseries within the horizon to be kept, got %d values", len(ts.Values))
+	}
+	ts := values["meter.long"].Message.Payload.(shemmsg.TimeSeries)
+	if len(ts.Values) != 6 || ts.Duration() != instance.maxHorizon || ts.Values[5].Float64() != 6 {
+		t.Errorf("expected timeseries to be truncated to 6 values, got %v", ts.Values)
+	}
+	if !ts.StartTime.Equal(time.Date(2025, 12, 6, 8, 5, 0, 0, time.UTC)) {
+		t.Errorf("expected start time to be kept, got %s", ts.StartTime)
+	}
+	if !maps.Equal(instance.overHorizon, map[string]bool{"meter.long": true}) {
+		t.Errorf("expected meter.long to be reported once, got %v", instance.overHorizon)
+	}
+}
+
+func TestMergeTimeSeries(t *testing.T) {
+	input := "timeseries forecast\n2025-12-06T08:00\n1\n2\n3\n\n" +
+		"timeseries other\n2025-12-06T08:00\n1\n2\n3\n\n" +
+		"timeseries forecast\n2025-12-06T08:05\n20\nmissing\n40\n\n" +
+		"timeseries other\n2025-12-06T08:05\n20\nmissing\n\n"
+	tests := []struct {
+		policy   shemmsg.MergePolicy
+		start    int // minutes after 08:00
+		expected []string
+	}{
+		{shemmsg.MergeNewerWins, 5, []string{"20.000", "missing", "40.000"}},
+		{shemmsg.MergeKeepExisting, 5, []string{"2.000", "3.000", "40.000"}},
+		{shemmsg.MergeErrorOnConflict, 0, []string{"1.000", "2.000", "3.000"}}, // conflicting series is dropped
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			mm, instance := newTestModuleManager(t)
+			instance.mergePolicies = map[string]shemmsg.MergePolicy{"forecast": tt.policy}
+			instance.reader = shemmsg.NewReader(strings.NewReader(input))
+			mm.readMessages(instance)
+			mm.router.flush()
+
+			values := mm.router.LastValues()
+			ts := values["meter.forecast"].Message.Payload.(shemmsg.TimeSeries)
+			var got []string
+			for _, v := range ts.Values {
+				got = append(got, v.String())
+			}
+			if !slices.Equal(got, tt.expected) || !ts.StartTime.Equal(time.Date(2025, 12, 6, 8, tt.start, 0, 0, time.UTC)) {
+				t.Errorf("expected %v from 08:%02d, got %v from %s", tt.expected, tt.start, got, ts.StartTime)
+			}
+			// variables without a policy are replaced
+			if other := values["meter.other"].Message.Payload.(shemmsg.TimeSeries); len(other.Values) != 2 {
+				t.Errorf("expected unmerged timeseries to be replaced, got %v", other.Values)
+			}
+		})
+	}
+}
+
+func TestMergeTimeSeriesAfterGap(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	instance.mergePolicies = map[string]shemmsg.MergePolicy{"forecast": shemmsg.MergeKeepExisting}
+	// the merged series would exceed MaxTimeSeriesValues, so the new one replaces the last one
+	instance.reader = shemmsg.NewReader(strings.NewReader(
+		"timeseries forecast\n2025-12-06T08:00\n1\n2\n\n" +
+			"timeseries forecast\n2026-01-06T08:00\n10\n20\n\n" +
+			"timeseries forecast\n2026-01-06T08:05\n30\n40\n\n"))
+	mm.readMessages(instance)
+	mm.router.flush()
+
+	ts := mm.router.LastValues()["meter.forecast"].Message.Payload.(shemmsg.TimeSeries)
+	var got []string
+	for _, v := range ts.Values {
+		got = append(got, v.String())
+	}
+	expected := []string{"20.000", "40.000"}
+	if !slices.Equal(got, expected) || !ts.StartTime.Equal(time.Date(2026, 1, 6, 8, 5, 0, 0, time.UTC)) {
+		t.Errorf("expected %v from 2026-01-06T08:05, got %v from %s", expected, got, ts.StartTime)
+	}
+}
+
+func TestParseErrorRate(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	mm.instances["meter"] = instance
+	messages := func(n, malformed int) *shemmsg.Reader {
+		var input strings.Builder
+		for i := range n {
+			if i%(n/malformed) == 0 {
+				input.WriteString("pointvalue power\n1.5e3\n\n") // no scientific notation
+			} else {
+				input.WriteString(fmt.Sprintf("pointvalue power\n%d\n\n", i))
+			}
+		}
+		return shemmsg.NewReader(strings.NewReader(input.String()))
+	}
+
+	// occasional errors are tolerated
+	instance.reader = messages(parseErrorWindow, 5)
+	mm.readMessages(instance)
+	if instance.malformed {
+		t.Error("expected 5% parse errors not to be reported")
+	}
+
+	instance.reader = messages(parseErrorWindow, 20)
+	mm.readMessages(instance)
+	if !instance.malformed {
+		t.Error("expected 20% parse errors to be reported")
+	}
+	if stats := mm.ParseStats("meter"); stats != (ParseStats{Messages: 2 * parseErrorWindow, Errors: 25}) {
+		t.Errorf("unexpected parse statistics %+v", stats)
+	}
+
+	// the rate is computed over complete windows only
+	instance.reader = messages(parseErrorWindow/2, 1)
+	mm.readMessages(instance)
+	if !instance.malformed {
+		t.Error("expected report to persist until the window is complete")
+	}
+	instance.reader = messages(parseErrorWindow/2, 1)
+	mm.readMessages(instance)
+	if instance.malformed {
+		t.Error("expected recovery to be noticed")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":           "localhost/meter",
+		"current_version": "1.0.0",
+	})
+	setConfig(t, cm, "orchestrator", "QuarantineFailures", "2")
+	mm := NewModuleManager(cm)
+	runs, exitCode := 0, 1
+	fakePodman(t, mm, &runs, &exitCode)
+	mc, _ := cm.NewModuleConfig("meter")
+
+	for i := 0; i < 5 && !mc.KeyExists("failed"); i++ {
+		mm.reconcileModules()
+		waitForModulesToExit(t, mm)
+	}
+	if !mc.KeyExists("failed") {
+		t.Fatal("expected crashing module without fallback_version to be quarantined")
+	}
+	if runs != 2 {
+		t.Errorf("expected quarantine after 2 runs, got %d", runs)
+	}
+
+	for range 3 {
+		mm.reconcileModules()
+	}
+	if runs != 2 {
+		t.Errorf("expected quarantined module not to be started, got %d runs", runs)
+	}
+
+	setConfig(t, cm, "meter", "restart", "")
+	mm.reconcileModules()
+	waitForModulesToExit(t, mm)
+	if mc.KeyExists("failed") || mc.KeyExists("restart") {
+		t.Error("expected restart request to lift the quarantine")
+	}
+	if runs != 3 {
+		t.Errorf("expected module to be started after the quarantine was lifted, got %d runs", runs)
+	}
+}
+
+func TestForgetRemovedModules(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "current_version": "1.0.0"})
+	mm := NewModuleManager(cm)
+	var runs, exitCode int
+	fakePodman(t, mm, &runs, &exitCode)
+	now := time.Now()
+	mm.health["gone"] = -1
+	mm.failureTimes["gone"] = []time.Time{now}
+	mm.restarts["gone"] = now
+	mm.valueTTLErrors["gone"] = "invalid"
+	mm.securityErrors["gone"] = "not allowed"
+	mm.schedules["gone"] = &scheduleState{}
+	mm.held["gone"] = "localhost/gone:1.0.0-amd64"
+
+	mm.reconcileModules()
+	waitForModulesToExit(t, mm)
+	for field, kept := range map[string]bool{
+		"health":         mm.health["gone"] != 0,
+		"failureTimes":   mm.failureTimes["gone"] != nil,
+		"restarts":       !mm.restarts["gone"].IsZero(),
+		"valueTTLErrors": mm.valueTTLErrors["gone"] != "",
+		"securityErrors": mm.securityErrors["gone"] != "",
+		"schedules":      mm.schedules["gone"] != nil,
+		"held":           mm.held["gone"] != "",
+	} {
+		if kept {
+			t.Errorf("expected %s of the removed module to be dropped", field)
+		}
+	}
+	if _, ok := mm.health["meter"]; !ok {
+		t.Error("expected the state of configured modules to be kept")
+	}
+}
+
+func TestQuarantineWindow(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":           "localhost/meter",
+		"current_version": "1.0.0",
+	})
+	setConfig(t, cm, "orchestrator", "QuarantineFailures", "2")
+	setConfig(t, cm, "orchestrator", "QuarantineWindowMinutes", "5")
+	mm := NewModuleManager(cm)
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mm.now = clock.Now
+	runs, exitCode := 0, 1
+	fakePodman(t, mm, &runs, &exitCode)
+	mc, _ := cm.NewModuleConfig("meter")
+
+	// failures further apart than the window do not add up
+	for range 4 {
+		mm.reconcileModules()
+		waitForModulesToExit(t, mm)
+		clock.Advance(10 * time.Minute)
+	}
+	if mc.KeyExists("failed") {
+		t.Fatal("expected failures outside of the window not to quarantine the module")
+	}
+
+	mm.reconcileModules()
+	waitForModulesToExit(t, mm)
+	clock.Advance(time.Minute)
+	mm.reconcileModules()
+	if !mc.KeyExists("failed") {
+		t.Error("expected failures within the window to quarantine the module")
+	}
+}
+
+func TestBuildPodmanCommandKeepContainer(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	mm := NewModuleManager(cm)
+
+	cmd, err := mm.buildPodmanCommand("meter", "shem-module-meter", "localhost/meter:1.0.0-amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(cmd.Args, "--rm") || !slices.Contains(cmd.Args, "--log-driver") {
+		t.Errorf("expected --rm and --log-driver by default, got %v", cmd.Args)
+	}
+
+	setConfig(t, cm, "meter", "keep_container", "")
+	cmd, err = mm.buildPodmanCommand("meter", "shem-module-meter", "localhost/meter:1.0.0-amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(cmd.Args, "--rm") || slices.Contains(cmd.Args, "--log-driver") {
+		t.Errorf("expected container and log to be kept, got %v", cmd.Args)
+	}
+	if !slices.Contains(cmd.Args, "--replace") {
+		t.Errorf("expected kept container to be replaced on the next start, got %v", cmd.Args)
+	}
+	if cmd.Args[len(cmd.Args)-1] != "localhost/meter:1.0.0-amd64" {
+		t.Errorf("expected image as last argument, got %v", cmd.Args)
+	}
+}
+
+func TestCleanupOrphanedContainersKeepContainer(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "keep_container": ""})
+	setConfig(t, cm, "logger", "keep_container", "")
+	mm := NewModuleManager(cm)
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	var removed []string
+	mm.podman = func(args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0")
+		switch args[0] {
+		case "ps":
+			cmd.Env = append(os.Environ(), "HELPER_OUTPUT=shem-module-meter exited\nshem-module-logger running\nshem-module-other exited\n")
+		case "rm":
+			removed = append(removed, args[len(args)-1])
+		}
+		return cmd
+	}
+
+	if err := mm.cleanupOrphanedContainers(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{"shem-module-logger", "shem-module-other"}) {
+		t.Errorf("expected only the exited container with keep_container to be kept, removed %v", removed)
+	}
+}
+
+func TestCheckPartialMessage(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	clock := &fakeClock{now: time.Now()}
+	mm.now = clock.Now
+	stdout, moduleStdout := io.Pipe()
+	defer moduleStdout.Close()
+	instance.reader = shemmsg.NewReader(stdout)
+	go mm.readMessages(instance)
+
+	// idle module
+	mm.checkPartialMessage(instance)
+	if instance.stuck {
+		t.Fatal("idle module reported as stuck")
+	}
+
+	// partial message, followed by a pause
+	moduleStdout.Write([]byte("pointvalue power\n"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, pending := instance.reader.PendingSince(); pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for partial message")
+		}
+	}
+	mm.checkPartialMessage(instance)
+	if instance.stuck {
+		t.Fatal("module reported as stuck right after the partial write")
+	}
+	clock.Advance(2 * partialMessageTimeout)
+	mm.checkPartialMessage(instance)
+	if !instance.stuck {
+		t.Fatal("expected module to be reported as stuck")
+	}
+
+	// completing the message
+	moduleStdout.Write([]byte("1\n\n"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, pending := instance.reader.PendingSince(); !pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for complete message")
+		}
+	}
+	mm.checkPartialMessage(instance)
+	if instance.stuck {
+		t.Error("expected module to be no longer stuck")
+	}
+}
+
+// recordingObserver records the names of the observed messages
+type recordingObserver struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (o *recordingObserver) ObserveMessage(msg shemmsg.Message, received time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.names = append(o.names, msg.Name)
+}
+
+func (o *recordingObserver) waitFor(t *testing.T, n int) []string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		o.mu.Lock()
+		names := slices.Clone(o.names)
+		o.mu.Unlock()
+		if len(names) >= n || time.Now().After(deadline) {
+			return names
+		}
+	}
+}
+
+// blockingObserver blocks until released
+type blockingObserver struct {
+	release chan struct{}
+}
+
+func (o *blockingObserver) ObserveMessage(msg shemmsg.Message, received time.Time) {
+	<-o.release
+}
+
+func TestMessageObservers(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	first, second := &recordingObserver{}, &recordingObserver{}
+	mm.AddObserver(first)
+	mm.AddObserver(second)
+
+	// two subscriptions match net_power, but observers see each message once
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go io.Copy(io.Discard, pr)
+	mm.router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.*", "meter.net_power"), pw, NewLogger("test"))
+	defer mm.router.RemoveSubscriber("optimizer")
+
+	var input strings.Builder
+	var expected []string
+	for i := range 200 {
+		name := fmt.Sprintf("value_%d", i%7)
+		input.WriteString(fmt.Sprintf("pointvalue %s\n%d\n\n", name, i))
+		expected = append(expected, "meter."+name)
+	}
+	input.WriteString("pointvalue net_power\n1\n\npointvalue bad.name\n1\n\n")
+	expected = append(expected, "meter.net_power")
+	instance.reader = shemmsg.NewReader(strings.NewReader(input.String()))
+	mm.readMessages(instance)
+
+	for _, o := range []*recordingObserver{first, second} {
+		if names := o.waitFor(t, len(expected)); !slices.Equal(names, expected) {
+			t.Errorf("expected %d messages in order, got %d", len(expected), len(names))
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if len(first.names) != len(expected) {
+		t.Errorf("expected each message to be observed once, got %d observations", len(first.names))
+	}
+}
+
+func TestCloseObservers(t *testing.T) {
+	mm, _ := newTestModuleManager(t)
+	observer := &recordingObserver{}
+	mm.AddObserver(observer)
+
+	mm.observe(testMessage(t, "meter.net_power", 1))
+	mm.closeObservers()
+	mm.observe(testMessage(t, "meter.net_power", 2))
+	if names := observer.waitFor(t, 1); len(names) != 1 {
+		t.Fatalf("expected the queued message to be observed, got %v", names)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if names := observer.waitFor(t, 1); len(names) != 1 {
+		t.Errorf("expected no messages to be observed after closing, got %v", names)
+	}
+}
+
+func TestBlockedMessageObserver(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	stuck := &blockingObserver{release: make(chan struct{})}
+	defer close(stuck.release)
+	mm.AddObserver(stuck)
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go io.Copy(io.Discard, pr)
+	mm.router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.*"), pw, NewLogger("test"))
+	defer mm.router.RemoveSubscriber("optimizer")
+
+	n := observerQueueSize + 100
+	instance.reader = shemmsg.NewReader(strings.NewReader(strings.Repeat("pointvalue power\n1\n\n", n)))
+
+	// a blocked observer does not hold up reading and routing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mm.readMessages(instance)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked observer delays reading messages")
+	}
+
+	mm.mu.Lock()
+	dropped := mm.observers[0].dropped
+	mm.mu.Unlock()
+	// the observer itself may have taken one message off the queue before blocking
+	if dropped < n-observerQueueSize-1 || dropped > n-observerQueueSize {
+		t.Errorf("expected about %d dropped messages, got %d", n-observerQueueSize, dropped)
+	}
+}
+
+func TestRestartFileDebounced(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "current_version": "1.0.0"})
+	mm := NewModuleManager(cm)
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	mm.now = clock.Now
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	runs := 0
+	mm.podman = func(args ...string) *exec.Cmd {
+		if args[0] == "run" {
+			runs++
+		}
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "stdin")
+	}
+	t.Cleanup(mm.stopAllModules)
+	mc, _ := cm.NewModuleConfig("meter")
+
+	mm.reconcileModules()
+	// an operator script writes the restart file in a tight loop
+	for range 20 {
+		setConfig(t, cm, "meter", "restart", "")
+		mm.reconcileModules()
+		clock.Advance(time.Second)
+	}
+	if runs != 2 {
+		t.Errorf("expected one restart within %v, got %d runs", restartDebounce, runs)
+	}
+	if !mc.KeyExists("restart") {
+		t.Error("expected the last request to be kept")
+	}
+
+	// the coalesced requests result in one more restart
+	clock.Advance(restartDebounce)
+	for range 3 {
+		mm.reconcileModules()
+	}
+	if runs != 3 {
+		t.Errorf("expected one more restart after %v, got %d runs", restartDebounce, runs)
+	}
+	if mc.KeyExists("restart") {
+		t.Error("expected the restart file to be removed")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// labels of a module image that describe the module
+const (
+	labelTitle       = "org.opencontainers.image.title"
+	labelDescription = "org.opencontainers.image.description"
+	labelProtocol    = "energy.shem.protocol"
+)
+
+// ModuleMetadata describes a module as stated by the labels of its image
+type ModuleMetadata struct {
+	Title       string // display name, empty if the image has no title label
+	Description string // empty if the image has no description label
+	Protocol    int    // protocol version the module requires, 1 if the image does not state one
+}
+
+// parseModuleMetadata returns the metadata stated by the labels of a module image
+func parseModuleMetadata(labels map[string]string) (ModuleMetadata, error) {
+	metadata := ModuleMetadata{
+		Title:       strings.TrimSpace(labels[labelTitle]),
+		Description: strings.TrimSpace(labels[labelDescription]),
+		Protocol:    1,
+	}
+	if label := strings.TrimSpace(labels[labelProtocol]); label != "" {
+		protocol, err := strconv.Atoi(label)
+		if err != nil || protocol < 1 {
+			return ModuleMetadata{}, fmt.Errorf("invalid protocol %q, must be a positive number", label)
+		}
+		metadata.Protocol = protocol
+	}
+	return metadata, nil
+}
+
+// imageMetadata returns the metadata of a module image. Images are immutable for a given
+// version, so the result is cached per image reference; failures are not cached.
+func (mm *ModuleManager) imageMetadata(fullImage string) (ModuleMetadata, error) {
+	mm.mu.Lock()
+	metadata, ok := mm.metadata[fullImage]
+	mm.mu.Unlock()
+	if ok {
+		return metadata, nil
+	}
+
+	metadata, err := inspectImageMetadata(mm.podman, fullImage)
+	if err != nil {
+		return ModuleMetadata{}, err
+	}
+
+	mm.mu.Lock()
+	mm.metadata[fullImage] = metadata
+	mm.mu.Unlock()
+	return metadata, nil
+}
+
+// inspectImageMetadata reads the metadata of a module image from its labels; podman returns the
+// command that runs podman with the given arguments
+func inspectImageMetadata(podman func(args ...string) *exec.Cmd, fullImage string) (ModuleMetadata, error) {
+	output, err := podman("image", "inspect", "--format", "{{json .Config.Labels}}", fullImage).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return ModuleMetadata{}, fmt.Errorf("failed to inspect %s: %w, %s", fullImage, err, ee.Stderr)
+		}
+		return ModuleMetadata{}, fmt.Errorf("failed to inspect %s: %w", fullImage, err)
+	}
+	var labels map[string]string // null if the image has no labels
+	if err := json.Unmarshal(output, &labels); err != nil {
+		return ModuleMetadata{}, fmt.Errorf("failed to read labels of %s: %w", fullImage, err)
+	}
+	metadata, err := parseModuleMetadata(labels)
+	if err != nil {
+		return ModuleMetadata{}, fmt.Errorf("%s: %w", fullImage, err)
+	}
+	return metadata, nil
+}
+
+// ModuleMetadata returns the image metadata of the current version of a module
+func (mm *ModuleManager) ModuleMetadata(name string) (ModuleMetadata, error) {
+	fullImage, err := currentImageRef(mm.configManager, name)
+	if err != nil {
+		return ModuleMetadata{}, err
+	}
+	return mm.imageMetadata(fullImage)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseModuleMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		want    ModuleMetadata
+		wantErr bool
+	}{
+		{name: "no labels", labels: nil, want: ModuleMetadata{Protocol: 1}},
+		{
+			name: "all labels",
+			labels: map[string]string{
+				labelTitle:       "Smart Meter",
+				labelDescription: " Reads the smart meter via its optical interface\n",
+				labelProtocol:    "2",
+				"other":          "ignored",
+			},
+			want: ModuleMetadata{Title: "Smart Meter", Description: "Reads the smart meter via its optical interface", Protocol: 2},
+		},
+		{name: "empty protocol", labels: map[string]string{labelProtocol: ""}, want: ModuleMetadata{Protocol: 1}},
+		{name: "invalid protocol", labels: map[string]string{labelProtocol: "two"}, wantErr: true},
+		{name: "zero protocol", labels: map[string]string{labelProtocol: "0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseModuleMetadata(tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestModuleMetadata(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "current_version": "1.0.0"})
+	mm := NewModuleManager(cm)
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	inspections := 0
+	mm.podman = func(args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "stdin")
+		if args[0] == "image" && args[1] == "inspect" {
+			inspections++
+			cmd = exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0")
+			cmd.Env = append(os.Environ(), `HELPER_OUTPUT={"`+labelTitle+`":"Smart Meter","`+labelProtocol+`":"1"}`)
+		}
+		return cmd
+	}
+	t.Cleanup(mm.stopAllModules)
+
+	mm.reconcileModules()
+	metadata, err := mm.ModuleMetadata("meter")
+	if err != nil || metadata.Title != "Smart Meter" || metadata.Protocol != 1 {
+		t.Errorf("expected metadata of the image, got %+v, %v", metadata, err)
+	}
+
+	// the image is inspected only once, also when the module is started again
+	mm.stopAllModules()
+	mm.reconcileModules()
+	for deadline := time.Now().Add(5 * time.Second); mm.ModuleState("meter") != ModuleRunning; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("module was not started again")
+		}
+	}
+	if inspections != 1 {
+		t.Errorf("expected the image to be inspected once, got %d", inspections)
+	}
+}
+
+func TestModuleMetadataWithoutVersion(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	if _, err := NewModuleManager(cm).ModuleMetadata("meter"); err == nil {
+		t.Error("expected an error for a module without current_version")
+	}
+}
+
+func TestImageMetadataFailureNotCached(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "current_version": "1.0.0"})
+	mm := NewModuleManager(cm)
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	exitCode := 1
+	mm.podman = func(args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", strconv.Itoa(exitCode))
+		cmd.Env = append(os.Environ(), "HELPER_OUTPUT=null")
+		return cmd
+	}
+
+	if _, err := mm.imageMetadata("localhost/meter:1.0.0-amd64"); err == nil {
+		t.Fatal("expected an error when podman fails")
+	}
+	exitCode = 0
+	metadata, err := mm.imageMetadata("localhost/meter:1.0.0-amd64")
+	if err != nil || metadata != (ModuleMetadata{Protocol: 1}) {
+		t.Errorf("expected default metadata for an image without labels, got %+v, %v", metadata, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ModuleState is the state of a module in its lifecycle
+//
+//	stopped ──► starting ──► running ──► stopping ──► stopped
+//	               │            │
+//	               └────────────┴──────────────────► stopped or crashed
+//
+// An instance is starting until it has sent its first valid message, but only if the module has a
+// ready_timeout file; otherwise, it is running as soon as its container has been started. An
+// instance that exits without being asked to is crashed, unless it is a scheduled module that
+// completed its run. Stopped and crashed instances do not change their state again; starting the
+// module again creates a new instance.
+type ModuleState int
+
+const (
+	ModuleStopped         ModuleState = iota // not started yet, or exited after it was asked to stop or completed its run
+	ModuleStarting                           // container started, waiting for the first valid message
+	ModuleRunning                            // ready and receiving messages
+	ModuleStopping                           // asked to stop, waiting for it to exit
+	ModuleCrashed                            // exited without being asked to stop
+	ModuleQuarantined                        // not started until a restart is requested, see quarantine
+	ModulePendingCapacity                    // not started because MaxConcurrentModules modules are running
+)
+
+var moduleStateNames = [...]string{
+	ModuleStopped:         "stopped",
+	ModuleStarting:        "starting",
+	ModuleRunning:         "running",
+	ModuleStopping:        "stopping",
+	ModuleCrashed:         "crashed",
+	ModuleQuarantined:     "quarantined",
+	ModulePendingCapacity: "pending-capacity",
+}
+
+func (s ModuleState) String() string {
+	if s < 0 || int(s) >= len(moduleStateNames) {
+		return fmt.Sprintf("ModuleState(%d)", int(s))
+	}
+	return moduleStateNames[s]
+}
+
+// moduleTransitions lists the states an instance may move to from each state
+// Quarantined and pending-capacity are not states of an instance, they are only reported by
+// ModuleManager.ModuleState.
+var moduleTransitions = map[ModuleState][]ModuleState{
+	ModuleStopped:  {ModuleStarting},
+	ModuleStarting: {ModuleRunning, ModuleStopping, ModuleStopped, ModuleCrashed},
+	ModuleRunning:  {ModuleStopping, ModuleStopped, ModuleCrashed},
+	ModuleStopping: {ModuleStopped},
+}
+
+// canTransitionTo reports whether an instance may move from state s to next
+func (s ModuleState) canTransitionTo(next ModuleState) bool {
+	return slices.Contains(moduleTransitions[s], next)
+}
+
+// setState moves the instance to state, leaving it unchanged if that is not a valid transition
+// Must be called with ModuleManager.mu held.
+func (instance *ModuleInstance) setState(state ModuleState) error {
+	if !instance.state.canTransitionTo(state) {
+		return fmt.Errorf("invalid state transition from %s to %s", instance.state, state)
+	}
+	instance.logger.Debug("state changed from %s to %s", instance.state, state)
+	instance.state = state
+	return nil
+}
+
+// ModuleState returns the state of the most recent instance of a module, or ModuleStopped if the
+// module has not been started yet. A module that is not running and has a failed file is reported
+// as ModuleQuarantined, and a module that waits for others to stop as ModulePendingCapacity.
+func (mm *ModuleManager) ModuleState(name string) ModuleState {
+	mm.mu.Lock()
+	state := ModuleStopped
+	if instance := mm.instances[name]; instance != nil {
+		state = instance.state
+	}
+	pending := mm.pending[name]
+	mm.mu.Unlock()
+
+	if pending && (state == ModuleStopped || state == ModuleCrashed) {
+		return ModulePendingCapacity
+	}
+
+	if state == ModuleStopped || state == ModuleCrashed {
+		if moduleConfig, err := mm.configManager.NewModuleConfig(name); err == nil && moduleConfig.KeyExists("failed") {
+			return ModuleQuarantined
+		}
+	}
+	return state
+}
+
+// StartedModules returns the number of modules that have been started since the module manager
+// was created
+func (mm *ModuleManager) StartedModules() int {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return len(mm.instances)
+}
+
+// QuarantinedModules returns the names of the modules that are quarantined
+func (mm *ModuleManager) QuarantinedModules() []string {
+	moduleNames, _ := mm.configManager.ListModules()
+	var quarantined []string
+	for _, name := range moduleNames {
+		if mm.ModuleState(name) == ModuleQuarantined {
+			quarantined = append(quarantined, name)
+		}
+	}
+	return quarantined
+}
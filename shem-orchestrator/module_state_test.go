@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestModuleStateTransitions(t *testing.T) {
+	tests := []struct {
+		from, to ModuleState
+		valid    bool
+	}{
+		{ModuleStopped, ModuleStarting, true},
+		{ModuleStarting, ModuleRunning, true},
+		{ModuleStarting, ModuleStopping, true},
+		{ModuleStarting, ModuleCrashed, true},
+		{ModuleRunning, ModuleStopping, true},
+		{ModuleRunning, ModuleStopped, true}, // scheduled module completed its run
+		{ModuleRunning, ModuleCrashed, true},
+		{ModuleStopping, ModuleStopped, true},
+		{ModuleStopped, ModuleRunning, false},
+		{ModuleRunning, ModuleStarting, false},
+		{ModuleStopping, ModuleRunning, false},
+		{ModuleStopping, ModuleCrashed, false},
+		{ModuleStopped, ModuleStopping, false},
+		{ModuleCrashed, ModuleStarting, false},
+		{ModuleRunning, ModuleQuarantined, false},
+	}
+	for _, tt := range tests {
+		instance := &ModuleInstance{state: tt.from, logger: NewLogger("module-test")}
+		err := instance.setState(tt.to)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s → %s: expected valid %v, got %v", tt.from, tt.to, tt.valid, err)
+		}
+		expected := tt.from
+		if tt.valid {
+			expected = tt.to
+		}
+		if instance.state != expected {
+			t.Errorf("%s → %s: expected state %s, got %s", tt.from, tt.to, expected, instance.state)
+		}
+	}
+}
+
+func TestModuleStateLifecycle(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	mm.instances["meter"] = instance
+	if state := mm.ModuleState("meter"); state != ModuleRunning {
+		t.Fatalf("expected %s, got %s", ModuleRunning, state)
+	}
+
+	mm.requestStop(instance, StopReasonRestart)
+	if state := mm.ModuleState("meter"); state != ModuleStopping {
+		t.Fatalf("expected %s after stop was requested, got %s", ModuleStopping, state)
+	}
+	mm.moduleExited(instance, nil)
+	if state := mm.ModuleState("meter"); state != ModuleStopped {
+		t.Fatalf("expected %s after exit, got %s", ModuleStopped, state)
+	}
+	// stopping an instance that has exited changes neither its state nor its stop reason
+	mm.requestStop(instance, StopReasonDisabled)
+	if state := mm.ModuleState("meter"); state != ModuleStopped || instance.stopReason != StopReasonRestart {
+		t.Fatalf("expected exited instance to stay %s (%s), got %s (%s)", ModuleStopped, StopReasonRestart, state, instance.stopReason)
+	}
+
+	instance = newTestInstance("meter", "localhost/meter", "1.0.0")
+	mm.modules["meter"], mm.instances["meter"] = instance, instance
+	mm.moduleExited(instance, errors.New("exit status 1"))
+	if state := mm.ModuleState("meter"); state != ModuleCrashed {
+		t.Fatalf("expected %s, got %s", ModuleCrashed, state)
+	}
+	setConfig(t, mm.configManager, "meter", "failed", "")
+	if state := mm.ModuleState("meter"); state != ModuleQuarantined {
+		t.Fatalf("expected %s, got %s", ModuleQuarantined, state)
+	}
+}
+
+func TestModuleStateStarting(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":           "localhost/meter",
+		"current_version": "1.0.0",
+		"ready_timeout":   "1m",
+	})
+	mm := NewModuleManager(cm)
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	mm.podman = func(args ...string) *exec.Cmd {
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "stdin")
+	}
+	t.Cleanup(mm.stopAllModules)
+
+	if state := mm.ModuleState("meter"); state != ModuleStopped {
+		t.Fatalf("expected %s before the first start, got %s", ModuleStopped, state)
+	}
+	mm.reconcileModules()
+	if state := mm.ModuleState("meter"); state != ModuleStarting {
+		t.Fatalf("expected %s until the first message, got %s", ModuleStarting, state)
+	}
+	mm.mu.Lock()
+	instance := mm.modules["meter"]
+	mm.mu.Unlock()
+	mm.markReady(instance)
+	if state := mm.ModuleState("meter"); state != ModuleRunning {
+		t.Fatalf("expected %s after the first message, got %s", ModuleRunning, state)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// notificationTimeout limits how long a single hook command or webhook request may take
+const notificationTimeout = 10 * time.Second
+
+// UpdateEventType identifies an update event that is reported to the notification hooks
+type UpdateEventType string
+
+const (
+	UpdateEventScheduled          UpdateEventType = "update-scheduled"
+	UpdateEventApplied            UpdateEventType = "update-applied"
+	UpdateEventVerificationFailed UpdateEventType = "verification-failed"
+)
+
+// UpdateEvent is passed as JSON to the update hook command (on stdin) and the webhook (as body)
+type UpdateEvent struct {
+	Type           UpdateEventType `json:"event"`
+	Module         string          `json:"module"`
+	CurrentVersion string          `json:"current_version"`
+	NewVersion     string          `json:"new_version"`
+	Outcome        string          `json:"outcome"` // "success" or "failure"
+	Details        string          `json:"details,omitempty"`
+	Time           time.Time       `json:"time"`
+}
+
+// notify reports an update event to the configured hook command and webhook
+// Notifications are sent in the background; failures are logged and never affect the update.
+func (um *UpdateManager) notify(event UpdateEvent) {
+	config := um.currentConfig()
+	if config.UpdateHookCommand == "" && config.UpdateWebhookURL == "" {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		um.logger.Error("failed to encode %s event: %v", event.Type, err)
+		return
+	}
+
+	if config.UpdateHookCommand != "" {
+		um.notifications.Go(func() {
+			if err := runHookCommand(config.UpdateHookCommand, event, payload); err != nil {
+				um.logger.Warn("update hook command failed for %s event of %s: %v", event.Type, event.Module, err)
+			}
+		})
+	}
+	if config.UpdateWebhookURL != "" {
+		um.notifications.Go(func() {
+			if err := postWebhook(config.UpdateWebhookURL, payload); err != nil {
+				um.logger.Warn("update webhook failed for %s event of %s: %v", event.Type, event.Module, err)
+			}
+		})
+	}
+}
+
+// runHookCommand runs the hook command with the event as JSON on stdin
+// The most important fields are also passed as environment variables for simple shell scripts.
+func runHookCommand(command string, event UpdateEvent, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"SHEM_EVENT="+string(event.Type),
+		"SHEM_MODULE="+event.Module,
+		"SHEM_CURRENT_VERSION="+event.CurrentVersion,
+		"SHEM_NEW_VERSION="+event.NewVersion,
+		"SHEM_OUTCOME="+event.Outcome,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if output = bytes.TrimSpace(output); len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+// postWebhook posts the JSON encoded event to url
+func postWebhook(url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newWebhookServer starts an HTTP server that records the events posted to it
+func newWebhookServer(t *testing.T, status int) (*httptest.Server, *[]UpdateEvent) {
+	t.Helper()
+	var events []UpdateEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event UpdateEvent
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid webhook payload %q: %v", body, err)
+		}
+		events = append(events, event)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &events
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	server, events := newWebhookServer(t, http.StatusOK)
+	um := newTestUpdateManager(t, map[string]string{
+		"UpdateDelayMaxHours": "1",
+		"UpdateWebhookURL":    server.URL,
+	})
+	if err := os.MkdirAll(filepath.Join(um.shemHome, "modules", "meter"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	moduleConfig, _ := um.configManager.NewModuleConfig("meter")
+	moduleConfig.SetString("current_version", "1.0.0")
+
+	um.scheduleUpdate("meter", "1.0.1")
+	um.notifications.Wait()
+
+	if len(*events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(*events))
+	}
+	event := (*events)[0]
+	if event.Type != UpdateEventScheduled || event.Module != "meter" || event.CurrentVersion != "1.0.0" ||
+		event.NewVersion != "1.0.1" || event.Outcome != "success" || event.Time.IsZero() {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestNotifyHookCommand(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	output := filepath.Join(dir, "event")
+	content := "#!/bin/sh\ncat > " + output + "\necho \"$SHEM_EVENT $SHEM_MODULE\" >> " + output + "\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	um := newTestUpdateManager(t, map[string]string{"UpdateHookCommand": script})
+
+	um.notifyApplied("meter", "1.0.0", "1.0.1")
+	um.notifications.Wait()
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("hook was not run: %v", err)
+	}
+	var event UpdateEvent
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&event); err != nil {
+		t.Fatalf("invalid hook payload %q: %v", data, err)
+	}
+	if event.Type != UpdateEventApplied || event.CurrentVersion != "1.0.0" || event.NewVersion != "1.0.1" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	rest, _ := io.ReadAll(decoder.Buffered())
+	if strings.TrimSpace(string(rest)) != "update-applied meter" {
+		t.Errorf("unexpected environment in hook: %q", rest)
+	}
+}
+
+func TestNotifyFailuresAreIgnored(t *testing.T) {
+	server, events := newWebhookServer(t, http.StatusInternalServerError)
+	um := newTestUpdateManager(t, map[string]string{
+		"UpdateWebhookURL":  server.URL,
+		"UpdateHookCommand": filepath.Join(t.TempDir(), "missing"),
+	})
+
+	um.notify(UpdateEvent{Type: UpdateEventVerificationFailed, Module: "meter", Outcome: "failure"})
+	um.notifications.Wait()
+
+	if len(*events) != 1 {
+		t.Errorf("expected webhook to be called despite failing command, got %d calls", len(*events))
+	}
+}
+
+func TestInvalidWebhookURL(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{"UpdateWebhookURL": "ftp://example.com/hook"})
+	mc, _ := cm.NewModuleConfig("orchestrator")
+
+	config, err := LoadOrchestratorConfig(mc)
+	if err == nil {
+		t.Error("expected error for invalid webhook URL")
+	}
+	if config.UpdateWebhookURL != "" {
+		t.Errorf("expected invalid webhook URL to be ignored, got %q", config.UpdateWebhookURL)
+	}
+}
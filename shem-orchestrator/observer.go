@@ -0,0 +1,78 @@
+package main
+
+import (
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// observerQueueSize is the number of messages buffered per observer before new messages are dropped
+const observerQueueSize = 1000
+
+// MessageObserver is notified of every message sent by a module, e.g. to write an audit log
+// The message has its qualified name and has been validated, but is not transformed for any
+// subscriber. Observers are called from a goroutine of their own, one message at a time, so a slow
+// observer never delays routing; the message must not be modified.
+type MessageObserver interface {
+	ObserveMessage(msg shemmsg.Message, received time.Time)
+}
+
+// observation is a message waiting to be passed to an observer
+type observation struct {
+	msg      shemmsg.Message
+	received time.Time
+}
+
+// observerQueue passes messages to a single observer
+type observerQueue struct {
+	observer MessageObserver
+	queue    chan observation
+	dropped  int // number of messages dropped because the queue was full, guarded by ModuleManager.mu
+}
+
+// AddObserver registers an observer for all messages sent by modules from now on
+func (mm *ModuleManager) AddObserver(observer MessageObserver) {
+	q := &observerQueue{
+		observer: observer,
+		queue:    make(chan observation, observerQueueSize),
+	}
+	go func() {
+		for o := range q.queue {
+			q.observer.ObserveMessage(o.msg, o.received)
+		}
+	}()
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.observers = append(mm.observers, q)
+}
+
+// closeObservers stops passing messages to the observers; each observer still receives the messages
+// that are already queued for it
+func (mm *ModuleManager) closeObservers() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for _, q := range mm.observers {
+		close(q.queue)
+	}
+	mm.observers = nil
+}
+
+// observe queues a message for all observers without blocking; if the queue of an observer is
+// full, the message is dropped for this observer
+func (mm *ModuleManager) observe(msg shemmsg.Message) {
+	received := mm.now()
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for _, q := range mm.observers {
+		select {
+		case q.queue <- observation{msg, received}:
+		default:
+			q.dropped++
+			if q.dropped%100 == 1 {
+				mm.logger.Warn("message observer falls behind, dropped %s (%d dropped so far)", msg.Name, q.dropped)
+			}
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -19,6 +23,8 @@ type Orchestrator struct {
 	configManager   *ConfigManager
 	updateManager   *UpdateManager
 	moduleManager   *ModuleManager
+	after           func(d time.Duration) <-chan time.Time // timer for the verification run, replaced in tests
+	started         time.Time                              // when Run was called
 }
 
 // NewOrchestrator creates a new orchestrator instance
@@ -28,6 +34,30 @@ func NewOrchestrator(shemHome string, verificationRun bool) (*Orchestrator, erro
 	// Initialize configuration manager
 	configManager := NewConfigManager(shemHome)
 
+	// Migrate the configs of an older orchestrator before anything reads them; an orchestrator
+	// that cannot read its configs does not start, so that a failed update is rolled back
+	migrated, err := configManager.MigrateConfig(configMigrations)
+	for _, description := range migrated {
+		logger.Info("migrated config: %s", description)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if version, _ := configManager.ConfigVersion(); version > latestConfigVersion(configMigrations) {
+		logger.Warn("config version %d is newer than the version %d this orchestrator knows, configs may be misread",
+			version, latestConfigVersion(configMigrations))
+	}
+
+	// Create the modules of a provisioning manifest before anything reads the module configs
+	manifestPath := filepath.Join(shemHome, "manifest.json")
+	created, err := configManager.ApplyManifest(manifestPath)
+	if err != nil {
+		logger.Error("failed to apply %s: %v", manifestPath, err)
+	}
+	for _, name := range created {
+		logger.Info("created module %s from %s", name, manifestPath)
+	}
+
 	// Initialize update manager
 	updateManager := NewUpdateManager(configManager, verificationRun)
 
@@ -41,12 +71,14 @@ func NewOrchestrator(shemHome string, verificationRun bool) (*Orchestrator, erro
 		updateManager:   updateManager,
 		moduleManager:   moduleManager,
 		verificationRun: verificationRun,
+		after:           time.After,
 	}, nil
 }
 
 // runs the orchestrator; will return only after orchestrator stops
 func (o *Orchestrator) Run() {
 	o.logger.Info("starting SHEM orchestrator version %s", Version)
+	o.started = time.Now()
 
 	// Create context and WaitGroup for coordinated shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -54,9 +86,10 @@ func (o *Orchestrator) Run() {
 
 	var wg sync.WaitGroup
 
-	// Setup signal handling for graceful shutdown
+	// Setup signal handling for graceful shutdown and for reloading on SIGHUP
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
 
 	// Start services
 	wg.Go(func() {
@@ -67,6 +100,26 @@ func (o *Orchestrator) Run() {
 		o.moduleManager.Run(ctx)
 	})
 
+	// Log the routing table on SIGUSR1 for diagnosing routing problems
+	routingChan := make(chan os.Signal, 1)
+	signal.Notify(routingChan, syscall.SIGUSR1)
+	defer signal.Stop(routingChan)
+	wg.Go(func() {
+		for {
+			select {
+			case <-routingChan:
+				o.logRoutingTable()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	snapshotWriter := NewSnapshotWriter(o.configManager, o.moduleManager.router, o.updateManager.currentConfig)
+	wg.Go(func() {
+		snapshotWriter.Run(ctx)
+	})
+
 	if heartbeatService, err := NewHeartbeatService(); err == nil {
 		wg.Go(func() {
 			heartbeatService.Run(ctx)
@@ -76,10 +129,12 @@ func (o *Orchestrator) Run() {
 	}
 
 	if o.verificationRun {
-		// after 10 minutes run verification
+		// run verification after the configured time (orchestrator option VerificationRunMinutes)
+		delay := time.Duration(o.updateManager.currentConfig().VerificationRunMinutes * float64(time.Minute))
+		o.logger.Info("verification run, checking health in %v", delay)
 		wg.Go(func() {
 			select {
-			case <-time.After(10 * time.Minute):
+			case <-o.after(delay):
 				o.VerificationRunCheck()
 			case <-ctx.Done():
 				return
@@ -88,20 +143,83 @@ func (o *Orchestrator) Run() {
 	}
 
 	// Wait for shutdown signal or context cancellation
-	select {
-	case <-sigChan:
-		o.logger.Info("received shutdown signal, stopping orchestrator...")
-		o.cancel()
-	case <-ctx.Done():
-		o.logger.Info("orchestrator shutdown requested...")
+wait:
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				o.Reload()
+				continue
+			}
+			o.logger.Info("received shutdown signal, stopping orchestrator...")
+			o.cancel()
+			break wait
+		case <-ctx.Done():
+			o.logger.Info("orchestrator shutdown requested...")
+			break wait
+		}
 	}
 
 	// wait for services to finish
 	wg.Wait()
 
+	o.logger.Info("session summary: %s", o.Summary())
 	o.logger.Info("orchestrator stopped")
 }
 
+// SessionSummary describes what happened while the orchestrator was running, for analyzing why a
+// device restarted
+type SessionSummary struct {
+	Uptime         time.Duration
+	Modules        int   // modules started during the session
+	UpdatesApplied int   // updates applied to modules and the orchestrator
+	MessagesRouted int64 // messages routed between modules
+	Quarantined    []string
+}
+
+// String formats the summary as key=value pairs on a single line
+func (s SessionSummary) String() string {
+	quarantined := "none"
+	if len(s.Quarantined) > 0 {
+		quarantined = strings.Join(s.Quarantined, ",")
+	}
+	return fmt.Sprintf("uptime=%v modules=%d updates_applied=%d messages_routed=%d quarantined=%s",
+		s.Uptime.Round(time.Second), s.Modules, s.UpdatesApplied, s.MessagesRouted, quarantined)
+}
+
+// Summary returns the summary of the session since Run was called
+func (o *Orchestrator) Summary() SessionSummary {
+	return SessionSummary{
+		Uptime:         time.Since(o.started),
+		Modules:        o.moduleManager.StartedModules(),
+		UpdatesApplied: o.updateManager.AppliedUpdates(),
+		MessagesRouted: o.moduleManager.router.RoutedMessages(),
+		Quarantined:    o.moduleManager.QuarantinedModules(),
+	}
+}
+
+// Reload re-reads the orchestrator options and the module configs without a restart
+// Log messages are written to stdout and stderr and collected by systemd, so there are no log
+// files to reopen.
+func (o *Orchestrator) Reload() {
+	o.updateManager.ReloadConfig()
+	o.moduleManager.Reload()
+	o.logger.Info("reloaded configuration")
+}
+
+// logRoutingTable logs the current routing table, one line per log entry
+func (o *Orchestrator) logRoutingTable() {
+	var buf bytes.Buffer
+	if err := o.moduleManager.router.RoutingTable().Write(&buf); err != nil {
+		o.logger.Error("failed to format routing table: %v", err)
+		return
+	}
+	o.logger.Info("routing table:")
+	for line := range strings.Lines(buf.String()) {
+		o.logger.Info("%s", strings.TrimRight(line, "\n"))
+	}
+}
+
 // Shutdown gracefully shuts down the orchestrator
 func (o *Orchestrator) Shutdown() {
 	o.logger.Info("shutting down orchestrator...")
@@ -135,19 +253,79 @@ func (o *Orchestrator) VerificationRunCheck() {
 	}
 
 	// update symlink to point to this version
-	targetBinary := filepath.Join(o.shemHome, "bin", fmt.Sprintf("shem-orchestrator-%s", Version))
-	o.logger.Info("updating symlink to point to %s", targetBinary)
-	symlinkPath := filepath.Join(o.shemHome, "bin", "shem-orchestrator")
-	tempSymlinkPath := symlinkPath + ".tmp"
+	binDir := filepath.Join(o.shemHome, "bin")
+	o.logger.Info("updating symlink to point to %s", orchestratorBinary(binDir, Version))
+	if err := promoteOrchestratorBinary(binDir, Version); err != nil {
+		o.logger.Error("failed to promote version %s, keeping the previous version: %v", Version, err)
+	}
+
+	o.logger.Info("verification run completed successfully, shutting down")
+	o.Shutdown()
+}
+
+// orchestratorBinary returns the path of the binary of an orchestrator version
+func orchestratorBinary(binDir, version string) string {
+	return filepath.Join(binDir, fmt.Sprintf("shem-orchestrator-%s", version))
+}
+
+// promoteOrchestratorBinary atomically points the shem-orchestrator symlink in binDir to the
+// binary of the given version
+// The binary must be an executable regular file; otherwise the symlink is left unchanged, so
+// that the next boot does not follow a dangling symlink.
+func promoteOrchestratorBinary(binDir, version string) error {
+	targetBinary := orchestratorBinary(binDir, version)
+	info, err := os.Stat(targetBinary)
+	if err != nil {
+		return fmt.Errorf("symlink target missing: %w", err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("symlink target %s is not an executable file", targetBinary)
+	}
 
-	// Atomically replace the symlink
+	symlinkPath := filepath.Join(binDir, "shem-orchestrator")
+	tempSymlinkPath := symlinkPath + ".tmp"
+	os.Remove(tempSymlinkPath) // left over from an interrupted promotion
 	if err := os.Symlink(targetBinary, tempSymlinkPath); err != nil {
-		o.logger.Error("failed to create temporary symlink: %v", err)
-	} else if err := os.Rename(tempSymlinkPath, symlinkPath); err != nil {
-		o.logger.Error("failed to replace symlink: %v", err)
+		return fmt.Errorf("failed to create temporary symlink: %w", err)
+	}
+	if err := os.Rename(tempSymlinkPath, symlinkPath); err != nil {
 		os.Remove(tempSymlinkPath)
+		return fmt.Errorf("failed to replace symlink: %w", err)
 	}
+	return nil
+}
 
-	o.logger.Info("verification run completed successfully, shutting down")
-	o.Shutdown()
+// repairOrchestratorSymlink checks that the shem-orchestrator symlink in binDir points to an
+// executable file. If its target has been removed (e.g. by cleaning up bin/ by hand), systemd
+// could not start the orchestrator again, so the symlink is pointed to the newest installed binary
+// that is not blacklisted. Returns the version it points to now, or "" if it was left unchanged.
+// Installations without the symlink are left alone.
+func repairOrchestratorSymlink(binDir string, blacklist map[string]struct{}) (string, error) {
+	symlinkPath := filepath.Join(binDir, "shem-orchestrator")
+	if _, err := os.Lstat(symlinkPath); err != nil {
+		return "", nil
+	}
+	if info, err := os.Stat(symlinkPath); err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+		return "", nil
+	}
+
+	versions, err := installedOrchestratorVersions(binDir)
+	if err != nil {
+		return "", err
+	}
+	var errs []error
+	for _, version := range slices.Backward(versions) {
+		if _, blacklisted := blacklist[version]; blacklisted {
+			continue
+		}
+		if err := promoteOrchestratorBinary(binDir, version); err != nil {
+			errs = append(errs, fmt.Errorf("version %s: %w", version, err))
+			continue
+		}
+		return version, nil
+	}
+	if len(errs) == 0 {
+		return "", errors.New("no orchestrator binary that is not blacklisted is installed")
+	}
+	return "", errors.Join(errs...)
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// OrchestratorConfig holds the orchestrator options stored in $SHEM_HOME/modules/orchestrator/
+// (see modules.md, "Orchestrator additional options")
+type OrchestratorConfig struct {
+	UpdateCheckIntervalHours float64 // interval between update checks
+	UpdateDelayMaxHours      float64 // maximum random delay before a scheduled update is applied
+	UpdateHookCommand        string  // executable that is run for update events, empty if not set
+	UpdateWebhookURL         string  // URL that update events are posted to, empty if not set
+	PodmanStorageOptions     string  // global podman options that select the container storage, empty if not set
+	SnapshotIntervalMinutes  float64 // interval between snapshots of the last known values, 0 if disabled
+	ReconcileIntervalSeconds float64 // interval between two reconciliations of the running modules
+	MaxStartsPerReconcile    int     // maximum number of modules started per reconciliation, 0 if unlimited
+	MaxConcurrentModules     int     // maximum number of modules running at the same time, 0 if unlimited
+	BlacklistExpiryHours     float64 // time for which update checks skip a version that failed verification, 0 if only the current check
+	VerificationRunMinutes   float64 // time a new orchestrator version runs before it checks its health and promotes itself
+	MaxTimeSeriesHours       float64 // maximum time span of a timeseries sent by a module, 0 if unlimited
+	MaxModuleMemory          int     // highest memory limit in megabytes that a module can request
+	MaxModuleCPUs            float64 // highest number of CPUs that a module can request
+	QuarantineFailures       int     // failures within QuarantineWindowMinutes after which a module without fallback version is quarantined
+	QuarantineWindowMinutes  float64 // time span in which the failures of a module are counted
+	OfflineUpdates           bool    // take updates from images in local storage instead of the registry
+	TrimTrailingMissing      bool    // remove missing values at the end of timeseries sent by modules
+}
+
+// floatOption describes a float orchestrator option with its allowed range
+type floatOption struct {
+	key      string
+	value    *float64
+	min, max float64
+	clampMin bool // values below min are raised to min instead of being replaced by the default
+}
+
+// intOption describes an integer orchestrator option with its allowed range; fractions are invalid
+type intOption struct {
+	key      string
+	value    *int
+	min, max int
+}
+
+// DefaultOrchestratorConfig returns the configuration that is used for options that are not set
+func DefaultOrchestratorConfig() OrchestratorConfig {
+	return OrchestratorConfig{
+		UpdateCheckIntervalHours: 22.15,
+		UpdateDelayMaxHours:      96.0,
+		ReconcileIntervalSeconds: 10,
+		VerificationRunMinutes:   10,
+		MaxModuleMemory:          1024,
+		MaxModuleCPUs:            1,
+		QuarantineFailures:       3,
+		QuarantineWindowMinutes:  10,
+	}
+}
+
+// floatOptions returns the float options of config together with their allowed ranges
+func (config *OrchestratorConfig) floatOptions() []floatOption {
+	return []floatOption{
+		{"UpdateCheckIntervalHours", &config.UpdateCheckIntervalHours, 0.1, 30 * 24, false},
+		// a negative delay is taken to mean "apply immediately", like 0
+		{"UpdateDelayMaxHours", &config.UpdateDelayMaxHours, 0, 30 * 24, true},
+		{"SnapshotIntervalMinutes", &config.SnapshotIntervalMinutes, 0, 24 * 60, false},
+		// reconciling runs podman ps, so very short intervals put a noticeable load on the system
+		{"ReconcileIntervalSeconds", &config.ReconcileIntervalSeconds, 2, 3600, false},
+		{"BlacklistExpiryHours", &config.BlacklistExpiryHours, 0, 365 * 24, false},
+		// the previous version is not restored while the verification run lasts
+		{"VerificationRunMinutes", &config.VerificationRunMinutes, 1, 120, false},
+		{"MaxTimeSeriesHours", &config.MaxTimeSeriesHours, 0, 30 * 24, false},
+		// modules without a cpus file get the default even if the ceiling is lower
+		{"MaxModuleCPUs", &config.MaxModuleCPUs, defaultCPUs, 1024, false},
+		{"QuarantineWindowMinutes", &config.QuarantineWindowMinutes, 1, 7 * 24 * 60, false},
+	}
+}
+
+// intOptions returns the integer options of config together with their allowed ranges
+func (config *OrchestratorConfig) intOptions() []intOption {
+	return []intOption{
+		{"MaxStartsPerReconcile", &config.MaxStartsPerReconcile, 0, 1000},
+		{"MaxConcurrentModules", &config.MaxConcurrentModules, 0, 1000},
+		// modules without a memory_mb file get the default even if the ceiling is lower
+		{"MaxModuleMemory", &config.MaxModuleMemory, defaultMemoryMB, 1024 * 1024},
+		{"QuarantineFailures", &config.QuarantineFailures, 1, 1000},
+	}
+}
+
+// check returns value if it is in the allowed range of the option; otherwise, it returns the
+// value that is used instead (the minimum or the default) and an error that describes the problem
+func (option floatOption) check(value float64) (float64, error) {
+	if value < option.min && option.clampMin {
+		return option.min, fmt.Errorf("%s must not be below %g, got %g, using %g",
+			option.key, option.min, value, option.min)
+	}
+	if value < option.min || value > option.max || math.IsNaN(value) {
+		return *option.value, fmt.Errorf("%s must be between %g and %g, got %g, using default %g",
+			option.key, option.min, option.max, value, *option.value)
+	}
+	return value, nil
+}
+
+// check returns value if it is in the allowed range of the option; otherwise, it returns the
+// default and an error that describes the problem
+func (option intOption) check(value int) (int, error) {
+	if value < option.min || value > option.max {
+		return *option.value, fmt.Errorf("%s must be between %d and %d, got %d, using default %d",
+			option.key, option.min, option.max, value, *option.value)
+	}
+	return value, nil
+}
+
+// option returns the float option with the given key
+func (config *OrchestratorConfig) option(key string) floatOption {
+	options := config.floatOptions()
+	return options[slices.IndexFunc(options, func(option floatOption) bool { return option.key == key })]
+}
+
+// LoadOrchestratorConfig reads all orchestrator options
+// Options that are not set keep their default value. Invalid or out-of-range values are also
+// replaced by the default and reported in the returned error.
+func LoadOrchestratorConfig(orchestratorConfig *ModuleConfig) (OrchestratorConfig, error) {
+	config := DefaultOrchestratorConfig()
+
+	var errs []error
+	for _, option := range config.floatOptions() {
+		value, err := orchestratorConfig.GetFloat(option.key, *option.value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w, using default %g", err, *option.value))
+			continue
+		}
+		if *option.value, err = option.check(value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, option := range config.intOptions() {
+		value, err := orchestratorConfig.GetInt(option.key, *option.value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w, using default %d", err, *option.value))
+			continue
+		}
+		if *option.value, err = option.check(value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if config.SnapshotIntervalMinutes > 0 && config.SnapshotIntervalMinutes < 1 {
+		errs = append(errs, fmt.Errorf("SnapshotIntervalMinutes must be 0 or at least 1, got %g, using 1",
+			config.SnapshotIntervalMinutes))
+		config.SnapshotIntervalMinutes = 1
+	}
+
+	offline, err := orchestratorConfig.GetBool("OfflineUpdates", false)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%w, using default false", err))
+	}
+	config.OfflineUpdates = offline
+
+	trim, err := orchestratorConfig.GetBool("TrimTrailingMissing", false)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%w, using default false", err))
+	}
+	config.TrimTrailingMissing = trim
+
+	config.UpdateHookCommand, _ = orchestratorConfig.GetString("UpdateHookCommand", "")
+
+	webhookURL, _ := orchestratorConfig.GetString("UpdateWebhookURL", "")
+	if webhookURL != "" {
+		if u, err := url.Parse(webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("UpdateWebhookURL must be an http or https URL, got %q, ignoring it", webhookURL))
+		} else {
+			config.UpdateWebhookURL = webhookURL
+		}
+	}
+
+	storageOptions, _ := orchestratorConfig.GetString("PodmanStorageOptions", "")
+	if _, err := parsePodmanStorageOptions(storageOptions); err != nil {
+		errs = append(errs, fmt.Errorf("PodmanStorageOptions: %w, ignoring it", err))
+	} else {
+		config.PodmanStorageOptions = strings.Join(strings.Fields(storageOptions), " ")
+	}
+
+	return config, errors.Join(errs...)
+}
+
+// podmanStorageFlags are the global podman options that can be set with PodmanStorageOptions;
+// other global options, like --remote, would change more than where containers are stored
+var podmanStorageFlags = []string{"--root", "--runroot", "--storage-driver", "--storage-opt"}
+
+// parsePodmanStorageOptions splits PodmanStorageOptions, e.g. "--root /data/containers/storage
+// --runroot=/run/containers", into podman arguments. Each option needs a value, given after a
+// space or "="; values cannot contain spaces.
+func parsePodmanStorageOptions(s string) ([]string, error) {
+	fields := strings.Fields(s)
+	var args []string
+	for i := 0; i < len(fields); i++ {
+		flag, value, hasValue := strings.Cut(fields[i], "=")
+		if !slices.Contains(podmanStorageFlags, flag) {
+			return nil, fmt.Errorf("unsupported option %q, allowed are %s", fields[i], strings.Join(podmanStorageFlags, ", "))
+		}
+		if !hasValue && i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "-") {
+			i++
+			value = fields[i]
+		}
+		if value == "" {
+			return nil, fmt.Errorf("option %s needs a value", flag)
+		}
+		args = append(args, flag+"="+value)
+	}
+	return args, nil
+}
+
+// podmanStorageArgs returns the arguments that select the container storage, which are passed to
+// every podman invocation
+func (config OrchestratorConfig) podmanStorageArgs() []string {
+	args, _ := parsePodmanStorageOptions(config.PodmanStorageOptions)
+	return args
+}
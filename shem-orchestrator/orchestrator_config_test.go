@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadOrchestratorConfigDefaults(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", nil)
+	mc, _ := cm.NewModuleConfig("orchestrator")
+
+	config, err := LoadOrchestratorConfig(mc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config != DefaultOrchestratorConfig() {
+		t.Errorf("expected defaults, got %+v", config)
+	}
+	if config.UpdateCheckIntervalHours != 22.15 || config.UpdateDelayMaxHours != 96.0 {
+		t.Errorf("unexpected default values %+v", config)
+	}
+}
+
+func TestLoadOrchestratorConfigValues(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{
+		"UpdateCheckIntervalHours": "1.5\n",
+		"UpdateDelayMaxHours":      "0",
+	})
+	mc, _ := cm.NewModuleConfig("orchestrator")
+
+	config, err := LoadOrchestratorConfig(mc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.UpdateCheckIntervalHours != 1.5 || config.UpdateDelayMaxHours != 0 {
+		t.Errorf("unexpected values %+v", config)
+	}
+}
+
+func TestLoadOrchestratorConfigInvalid(t *testing.T) {
+	tests := []struct {
+		key, value string
+	}{
+		{"UpdateCheckIntervalHours", "0"},
+		{"UpdateCheckIntervalHours", "-1"},
+		{"UpdateCheckIntervalHours", "0.01"}, // would query the registry every 36 seconds
+		{"UpdateCheckIntervalHours", "NaN"},
+		{"UpdateCheckIntervalHours", "1000"},
+		{"UpdateDelayMaxHours", "a lot"},
+		{"MaxStartsPerReconcile", "-1"},
+		{"MaxStartsPerReconcile", "2.9"},
+		{"MaxStartsPerReconcile", "1001"},
+		{"MaxConcurrentModules", "1.5"},
+		{"VerificationRunMinutes", "0"},
+		{"VerificationRunMinutes", "1440"},
+		{"MaxTimeSeriesHours", "-48"},
+		{"MaxModuleMemory", "64"},
+		{"MaxModuleMemory", "512.5"},
+		{"OfflineUpdates", "sometimes"},
+		{"TrimTrailingMissing", "maybe"},
+		{"PodmanStorageOptions", "--remote"},
+		{"PodmanStorageOptions", "--root"},
+		{"PodmanStorageOptions", "--root --runroot /run/containers"},
+	}
+	for _, tt := range tests {
+		cm := newTestModule(t, "orchestrator", map[string]string{tt.key: tt.value})
+		mc, _ := cm.NewModuleConfig("orchestrator")
+
+		config, err := LoadOrchestratorConfig(mc)
+		if err == nil || !strings.Contains(err.Error(), tt.key) {
+			t.Errorf("%s=%s: expected error mentioning the key, got %v", tt.key, tt.value, err)
+		}
+		if config != DefaultOrchestratorConfig() {
+			t.Errorf("%s=%s: expected default to be used, got %+v", tt.key, tt.value, config)
+		}
+	}
+}
+
+func TestLoadOrchestratorConfigNegativeDelay(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{"UpdateDelayMaxHours": "-5"})
+	mc, _ := cm.NewModuleConfig("orchestrator")
+
+	config, err := LoadOrchestratorConfig(mc)
+	if err == nil || !strings.Contains(err.Error(), "UpdateDelayMaxHours") {
+		t.Errorf("expected warning about UpdateDelayMaxHours, got %v", err)
+	}
+	if config.UpdateDelayMaxHours != 0 {
+		t.Errorf("expected negative delay to be clamped to 0, got %v", config.UpdateDelayMaxHours)
+	}
+}
+
+func TestLoadOrchestratorConfigSnapshotInterval(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{"SnapshotIntervalMinutes": "0.25"})
+	mc, _ := cm.NewModuleConfig("orchestrator")
+
+	config, err := LoadOrchestratorConfig(mc)
+	if err == nil || !strings.Contains(err.Error(), "SnapshotIntervalMinutes") {
+		t.Errorf("expected warning about SnapshotIntervalMinutes, got %v", err)
+	}
+	if config.SnapshotIntervalMinutes != 1 {
+		t.Errorf("expected interval to be raised to 1 minute, got %v", config.SnapshotIntervalMinutes)
+	}
+}
+
+func TestPodmanStorageOptions(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", map[string]string{
+		"PodmanStorageOptions": "--root /data/containers/storage\n--runroot=/run/containers --storage-driver overlay\n",
+	})
+	setConfig(t, cm, "meter", "image", "localhost/meter")
+	setConfig(t, cm, "meter", "current_version", "1.0.0")
+	expected := []string{"--root=/data/containers/storage", "--runroot=/run/containers", "--storage-driver=overlay"}
+
+	mm := NewModuleManager(cm)
+	if args := mm.podman("ps", "-a").Args; !slices.Equal(args[1:], append(slices.Clone(expected), "ps", "-a")) {
+		t.Errorf("unexpected module manager command %v", args)
+	}
+	cmd, err := mm.buildPodmanCommand("meter", "shem-module-meter", "localhost/meter:1.0.0-amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cmd.Args[1:4], expected) || cmd.Args[4] != "run" {
+		t.Errorf("expected storage options before run, got %v", cmd.Args)
+	}
+	if described, _ := mm.DescribeCommand("meter"); !slices.Equal(described[1:4], expected) {
+		t.Errorf("expected storage options in described command, got %v", described)
+	}
+
+	um := NewUpdateManager(cm, false)
+	if args := um.podman(context.Background(), "pull", "localhost/meter-sig:1.0.0-amd64").Args; !slices.Equal(args[1:4], expected) || args[4] != "pull" {
+		t.Errorf("unexpected update manager command %v", args)
+	}
+
+	// the module manager keeps the storage options of the running containers until it is reloaded
+	setConfig(t, cm, "orchestrator", "PodmanStorageOptions", "")
+	mm.reloadConfig() // as done by every reconciliation
+	if args := mm.podman("ps").Args; !slices.Equal(args[1:4], expected) {
+		t.Errorf("expected storage options until reload, got %v", args)
+	}
+
+	// without the option, podman is run without extra arguments
+	um.ReloadConfig()
+	mm.Reload()
+	if args := mm.podman("ps").Args; !slices.Equal(args, []string{"podman", "ps"}) {
+		t.Errorf("expected no storage options, got %v", args)
+	}
+	if args := um.podman(context.Background(), "images").Args; !slices.Equal(args, []string{"podman", "images"}) {
+		t.Errorf("expected no storage options, got %v", args)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPromoteOrchestratorBinary(t *testing.T) {
+	setup := func(t *testing.T) (binDir, symlinkPath string) {
+		binDir = t.TempDir()
+		symlinkPath = filepath.Join(binDir, "shem-orchestrator")
+		if err := os.WriteFile(orchestratorBinary(binDir, "1.0.0"), []byte("old"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(orchestratorBinary(binDir, "1.0.0"), symlinkPath); err != nil {
+			t.Fatal(err)
+		}
+		return binDir, symlinkPath
+	}
+
+	assertTarget := func(t *testing.T, symlinkPath, expected string) {
+		t.Helper()
+		target, err := os.Readlink(symlinkPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != expected {
+			t.Errorf("expected symlink to point to %s, got %s", expected, target)
+		}
+	}
+
+	t.Run("executable target", func(t *testing.T) {
+		binDir, symlinkPath := setup(t)
+		if err := os.WriteFile(orchestratorBinary(binDir, "1.1.0"), []byte("new"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := promoteOrchestratorBinary(binDir, "1.1.0"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assertTarget(t, symlinkPath, orchestratorBinary(binDir, "1.1.0"))
+	})
+
+	t.Run("missing target", func(t *testing.T) {
+		binDir, symlinkPath := setup(t)
+		if err := promoteOrchestratorBinary(binDir, "1.1.0"); err == nil {
+			t.Fatal("expected an error for a missing target")
+		}
+		assertTarget(t, symlinkPath, orchestratorBinary(binDir, "1.0.0"))
+		if _, err := os.Lstat(symlinkPath + ".tmp"); err == nil {
+			t.Error("expected no temporary symlink to be left behind")
+		}
+	})
+
+	t.Run("target not executable", func(t *testing.T) {
+		binDir, symlinkPath := setup(t)
+		if err := os.WriteFile(orchestratorBinary(binDir, "1.1.0"), []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := promoteOrchestratorBinary(binDir, "1.1.0"); err == nil {
+			t.Fatal("expected an error for a non-executable target")
+		}
+		assertTarget(t, symlinkPath, orchestratorBinary(binDir, "1.0.0"))
+	})
+}
+
+func TestRepairOrchestratorSymlink(t *testing.T) {
+	binDir := t.TempDir()
+	symlinkPath := filepath.Join(binDir, "shem-orchestrator")
+	for version, perm := range map[string]os.FileMode{"1.0.0": 0755, "1.1.0": 0755, "1.2.0": 0755, "1.3.0": 0644} {
+		if err := os.WriteFile(orchestratorBinary(binDir, version), []byte(version), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an intact symlink is left alone
+	if err := os.Symlink(orchestratorBinary(binDir, "1.0.0"), symlinkPath); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := repairOrchestratorSymlink(binDir, nil); version != "" || err != nil {
+		t.Errorf("expected intact symlink to be kept, got %q, %v", version, err)
+	}
+
+	// dangling symlink: 1.3.0 is not executable and 1.2.0 is blacklisted
+	os.Remove(orchestratorBinary(binDir, "1.0.0"))
+	version, err := repairOrchestratorSymlink(binDir, map[string]struct{}{"1.2.0": {}})
+	if version != "1.1.0" || err != nil {
+		t.Fatalf("expected symlink to be repaired with 1.1.0, got %q, %v", version, err)
+	}
+	if target, _ := os.Readlink(symlinkPath); target != orchestratorBinary(binDir, "1.1.0") {
+		t.Errorf("expected symlink to point to 1.1.0, got %s", target)
+	}
+
+	// no usable binary left: the symlink stays as it is
+	os.Remove(orchestratorBinary(binDir, "1.1.0"))
+	if _, err := repairOrchestratorSymlink(binDir, map[string]struct{}{"1.2.0": {}}); err == nil {
+		t.Error("expected an error without usable binaries")
+	}
+	if target, _ := os.Readlink(symlinkPath); target != orchestratorBinary(binDir, "1.1.0") {
+		t.Errorf("expected symlink to be unchanged, got %s", target)
+	}
+
+	// installations without the symlink are left alone
+	os.Remove(symlinkPath)
+	if version, err := repairOrchestratorSymlink(binDir, nil); version != "" || err != nil {
+		t.Errorf("expected missing symlink to be ignored, got %q, %v", version, err)
+	}
+	if _, err := os.Lstat(symlinkPath); err == nil {
+		t.Error("expected no symlink to be created")
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	// keep SIGHUP from terminating the test binary before Run has installed its handler
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	cm := newTestModule(t, "orchestrator", map[string]string{"image": "quay.io/shem/shem-orchestrator"})
+	o, err := NewOrchestrator(cm.shemHome, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs, exitCode int
+	fakePodman(t, o.moduleManager, &runs, &exitCode)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		o.Run()
+	}()
+
+	setConfig(t, cm, "orchestrator", "UpdateCheckIntervalHours", "5")
+	for deadline := time.Now().Add(5 * time.Second); o.updateManager.currentConfig().UpdateCheckIntervalHours != 5; {
+		if time.Now().After(deadline) {
+			t.Fatal("config not reloaded on SIGHUP")
+		}
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case <-stopped:
+		t.Fatal("orchestrator stopped on SIGHUP")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	o.Shutdown()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("orchestrator did not stop")
+	}
+}
+
+func TestVerificationRunDelay(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	cm := newTestModule(t, "orchestrator", map[string]string{
+		"image":                  "quay.io/shem/shem-orchestrator",
+		"VerificationRunMinutes": "45",
+	})
+	o, err := NewOrchestrator(cm.shemHome, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs, exitCode int
+	fakePodman(t, o.moduleManager, &runs, &exitCode)
+	delays := make(chan time.Duration, 1)
+	timer := make(chan time.Time)
+	o.after = func(d time.Duration) <-chan time.Time {
+		delays <- d
+		return timer
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		o.Run()
+	}()
+
+	select {
+	case d := <-delays:
+		if d != 45*time.Minute {
+			t.Errorf("expected health check after 45m, got %v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("verification run did not wait for the health check")
+	}
+	select {
+	case <-stopped:
+		t.Fatal("orchestrator stopped before the verification run was over")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the orchestrator stops after a successful verification run
+	timer <- time.Now()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("orchestrator did not stop after the verification run")
+	}
+}
+
+func TestSessionSummary(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	t.Setenv("HELPER_OUTPUT", "\n\npointvalue power\n1.5\n\n")
+	cm := newTestModule(t, "orchestrator", map[string]string{"image": "quay.io/shem/shem-orchestrator"})
+	for name, files := range map[string]map[string]string{
+		"meter":     {"image": "localhost/meter", "current_version": "1.0.0"},
+		"optimizer": {"image": "localhost/optimizer", "current_version": "1.0.0", "failed": ""},
+	} {
+		for key, value := range files {
+			setConfig(t, cm, name, key, value)
+		}
+	}
+	o, err := NewOrchestrator(cm.shemHome, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs, exitCode int
+	fakePodman(t, o.moduleManager, &runs, &exitCode)
+
+	output := captureLogger(&o.logger)
+	go func() {
+		for deadline := time.Now().Add(5 * time.Second); o.moduleManager.router.RoutedMessages() == 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Error("no message routed")
+				break
+			}
+		}
+		o.updateManager.notifyApplied("meter", "1.0.0", "1.1.0")
+		o.Shutdown()
+	}()
+	o.Run()
+
+	summary := o.Summary()
+	if summary.Modules != 1 || summary.UpdatesApplied != 1 || summary.MessagesRouted != 1 ||
+		len(summary.Quarantined) != 1 || summary.Quarantined[0] != "optimizer" {
+		t.Errorf("summary does not reflect the session: %+v", summary)
+	}
+	if !strings.Contains(output.String(), "modules=1 updates_applied=1 messages_routed=1 quarantined=optimizer") {
+		t.Errorf("expected session summary in log, got:\n%s", output)
+	}
+}
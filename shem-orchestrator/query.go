@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// queryTopics answer the queries of a module by topic (see shemmsg.Query), returning the values of
+// the response
+var queryTopics = map[string]func(mm *ModuleManager, instance *ModuleInstance, args []string) ([]string, error){
+	"peers":  queryPeers,
+	"config": queryConfig,
+}
+
+// answerQuery sends the response to a query of a module. Responses are queued like routed
+// messages, so that a module that does not read its input cannot block the reading of its output.
+func (mm *ModuleManager) answerQuery(instance *ModuleInstance, name string, query shemmsg.Query) {
+	response := shemmsg.Response{ID: query.ID}
+	topic, _ := shemmsg.QueryTopic(name)
+	if answer, ok := queryTopics[topic]; !ok {
+		response.Error = "unknown topic " + topic
+	} else if values, err := answer(mm, instance, query.Args); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Values = values
+	}
+	if response.Error != "" {
+		instance.logger.Debug("query %s (id %s) failed: %s", name, query.ID, response.Error)
+	} else {
+		instance.logger.Debug("answered query %s (id %s)", name, query.ID)
+	}
+
+	if !mm.router.Send(instance.name, shemmsg.Message{Name: name, Payload: response}) {
+		instance.logger.Debug("failed to send response to query %s: module is not subscribed", name)
+	}
+}
+
+// queryPeers answers the names of the running modules, including the asking module
+func queryPeers(mm *ModuleManager, instance *ModuleInstance, args []string) ([]string, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("expected no arguments")
+	}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	var names []string
+	for name := range mm.modules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// queryConfig answers the non-empty lines of a file in the configuration directory of the asking
+// module; other modules' configurations are not accessible
+func queryConfig(mm *ModuleManager, instance *ModuleInstance, args []string) ([]string, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected the key as only argument")
+	}
+	key := args[0]
+	if err := shemmsg.ValidateNamePart(key); err != nil {
+		return nil, fmt.Errorf("invalid key %s", key)
+	}
+	moduleConfig, err := mm.configManager.NewModuleConfig(instance.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration")
+	}
+	if !moduleConfig.KeyExists(key) {
+		return nil, fmt.Errorf("unknown key %s", key)
+	}
+	lines, err := moduleConfig.GetLines(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s", key)
+	}
+	for _, line := range lines {
+		if strings.ContainsFunc(line, func(c rune) bool { return c < ' ' || c > '~' }) {
+			return nil, fmt.Errorf("key %s contains invalid characters", key)
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+func TestQueryRoundTrip(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	mm.modules["optimizer"] = newTestInstance("optimizer", "localhost/optimizer", "1.0.0")
+	moduleConfig, _ := mm.configManager.NewModuleConfig("meter")
+	if err := moduleConfig.SetString("max_power", "11\n"); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mm.router.AddSubscriber("meter", nil, pw, NewLogger("test"))
+	defer mm.router.RemoveSubscriber("meter")
+
+	instance.reader = shemmsg.NewReader(strings.NewReader(
+		"command shem_query.peers\nid 1\n\n" +
+			"command shem_query.config\nid 2\narg max_power\n\n" +
+			"command shem_query.config\nid 3\narg max_current\n\n" +
+			"command shem_query.weather\nid 4\n\n"))
+	mm.readMessages(instance)
+
+	expected := []struct {
+		id      string
+		values  []string
+		failure string
+	}{
+		{id: "1", values: []string{"meter", "optimizer"}},
+		{id: "2", values: []string{"11"}},
+		{id: "3", failure: "unknown key max_current"},
+		{id: "4", failure: "unknown topic weather"},
+	}
+	for i, msg := range readMessages(t, pr, len(expected)) {
+		response, ok := msg.Payload.(shemmsg.Response)
+		if !ok {
+			t.Fatalf("expected response, got %+v", msg)
+		}
+		if response.ID != expected[i].id || !slices.Equal(response.Values, expected[i].values) || response.Error != expected[i].failure {
+			t.Errorf("expected %+v, got %+v", expected[i], response)
+		}
+	}
+
+	mm.router.flush()
+	if values := mm.router.LastValues(); len(values) != 0 {
+		t.Errorf("expected queries not to be routed, got %v", values)
+	}
+}
+
+func TestQueryConfigKeys(t *testing.T) {
+	mm, instance := newTestModuleManager(t)
+	for _, args := range [][]string{nil, {"../optimizer/image"}, {"image", "current_version"}} {
+		if _, err := queryConfig(mm, instance, args); err == nil {
+			t.Errorf("expected error for arguments %q", args)
+		}
+	}
+	if values, err := queryConfig(mm, instance, []string{"current_version"}); err != nil || !slices.Equal(values, []string{"1.0.0"}) {
+		t.Errorf("expected current version, got %v, %v", values, err)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// subscriberQueueSize is the number of messages buffered per subscriber before the oldest
+// message is dropped
+const subscriberQueueSize = 100
+
+// brokerQueueSize is the number of messages buffered for the broker before Route blocks
+const brokerQueueSize = 1000
+
+// Router delivers messages from producing modules to the modules subscribing to them
+// (see modules.md, "Message Routing")
+// Messages are matched against the subscriptions by a central broker goroutine and then queued per
+// subscriber, so neither matching nor slow subscribers hold up the read loop of the producer.
+type Router struct {
+	logger      *Logger
+	incoming    chan brokerItem                     // messages waiting for the broker
+	subscribers map[string]*subscriber              // running modules by name
+	values      ValueStore                          // last message for each qualified name
+	valueTTLs   map[string]map[string]time.Duration // TTLs of cached values by module and variable
+	now         func() time.Time                    // clock for the receive time of cached values
+	trimMissing atomic.Bool                         // remove trailing missing values from timeseries, see SetTrimTrailingMissing
+	routed      atomic.Int64                        // messages routed since the router was created
+	stop        chan struct{}                       // closed by Close to stop the broker
+	closeOnce   sync.Once
+	mu          sync.Mutex
+}
+
+// CachedValue is the last message received for a qualified name
+type CachedValue struct {
+	Message  shemmsg.Message
+	Received time.Time
+	TTL      time.Duration // time after which the value is stale; 0 if it never is
+}
+
+// Stale reports whether the value has outlived its TTL at time now
+func (v CachedValue) Stale(now time.Time) bool {
+	return v.TTL > 0 && now.Sub(v.Received) >= v.TTL
+}
+
+// brokerItem is either a message to route or, if flushed is set, a request to signal that all
+// earlier messages have been routed
+type brokerItem struct {
+	msg     shemmsg.Message
+	flushed chan struct{}
+}
+
+// subscriber delivers messages to the stdin of a single module. Messages are queued and written
+// by a separate goroutine, so a module that stops reading its stdin never blocks the producer.
+type subscriber struct {
+	name          string
+	subscriptions []Subscription
+	queue         chan shemmsg.Message
+	dropped       int // number of messages dropped because the queue was full, guarded by Router.mu
+	logger        *Logger
+}
+
+// NewRouter creates a new router without subscribers that keeps the last values in memory and
+// starts its broker
+func NewRouter() *Router {
+	return NewRouterWithStore(NewMemoryValueStore())
+}
+
+// NewRouterWithStore creates a new router without subscribers that keeps the last values in store
+// and starts its broker
+func NewRouterWithStore(store ValueStore) *Router {
+	r := &Router{
+		logger:      NewLogger("orchestrator-router"),
+		incoming:    make(chan brokerItem, brokerQueueSize),
+		subscribers: make(map[string]*subscriber),
+		values:      store,
+		now:         time.Now,
+		stop:        make(chan struct{}),
+	}
+	go r.broker()
+	return r
+}
+
+// AddSubscriber registers a running module and starts delivering matching messages to w
+// The last known values matching the subscriptions are delivered first. An existing subscriber
+// with the same name is replaced.
+func (r *Router) AddSubscriber(name string, subscriptions []Subscription, w io.Writer, logger *Logger) {
+	s := &subscriber{
+		name:          name,
+		subscriptions: subscriptions,
+		queue:         make(chan shemmsg.Message, subscriberQueueSize),
+		logger:        logger,
+	}
+
+	r.mu.Lock()
+	if old, ok := r.subscribers[name]; ok {
+		close(old.queue)
+	}
+	r.subscribers[name] = s
+	r.deliverLastValues(s, subscriptions)
+	r.mu.Unlock()
+
+	go s.deliver(shemmsg.NewWriter(w))
+}
+
+// RemoveSubscriber stops delivering messages to a module; messages still queued are discarded
+func (r *Router) RemoveSubscriber(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.subscribers[name]; ok {
+		close(s.queue)
+		delete(r.subscribers, name)
+	}
+}
+
+// UpdateSubscriptions replaces the subscriptions of a running module
+// Messages matching the new subscriptions are delivered from now on, starting with the last known
+// values for subscriptions that have been added. Returns false if the module is not subscribed.
+func (r *Router) UpdateSubscriptions(name string, subscriptions []Subscription) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.subscribers[name]
+	if !ok {
+		return false
+	}
+	if slices.Equal(s.subscriptions, subscriptions) {
+		return true
+	}
+	s.logger.Info("inputs changed, now %d subscriptions", len(subscriptions))
+
+	var added []Subscription
+	for _, subscription := range subscriptions {
+		if !slices.Contains(s.subscriptions, subscription) {
+			added = append(added, subscription)
+		}
+	}
+	s.subscriptions = subscriptions
+	r.deliverLastValues(s, added)
+	return true
+}
+
+// deliverLastValues queues the last known values matching the given subscriptions, except for
+// stale ones
+// Must be called with r.mu held
+func (r *Router) deliverLastValues(s *subscriber, subscriptions []Subscription) {
+	if len(subscriptions) == 0 {
+		return
+	}
+	values, err := r.values.List()
+	if err != nil {
+		r.logger.Warn("failed to read last values for module %s: %v", s.name, err)
+		return
+	}
+	now := r.now()
+	for _, subscription := range subscriptions {
+		for _, cached := range values {
+			cached.TTL = r.valueTTL(cached.Message.Name)
+			if cached.Stale(now) {
+				continue
+			}
+			s.route(subscription, cached.Message)
+		}
+	}
+}
+
+// LastValues returns a copy of the last known values by qualified name, including stale ones
+func (r *Router) LastValues() map[string]CachedValue {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list, err := r.values.List()
+	if err != nil {
+		r.logger.Warn("failed to read last values: %v", err)
+	}
+	values := make(map[string]CachedValue, len(list))
+	for _, cached := range list {
+		cached.TTL = r.valueTTL(cached.Message.Name)
+		values[cached.Message.Name] = cached
+	}
+	return values
+}
+
+// SetValueTTLs replaces the TTLs of the cached values, given by module and variable name; the
+// variable "*" applies to all variables of a module without an entry of their own
+// Stale values are no longer delivered to new subscribers.
+func (r *Router) SetValueTTLs(ttls map[string]map[string]time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.valueTTLs = ttls
+}
+
+// valueTTL returns the TTL of the cached value of a qualified name, 0 if none is configured
+// Must be called with r.mu held
+func (r *Router) valueTTL(name string) time.Duration {
+	module, variable := shemmsg.SplitName(name)
+	ttls := r.valueTTLs[module]
+	if ttl, ok := ttls[variable]; ok {
+		return ttl
+	}
+	return ttls["*"]
+}
+
+// SetTrimTrailingMissing sets whether Route removes the missing values at the end of timeseries
+// (see shemmsg.TimeSeries.TrimTrailingMissing) before they are cached and delivered
+func (r *Router) SetTrimTrailingMissing(trim bool) {
+	r.trimMissing.Store(trim)
+}
+
+// Route hands a message with a qualified name to the broker, which queues it for all subscribers
+// whose subscriptions match it. A message matching several subscriptions of the same module is
+// delivered several times.
+// Route only blocks if the broker itself falls behind by more than brokerQueueSize messages.
+func (r *Router) Route(msg shemmsg.Message) {
+	if ts, ok := msg.Payload.(shemmsg.TimeSeries); ok && r.trimMissing.Load() {
+		msg.Payload = ts.TrimTrailingMissing()
+	}
+	select {
+	case r.incoming <- brokerItem{msg: msg}:
+	case <-r.stop: // discarded, the router is closed
+	}
+}
+
+// Send queues a message for a single module, bypassing subscriptions and the last values, e.g. the
+// response to a query. Returns false if the module is not subscribed.
+func (r *Router) Send(name string, msg shemmsg.Message) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.subscribers[name]
+	if !ok {
+		return false
+	}
+	s.enqueue(msg)
+	return true
+}
+
+// RoutedMessages returns the number of messages routed since the router was created
+func (r *Router) RoutedMessages() int64 {
+	return r.routed.Load()
+}
+
+// flush waits until all messages passed to Route before have been queued for the subscribers, or
+// until the router is closed
+func (r *Router) flush() {
+	flushed := make(chan struct{})
+	select {
+	case r.incoming <- brokerItem{flushed: flushed}:
+	case <-r.stop:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-r.stop:
+	}
+}
+
+// Close stops the broker after the messages routed so far have been queued and removes all
+// subscribers, which ends their deliveries. Messages routed afterwards are discarded; the last
+// values can still be read.
+func (r *Router) Close() {
+	r.flush()
+	r.closeOnce.Do(func() { close(r.stop) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, s := range r.subscribers {
+		close(s.queue)
+		delete(r.subscribers, name)
+	}
+}
+
+// broker queues incoming messages for the matching subscribers until the router is closed
+func (r *Router) broker() {
+	for {
+		var item brokerItem
+		select {
+		case item = <-r.incoming:
+		case <-r.stop:
+			return
+		}
+		if item.flushed != nil {
+			close(item.flushed)
+			continue
+		}
+
+		r.routed.Add(1)
+		r.mu.Lock()
+		if err := r.values.Put(CachedValue{Message: item.msg, Received: r.now()}); err != nil {
+			r.logger.Warn("failed to store last value of %s: %v", item.msg.Name, err)
+		}
+		for _, s := range r.subscribers {
+			for _, subscription := range s.subscriptions {
+				s.route(subscription, item.msg)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// route queues msg if it matches the subscription, renaming it to the subscription's alias and
+// transforming its values
+// Must be called with Router.mu held
+func (s *subscriber) route(subscription Subscription, msg shemmsg.Message) {
+	if !subscription.Matches(msg.Name) {
+		return
+	}
+	transformed, err := subscription.Transform.Apply(msg)
+	if err != nil {
+		s.logger.Warn("dropping %s: %v", msg.Name, err)
+		return
+	}
+	msg = transformed
+	if subscription.Alias != "" {
+		msg = msg.WithName(subscription.Alias)
+	}
+	s.enqueue(msg)
+}
+
+// enqueue adds a message to the queue, dropping the oldest message if the queue is full
+// Must be called with Router.mu held, so that no other message is queued in between
+func (s *subscriber) enqueue(msg shemmsg.Message) {
+	select {
+	case s.queue <- msg:
+		return
+	default:
+	}
+
+	select {
+	case <-s.queue:
+		s.dropped++
+		if s.dropped%100 == 1 {
+			s.logger.Warn("module does not read its input, dropped oldest message (%d dropped so far)", s.dropped)
+		}
+	default:
+		// the queue has been read in the meantime
+	}
+	s.queue <- msg
+}
+
+// deliver writes queued messages until the queue is closed
+func (s *subscriber) deliver(w *shemmsg.Writer) {
+	for msg := range s.queue {
+		if err := w.Write(msg); err != nil {
+			s.logger.Debug("failed to deliver %s: %v", msg.Name, err)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+func testMessage(t *testing.T, name string, value float64) shemmsg.Message {
+	t.Helper()
+	v, err := shemmsg.Number(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shemmsg.Message{Name: name, Payload: shemmsg.PointValue{Value: v}}
+}
+
+// readMessages reads n messages from r or fails the test after a timeout
+func readMessages(t *testing.T, r io.Reader, n int) []shemmsg.Message {
+	t.Helper()
+	return readMessagesWithOptions(t, r, n, shemmsg.ParseOptions{})
+}
+
+// readMessagesWithOptions is like readMessages, but parses the messages with the given options
+func readMessagesWithOptions(t *testing.T, r io.Reader, n int, opts shemmsg.ParseOptions) []shemmsg.Message {
+	t.Helper()
+	result := make(chan []shemmsg.Message, 1)
+	go func() {
+		reader := shemmsg.NewReaderWithOptions(r, opts)
+		var messages []shemmsg.Message
+		for range n {
+			msg, err := reader.Read()
+			if err != nil {
+				break
+			}
+			messages = append(messages, msg)
+		}
+		result <- messages
+	}()
+
+	select {
+	case messages := <-result:
+		if len(messages) != n {
+			t.Fatalf("expected %d messages, got %d", n, len(messages))
+		}
+		return messages
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %d messages", n)
+		return nil
+	}
+}
+
+func TestRouterDelivery(t *testing.T) {
+	router := NewRouter()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.net_power", "prices.price local_price"), pw, NewLogger("test"))
+	defer router.RemoveSubscriber("optimizer")
+
+	router.Route(testMessage(t, "meter.net_power", 1))
+	router.Route(testMessage(t, "meter.total_energy", 2)) // not subscribed
+	router.Route(testMessage(t, "prices.price", 3))
+
+	messages := readMessages(t, pr, 2)
+	if messages[0].Name != "meter.net_power" {
+		t.Errorf("expected meter.net_power, got %s", messages[0].Name)
+	}
+	if messages[1].Name != "local_price" {
+		t.Errorf("expected alias local_price, got %s", messages[1].Name)
+	}
+}
+
+func TestRouterClose(t *testing.T) {
+	router := NewRouter()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go io.Copy(io.Discard, pr)
+	router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.*"), pw, NewLogger("test"))
+
+	router.Route(testMessage(t, "meter.net_power", 1))
+	router.Close()
+	if _, ok := router.LastValues()["meter.net_power"]; !ok {
+		t.Error("expected messages routed before Close to be stored")
+	}
+	if router.Send("optimizer", testMessage(t, "meter.net_power", 2)) {
+		t.Error("expected subscribers to be removed")
+	}
+
+	// the broker is gone, so routing must not block once its queue is full
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range brokerQueueSize + 10 {
+			router.Route(testMessage(t, "meter.net_power", float64(i)))
+		}
+		router.flush()
+		router.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("routing blocks after Close")
+	}
+}
+
+func TestRouterSubscriberNeverReads(t *testing.T) {
+	router := NewRouter()
+
+	// nobody reads from the pipe, so the first write blocks forever
+	stuckReader, stuckWriter := io.Pipe()
+	defer stuckReader.Close()
+	router.AddSubscriber("stuck", mustParseSubscriptions(t, "meter.*"), stuckWriter, NewLogger("test"))
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	router.AddSubscriber("fast", mustParseSubscriptions(t, "meter.net_power"), pw, NewLogger("test"))
+
+	// wait until the first message is stuck in the write
+	router.Route(testMessage(t, "meter.total_energy", -1))
+	router.flush()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		router.mu.Lock()
+		queued := len(router.subscribers["stuck"].queue)
+		router.mu.Unlock()
+		if queued == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for first write")
+		}
+	}
+
+	count := 3 * subscriberQueueSize
+	routed := make(chan struct{})
+	go func() {
+		defer close(routed)
+		for i := range count {
+			router.Route(testMessage(t, "meter.total_energy", float64(i)))
+		}
+	}()
+	select {
+	case <-routed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("routing blocked by subscriber that does not read")
+	}
+
+	// other subscribers are not affected by the stuck one
+	for i := range 5 {
+		router.Route(testMessage(t, "meter.net_power", float64(i)))
+	}
+	messages := readMessages(t, pr, 5)
+	if last := messages[4].Payload.(shemmsg.PointValue).Value.Float64(); last != 4 {
+		t.Errorf("expected last value 4, got %v", last)
+	}
+
+	router.flush()
+	router.mu.Lock()
+	dropped := router.subscribers["stuck"].dropped
+	queued := len(router.subscribers["stuck"].queue)
+	router.mu.Unlock()
+
+	// one message is stuck in the write, the queue is full, the rest has been dropped
+	if expected := count + 5 - subscriberQueueSize; dropped != expected {
+		t.Errorf("expected %d dropped messages, got %d", expected, dropped)
+	}
+	if queued != subscriberQueueSize {
+		t.Errorf("expected full queue, got %d messages", queued)
+	}
+
+	router.RemoveSubscriber("stuck")
+	router.RemoveSubscriber("fast")
+}
+
+func TestRouterUpdateSubscriptions(t *testing.T) {
+	router := NewRouter()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	router.Route(testMessage(t, "meter.total_energy", 1))
+	router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.net_power"), pw, NewLogger("test"))
+	defer router.RemoveSubscriber("optimizer")
+	router.Route(testMessage(t, "meter.total_energy", 2)) // not subscribed yet
+	router.flush()
+
+	if !router.UpdateSubscriptions("optimizer", mustParseSubscriptions(t, "meter.net_power", "meter.total_energy energy")) {
+		t.Fatal("expected subscriber to exist")
+	}
+	router.Route(testMessage(t, "meter.total_energy", 3))
+
+	// the last value is delivered when the subscription is added, then new messages follow
+	messages := readMessages(t, pr, 2)
+	for i, expected := range []float64{2, 3} {
+		if messages[i].Name != "energy" {
+			t.Errorf("expected alias energy, got %s", messages[i].Name)
+		}
+		if value := messages[i].Payload.(shemmsg.PointValue).Value.Float64(); value != expected {
+			t.Errorf("expected value %v, got %v", expected, value)
+		}
+	}
+
+	if router.UpdateSubscriptions("unknown", nil) {
+		t.Error("expected update of unknown subscriber to fail")
+	}
+}
+
+func TestRouterDeliversLastValuesToNewSubscriber(t *testing.T) {
+	router := NewRouter()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	router.Route(testMessage(t, "meter.net_power", 1))
+	router.Route(testMessage(t, "meter.net_power", 2))
+	router.Route(testMessage(t, "prices.price", 3))
+	router.flush()
+
+	router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.net_power"), pw, NewLogger("test"))
+	defer router.RemoveSubscriber("optimizer")
+
+	messages := readMessages(t, pr, 1)
+	if value := messages[0].Payload.(shemmsg.PointValue).Value.Float64(); value != 2 {
+		t.Errorf("expected last value 2, got %v", value)
+	}
+}
+
+func TestRouterStaleValues(t *testing.T) {
+	router := NewRouter()
+	received := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := received
+	router.now = func() time.Time { return now }
+	router.SetValueTTLs(map[string]map[string]time.Duration{
+		"meter": {"net_power": 5 * time.Minute, "*": time.Hour},
+	})
+
+	router.Route(testMessage(t, "meter.net_power", 1))
+	router.Route(testMessage(t, "meter.total_energy", 2))
+	router.Route(testMessage(t, "prices.price", 3)) // no TTL, never stale
+	router.flush()
+
+	// staleValues returns the names of the stale cached values
+	staleValues := func() []string {
+		var stale []string
+		for name, cached := range router.LastValues() {
+			if cached.Stale(now) {
+				stale = append(stale, name)
+			}
+		}
+		slices.Sort(stale)
+		return stale
+	}
+
+	// fresh values are delivered to new subscribers
+	now = received.Add(4 * time.Minute)
+	if stale := staleValues(); len(stale) != 0 {
+		t.Errorf("expected no stale values, got %v", stale)
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	router.AddSubscriber("optimizer", mustParseSubscriptions(t, "*.*"), pw, NewLogger("test"))
+	if messages := readMessages(t, pr, 3); messages[0].Name != "meter.net_power" {
+		t.Errorf("expected meter.net_power first, got %v", messages[0].Name)
+	}
+	router.RemoveSubscriber("optimizer")
+
+	// expired values are kept in the cache, but no longer replayed
+	now = received.Add(time.Hour)
+	if stale := staleValues(); !slices.Equal(stale, []string{"meter.net_power", "meter.total_energy"}) {
+		t.Errorf("expected meter values to be stale, got %v", stale)
+	}
+	if len(router.LastValues()) != 3 {
+		t.Errorf("expected stale values to stay in the cache")
+	}
+	pr, pw = io.Pipe()
+	defer pr.Close()
+	router.AddSubscriber("logger", mustParseSubscriptions(t, "meter.*", "prices.price"), pw, NewLogger("test"))
+	defer router.RemoveSubscriber("logger")
+	if messages := readMessages(t, pr, 1); messages[0].Name != "prices.price" {
+		t.Errorf("expected only prices.price to be replayed, got %v", messages[0].Name)
+	}
+
+	// a new message makes the variable fresh again
+	router.Route(testMessage(t, "meter.net_power", 4))
+	router.flush()
+	if stale := staleValues(); !slices.Equal(stale, []string{"meter.total_energy"}) {
+		t.Errorf("expected only meter.total_energy to be stale, got %v", stale)
+	}
+	if messages := readMessages(t, pr, 1); messages[0].Name != "meter.net_power" {
+		t.Errorf("expected new message to be delivered, got %v", messages[0].Name)
+	}
+}
+
+// gatedWriter blocks each write until the test allows it
+type gatedWriter struct {
+	gate    chan struct{}
+	written chan []byte
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	w.written <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestRouterSlowAndFastSubscriber(t *testing.T) {
+	router := NewRouter()
+
+	slow := &gatedWriter{gate: make(chan struct{}), written: make(chan []byte, subscriberQueueSize)}
+	router.AddSubscriber("slow", mustParseSubscriptions(t, "meter.net_power"), slow, NewLogger("test"))
+	defer router.RemoveSubscriber("slow")
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	router.AddSubscriber("fast", mustParseSubscriptions(t, "meter.net_power"), pw, NewLogger("test"))
+	defer router.RemoveSubscriber("fast")
+
+	// the producer is not held up while the slow subscriber does not accept any writes
+	count := subscriberQueueSize / 2
+	for i := range count {
+		router.Route(testMessage(t, "meter.net_power", float64(i)))
+	}
+	messages := readMessages(t, pr, count)
+	if last := messages[count-1].Payload.(shemmsg.PointValue).Value.Float64(); last != float64(count-1) {
+		t.Errorf("expected last value %d, got %v", count-1, last)
+	}
+	if len(slow.written) != 0 {
+		t.Fatalf("expected slow subscriber to have received nothing yet, got %d messages", len(slow.written))
+	}
+
+	// once the slow subscriber catches up, it receives all messages in order
+	close(slow.gate)
+	for i := range count {
+		select {
+		case data := <-slow.written:
+			msg, err := shemmsg.NewReader(bytes.NewReader(data)).Read()
+			if err != nil {
+				t.Fatalf("invalid message written to slow subscriber: %v", err)
+			}
+			if value := msg.Payload.(shemmsg.PointValue).Value.Float64(); value != float64(i) {
+				t.Fatalf("expected value %d, got %v", i, value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for message %d at slow subscriber", i)
+		}
+	}
+}
+
+func TestRouterTransform(t *testing.T) {
+	router := NewRouter()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	subscriptions := mustParseSubscriptions(t, "meter.energy energy_kwh scale=0.001 unit=kWh", "weather.forecast offset=-273.15")
+	router.AddSubscriber("optimizer", subscriptions, pw, NewLogger("test"))
+	defer router.RemoveSubscriber("optimizer")
+
+	energy := testMessage(t, "meter.energy", 12345)
+	energy.Unit = "Wh"
+	router.Route(energy)
+	router.Route(testMessage(t, "meter.energy", 99999999)) // transformed value is in range as well
+	temperature, _ := shemmsg.Number(293.15)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	router.Route(shemmsg.Message{Name: "weather.forecast", Payload: shemmsg.TimeSeries{
+		StartTime: start,
+		Values:    []shemmsg.Value{temperature, shemmsg.Missing()},
+	}})
+
+	messages := readMessages(t, pr, 3)
+
+	if messages[0].Name != "energy_kwh" || messages[0].Unit != "kWh" {
+		t.Errorf("expected energy_kwh in kWh, got %s in %q", messages[0].Name, messages[0].Unit)
+	}
+	if v := messages[0].Payload.(shemmsg.PointValue).Value; v.Float64() != 12.345 {
+		t.Errorf("expected scaled value 12.345, got %v", v)
+	}
+	if v := messages[1].Payload.(shemmsg.PointValue).Value; v.Float64() != 99999.999 {
+		t.Errorf("expected scaled value 99999.999, got %v", v)
+	}
+
+	series := messages[2].Payload.(shemmsg.TimeSeries)
+	if messages[2].Name != "weather.forecast" || !series.StartTime.Equal(start) || len(series.Values) != 2 {
+		t.Fatalf("unexpected timeseries %+v", messages[2])
+	}
+	if series.Values[0].Float64() != 20 {
+		t.Errorf("expected 20, got %v", series.Values[0])
+	}
+	if !series.Values[1].IsMissing() {
+		t.Errorf("expected missing value to pass through, got %v", series.Values[1])
+	}
+}
+
+func TestRouterTransformOutOfRange(t *testing.T) {
+	router := NewRouter()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.energy scale=1000"), pw, NewLogger("test"))
+	defer router.RemoveSubscriber("optimizer")
+
+	router.Route(testMessage(t, "meter.energy", 1000000)) // 1e9 is out of range, dropped
+	router.Route(testMessage(t, "meter.energy", 2))
+
+	messages := readMessages(t, pr, 1)
+	if v := messages[0].Payload.(shemmsg.PointValue).Value; v.Float64() != 2000 {
+		t.Errorf("expected only the value in range to be delivered, got %v", v)
+	}
+}
+
+func TestRouterRoutingTable(t *testing.T) {
+	router := NewRouter()
+	optimizerReader, optimizerWriter := io.Pipe()
+	defer optimizerReader.Close()
+	loggerReader, loggerWriter := io.Pipe()
+	defer loggerReader.Close()
+	go io.Copy(io.Discard, optimizerReader)
+	go io.Copy(io.Discard, loggerReader)
+
+	router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.net_power", "prices.price local_price"), optimizerWriter, NewLogger("test"))
+	router.AddSubscriber("logger", mustParseSubscriptions(t, "meter.*", "*.temperature"), loggerWriter, NewLogger("test"))
+	router.Route(testMessage(t, "meter.net_power", 100))
+	router.Route(testMessage(t, "meter.total_energy", 5000))
+	router.Route(testMessage(t, "weather.wind", 3))
+	router.flush()
+
+	table := router.RoutingTable()
+
+	var variables []string
+	for _, variable := range table.Variables {
+		var deliveries []string
+		for _, delivery := range variable.Deliveries {
+			deliveries = append(deliveries, delivery.Subscriber+":"+delivery.Subscription.String())
+		}
+		variables = append(variables, variable.Name+" -> "+strings.Join(deliveries, ","))
+	}
+	expected := []string{
+		"meter.net_power -> logger:meter.*,optimizer:meter.net_power",
+		"meter.total_energy -> logger:meter.*",
+		"weather.wind -> ",
+	}
+	if !slices.Equal(variables, expected) {
+		t.Errorf("expected variables %q, got %q", expected, variables)
+	}
+
+	if len(table.Subscribers) != 2 || table.Subscribers[0].Name != "logger" || table.Subscribers[1].Name != "optimizer" {
+		t.Fatalf("unexpected subscribers %+v", table.Subscribers)
+	}
+	if unmatched := table.Subscribers[0].Unmatched; len(unmatched) != 1 || unmatched[0].String() != "*.temperature" {
+		t.Errorf("expected *.temperature to be unmatched for logger, got %v", unmatched)
+	}
+	if unmatched := table.Subscribers[1].Unmatched; len(unmatched) != 1 || unmatched[0].String() != "prices.price local_price" {
+		t.Errorf("expected prices.price to be unmatched for optimizer, got %v", unmatched)
+	}
+
+	var buf bytes.Buffer
+	if err := table.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"optimizer (meter.net_power)", "logger (meter.*)", "prices.price local_price"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("routing table does not contain %q:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestRouterTrimTrailingMissing(t *testing.T) {
+	start := time.Date(2025, 12, 6, 8, 0, 0, 0, time.UTC)
+	m := shemmsg.Missing()
+	one, _ := shemmsg.Number(1)
+	tests := []struct {
+		name     string
+		trim     bool
+		values   []shemmsg.Value
+		expected int
+	}{
+		{"trailing", true, []shemmsg.Value{one, one, m, m, m}, 2},
+		{"internal", true, []shemmsg.Value{m, one, m, one}, 4},
+		{"no missing values", true, []shemmsg.Value{one, one, one}, 3},
+		{"disabled", false, []shemmsg.Value{one, one, m, m, m}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter()
+			router.SetTrimTrailingMissing(tt.trim)
+			router.Route(shemmsg.Message{Name: "forecast.pv", Payload: shemmsg.TimeSeries{StartTime: start, Values: tt.values}})
+			router.flush()
+
+			ts := router.LastValues()["forecast.pv"].Message.Payload.(shemmsg.TimeSeries)
+			if len(ts.Values) != tt.expected || !ts.StartTime.Equal(start) {
+				t.Errorf("expected %d values from %s, got %d from %s", tt.expected, start, len(ts.Values), ts.StartTime)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// RoutingTable is a snapshot of the subscriptions of all running modules, resolved against the
+// variables the router has seen so far, for diagnosing why a module does not receive a message
+type RoutingTable struct {
+	Variables   []RoutedVariable   // all variables seen so far, sorted by name
+	Subscribers []SubscriberStatus // all running modules, sorted by name
+}
+
+// RoutedVariable lists the modules a variable is delivered to
+type RoutedVariable struct {
+	Name       string
+	Deliveries []Delivery // one per matching subscription, so a module may be listed several times
+}
+
+// Delivery is a subscription of a module that matches a variable
+type Delivery struct {
+	Subscriber   string
+	Subscription Subscription
+}
+
+// SubscriberStatus describes the subscriptions and the queue of a running module
+type SubscriberStatus struct {
+	Name          string
+	Subscriptions []Subscription
+	Unmatched     []Subscription // subscriptions that match none of the variables seen so far
+	Queued        int            // messages waiting to be written to the module's stdin
+	Dropped       int            // messages dropped because the module did not read its input
+}
+
+// RoutingTable returns the current routing table
+// Wildcard subscriptions are expanded to the variables seen so far; variables that have not been
+// sent since the orchestrator started are not known to the router.
+func (r *Router) RoutingTable() RoutingTable {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var table RoutingTable
+	values, err := r.values.List()
+	if err != nil {
+		r.logger.Warn("failed to read last values: %v", err)
+	}
+	names := make([]string, len(values))
+	for i, cached := range values {
+		names[i] = cached.Message.Name
+	}
+	subscriberNames := slices.Sorted(maps.Keys(r.subscribers))
+
+	for _, name := range names {
+		variable := RoutedVariable{Name: name}
+		for _, subscriberName := range subscriberNames {
+			for _, subscription := range r.subscribers[subscriberName].subscriptions {
+				if subscription.Matches(name) {
+					variable.Deliveries = append(variable.Deliveries, Delivery{subscriberName, subscription})
+				}
+			}
+		}
+		table.Variables = append(table.Variables, variable)
+	}
+
+	for _, subscriberName := range subscriberNames {
+		s := r.subscribers[subscriberName]
+		status := SubscriberStatus{
+			Name:          subscriberName,
+			Subscriptions: slices.Clone(s.subscriptions),
+			Queued:        len(s.queue),
+			Dropped:       s.dropped,
+		}
+		for _, subscription := range s.subscriptions {
+			if !slices.ContainsFunc(names, subscription.Matches) {
+				status.Unmatched = append(status.Unmatched, subscription)
+			}
+		}
+		table.Subscribers = append(table.Subscribers, status)
+	}
+	return table
+}
+
+// Write writes the routing table as human-readable text with aligned columns
+func (t RoutingTable) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "VARIABLE\tDELIVERED TO")
+	for _, variable := range t.Variables {
+		deliveries := make([]string, len(variable.Deliveries))
+		for i, delivery := range variable.Deliveries {
+			deliveries[i] = fmt.Sprintf("%s (%s)", delivery.Subscriber, delivery.Subscription)
+		}
+		if len(deliveries) == 0 {
+			deliveries = []string{"-"}
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", variable.Name, strings.Join(deliveries, ", "))
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "MODULE\tQUEUED\tDROPPED\tUNMATCHED SUBSCRIPTIONS")
+	for _, status := range t.Subscribers {
+		unmatched := make([]string, len(status.Unmatched))
+		for i, subscription := range status.Unmatched {
+			unmatched[i] = subscription.String()
+		}
+		if len(unmatched) == 0 {
+			unmatched = []string{"-"}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", status.Name, status.Queued, status.Dropped, strings.Join(unmatched, ", "))
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleInterval(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected time.Duration
+	}{
+		{"6h", 6 * time.Hour},
+		{"@every 90m", 90 * time.Minute},
+		{" 24h\n", 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		schedule, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if schedule != (intervalSchedule{tt.expected}) {
+			t.Errorf("%q: expected interval %v, got %+v", tt.spec, tt.expected, schedule)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"30s",
+		"@every soon",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"a * * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2026-01-01 is a Thursday
+	start := time.Date(2026, 1, 1, 12, 0, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"0 13 * * *", start, time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"0 13 * * *", time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC), time.Date(2026, 1, 2, 13, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", start, time.Date(2026, 1, 1, 12, 15, 0, 0, time.UTC)},
+		{"0-30/10 8,20 * * *", start, time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", start, time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", start, time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 6 * * 1-5", time.Date(2026, 1, 2, 7, 0, 0, 0, time.UTC), time.Date(2026, 1, 5, 6, 0, 0, 0, time.UTC)},
+		// day of month and day of week are combined with "or" if both are restricted
+		{"0 0 15 * 6", start, time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", start, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", start, time.Time{}},
+	}
+	for _, tt := range tests {
+		schedule, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if next := schedule.Next(tt.from); !next.Equal(tt.expected) {
+			t.Errorf("%q: expected next run %v after %v, got %v", tt.spec, tt.expected, tt.from, next)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// capabilityPattern matches Linux capability names after normalization
+var capabilityPattern = regexp.MustCompile(`^CAP_[A-Z0-9_]+$`)
+
+// normalizeCapability converts a capability name like "net_raw" to the form "CAP_NET_RAW"
+func normalizeCapability(name string) (string, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	if !capabilityPattern.MatchString(name) {
+		return "", fmt.Errorf("invalid capability %q", name)
+	}
+	return name, nil
+}
+
+// validateDevice checks that a device path is a clean absolute path below /dev
+func validateDevice(device string) error {
+	if !strings.HasPrefix(device, "/dev/") || filepath.Clean(device) != device || strings.ContainsAny(device, ":, ") {
+		return fmt.Errorf("invalid device %q", device)
+	}
+	return nil
+}
+
+// userPattern matches the argument of podman's --user option: a user name or UID, optionally
+// followed by a group name or GID
+var userPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$|^[0-9]+$`)
+
+// validateUser checks a value for podman's --user option ("user", "uid", "user:group" or "uid:gid")
+func validateUser(user string) error {
+	name, group, hasGroup := strings.Cut(user, ":")
+	if !userPattern.MatchString(name) || (hasGroup && !userPattern.MatchString(group)) {
+		return fmt.Errorf("invalid user %q", user)
+	}
+	return nil
+}
+
+// allowedUsernsModes are the user namespace modes a module may use; modes that join the namespace
+// of another container or process are not allowed
+var allowedUsernsModes = []string{"auto", "host", "keep-id", "nomap", "private"}
+
+// usernsOptionsPattern matches the options of a user namespace mode, e.g. "uid=1000,gid=1000"
+var usernsOptionsPattern = regexp.MustCompile(`^[a-z]+=[0-9a-z:]+(,[a-z]+=[0-9a-z:]+)*$`)
+
+// validateUserns checks a value for podman's --userns option, e.g. "auto" or "keep-id:uid=1000"
+func validateUserns(userns string) error {
+	mode, options, hasOptions := strings.Cut(userns, ":")
+	if !slices.Contains(allowedUsernsModes, mode) || (hasOptions && !usernsOptionsPattern.MatchString(options)) {
+		return fmt.Errorf("invalid or unsupported user namespace mode %q", userns)
+	}
+	return nil
+}
+
+// userArgs returns the podman arguments for the user a module runs as and its user namespace
+// They are taken from the module's user and userns files, or else from the orchestrator options
+// DefaultUser and DefaultUserns. Without any of them, the user specified by the image is used.
+func userArgs(moduleConfig, orchestratorConfig *ModuleConfig) ([]string, error) {
+	var args []string
+	for _, option := range []struct {
+		key, defaultKey, arg string
+		validate             func(string) error
+	}{
+		{"user", "DefaultUser", "--user", validateUser},
+		{"userns", "DefaultUserns", "--userns", validateUserns},
+	} {
+		value, err := moduleConfig.GetString(option.key, "")
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			if value, err = orchestratorConfig.GetString(option.defaultKey, ""); err != nil {
+				return nil, err
+			}
+		}
+		if value == "" {
+			continue
+		}
+		if err := option.validate(value); err != nil {
+			return nil, err
+		}
+		args = append(args, option.arg, value)
+	}
+	return args, nil
+}
+
+// securityArgs returns the podman arguments that grant a module the devices and capabilities
+// listed in its devices and capabilities files, and that set its user (see userArgs)
+// Each device and capability must be allowed by the orchestrator options AllowedDevices and
+// AllowedCapabilities; by default, nothing is allowed.
+func securityArgs(configManager *ConfigManager, moduleName string) ([]string, error) {
+	moduleConfig, _ := configManager.NewModuleConfig(moduleName)
+	orchestratorConfig, _ := configManager.NewModuleConfig("orchestrator")
+
+	devices, err := moduleConfig.GetLines("devices")
+	if err != nil {
+		return nil, err
+	}
+	allowedDevices, err := orchestratorConfig.GetLines("AllowedDevices")
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for _, device := range devices {
+		if err := validateDevice(device); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(allowedDevices, device) {
+			return nil, fmt.Errorf("device %s is not in the orchestrator's AllowedDevices", device)
+		}
+		args = append(args, "--device", device)
+	}
+
+	capabilities, err := moduleConfig.GetLines("capabilities")
+	if err != nil {
+		return nil, err
+	}
+	allowedCapabilities, err := orchestratorConfig.GetLines("AllowedCapabilities")
+	if err != nil {
+		return nil, err
+	}
+	for i, capability := range allowedCapabilities {
+		// invalid entries in the allowlist can never match a valid capability
+		allowedCapabilities[i], _ = normalizeCapability(capability)
+	}
+
+	for _, capability := range capabilities {
+		capability, err := normalizeCapability(capability)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(allowedCapabilities, capability) {
+			return nil, fmt.Errorf("capability %s is not in the orchestrator's AllowedCapabilities", capability)
+		}
+		args = append(args, "--cap-add", capability)
+	}
+
+	user, err := userArgs(moduleConfig, orchestratorConfig)
+	if err != nil {
+		return nil, err
+	}
+	return append(args, user...), nil
+}
+
+// resourceArgs returns the podman arguments that limit the memory and CPU usage of a module
+// Limits above the defaults are logged as grants; requests above the orchestrator options
+// MaxModuleMemory and MaxModuleCPUs are lowered to them with a warning.
+func resourceArgs(moduleConfig *ModuleConfig, config OrchestratorConfig, logger *Logger) []string {
+	moduleName := moduleConfig.moduleName
+
+	memoryMB, err := moduleConfig.GetMemoryMB()
+	if err != nil {
+		logger.Warn("module %s: %v, using default %d", moduleName, err, defaultMemoryMB)
+	}
+	if maxMemoryMB := config.MaxModuleMemory; memoryMB > maxMemoryMB {
+		logger.Warn("module %s requests %d MB of memory, more than MaxModuleMemory, limiting it to %d MB", moduleName, memoryMB, maxMemoryMB)
+		memoryMB = maxMemoryMB
+	}
+	cpus, err := moduleConfig.GetCPUs()
+	if err != nil {
+		logger.Warn("module %s: %v, using default %g", moduleName, err, defaultCPUs)
+	}
+	if cpus > config.MaxModuleCPUs {
+		logger.Warn("module %s requests %g CPUs, more than MaxModuleCPUs, limiting it to %g", moduleName, cpus, config.MaxModuleCPUs)
+		cpus = config.MaxModuleCPUs
+	}
+
+	if memoryMB > defaultMemoryMB || cpus > defaultCPUs {
+		logger.Info("module %s is granted %d MB of memory and %g CPUs", moduleName, memoryMB, cpus)
+	}
+	return []string{"--memory", strconv.Itoa(memoryMB) + "m", "--cpus", strconv.FormatFloat(cpus, 'f', -1, 64)}
+}
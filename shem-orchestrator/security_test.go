@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setConfig writes a config file of a module, creating the module directory if needed
+func setConfig(t *testing.T, cm *ConfigManager, moduleName, key, value string) {
+	t.Helper()
+	moduleDir := filepath.Join(cm.shemHome, "modules", moduleName)
+	if err := os.MkdirAll(moduleDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(moduleDir, key), []byte(value), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildPodmanCommandDevicesAndCapabilities(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":        "localhost/meter",
+		"devices":      "/dev/ttyUSB0\n",
+		"capabilities": "net_raw\nCAP_SYS_TIME\n",
+	})
+	setConfig(t, cm, "orchestrator", "AllowedDevices", "/dev/ttyUSB0\n/dev/ttyUSB1\n")
+	setConfig(t, cm, "orchestrator", "AllowedCapabilities", "CAP_NET_RAW\nsys_time\n")
+	mm := NewModuleManager(cm)
+
+	cmd, err := mm.buildPodmanCommand("meter", "shem-module-meter", "localhost/meter:1.0.0-amd64")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	args := cmd.Args
+	for _, expected := range [][]string{
+		{"--device", "/dev/ttyUSB0"},
+		{"--cap-add", "CAP_NET_RAW"},
+		{"--cap-add", "CAP_SYS_TIME"},
+	} {
+		i := slices.Index(args, expected[1])
+		if i < 1 || args[i-1] != expected[0] {
+			t.Errorf("expected %v in arguments %v", expected, args)
+		}
+	}
+	if args[len(args)-1] != "localhost/meter:1.0.0-amd64" {
+		t.Errorf("expected image as last argument, got %v", args)
+	}
+	if slices.Contains(args, "/dev/ttyUSB1") {
+		t.Error("expected only requested devices to be passed")
+	}
+}
+
+func TestBuildPodmanCommandWithoutDevices(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+	setConfig(t, cm, "orchestrator", "AllowedDevices", "/dev/ttyUSB0\n")
+	mm := NewModuleManager(cm)
+
+	cmd, err := mm.buildPodmanCommand("meter", "shem-module-meter", "localhost/meter:1.0.0-amd64")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if slices.Contains(cmd.Args, "--device") || slices.Contains(cmd.Args, "--cap-add") {
+		t.Errorf("expected no devices or capabilities by default, got %v", cmd.Args)
+	}
+}
+
+func TestSecurityArgsRejected(t *testing.T) {
+	tests := []struct {
+		name                string
+		key, value          string
+		allowedDevices      string
+		allowedCapabilities string
+	}{
+		{"device without allowlist", "devices", "/dev/ttyUSB0", "", ""},
+		{"device not allowed", "devices", "/dev/ttyUSB1", "/dev/ttyUSB0", ""},
+		{"device outside /dev", "devices", "/dev/../etc/shadow", "/dev/../etc/shadow", ""},
+		{"device with options", "devices", "/dev/ttyUSB0:/dev/ttyUSB0:rwm", "/dev/ttyUSB0:/dev/ttyUSB0:rwm", ""},
+		{"capability without allowlist", "capabilities", "NET_RAW", "", ""},
+		{"capability not allowed", "capabilities", "SYS_ADMIN", "", "NET_RAW"},
+		{"invalid capability", "capabilities", "NET RAW", "", "NET RAW"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", tt.key: tt.value})
+			setConfig(t, cm, "orchestrator", "AllowedDevices", tt.allowedDevices)
+			setConfig(t, cm, "orchestrator", "AllowedCapabilities", tt.allowedCapabilities)
+
+			if args, err := securityArgs(cm, "meter"); err == nil {
+				t.Errorf("expected error, got arguments %v", args)
+			}
+		})
+	}
+}
+
+func TestModuleWithDisallowedDeviceIsNotStarted(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":           "localhost/meter",
+		"current_version": "1.0.0",
+		"devices":         "/dev/ttyUSB0",
+	})
+	mm := NewModuleManager(cm)
+	var runs, exitCode int
+	fakePodman(t, mm, &runs, &exitCode)
+	log := captureLogger(&mm.logger)
+
+	mm.reconcileModules()
+	mm.reconcileModules()
+	waitForModulesToExit(t, mm)
+	if runs != 0 {
+		t.Errorf("expected module not to be started, got %d runs", runs)
+	}
+	if mm.health["meter"] != 0 {
+		t.Errorf("expected no health penalty, got %v", mm.health["meter"])
+	}
+	if n := strings.Count(log.String(), "module meter is not started"); n != 1 {
+		t.Errorf("expected the rejection to be logged once, got %d times", n)
+	}
+}
+
+func TestBuildPodmanCommandUser(t *testing.T) {
+	tests := []struct {
+		name             string
+		module, defaults map[string]string
+		expected         []string // expected arguments between the devices/capabilities and the image
+		expectError      bool
+	}{
+		{"default", nil, nil, nil, false},
+		{"module user", map[string]string{"user": "1000:1000", "userns": "auto"}, nil,
+			[]string{"--user", "1000:1000", "--userns", "auto"}, false},
+		{"orchestrator default", nil, map[string]string{"DefaultUser": "nobody", "DefaultUserns": "keep-id:uid=1000,gid=1000"},
+			[]string{"--user", "nobody", "--userns", "keep-id:uid=1000,gid=1000"}, false},
+		{"module overrides default", map[string]string{"user": "2000"}, map[string]string{"DefaultUser": "1000"},
+			[]string{"--user", "2000"}, false},
+		{"invalid user", map[string]string{"user": "1000 --privileged"}, nil, nil, true},
+		{"invalid userns", map[string]string{"userns": "container:other"}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter"})
+			for key, value := range tt.module {
+				setConfig(t, cm, "meter", key, value)
+			}
+			for key, value := range tt.defaults {
+				setConfig(t, cm, "orchestrator", key, value)
+			}
+			mm := NewModuleManager(cm)
+
+			cmd, err := mm.buildPodmanCommand("meter", "shem-module-meter", "localhost/meter:1.0.0-amd64")
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected an error, got arguments %v", cmd.Args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			args := cmd.Args[:len(cmd.Args)-1]
+			if got := args[len(args)-len(tt.expected):]; !slices.Equal(got, tt.expected) {
+				t.Errorf("expected %v before the image, got %v", tt.expected, cmd.Args)
+			}
+			if len(tt.expected) == 0 && (slices.Contains(args, "--user") || slices.Contains(args, "--userns")) {
+				t.Errorf("expected no user arguments, got %v", cmd.Args)
+			}
+		})
+	}
+}
+
+func TestDescribeCommand(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{
+		"image":           "localhost/meter",
+		"current_version": "1.0.0",
+		"devices":         "/dev/ttyUSB0\n",
+	})
+	setConfig(t, cm, "orchestrator", "AllowedDevices", "/dev/ttyUSB0\n")
+	if err := os.MkdirAll(filepath.Join(cm.shemHome, "modules", "meter", "storage"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mm := NewModuleManager(cm)
+	var started []string
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	mm.podman = func(args ...string) *exec.Cmd {
+		if args[0] == "run" {
+			started = append([]string{"podman"}, args...)
+		}
+		return exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--", "0", "stdin")
+	}
+	t.Cleanup(mm.stopAllModules)
+
+	described, err := mm.DescribeCommand("meter")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mm.reconcileModules()
+	if !slices.Equal(described, started) {
+		t.Errorf("described command differs from the one that was run:\n%v\n%v", described, started)
+	}
+	if !slices.Contains(described, "/dev/ttyUSB0") || !slices.Contains(described, filepath.Join(cm.shemHome, "modules", "meter", "storage")+":/storage") {
+		t.Errorf("expected device and storage mount in %v", described)
+	}
+
+	var out strings.Builder
+	if err := describeModule(&out, cm, podmanCommand, "meter"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "podman run -i ") || !strings.HasSuffix(out.String(), " localhost/meter:1.0.0-"+runtime.GOARCH+"\n") {
+		t.Errorf("unexpected command line %q", out.String())
+	}
+
+	setConfig(t, cm, "unversioned", "image", "localhost/unversioned")
+	if _, err := mm.DescribeCommand("unversioned"); err == nil {
+		t.Error("expected error for module without current_version")
+	}
+}
+
+// logBuffer collects the entries written by a Logger in tests
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogger replaces *logger with a logger for the same component that writes to the returned
+// buffer instead of stdout and stderr
+func captureLogger(logger **Logger) *logBuffer {
+	buf := &logBuffer{}
+	*logger = &Logger{component: (*logger).component, out: buf}
+	return buf
+}
+
+func TestResourceLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		files          map[string]string
+		orchestrator   map[string]string
+		memory, cpus   string
+		granted, limit bool
+	}{
+		{"defaults", nil, nil, "100m", "0.1", false, false},
+		{"lower", map[string]string{"memory_mb": "50", "cpus": "0.05"}, nil, "50m", "0.05", false, false},
+		{"grant", map[string]string{"memory_mb": "512", "cpus": "0.5"}, nil, "512m", "0.5", true, false},
+		{"above ceiling", map[string]string{"memory_mb": "4096", "cpus": "2"}, nil, "1024m", "1", true, true},
+		{"lower ceiling", map[string]string{"memory_mb": "512"}, map[string]string{"MaxModuleMemory": "256"}, "256m", "0.1", true, true},
+		{"invalid", map[string]string{"memory_mb": "1", "cpus": "lots"}, nil, "100m", "0.1", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestModule(t, "meter", tt.files)
+			for key, value := range tt.orchestrator {
+				setConfig(t, cm, "orchestrator", key, value)
+			}
+			mm := NewModuleManager(cm)
+			moduleConfig, _ := cm.NewModuleConfig("meter")
+
+			output := captureLogger(&mm.logger)
+			args := resourceArgs(moduleConfig, mm.currentConfig(), mm.logger)
+			if !slices.Equal(args, []string{"--memory", tt.memory, "--cpus", tt.cpus}) {
+				t.Errorf("expected memory %s and cpus %s, got %v", tt.memory, tt.cpus, args)
+			}
+			if granted := strings.Contains(output.String(), "<6>[orchestrator-modulemanager] module meter is granted"); granted != tt.granted {
+				t.Errorf("expected grant to be logged: %v, got %q", tt.granted, output)
+			}
+			if limited := strings.Contains(output.String(), "limiting it to"); limited != tt.limit {
+				t.Errorf("expected request to be limited: %v, got %q", tt.limit, output)
+			}
+		})
+	}
+}
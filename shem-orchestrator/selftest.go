@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// selfTestCheck is a single check run by the --selftest command
+type selfTestCheck struct {
+	name string
+	run  func() error
+}
+
+// runSelfTest exercises the core code paths of the orchestrator without podman, registry access
+// or an existing SHEM_HOME, and prints PASS or FAIL for every check
+// Returns true if all checks passed
+func runSelfTest(out io.Writer) bool {
+	checks := []selfTestCheck{
+		{"message round trip", selfTestMessages},
+		{"config read/write", selfTestConfig},
+		{"blacklist add/remove", selfTestBlacklist},
+		{"version comparison", selfTestVersions},
+	}
+
+	passed := true
+	for _, check := range checks {
+		if err := check.run(); err != nil {
+			fmt.Fprintf(out, "FAIL %s: %v\n", check.name, err)
+			passed = false
+		} else {
+			fmt.Fprintf(out, "PASS %s\n", check.name)
+		}
+	}
+	return passed
+}
+
+// selfTestMessages writes messages to a buffer and reads them back
+func selfTestMessages() error {
+	value, err := shemmsg.Number(-802.1)
+	if err != nil {
+		return err
+	}
+	messages := []shemmsg.Message{
+		{Name: "net_power", Payload: shemmsg.PointValue{Value: value}},
+		{Name: "irradiance", Payload: shemmsg.PointValue{Value: shemmsg.Missing()}},
+		{Name: "pv_forecast", Payload: shemmsg.TimeSeries{
+			StartTime: time.Date(2025, 12, 6, 8, 0, 0, 0, time.UTC),
+			Values:    []shemmsg.Value{value, shemmsg.Missing(), value},
+		}},
+	}
+
+	var buf bytes.Buffer
+	writer := shemmsg.NewWriter(&buf)
+	for _, m := range messages {
+		if err := writer.Write(m); err != nil {
+			return fmt.Errorf("failed to write %s: %w", m.Name, err)
+		}
+	}
+
+	reader := shemmsg.NewReader(&buf)
+	for _, expected := range messages {
+		got, err := reader.Read()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", expected.Name, err)
+		}
+		if !bytes.Equal(got.Encode(), expected.Encode()) {
+			return fmt.Errorf("round trip mismatch: expected %q, got %q", expected.Encode(), got.Encode())
+		}
+	}
+	if _, err := reader.Read(); err != io.EOF {
+		return fmt.Errorf("expected end of stream, got %v", err)
+	}
+	return nil
+}
+
+// withSelfTestModule runs fn with the config of a module in a temporary SHEM_HOME
+func withSelfTestModule(fn func(mc *ModuleConfig) error) error {
+	shemHome, err := os.MkdirTemp("", "shem-selftest-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(shemHome)
+
+	if err := os.MkdirAll(filepath.Join(shemHome, "modules", "selftest"), 0755); err != nil {
+		return fmt.Errorf("failed to create module directory: %w", err)
+	}
+
+	mc, err := NewConfigManager(shemHome).NewModuleConfig("selftest")
+	if err != nil {
+		return err
+	}
+	return fn(mc)
+}
+
+// selfTestConfig writes config values and reads them back
+func selfTestConfig() error {
+	return withSelfTestModule(func(mc *ModuleConfig) error {
+		if err := mc.SetString("image", "localhost/selftest"); err != nil {
+			return err
+		}
+		if image, err := mc.GetString("image", ""); err != nil || image != "localhost/selftest" {
+			return fmt.Errorf("expected image localhost/selftest, got %q (%v)", image, err)
+		}
+
+		if err := mc.SetString("number", "22.15"); err != nil {
+			return err
+		}
+		if number, err := mc.GetFloat("number", 0); err != nil || number != 22.15 {
+			return fmt.Errorf("expected 22.15, got %v (%v)", number, err)
+		}
+
+		if value, err := mc.GetInt("missing", 42); err != nil || value != 42 {
+			return fmt.Errorf("expected default 42 for missing key, got %v (%v)", value, err)
+		}
+
+		if err := mc.RemoveKey("number"); err != nil {
+			return err
+		}
+		if mc.KeyExists("number") {
+			return fmt.Errorf("key still exists after removal")
+		}
+		return nil
+	})
+}
+
+// selfTestBlacklist adds versions to the blacklist and removes them again
+func selfTestBlacklist() error {
+	return withSelfTestModule(func(mc *ModuleConfig) error {
+		for _, version := range []string{"0.0.10", "0.0.2"} {
+			if err := mc.AddToBlacklist(version); err != nil {
+				return err
+			}
+		}
+		if blacklisted, err := mc.IsVersionBlacklisted("0.0.10"); err != nil || !blacklisted {
+			return fmt.Errorf("expected 0.0.10 to be blacklisted (%v)", err)
+		}
+
+		if err := mc.RemoveFromBlacklist("0.0.10"); err != nil {
+			return err
+		}
+		blacklist, err := mc.GetBlacklistedVersions()
+		if err != nil {
+			return err
+		}
+		if _, found := blacklist["0.0.10"]; found || len(blacklist) != 1 {
+			return fmt.Errorf("unexpected blacklist after removal: %v", blacklist)
+		}
+
+		if err := mc.RemoveFromBlacklist("0.0.10"); err == nil {
+			return fmt.Errorf("expected error when removing a version that is not blacklisted")
+		}
+		return nil
+	})
+}
+
+// selfTestVersions checks version parsing and ordering
+func selfTestVersions() error {
+	tests := []struct {
+		v1, v2   string
+		expected int
+	}{
+		{"0.0.1", "0.0.1", 0},
+		{"0.0.2", "0.0.10", -1},
+		{"1.0.0", "0.99.99", 1},
+		{"invalid", "0.0.1", -1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.v1, tt.v2); got != tt.expected {
+			return fmt.Errorf("compareVersions(%s, %s) = %d, expected %d", tt.v1, tt.v2, got, tt.expected)
+		}
+	}
+
+	if _, _, _, err := parseVersion("1.2"); err == nil {
+		return fmt.Errorf("expected version 1.2 to be rejected")
+	}
+	return nil
+}
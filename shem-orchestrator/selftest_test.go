@@ -0,0 +1,17 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	var out bytes.Buffer
+	if !runSelfTest(&out) {
+		t.Fatalf("self-test failed:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "FAIL") {
+		t.Errorf("unexpected FAIL in output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// readSigningKey reads an Ed25519 private key from a PKCS #8 PEM file, as written by
+// generateSigningKey or openssl genpkey -algorithm ed25519
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s is not a PEM private key file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s is a %T, not an Ed25519 key", path, key)
+	}
+	return privateKey, nil
+}
+
+// signImage signs the binary image baseImage:tag with the given digest in the way verifySignature
+// checks it
+func signImage(privateKey ed25519.PrivateKey, baseImage, tag, digest string) *SignatureData {
+	signature := ed25519.Sign(privateKey, []byte(signedMessage(baseImage, tag, digest)))
+	return &SignatureData{
+		Digest:    digest,
+		PublicKey: base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}
+}
+
+// writeSignatureContainerfile signs the binary image imageAndTag (e.g.
+// "quay.io/shem/meter:1.0.0-amd64") with the given digest, as computed by podman push
+// --digestfile, and writes the Containerfile of its signature container to out
+// The image must be fully qualified and its tag must have the form [version]-[arch], as the
+// orchestrator only finds updates for such images.
+func writeSignatureContainerfile(out io.Writer, keyPath, imageAndTag, digest string) error {
+	baseImage, tag, err := splitImageTag(imageAndTag)
+	if err != nil {
+		return err
+	}
+	version, _, err := extractVersionAndArch(tag)
+	if err != nil {
+		return fmt.Errorf("invalid tag %q, expected [version]-[arch]: %w", tag, err)
+	}
+	algorithm, hash, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || hash == "" || strings.ContainsAny(digest, " \t\n\"") {
+		return fmt.Errorf("invalid digest %q, expected e.g. sha256:3b4c...", digest)
+	}
+	privateKey, err := readSigningKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	sigData := signImage(privateKey, baseImage, tag, digest)
+	_, err = fmt.Fprintf(out, "FROM scratch\n"+
+		"LABEL org.opencontainers.image.version=%q\n"+
+		"LABEL energy.shem.registryimage=%q\n"+
+		"LABEL %s=%q\n"+
+		"LABEL %s=%q\n"+
+		"LABEL %s=%q\n",
+		version, imageAndTag,
+		labelDigest, sigData.Digest,
+		labelPublicKey, sigData.PublicKey,
+		labelSignature, sigData.Signature)
+	return err
+}
+
+// splitImageTag splits a fully qualified image with tag into the image and the tag and checks
+// that there is a signature image for it
+func splitImageTag(imageAndTag string) (string, string, error) {
+	i := strings.LastIndex(imageAndTag, ":")
+	if i < 0 || strings.Contains(imageAndTag[i:], "/") {
+		return "", "", fmt.Errorf("image %q has no tag", imageAndTag)
+	}
+	baseImage, tag := imageAndTag[:i], imageAndTag[i+1:]
+	if _, err := signatureImage(baseImage); err != nil {
+		return "", "", err
+	}
+	return baseImage, tag, nil
+}
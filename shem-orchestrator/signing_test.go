@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWriteSignatureContainerfile(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "signing-key.pem")
+	var publicKey bytes.Buffer
+	if err := generateSigningKey(&publicKey, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	const digest = "sha256:0123456789abcdef"
+
+	var out bytes.Buffer
+	if err := writeSignatureContainerfile(&out, keyPath, "localhost:5000/shem/meter:1.1.0-amd64", digest); err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]string)
+	for line := range strings.Lines(out.String()) {
+		if label, ok := strings.CutPrefix(line, "LABEL "); ok {
+			name, value, _ := strings.Cut(strings.TrimSpace(label), "=")
+			labels[name], _ = strconv.Unquote(value)
+		}
+	}
+	if labels["org.opencontainers.image.version"] != "1.1.0" || labels[labelDigest] != digest ||
+		labels[labelPublicKey] != strings.TrimSpace(publicKey.String()) {
+		t.Errorf("unexpected labels %v", labels)
+	}
+
+	// the labels pass the verification of the update manager
+	sigData := &SignatureData{Digest: labels[labelDigest], PublicKey: labels[labelPublicKey], Signature: labels[labelSignature]}
+	um := newTestUpdateManager(t, nil)
+	keys := []string{strings.TrimSpace(publicKey.String())}
+	if err := um.verifySignature("localhost:5000/shem/meter", "1.1.0-amd64", sigData, keys); err != nil {
+		t.Errorf("expected signature to be verified, got %v", err)
+	}
+	if err := um.verifySignature("localhost:5000/shem/other", "1.1.0-amd64", sigData, keys); err == nil {
+		t.Error("expected signature of another image to be rejected")
+	}
+
+	for _, tt := range []struct{ image, digest string }{
+		{"localhost/meter", digest},              // no tag
+		{"localhost:5000/meter", digest},         // no tag, but a port
+		{"shem/meter:1.1.0-amd64", digest},       // unqualified
+		{"localhost/meter:latest-amd64", digest}, // no version
+		{"localhost/meter:1.1.0-amd64", "0123456789abcdef"},
+	} {
+		if err := writeSignatureContainerfile(&out, keyPath, tt.image, tt.digest); err == nil {
+			t.Errorf("%s %s: expected error", tt.image, tt.digest)
+		}
+	}
+}
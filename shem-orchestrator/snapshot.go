@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// SnapshotWriter periodically writes the last known values of all variables to
+// $SHEM_HOME/snapshot.json (see the orchestrator option SnapshotIntervalMinutes in modules.md)
+type SnapshotWriter struct {
+	router *Router
+	config func() OrchestratorConfig // current orchestrator options
+	path   string
+	logger *Logger
+	now    func() time.Time
+}
+
+// NewSnapshotWriter creates a snapshot writer for the values cached by router
+func NewSnapshotWriter(configManager *ConfigManager, router *Router, config func() OrchestratorConfig) *SnapshotWriter {
+	return &SnapshotWriter{
+		router: router,
+		config: config,
+		path:   filepath.Join(configManager.shemHome, "snapshot.json"),
+		logger: NewLogger("orchestrator-snapshot"),
+		now:    time.Now,
+	}
+}
+
+// Run writes snapshots until the context is canceled, and a last one on shutdown
+// The interval is taken from the current options every minute.
+func (sw *SnapshotWriter) Run(ctx context.Context) {
+	lastSnapshot := sw.now()
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		interval := time.Duration(sw.config().SnapshotIntervalMinutes * float64(time.Minute))
+
+		select {
+		case <-ctx.Done():
+			if interval > 0 {
+				if err := sw.WriteSnapshot(); err != nil {
+					sw.logger.Error("failed to write snapshot: %v", err)
+				}
+			}
+			return
+		case <-ticker.C:
+			if interval > 0 && sw.now().Sub(lastSnapshot) >= interval {
+				lastSnapshot = sw.now()
+				if err := sw.WriteSnapshot(); err != nil {
+					sw.logger.Error("failed to write snapshot: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// WriteSnapshot atomically replaces the snapshot file with the current last known values
+// Values are stored by qualified name together with the time they were received; missing
+// values are written as null.
+func (sw *SnapshotWriter) WriteSnapshot() error {
+	values := make(map[string]map[string]any)
+	for name, cached := range sw.router.LastValues() {
+		entry := map[string]any{
+			"type":     cached.Message.Type(),
+			"received": cached.Received.UTC(),
+		}
+		if cached.Message.Unit != "" {
+			entry["unit"] = cached.Message.Unit
+		}
+		if cached.Stale(sw.now()) {
+			entry["stale"] = true
+		}
+		switch payload := cached.Message.Payload.(type) {
+		case shemmsg.PointValue:
+			entry["value"] = snapshotNumber(payload.Value)
+		case shemmsg.TimeSeries:
+			series := make([]any, len(payload.Values))
+			for i, v := range payload.Values {
+				series[i] = snapshotNumber(v)
+			}
+			entry["start_time"] = payload.StartTime.UTC()
+			entry["values"] = series
+		}
+		values[name] = entry
+	}
+
+	data, err := json.MarshalIndent(map[string]any{
+		"time":   sw.now().UTC(),
+		"values": values,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	if err := writeFileAtomic(sw.path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", sw.path, err)
+	}
+	return nil
+}
+
+// snapshotNumber returns the value as float64, or nil if it is missing
+func snapshotNumber(v shemmsg.Value) any {
+	if v.IsMissing() {
+		return nil
+	}
+	return v.Float64()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+func TestWriteSnapshot(t *testing.T) {
+	cm := newTestModule(t, "orchestrator", nil)
+	router := NewRouter()
+	received := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	router.now = func() time.Time { return received }
+
+	power := testMessage(t, "meter.power", 1.5)
+	power.Unit = "kW"
+	router.Route(power)
+	router.Route(testMessage(t, "meter.power", 2.25)) // replaces the first value
+	price, _ := shemmsg.Number(0.3)
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	router.Route(shemmsg.Message{Name: "forecast.price", Payload: shemmsg.TimeSeries{
+		StartTime: start,
+		Values:    []shemmsg.Value{price, shemmsg.Missing()},
+	}})
+	router.flush()
+
+	sw := NewSnapshotWriter(cm, router, DefaultOrchestratorConfig)
+	sw.now = func() time.Time { return received.Add(time.Minute) }
+	if err := sw.WriteSnapshot(); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(cm.shemHome, "snapshot.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot struct {
+		Time   time.Time
+		Values map[string]struct {
+			Type      string
+			Unit      string
+			Received  time.Time
+			Value     *float64
+			StartTime time.Time `json:"start_time"`
+			Values    []*float64
+		}
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("invalid snapshot: %v\n%s", err, data)
+	}
+
+	if !snapshot.Time.Equal(received.Add(time.Minute)) {
+		t.Errorf("unexpected snapshot time %v", snapshot.Time)
+	}
+	if len(snapshot.Values) != 2 {
+		t.Fatalf("expected 2 values, got %d:\n%s", len(snapshot.Values), data)
+	}
+
+	pv := snapshot.Values["meter.power"]
+	if pv.Type != "pointvalue" || pv.Value == nil || *pv.Value != 2.25 || pv.Unit != "" || !pv.Received.Equal(received) {
+		t.Errorf("unexpected point value in snapshot:\n%s", data)
+	}
+
+	ts := snapshot.Values["forecast.price"]
+	if ts.Type != "timeseries" || !ts.StartTime.Equal(start) || len(ts.Values) != 2 ||
+		ts.Values[0] == nil || *ts.Values[0] != 0.3 || ts.Values[1] != nil {
+		t.Errorf("unexpected timeseries in snapshot:\n%s", data)
+	}
+
+	// a later snapshot replaces the file
+	router.Route(testMessage(t, "meter.energy", 10))
+	router.flush()
+	if err := sw.WriteSnapshot(); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	data, _ = os.ReadFile(filepath.Join(cm.shemHome, "snapshot.json"))
+	snapshot.Values = nil
+	if err := json.Unmarshal(data, &snapshot); err != nil || len(snapshot.Values) != 3 {
+		t.Errorf("expected replaced snapshot with 3 values, got %v:\n%s", err, data)
+	}
+	if _, err := os.Stat(filepath.Join(cm.shemHome, "snapshot.json.tmp")); err == nil {
+		t.Error("expected no temporary file to be left behind")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// Subscription is a single line of a module's inputs file (see modules.md, "The inputs File")
+type Subscription struct {
+	Module    string    // name of the producing module or "*" for all modules
+	Variable  string    // name of the variable or "*" for all variables
+	Alias     string    // local name the message is delivered with; empty for the qualified name
+	Transform Transform // conversion of the values before delivery; zero for none
+}
+
+// parseSubscription parses a line of the form "module.variable [localname] [options]"
+// The options scale=x, offset=x and unit=x configure a Transform.
+func parseSubscription(line string) (Subscription, error) {
+	fields := strings.Fields(line)
+	var options []string
+	for len(fields) > 1 && strings.Contains(fields[len(fields)-1], "=") {
+		options = append([]string{fields[len(fields)-1]}, options...)
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) < 1 || len(fields) > 2 {
+		return Subscription{}, fmt.Errorf("expected 'module.variable [localname] [options]': %q", line)
+	}
+
+	module, variable := shemmsg.SplitName(fields[0])
+	if module == "" {
+		return Subscription{}, fmt.Errorf("subscription %q is not qualified with a module name", fields[0])
+	}
+	for _, part := range []string{module, variable} {
+		if part == "*" {
+			continue
+		}
+		if err := shemmsg.ValidateNamePart(part); err != nil {
+			return Subscription{}, fmt.Errorf("invalid subscription %q: %w", fields[0], err)
+		}
+	}
+
+	subscription := Subscription{Module: module, Variable: variable}
+
+	if len(fields) == 2 {
+		if module == "*" || variable == "*" {
+			return Subscription{}, fmt.Errorf("subscription %q: wildcards are not allowed with a local name", fields[0])
+		}
+		if err := shemmsg.ValidateNamePart(fields[1]); err != nil {
+			return Subscription{}, fmt.Errorf("invalid local name %q: %w", fields[1], err)
+		}
+		subscription.Alias = fields[1]
+	}
+
+	for _, option := range options {
+		if err := subscription.Transform.parseOption(option); err != nil {
+			return Subscription{}, fmt.Errorf("subscription %q: %w", fields[0], err)
+		}
+	}
+	if subscription.Transform == (Transform{Scale: 1}) {
+		subscription.Transform = Transform{}
+	}
+
+	return subscription, nil
+}
+
+// Matches reports whether a message with the given qualified name is covered by the subscription
+func (s Subscription) Matches(qualifiedName string) bool {
+	module, variable := shemmsg.SplitName(qualifiedName)
+	return (s.Module == "*" || s.Module == module) && (s.Variable == "*" || s.Variable == variable)
+}
+
+// String returns the subscription in the format of the inputs file
+func (s Subscription) String() string {
+	line := s.Module + "." + s.Variable
+	if s.Alias != "" {
+		line += " " + s.Alias
+	}
+	return line + s.Transform.String()
+}
+
+// wiringProblems checks the inputs of the given modules against the modules that exist and the
+// variables they declare in their produces files; produces has an entry for each module that
+// declares its variables. Subscriptions of modules without such a declaration can not be checked.
+// Returns a description of each subscription that can never match, sorted by module.
+func wiringProblems(names []string, inputs map[string][]Subscription, produces map[string][]string) []string {
+	declares := func(module, variable string) bool {
+		variables, ok := produces[module]
+		return !ok || variable == "*" || slices.Contains(variables, variable)
+	}
+
+	var problems []string
+	for _, name := range slices.Sorted(slices.Values(names)) {
+		for _, subscription := range inputs[name] {
+			switch {
+			case subscription.Module == "*":
+				if !slices.ContainsFunc(names, func(producer string) bool { return declares(producer, subscription.Variable) }) {
+					problems = append(problems, fmt.Sprintf("module %s subscribes to %s, but no module declares %s",
+						name, subscription, subscription.Variable))
+				}
+			case !slices.Contains(names, subscription.Module):
+				problems = append(problems, fmt.Sprintf("module %s subscribes to %s, but there is no module %s",
+					name, subscription, subscription.Module))
+			case !declares(subscription.Module, subscription.Variable):
+				problems = append(problems, fmt.Sprintf("module %s subscribes to %s, but module %s does not declare %s in its produces file",
+					name, subscription, subscription.Module, subscription.Variable))
+			}
+		}
+	}
+	return problems
+}
+
+// unusedVariables returns the variables of the given modules that no subscription of any module
+// matches, as qualified names sorted by module: the declared variables of modules with a produces
+// file, and "module.*" for other modules that nobody subscribes to at all
+func unusedVariables(names []string, inputs map[string][]Subscription, produces map[string][]string) []string {
+	subscribed := func(module, variable string) bool {
+		for _, subscriptions := range inputs {
+			for _, subscription := range subscriptions {
+				if (subscription.Module == "*" || subscription.Module == module) &&
+					(variable == "*" || subscription.Variable == "*" || subscription.Variable == variable) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var unused []string
+	for _, name := range slices.Sorted(slices.Values(names)) {
+		variables, ok := produces[name]
+		if !ok {
+			variables = []string{"*"}
+		}
+		for _, variable := range variables {
+			if !subscribed(name, variable) {
+				unused = append(unused, name+"."+variable)
+			}
+		}
+	}
+	return unused
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSubscription(t *testing.T) {
+	valid := map[string]Subscription{
+		"meter.net_power":                {Module: "meter", Variable: "net_power"},
+		"optimizer.device_2_setpoint sp": {Module: "optimizer", Variable: "device_2_setpoint", Alias: "sp"},
+		"*.temperature":                  {Module: "*", Variable: "temperature"},
+		"gui.*":                          {Module: "gui", Variable: "*"},
+		"*.*":                            {Module: "*", Variable: "*"},
+		"meter.energy energy_kwh scale=0.001 unit=kWh": {Module: "meter", Variable: "energy", Alias: "energy_kwh",
+			Transform: Transform{Scale: 0.001, Unit: "kWh"}},
+		"*.temperature offset=-273.15": {Module: "*", Variable: "temperature", Transform: Transform{Scale: 1, Offset: -273.15}},
+	}
+	for line, expected := range valid {
+		got, err := parseSubscription(line)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", line, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("%q: expected %+v, got %+v", line, expected, got)
+		}
+		if got.String() != line {
+			t.Errorf("expected String() to return %q, got %q", line, got.String())
+		}
+	}
+
+	invalid := []string{
+		"net_power",
+		"meter.net_power alias extra",
+		"*.temperature alias",
+		"meter.* alias",
+		"meter.net-power",
+		"meter.net_power bad-alias",
+		"**.x",
+		"meter.energy scale=0",
+		"meter.energy scale=ten",
+		"meter.energy offset=NaN",
+		"meter.energy factor=2",
+		"meter.energy unit=k W",
+		"meter.energy scale=2 alias",
+	}
+	for _, line := range invalid {
+		if _, err := parseSubscription(line); err == nil {
+			t.Errorf("expected %q to be rejected", line)
+		}
+	}
+}
+
+func TestSubscriptionMatches(t *testing.T) {
+	tests := []struct {
+		subscription string
+		name         string
+		expected     bool
+	}{
+		{"meter.net_power", "meter.net_power", true},
+		{"meter.net_power", "meter.total_energy", false},
+		{"meter.net_power", "other.net_power", false},
+		{"*.temperature", "room.temperature", true},
+		{"gui.*", "gui.button", true},
+		{"gui.*", "meter.button", false},
+		{"*.*", "any.thing", true},
+	}
+	for _, tt := range tests {
+		subscription, _ := parseSubscription(tt.subscription)
+		if got := subscription.Matches(tt.name); got != tt.expected {
+			t.Errorf("%s matches %s: expected %v, got %v", tt.subscription, tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestWiringProblems(t *testing.T) {
+	names := []string{"meter", "optimizer", "gui"}
+	produces := map[string][]string{
+		"meter":     {"net_power", "total_energy"},
+		"optimizer": {},
+		// gui does not declare its variables
+	}
+	inputs := map[string][]Subscription{
+		"optimizer": mustParseSubscriptions(t,
+			"meter.net_power",
+			"meter.power",       // not declared by meter
+			"inverter.pv_power", // no such module
+			"gui.setpoint",      // gui is not checked
+			"meter.*",
+			"*.total_energy",
+			"*.forecast", // gui might send it
+		),
+		"gui": mustParseSubscriptions(t, "optimizer.schedule", "*.*"),
+	}
+
+	expected := []string{
+		"module gui subscribes to optimizer.schedule, but module optimizer does not declare schedule in its produces file",
+		"module optimizer subscribes to meter.power, but module meter does not declare power in its produces file",
+		"module optimizer subscribes to inverter.pv_power, but there is no module inverter",
+	}
+	if got := wiringProblems(names, inputs, produces); !slices.Equal(got, expected) {
+		t.Errorf("expected problems\n%q\ngot\n%q", expected, got)
+	}
+
+	// once every module declares its variables, wildcard modules are checked as well
+	produces["gui"] = []string{"setpoint"}
+	problems := wiringProblems(names, inputs, produces)
+	if !slices.Contains(problems, "module optimizer subscribes to *.forecast, but no module declares forecast") {
+		t.Errorf("expected problem with *.forecast, got %q", problems)
+	}
+}
+
+func TestAnalyzeWiring(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "produces": "net_power\ntotal_energy\n"})
+	setConfig(t, cm, "optimizer", "image", "localhost/optimizer")
+	setConfig(t, cm, "optimizer", "produces", "schedule\n")
+	setConfig(t, cm, "optimizer", "inputs", "meter.net_power\ninverter.pv_power\n")
+	setConfig(t, cm, "logger", "image", "localhost/logger") // sends nothing that is declared
+	setConfig(t, cm, "orchestrator", "image", "localhost/shem-orchestrator")
+
+	report, err := cm.AnalyzeWiring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"logger.*", "meter.total_energy", "optimizer.schedule"}; !slices.Equal(report.Unused, expected) {
+		t.Errorf("expected unused %q, got %q", expected, report.Unused)
+	}
+	if expected := []string{"module optimizer subscribes to inverter.pv_power, but there is no module inverter"}; !slices.Equal(report.Dangling, expected) {
+		t.Errorf("expected dangling %q, got %q", expected, report.Dangling)
+	}
+
+	// wildcards use all matching variables
+	setConfig(t, cm, "logger", "inputs", "meter.*\noptimizer.*\n")
+	report, _ = cm.AnalyzeWiring()
+	if expected := []string{"logger.*"}; !slices.Equal(report.Unused, expected) {
+		t.Errorf("expected unused %q, got %q", expected, report.Unused)
+	}
+
+	var out strings.Builder
+	if err := printWiring(&out, cm); err != nil {
+		t.Fatal(err)
+	}
+	expected := "unused: no module subscribes to logger.*\n" +
+		"dangling: module optimizer subscribes to inverter.pv_power, but there is no module inverter\n"
+	if out.String() != expected {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
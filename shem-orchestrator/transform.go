@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/fhswf/shem/shemmsg"
+)
+
+// Transform converts the values of a subscribed variable before delivery, e.g. from Wh to kWh
+// (see modules.md, "The inputs File")
+// The zero value leaves messages unchanged.
+type Transform struct {
+	Scale  float64 // factor applied to each value; 0 if no transform is configured
+	Offset float64 // added to each value after scaling
+	Unit   string  // unit of the transformed values; empty to keep the unit of the message
+}
+
+// parseOption parses an option of the form "scale=x", "offset=x" or "unit=x" of a line
+// of the inputs file and applies it to t
+func (t *Transform) parseOption(option string) error {
+	key, value, ok := strings.Cut(option, "=")
+	if !ok {
+		return fmt.Errorf("expected 'key=value', got %q", option)
+	}
+
+	if t.Scale == 0 {
+		t.Scale = 1
+	}
+	switch key {
+	case "scale":
+		scale, err := strconv.ParseFloat(value, 64)
+		if err != nil || scale == 0 || !isFinite(scale) {
+			return fmt.Errorf("invalid scale %q", value)
+		}
+		t.Scale = scale
+	case "offset":
+		offset, err := strconv.ParseFloat(value, 64)
+		if err != nil || !isFinite(offset) {
+			return fmt.Errorf("invalid offset %q", value)
+		}
+		t.Offset = offset
+	case "unit":
+		if err := shemmsg.ValidateUnit(value); err != nil {
+			return err
+		}
+		t.Unit = value
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	return nil
+}
+
+// isFinite reports whether f is neither NaN nor infinite
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// String returns the transform as options in the format of the inputs file
+func (t Transform) String() string {
+	var s string
+	if t.Scale != 0 && t.Scale != 1 {
+		s += " scale=" + strconv.FormatFloat(t.Scale, 'g', -1, 64)
+	}
+	if t.Offset != 0 {
+		s += " offset=" + strconv.FormatFloat(t.Offset, 'g', -1, 64)
+	}
+	if t.Unit != "" {
+		s += " unit=" + t.Unit
+	}
+	return s
+}
+
+// Apply returns msg with transformed values; missing values are left as they are
+// Returns an error if a transformed value is out of range.
+func (t Transform) Apply(msg shemmsg.Message) (shemmsg.Message, error) {
+	if t == (Transform{}) {
+		return msg, nil
+	}
+
+	switch payload := msg.Payload.(type) {
+	case shemmsg.PointValue:
+		v, err := t.apply(payload.Value)
+		if err != nil {
+			return shemmsg.Message{}, err
+		}
+		msg.Payload = shemmsg.PointValue{Value: v}
+	case shemmsg.TimeSeries:
+		values := make([]shemmsg.Value, len(payload.Values))
+		for i, value := range payload.Values {
+			v, err := t.apply(value)
+			if err != nil {
+				return shemmsg.Message{}, err
+			}
+			values[i] = v
+		}
+		msg.Payload = shemmsg.TimeSeries{StartTime: payload.StartTime, Values: values}
+	}
+
+	if t.Unit != "" {
+		msg.Unit = t.Unit
+	}
+	return msg, nil
+}
+
+// apply transforms a single value, validating the result with shemmsg.Number
+func (t Transform) apply(v shemmsg.Value) (shemmsg.Value, error) {
+	if v.IsMissing() {
+		return v, nil
+	}
+	result, err := shemmsg.Number(v.Float64()*t.Scale + t.Offset)
+	if err != nil {
+		return shemmsg.Missing(), fmt.Errorf("transformed value of %s: %w", v, err)
+	}
+	return result, nil
+}
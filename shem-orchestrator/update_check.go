@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// UpdateCheckReason is a machine-readable outcome of the update check of a module
+type UpdateCheckReason string
+
+const (
+	UpdateCheckScheduled          UpdateCheckReason = "scheduled"           // an update has been scheduled
+	UpdateCheckUpToDate           UpdateCheckReason = "up-to-date"          // no version is newer than the current or scheduled one
+	UpdateCheckBlacklisted        UpdateCheckReason = "blacklisted"         // all newer versions are blacklisted
+	UpdateCheckVerificationFailed UpdateCheckReason = "verification-failed" // all newer versions failed verification
+	UpdateCheckRegistryError      UpdateCheckReason = "registry-error"      // the registry could not be queried
+	UpdateCheckNoVersions         UpdateCheckReason = "no-versions"         // the registry has no versions for this architecture
+	UpdateCheckNoPublicKey        UpdateCheckReason = "no-public-key"       // automatic updates are not enabled
+	UpdateCheckInvalidPublicKey   UpdateCheckReason = "invalid-public-key"  // the public_key file contains a malformed key
+	UpdateCheckNoImage            UpdateCheckReason = "no-image"            // the image file is empty
+	UpdateCheckDisabled           UpdateCheckReason = "disabled"            // the module is disabled
+	UpdateCheckVerificationRun    UpdateCheckReason = "verification-run"    // orchestrator updates wait until the verification run is over
+	UpdateCheckOutsideRollout     UpdateCheckReason = "outside-rollout"     // the orchestrator version is not rolled out to this device's cohort yet
+)
+
+// UpdateCheckResult is the outcome of the last update check of a module
+type UpdateCheckResult struct {
+	Reason         UpdateCheckReason
+	CurrentVersion string
+	Version        string // version that was scheduled or that failed verification, if any
+	Details        string // error message, if any
+	Time           time.Time
+}
+
+// Errors returned by findLatestEligibleVersion if there is no version to update to
+var (
+	errNoRemoteVersions = errors.New("no versions found")
+	errNoNewerVersion   = errors.New("no newer version found")
+	errOnlyBlacklisted  = errors.New("all newer versions are blacklisted")
+)
+
+// recordCheck stores the outcome of the update check of a module
+func (um *UpdateManager) recordCheck(moduleName string, result UpdateCheckResult) {
+	result.Time = time.Now()
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.checkResults[moduleName] = result
+}
+
+// LastUpdateCheck returns the outcome of the last update check of a module, answering the question
+// why a module has not been updated. Returns false if the module has not been checked yet.
+func (um *UpdateManager) LastUpdateCheck(moduleName string) (UpdateCheckResult, bool) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	result, ok := um.checkResults[moduleName]
+	return result, ok
+}
@@ -2,16 +2,25 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/ed25519"
+	"crypto/sha256"
+	"debug/elf"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
+	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,42 +34,111 @@ naming convention:
 	architecture: amd64
 */
 
+// defaultExtractTimeout is the time after which copying the orchestrator binary out of its container is aborted
+const defaultExtractTimeout = 5 * time.Minute
+
 type UpdateManager struct {
-	configManager      *ConfigManager
-	orchestratorConfig *ModuleConfig
-	shemHome           string
-	verificationRun    bool
-	logger             *Logger
-	updateChannel      chan string
-	cancelFunc         context.CancelFunc
-	scheduledUpdates  map[string]string    // maps module name to scheduled version
-	confirmationTimes map[string]time.Time // when each module's update should be confirmed
+	configManager           *ConfigManager
+	orchestratorConfig      *ModuleConfig
+	config                  OrchestratorConfig // options read from orchestratorConfig, guarded by mu
+	configError             string             // last error reported while reading config, guarded by mu
+	shemHome                string
+	verificationRun         bool
+	logger                  *Logger
+	updateChannel           chan string
+	cancelFunc              context.CancelFunc
+	scheduledUpdates        map[string]PendingUpdate     // updates that wait for their random delay, guarded by mu
+	confirmationTimes       map[string]time.Time         // when each module's update should be confirmed
+	notifications           sync.WaitGroup               // notifications of update events that are still being sent
+	checkResults            map[string]UpdateCheckResult // outcome of the last update check per module, guarded by mu
+	applied                 int                          // updates applied since the start, guarded by mu
+	extractTimeout          time.Duration                // maximum duration of copying the orchestrator binary out of its container
+	extractProgressInterval time.Duration                // how often progress of the extraction is logged
+	mu                      sync.Mutex
+
+	// seams for tests; default to findRemoteVersions, verifyAndPullImage, rolloutPercentage and
+	// podmanCommandContext with the storage options
+	remoteVersions func(ctx context.Context, image string) (map[string]struct{}, error)
+	verifyAndPull  func(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error
+	rollout        func(ctx context.Context, baseImage, tag string) (int, error)
+	podman         func(ctx context.Context, args ...string) *exec.Cmd
+}
+
+// podmanCommandContext returns a command that runs podman with the given arguments and is killed
+// when ctx is done
+func podmanCommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "podman", args...)
+	cmd.WaitDelay = time.Second // don't wait for children of a killed podman holding the output pipes
+	return cmd
 }
 
 // NewUpdateManager creates a new update manager instance
 func NewUpdateManager(configManager *ConfigManager, verificationRun bool) *UpdateManager {
 	logger := NewLogger("orchestrator-updatemanager")
 
-	orchestratorConfig, _ := configManager.NewModuleConfig("orchestrator")
+	// Without an orchestrator config directory, all options keep their defaults
+	orchestratorConfig, err := configManager.NewModuleConfig("orchestrator")
+	if err != nil {
+		logger.Info("%v, using default options", err)
+	}
+
+	um := &UpdateManager{
+		configManager:           configManager,
+		orchestratorConfig:      orchestratorConfig,
+		shemHome:                configManager.shemHome,
+		verificationRun:         verificationRun,
+		logger:                  logger,
+		updateChannel:           make(chan string, 100),
+		scheduledUpdates:        make(map[string]PendingUpdate),
+		confirmationTimes:       make(map[string]time.Time),
+		checkResults:            make(map[string]UpdateCheckResult),
+		extractTimeout:          defaultExtractTimeout,
+		extractProgressInterval: 10 * time.Second,
+	}
+	um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+		return podmanCommandContext(ctx, append(um.currentConfig().podmanStorageArgs(), args...)...)
+	}
+	um.remoteVersions = um.findRemoteVersions
+	um.verifyAndPull = um.verifyAndPullImage
+	um.rollout = um.rolloutPercentage
+	um.ReloadConfig()
+	return um
+}
+
+// ReloadConfig re-reads the orchestrator options
+// Errors are logged once; invalid options keep their default value
+func (um *UpdateManager) ReloadConfig() {
+	config, err := LoadOrchestratorConfig(um.orchestratorConfig)
 
-	return &UpdateManager{
-		configManager:      configManager,
-		orchestratorConfig: orchestratorConfig,
-		shemHome:           configManager.shemHome,
-		verificationRun:    verificationRun,
-		logger:             logger,
-		updateChannel:      make(chan string, 100),
-		scheduledUpdates:  make(map[string]string),
-		confirmationTimes: make(map[string]time.Time),
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.config = config
+	if err == nil {
+		um.configError = ""
+	} else if err.Error() != um.configError {
+		um.configError = err.Error()
+		um.logger.Warn("invalid orchestrator config: %v", err)
 	}
 }
 
+// currentConfig returns the orchestrator options read by the last call to ReloadConfig
+func (um *UpdateManager) currentConfig() OrchestratorConfig {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	return um.config
+}
+
 // Run runs the update manager until the context is canceled
+// Canceling the context also aborts update checks and updates that are in progress, including the
+// podman commands they run.
 func (um *UpdateManager) Run(ctx context.Context, cancel context.CancelFunc) {
 	um.logger.Info("starting update manager")
 
 	// Store the cancel function for orchestrator restart
 	um.cancelFunc = cancel
+	um.clearPendingUpdates()
+	um.removeStaleExtractContainers(ctx)
 
 	// Check every minute whether the configured update interval has elapsed since the last check
 	lastCheck := time.Now()
@@ -72,8 +150,12 @@ func (um *UpdateManager) Run(ctx context.Context, cancel context.CancelFunc) {
 		select {
 		case <-ctx.Done():
 			um.logger.Info("stopping update manager")
+			um.notifications.Wait()
 			return
 		case <-ticker.C:
+			// Config files may have been changed since the last tick
+			um.ReloadConfig()
+
 			// Check for updates that are ready to be confirmed
 			for moduleName, confirmTime := range um.confirmationTimes {
 				// Skip disabled modules — they haven't been running
@@ -87,18 +169,19 @@ func (um *UpdateManager) Run(ctx context.Context, cancel context.CancelFunc) {
 				}
 			}
 
-			checkIntervalHours, _ := um.orchestratorConfig.GetFloat("UpdateCheckIntervalHours", 22.15)
-			checkInterval := time.Duration(checkIntervalHours * float64(time.Hour))
+			um.applyRequestedUpdates(ctx)
+
+			checkInterval := time.Duration(um.currentConfig().UpdateCheckIntervalHours * float64(time.Hour))
 			if time.Since(lastCheck) < checkInterval {
 				continue
 			}
 			lastCheck = time.Now()
-			if err := um.checkAndScheduleUpdates(); err != nil {
+			if err := um.checkAndScheduleUpdates(ctx); err != nil && ctx.Err() == nil {
 				um.logger.Error("error checking for updates: %v", err)
 			}
 		case image := <-um.updateChannel:
 			um.logger.Info("executing scheduled update for module: %s", image)
-			if err := um.updateModule(image); err != nil {
+			if err := um.updateModule(ctx, image); err != nil {
 				um.logger.Error("error updating module %s: %v", image, err)
 			}
 		}
@@ -163,9 +246,9 @@ func compareVersions(v1, v2 string) int {
 
 // findLocalVersions uses podman to find all binary containers with correct architecture in local storage
 // Returns a set of versions
-func (um *UpdateManager) findLocalVersions(image string) (map[string]struct{}, error) {
+func (um *UpdateManager) findLocalVersions(ctx context.Context, image string) (map[string]struct{}, error) {
 	// Execute podman images command to list only images for the specific module
-	cmd := exec.Command("podman", "images", "--filter", "reference="+image, "--format", "{{.Tag}}")
+	cmd := um.podman(ctx, "images", "--filter", "reference="+image, "--format", "{{.Tag}}")
 	output, err := cmd.Output()
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
@@ -187,7 +270,7 @@ func (um *UpdateManager) findLocalVersions(image string) (map[string]struct{}, e
 			continue
 		}
 
-		version, arch, _ := um.extractVersionAndArch(tag)
+		version, arch, _ := extractVersionAndArch(tag)
 		if arch == runtime.GOARCH {
 			versions[version] = struct{}{}
 		}
@@ -202,45 +285,118 @@ func (um *UpdateManager) findLocalVersions(image string) (map[string]struct{}, e
 }
 
 // findRemoteVersions searches for remote signature containers and pulls latest tags to discover versions
-func (um *UpdateManager) findRemoteVersions(image string) (map[string]struct{}, error) {
-	remoteVersions := make(map[string]struct{})
+// With the orchestrator option OfflineUpdates, the staged signature containers are used instead.
+func (um *UpdateManager) findRemoteVersions(ctx context.Context, image string) (map[string]struct{}, error) {
+	if um.currentConfig().OfflineUpdates {
+		return um.findStagedVersions(ctx, image)
+	}
 
 	// Search for remote signature containers for this base image
-	tags, err := um.listRemoteSignatureTags(image)
+	tags, err := um.listRemoteSignatureTags(ctx, image)
 	if err != nil {
 		return nil, fmt.Errorf("failed to search remote signature tags for %s: %v", image, err)
 	}
 
-	for _, tag := range tags {
-		version, arch, err := um.extractVersionAndArch(tag)
-		if err == nil && arch == runtime.GOARCH {
-			remoteVersions[version] = struct{}{}
-		}
-	}
-
 	// Pull latest tag to discover its version
-	latestImageAndTag := image + "-sig:latest-" + runtime.GOARCH
-	latestVersion, err := um.extractVersionLabel(latestImageAndTag)
+	sigImage, err := signatureImage(image)
+	if err != nil {
+		return nil, err
+	}
+	latestImageAndTag := sigImage + ":latest-" + runtime.GOARCH
+	latestVersion, err := um.extractVersionLabel(ctx, latestImageAndTag)
 	if err != nil {
 		um.logger.Warn("failed to pull latest version for %s: %v", image, err)
-	} else if latestVersion != "" {
-		_, _, _, err := parseVersion(latestVersion)
-		if err == nil {
-			// Add latest version to the set (version only, no architecture suffix)
-			remoteVersions[latestVersion] = struct{}{}
-		}
+	}
+
+	tagExists := func(tag string) bool {
+		return um.remoteTagExists(ctx, sigImage+":"+tag)
+	}
+	remoteVersions, err := um.remoteVersionsForArch(tags, latestVersion, runtime.GOARCH, tagExists)
+	if err != nil {
+		um.logger.Warn("%s: %v", image, err)
 	}
 
 	um.logger.Info("found %d remote versions for module image %s", len(remoteVersions), image)
 	return remoteVersions, nil
 }
 
+// findStagedVersions finds the versions whose signature containers are in local storage, e.g.
+// because they were loaded from an update bundle at a site without access to the registry
+func (um *UpdateManager) findStagedVersions(ctx context.Context, image string) (map[string]struct{}, error) {
+	sigImage, err := signatureImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := um.podman(ctx, "images", "--filter", "reference="+sigImage, "--format", "{{.Tag}}")
+	output, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("failed to list staged signature containers for %s: %w, %s", image, err, ee.Stderr)
+		} else {
+			return nil, fmt.Errorf("failed to list staged signature containers for %s: %w", image, err)
+		}
+	}
+
+	versions := make(map[string]struct{})
+	for line := range strings.Lines(string(output)) {
+		version, arch, err := extractVersionAndArch(strings.TrimSpace(line))
+		if err == nil && arch == runtime.GOARCH {
+			versions[version] = struct{}{}
+		}
+	}
+
+	um.logger.Info("found %d staged versions for module image %s", len(versions), image)
+	return versions, nil
+}
+
+// remoteVersionsForArch returns the versions of all tags of the form [version]-[arch]
+// latestVersion (the version label of the "latest-[arch]" tag, may be empty) is only included if
+// the tag for its version and arch exists as well, because only such a tag can be pulled by
+// verifyAndPullImage. As the list of tags may be incomplete, tagExists is asked for tags that are
+// not listed. An error is returned if latestVersion is ignored.
+func (um *UpdateManager) remoteVersionsForArch(tags []string, latestVersion, arch string, tagExists func(tag string) bool) (map[string]struct{}, error) {
+	versions := make(map[string]struct{})
+	for _, tag := range tags {
+		version, tagArch, err := extractVersionAndArch(tag)
+		if err == nil && tagArch == arch {
+			versions[version] = struct{}{}
+		}
+	}
+
+	if latestVersion == "" {
+		return versions, nil
+	}
+	if _, _, _, err := parseVersion(latestVersion); err != nil {
+		return versions, fmt.Errorf("ignoring latest version: %w", err)
+	}
+	if _, ok := versions[latestVersion]; !ok {
+		if tag := latestVersion + "-" + arch; !tagExists(tag) {
+			return versions, fmt.Errorf("ignoring latest version %s, there is no tag %s", latestVersion, tag)
+		}
+		versions[latestVersion] = struct{}{}
+	}
+	return versions, nil
+}
+
+// remoteTagExists checks with the registry whether an image tag exists, without pulling it
+func (um *UpdateManager) remoteTagExists(ctx context.Context, imageAndTag string) bool {
+	cmd := um.podman(ctx, "manifest", "inspect", imageAndTag)
+	if err := cmd.Run(); err != nil {
+		um.logger.Debug("tag %s not found: %v", imageAndTag, err)
+		return false
+	}
+	return true
+}
+
 // listRemoteSignatureTags uses podman search --list-tags to find all signature container tags
-func (um *UpdateManager) listRemoteSignatureTags(baseImage string) ([]string, error) {
-	// Search for signature containers: baseImage + "-sig"
-	sigImage := baseImage + "-sig"
+func (um *UpdateManager) listRemoteSignatureTags(ctx context.Context, baseImage string) ([]string, error) {
+	sigImage, err := signatureImage(baseImage)
+	if err != nil {
+		return nil, err
+	}
 
-	cmd := exec.Command("podman", "search", sigImage, "--list-tags", "--limit", "10000", "--format", "{{.Tag}}")
+	cmd := um.podman(ctx, "search", sigImage, "--list-tags", "--limit", "10000", "--format", "{{.Tag}}")
 	output, err := cmd.Output()
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
@@ -270,9 +426,9 @@ func (um *UpdateManager) listRemoteSignatureTags(baseImage string) ([]string, er
 // extractVersionLabel pulls an image (usually the "latest-[arch]" version of a signature container)
 // and extracts its version from labels
 // Returns just the version string (without architecture suffix)
-func (um *UpdateManager) extractVersionLabel(imageAndTag string) (string, error) {
+func (um *UpdateManager) extractVersionLabel(ctx context.Context, imageAndTag string) (string, error) {
 	// Pull the image
-	cmd := exec.Command("podman", "pull", imageAndTag)
+	cmd := um.podman(ctx, "pull", imageAndTag)
 	if err := cmd.Run(); err != nil {
 		return "", fmt.Errorf("failed to pull %s: %w", imageAndTag, err)
 	}
@@ -280,7 +436,7 @@ func (um *UpdateManager) extractVersionLabel(imageAndTag string) (string, error)
 	um.logger.Debug("pulled image: %s", imageAndTag)
 
 	// Get standard OCI version annotation
-	cmd = exec.Command("podman", "inspect", "--format", "{{index .Config.Labels \"org.opencontainers.image.version\"}}", imageAndTag)
+	cmd = um.podman(ctx, "inspect", "--format", "{{index .Config.Labels \"org.opencontainers.image.version\"}}", imageAndTag)
 	output, err := cmd.Output()
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
@@ -305,43 +461,104 @@ type SignatureData struct {
 	Signature string
 }
 
+// labels of a signature container
+const (
+	labelDigest    = "energy.shem.digest"
+	labelPublicKey = "energy.shem.pubkey"
+	labelSignature = "energy.shem.signature"
+	labelRollout   = "energy.shem.rollout"
+)
+
+// signedMessage returns the message that is signed for the binary image baseImage:tag with the
+// given digest, e.g. "quay.io/shem/meter:1.0.0-amd64 sha256:3b4c..."
+func signedMessage(baseImage, tag, digest string) string {
+	return baseImage + ":" + tag + " " + digest
+}
+
+// splitImage splits an image name into the registry host and the repository path
+// The registry is empty for unqualified images like "shem/meter", which podman resolves using the
+// configured search registries.
+func splitImage(image string) (registry, repository string) {
+	first, rest, found := strings.Cut(image, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first, rest
+	}
+	return "", image
+}
+
+// signatureImage returns the name of the signature image that belongs to an image
+// The signature image must be in the same registry and namespace as the image, so that a signature
+// from one trust domain can never vouch for a binary from another. This rules out unqualified
+// images, because podman may resolve the image and the signature image to different registries.
+func signatureImage(baseImage string) (string, error) {
+	registry, repository := splitImage(baseImage)
+	if registry == "" || repository == "" {
+		return "", fmt.Errorf("image %q does not include a registry host and repository", baseImage)
+	}
+	if strings.ContainsAny(repository, ":@") {
+		return "", fmt.Errorf("image %q must not contain a tag or digest", baseImage)
+	}
+
+	sigImage := baseImage + "-sig"
+	sigRegistry, sigRepository := splitImage(sigImage)
+	if sigRegistry != registry || path.Dir(path.Clean(sigRepository)) != path.Dir(path.Clean(repository)) {
+		return "", fmt.Errorf("signature image %s is not in the same registry and namespace as image %s", sigImage, baseImage)
+	}
+	return sigImage, nil
+}
+
 // verifyAndPullImage pulls a signature container, verifies its signature, and pulls the binary container
-func (um *UpdateManager) verifyAndPullImage(baseImage, tag, modulePublicKey string) error {
-	sigImage := baseImage + "-sig:" + tag
+// With the orchestrator option OfflineUpdates, both containers must already be in local storage
+// and nothing is pulled.
+func (um *UpdateManager) verifyAndPullImage(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error {
+	offline := um.currentConfig().OfflineUpdates
+	sigImage, err := signatureImage(baseImage)
+	if err != nil {
+		return err
+	}
+	sigImage += ":" + tag
 
 	// Pull the signature container
-	um.logger.Debug("pulling signature container: %s", sigImage)
-	cmd := exec.Command("podman", "pull", sigImage)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to pull signature container %s: %w", sigImage, err)
+	if offline {
+		um.logger.Debug("using staged signature container: %s", sigImage)
+	} else {
+		um.logger.Debug("pulling signature container: %s", sigImage)
+		if err := um.podman(ctx, "pull", sigImage).Run(); err != nil {
+			return fmt.Errorf("failed to pull signature container %s: %w", sigImage, err)
+		}
 	}
 
 	// Extract signature data from the container
-	sigData, err := um.extractSignatureData(sigImage)
+	sigData, err := um.extractSignatureData(ctx, sigImage)
 	if err != nil {
 		return fmt.Errorf("failed to extract signature data from %s: %w", sigImage, err)
 	}
 
 	// Verify the signature
-	if err := um.verifySignature(baseImage, tag, sigData, modulePublicKey); err != nil {
+	if err := um.verifySignature(baseImage, tag, sigData, modulePublicKeys); err != nil {
 		return fmt.Errorf("signature verification failed for %s:%s: %w", baseImage, tag, err)
 	}
 
 	um.logger.Info("signature verified for %s:%s", baseImage, tag)
 
 	// Pull the binary container by digest
+	// The staged binary container is only used if it has the signed digest
 	binaryImage := baseImage + "@" + sigData.Digest
-	um.logger.Debug("pulling binary container: %s", binaryImage)
-	cmd = exec.Command("podman", "pull", binaryImage)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to pull binary container %s: %w", binaryImage, err)
+	if offline {
+		if err := um.podman(ctx, "image", "exists", binaryImage).Run(); err != nil {
+			return fmt.Errorf("binary container %s is not in local storage: %w", binaryImage, err)
+		}
+	} else {
+		um.logger.Debug("pulling binary container: %s", binaryImage)
+		if err := um.podman(ctx, "pull", binaryImage).Run(); err != nil {
+			return fmt.Errorf("failed to pull binary container %s: %w", binaryImage, err)
+		}
 	}
 
 	// Tag the digest-pulled image with version tag (findLocalVersions searches for tags)
 	versionTag := baseImage + ":" + tag
 	um.logger.Debug("tagging image %s as %s", binaryImage, versionTag)
-	cmd = exec.Command("podman", "tag", binaryImage, versionTag)
-	if err := cmd.Run(); err != nil {
+	if err := um.podman(ctx, "tag", binaryImage, versionTag).Run(); err != nil {
 		um.logger.Warn("failed to tag image %s as %s: %v", binaryImage, versionTag, err)
 	}
 
@@ -350,9 +567,9 @@ func (um *UpdateManager) verifyAndPullImage(baseImage, tag, modulePublicKey stri
 }
 
 // extractSignatureData extracts digest, public key, and signature from signature container labels
-func (um *UpdateManager) extractSignatureData(sigImage string) (*SignatureData, error) {
+func (um *UpdateManager) extractSignatureData(ctx context.Context, sigImage string) (*SignatureData, error) {
 	// Extract digest
-	digestCmd := exec.Command("podman", "inspect", "--format", "{{index .Config.Labels \"energy.shem.digest\"}}", sigImage)
+	digestCmd := um.podman(ctx, "inspect", "--format", "{{index .Config.Labels \""+labelDigest+"\"}}", sigImage)
 	digestOutput, err := digestCmd.Output()
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
@@ -367,7 +584,7 @@ func (um *UpdateManager) extractSignatureData(sigImage string) (*SignatureData,
 	}
 
 	// Extract public key
-	pubkeyCmd := exec.Command("podman", "inspect", "--format", "{{index .Config.Labels \"energy.shem.pubkey\"}}", sigImage)
+	pubkeyCmd := um.podman(ctx, "inspect", "--format", "{{index .Config.Labels \""+labelPublicKey+"\"}}", sigImage)
 	pubkeyOutput, err := pubkeyCmd.Output()
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
@@ -382,7 +599,7 @@ func (um *UpdateManager) extractSignatureData(sigImage string) (*SignatureData,
 	}
 
 	// Extract signature
-	sigCmd := exec.Command("podman", "inspect", "--format", "{{index .Config.Labels \"energy.shem.signature\"}}", sigImage)
+	sigCmd := um.podman(ctx, "inspect", "--format", "{{index .Config.Labels \""+labelSignature+"\"}}", sigImage)
 	sigOutput, err := sigCmd.Output()
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
@@ -403,16 +620,56 @@ func (um *UpdateManager) extractSignatureData(sigImage string) (*SignatureData,
 	}, nil
 }
 
+// rolloutPercentage returns the percentage of devices that a version is rolled out to, taken from
+// the rollout label of its signature container, which must have been pulled already. Without the
+// label, the version is rolled out to all devices.
+func (um *UpdateManager) rolloutPercentage(ctx context.Context, baseImage, tag string) (int, error) {
+	sigImage, err := signatureImage(baseImage)
+	if err != nil {
+		return 0, err
+	}
+	sigImage += ":" + tag
+	output, err := um.podman(ctx, "inspect", "--format", "{{index .Config.Labels \""+labelRollout+"\"}}", sigImage).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return 0, fmt.Errorf("failed to extract rollout: %w, %s", err, ee.Stderr)
+		}
+		return 0, fmt.Errorf("failed to extract rollout: %w", err)
+	}
+	label := strings.TrimSpace(string(output))
+	if label == "" || label == "<no value>" {
+		return 100, nil
+	}
+	percentage, err := strconv.Atoi(label)
+	if err != nil || percentage < 0 || percentage > 100 {
+		return 0, fmt.Errorf("invalid rollout %q in %s, must be between 0 and 100", label, sigImage)
+	}
+	return percentage, nil
+}
+
+// inRollout reports whether a device in cohort receives a version rolled out to rollout percent
+// of the devices. Devices in lower cohorts receive versions first; a complete rollout (100)
+// reaches all cohorts.
+func inRollout(cohort, rollout int) bool {
+	return rollout >= 100 || cohort < rollout
+}
+
 // verifySignature verifies the Ed25519 signature against the expected message
-func (um *UpdateManager) verifySignature(baseImage, tag string, sigData *SignatureData, modulePublicKey string) error {
-	// Check if the public key in the signature matches the module's public key
-	if sigData.PublicKey != modulePublicKey {
-		return fmt.Errorf("public key mismatch: container has %s, module expects %s",
-			sigData.PublicKey, modulePublicKey)
+// The signature must have been made with one of the module's public keys.
+func (um *UpdateManager) verifySignature(baseImage, tag string, sigData *SignatureData, modulePublicKeys []string) error {
+	// Check if the public key in the signature matches one of the module's public keys
+	if !slices.Contains(modulePublicKeys, sigData.PublicKey) {
+		fingerprints := make([]string, len(modulePublicKeys))
+		for i, key := range modulePublicKeys {
+			fingerprints[i] = keyFingerprint(key)
+		}
+		um.logger.Debug("public key mismatch: container has %s, module expects %s", sigData.PublicKey, strings.Join(modulePublicKeys, ", "))
+		return fmt.Errorf("public key mismatch: container has key %s, module expects key %s",
+			keyFingerprint(sigData.PublicKey), strings.Join(fingerprints, " or "))
 	}
 
 	// Decode the base64 public key
-	pubKeyBytes, err := base64.StdEncoding.DecodeString(modulePublicKey)
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(sigData.PublicKey)
 	if err != nil {
 		return fmt.Errorf("failed to decode public key: %w", err)
 	}
@@ -430,7 +687,7 @@ func (um *UpdateManager) verifySignature(baseImage, tag string, sigData *Signatu
 	}
 
 	// Construct the message that was signed: "baseImage:version digest"
-	message := baseImage + ":" + tag + " " + sigData.Digest
+	message := signedMessage(baseImage, tag, sigData.Digest)
 
 	// Verify the signature
 	publicKey := ed25519.PublicKey(pubKeyBytes)
@@ -442,36 +699,52 @@ func (um *UpdateManager) verifySignature(baseImage, tag string, sigData *Signatu
 	return nil
 }
 
+// keyFingerprint returns a short, stable identifier for a base64 encoded public key for use in log
+// messages: the first 8 hex digits of the SHA-256 hash of the key bytes
+// Keys that are not valid base64 are hashed as they are
+func keyFingerprint(publicKey string) string {
+	keyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		keyBytes = []byte(publicKey)
+	}
+	hash := sha256.Sum256(keyBytes)
+	return hex.EncodeToString(hash[:4])
+}
+
 // findLatestEligibleVersion finds the latest eligible version of a module
 // according to the update mechanism specification. It enumerates available versions
 // using findRemoteVersions, then selects the highest version that is not blacklisted
 // and higher than the specified minimum version.
-func (um *UpdateManager) findLatestEligibleVersion(image string, minimumVersion string, blacklist map[string]struct{}) (string, error) {
+// If there is none, the error matches errNoRemoteVersions, errOnlyBlacklisted or errNoNewerVersion;
+// any other error means the registry could not be queried.
+func (um *UpdateManager) findLatestEligibleVersion(ctx context.Context, image string, minimumVersion string, blacklist map[string]struct{}) (string, error) {
 	// Get available versions using findRemoteVersions
-	versionsMap, err := um.findRemoteVersions(image)
+	versionsMap, err := um.remoteVersions(ctx, image)
 	if err != nil {
 		return "", fmt.Errorf("failed to find remote versions for image %s: %w", image, err)
 	}
 
 	if len(versionsMap) == 0 {
-		return "", fmt.Errorf("no versions found for image %s", image)
+		return "", fmt.Errorf("%w for image %s", errNoRemoteVersions, image)
 	}
 
 	// Find the latest eligible version
 	var latestVersion string
+	skippedBlacklisted := false
 	for version := range versionsMap {
-		// Skip if version is blacklisted
-		if _, isBlacklisted := blacklist[version]; isBlacklisted {
-			um.logger.Debug("skipping blacklisted version %s for image %s", version, image)
-			continue
-		}
-
 		// Skip if version is not higher than minimum version
 		if minimumVersion != "" && compareVersions(version, minimumVersion) <= 0 {
 			um.logger.Debug("skipping version %s for image %s (not higher than minimum %s)", version, image, minimumVersion)
 			continue
 		}
 
+		// Skip if version is blacklisted
+		if _, isBlacklisted := blacklist[version]; isBlacklisted {
+			um.logger.Debug("skipping blacklisted version %s for image %s", version, image)
+			skippedBlacklisted = true
+			continue
+		}
+
 		// Compare with current latest candidate
 		if latestVersion == "" {
 			latestVersion = version
@@ -483,7 +756,10 @@ func (um *UpdateManager) findLatestEligibleVersion(image string, minimumVersion
 	}
 
 	if latestVersion == "" {
-		return "", fmt.Errorf("no eligible version found for image %s (minimum: %s)", image, minimumVersion)
+		if skippedBlacklisted {
+			return "", fmt.Errorf("%w for image %s (minimum: %s)", errOnlyBlacklisted, image, minimumVersion)
+		}
+		return "", fmt.Errorf("%w for image %s (minimum: %s)", errNoNewerVersion, image, minimumVersion)
 	}
 
 	um.logger.Info("found latest eligible version %s for image %s (minimum: %s)", latestVersion, image, minimumVersion)
@@ -493,7 +769,7 @@ func (um *UpdateManager) findLatestEligibleVersion(image string, minimumVersion
 // extractVersionAndArch extracts both version and architecture from a tag
 // Assumes version format is x.y.z-arch, returns version and architecture separately
 // For example: "1.2.3-amd64" -> ("1.2.3", "amd64")
-func (um *UpdateManager) extractVersionAndArch(tag string) (string, string, error) {
+func extractVersionAndArch(tag string) (string, string, error) {
 	dashIndex := strings.Index(tag, "-")
 	if dashIndex == -1 {
 		return "", "", fmt.Errorf("no dash in tag '%s'", tag)
@@ -520,21 +796,29 @@ func (um *UpdateManager) currentModuleVersion(moduleName string) string {
 }
 
 // checkAndScheduleUpdates checks for updates for all modules and schedules them
-func (um *UpdateManager) checkAndScheduleUpdates() error {
+func (um *UpdateManager) checkAndScheduleUpdates(ctx context.Context) error {
 	// Load modules configuration
 	moduleNames, err := um.configManager.ListModules()
 	if err != nil {
 		um.logger.Error("failed to list modules: %v", err)
 	}
 
+	if len(moduleNames) == 0 {
+		um.logger.Debug("no modules configured, nothing to update")
+		return nil
+	}
 	um.logger.Info("checking for updates for %d modules", len(moduleNames))
 
 	// Iterate through all modules
 	for _, moduleName := range moduleNames {
+		if err := ctx.Err(); err != nil {
+			return err // shutting down
+		}
 		moduleConfig, _ := um.configManager.NewModuleConfig(moduleName)
 
 		// Skip disabled modules
 		if moduleConfig.KeyExists("disabled") {
+			um.recordCheck(moduleName, UpdateCheckResult{Reason: UpdateCheckDisabled})
 			continue
 		}
 
@@ -547,51 +831,100 @@ func (um *UpdateManager) checkAndScheduleUpdates() error {
 			}
 		}
 
+		// Get current version of the module
+		currentVersion := um.currentModuleVersion(moduleName)
+
 		// Get image name
 		image, _ := moduleConfig.GetString("image", "")
 		if image == "" {
+			um.recordCheck(moduleName, UpdateCheckResult{Reason: UpdateCheckNoImage, CurrentVersion: currentVersion})
 			continue
 		}
 
 		// Skip modules without public key (no auto-updates)
-		publicKey, _ := moduleConfig.GetString("public_key", "")
-		if publicKey == "" {
+		// A malformed key would only show up as failed verifications of every version
+		publicKeys, err := moduleConfig.GetPublicKeys()
+		if err != nil {
+			um.logger.Error("not checking module %s for updates: %v", moduleName, err)
+			um.recordCheck(moduleName, UpdateCheckResult{Reason: UpdateCheckInvalidPublicKey, CurrentVersion: currentVersion, Details: err.Error()})
+			continue
+		}
+		if len(publicKeys) == 0 {
 			um.logger.Debug("no public key found for module %s, skipping auto-updates", moduleName)
+			um.recordCheck(moduleName, UpdateCheckResult{Reason: UpdateCheckNoPublicKey, CurrentVersion: currentVersion})
 			continue
 		}
 
 		um.logger.Debug("checking for updates for module: %s (image: %s)", moduleName, image)
 
-		// Get current version of the module
-		currentVersion := um.currentModuleVersion(moduleName)
-
 		// Determine minimum version (use scheduled version if exists, otherwise current)
 		minimumVersion := currentVersion
-		if scheduledVersion, exists := um.scheduledUpdates[moduleName]; exists {
-			minimumVersion = scheduledVersion
+		um.mu.Lock()
+		if scheduled, exists := um.scheduledUpdates[moduleName]; exists {
+			minimumVersion = scheduled.Version
 		}
+		um.mu.Unlock()
 
 		// Get module-specific blacklist
 		blacklist, _ := moduleConfig.GetBlacklistedVersions()
 
 		// Keep trying to find updates until we succeed or run out of versions
+		var failedVersion, failedDetails string // last version that failed verification
 		for {
 			// Find the latest eligible version
-			latestVersion, err := um.findLatestEligibleVersion(image, minimumVersion, blacklist)
+			latestVersion, err := um.findLatestEligibleVersion(ctx, image, minimumVersion, blacklist)
+			if ctx.Err() != nil {
+				return ctx.Err() // the registry was not necessarily at fault
+			}
 			if err != nil {
 				um.logger.Debug("no eligible update found for module %s: %v", image, err)
+				result := UpdateCheckResult{CurrentVersion: currentVersion, Details: err.Error()}
+				switch {
+				case failedVersion != "":
+					result.Reason = UpdateCheckVerificationFailed
+					result.Version = failedVersion
+					result.Details = failedDetails
+				case errors.Is(err, errNoRemoteVersions):
+					result.Reason = UpdateCheckNoVersions
+				case errors.Is(err, errOnlyBlacklisted):
+					result.Reason = UpdateCheckBlacklisted
+				case errors.Is(err, errNoNewerVersion):
+					result.Reason = UpdateCheckUpToDate
+					result.Details = ""
+				default:
+					result.Reason = UpdateCheckRegistryError
+				}
+				um.recordCheck(moduleName, result)
 				break // No more updates available
 			}
 
 			um.logger.Info("found potential update for module %s: %s -> %s", image, currentVersion, latestVersion)
 
 			// Try to verify and pull the binary
-			err = um.verifyAndPullImage(image, latestVersion+"-"+runtime.GOARCH, publicKey)
+			err = um.verifyAndPull(ctx, image, latestVersion+"-"+runtime.GOARCH, publicKeys)
+			if ctx.Err() != nil {
+				return ctx.Err() // an aborted pull says nothing about the version
+			}
 			if err != nil {
 				um.logger.Warn("verification failed for module %s version %s: %v", image, latestVersion, err)
-
-				// Add this version to module's blacklist and try again
+				um.notify(UpdateEvent{
+					Type:           UpdateEventVerificationFailed,
+					Module:         moduleName,
+					CurrentVersion: currentVersion,
+					NewVersion:     latestVersion,
+					Outcome:        "failure",
+					Details:        err.Error(),
+				})
+
+				// Skip this version and try again; with BlacklistExpiryHours, the following checks
+				// also skip it until the blacklist entry expires
+				failedVersion, failedDetails = latestVersion, err.Error()
 				blacklist[latestVersion] = struct{}{}
+				if expiry := time.Duration(um.currentConfig().BlacklistExpiryHours * float64(time.Hour)); expiry > 0 {
+					if err := moduleConfig.AddToBlacklistUntil(latestVersion, time.Now().Add(expiry)); err != nil {
+						um.logger.Error("failed to blacklist version %s of module %s: %v", latestVersion, moduleName, err)
+					}
+				}
 				continue
 			}
 
@@ -601,10 +934,15 @@ func (um *UpdateManager) checkAndScheduleUpdates() error {
 			// Check if we should schedule the update (skip shem-orchestrator during verification run)
 			if um.verificationRun && moduleName == "orchestrator" {
 				um.logger.Info("skipping shem-orchestrator update scheduling during verification run")
+				um.recordCheck(moduleName, UpdateCheckResult{Reason: UpdateCheckVerificationRun, CurrentVersion: currentVersion, Version: latestVersion})
+			} else if deferred, details := um.outsideRollout(ctx, moduleName, moduleConfig, image, latestVersion); deferred {
+				um.logger.Info("deferring update of module %s to version %s: %s", moduleName, latestVersion, details)
+				um.recordCheck(moduleName, UpdateCheckResult{Reason: UpdateCheckOutsideRollout, CurrentVersion: currentVersion, Version: latestVersion, Details: details})
 			} else {
 				// Schedule the update
 				um.logger.Info("scheduling update for module %s to version %s", moduleName, latestVersion)
 				um.scheduleUpdate(moduleName, latestVersion)
+				um.recordCheck(moduleName, UpdateCheckResult{Reason: UpdateCheckScheduled, CurrentVersion: currentVersion, Version: latestVersion})
 			}
 			break // Successfully found and processed an update
 		}
@@ -613,18 +951,84 @@ func (um *UpdateManager) checkAndScheduleUpdates() error {
 	return nil
 }
 
+// outsideRollout reports whether an orchestrator update to version is deferred because this device
+// is not in the staged rollout of the version yet, together with the reason. Other modules are
+// always updated. If the rollout of the version cannot be determined, the update is deferred as well.
+func (um *UpdateManager) outsideRollout(ctx context.Context, moduleName string, moduleConfig *ModuleConfig, image, version string) (bool, string) {
+	if moduleName != "orchestrator" {
+		return false, ""
+	}
+	cohort, err := moduleConfig.GetUpdateCohort()
+	if err != nil {
+		um.logger.Warn("module %s: %v", moduleName, err)
+	}
+	rollout, err := um.rollout(ctx, image, version+"-"+runtime.GOARCH)
+	if err != nil {
+		return true, err.Error()
+	}
+	if !inRollout(cohort, rollout) {
+		return true, fmt.Sprintf("rolled out to %d%% of devices, this device is in cohort %d", rollout, cohort)
+	}
+	return false, ""
+}
+
+// PendingUpdate is a verified update that has been scheduled but not applied yet
+type PendingUpdate struct {
+	Version string
+	Due     time.Time // when the random delay ends
+}
+
+// PendingUpdate returns the update of a module that waits for its random delay, if any
+// Writing the version to the module's apply_update file applies it right away.
+func (um *UpdateManager) PendingUpdate(moduleName string) (PendingUpdate, bool) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	pending, ok := um.scheduledUpdates[moduleName]
+	return pending, ok
+}
+
+// clearPendingUpdates removes the pending_update files left behind by a previous run; scheduled
+// updates do not survive a restart and are scheduled again by the next update check
+func (um *UpdateManager) clearPendingUpdates() {
+	moduleNames, _ := um.configManager.ListModules()
+	for _, moduleName := range moduleNames {
+		moduleConfig, _ := um.configManager.NewModuleConfig(moduleName)
+		if err := moduleConfig.RemoveKey("pending_update"); err != nil {
+			um.logger.Warn("failed to remove pending_update file of module %s: %v", moduleName, err)
+		}
+	}
+}
+
 // scheduleUpdate schedules a module update with a random delay up to UpdateDelayMaxHours
+// The update is recorded in the module's pending_update file until it is applied.
 func (um *UpdateManager) scheduleUpdate(moduleName, newVersion string) {
-	// Generate random delay between 0 and UpdateDelayMaxHours
-	maxDelayHours, _ := um.orchestratorConfig.GetFloat("UpdateDelayMaxHours", 96.0)
-	delayHours := rand.Float64() * maxDelayHours
-	delay := time.Duration(delayHours * float64(time.Hour))
+	moduleConfig, _ := um.configManager.NewModuleConfig(moduleName)
+	maxDelayHours, err := moduleConfig.GetUpdateDelayMaxHours(um.currentConfig().UpdateDelayMaxHours)
+	if err != nil {
+		um.logger.Warn("module %s: %v", moduleName, err)
+	}
+	delay := updateDelay(maxDelayHours)
+	delayHours := delay.Hours()
 
 	// Record the scheduled update
-	um.scheduledUpdates[moduleName] = newVersion
+	pending := PendingUpdate{Version: newVersion, Due: time.Now().Add(delay)}
+	um.mu.Lock()
+	um.scheduledUpdates[moduleName] = pending
+	um.mu.Unlock()
+	if err := moduleConfig.SetPendingUpdate(pending); err != nil {
+		um.logger.Warn("failed to record pending update of module %s: %v", moduleName, err)
+	}
 
 	um.logger.Info("update scheduled: %s -> %s (will execute in %.1f hours)",
 		moduleName, newVersion, delayHours)
+	um.notify(UpdateEvent{
+		Type:           UpdateEventScheduled,
+		Module:         moduleName,
+		CurrentVersion: um.currentModuleVersion(moduleName),
+		NewVersion:     newVersion,
+		Outcome:        "success",
+		Details:        fmt.Sprintf("will execute in %.1f hours", delayHours),
+	})
 
 	// Start a goroutine to send the update message after the delay
 	go func() {
@@ -639,13 +1043,25 @@ func (um *UpdateManager) scheduleUpdate(moduleName, newVersion string) {
 	}()
 }
 
+// updateDelay returns a random delay between 0 and maxDelayHours
+// A maximum of zero or below means that updates are applied immediately.
+func updateDelay(maxDelayHours float64) time.Duration {
+	if maxDelayHours <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Float64() * maxDelayHours * float64(time.Hour))
+}
+
 // updateModule updates the module to the newest installed version
-func (um *UpdateManager) updateModule(moduleName string) error {
+func (um *UpdateManager) updateModule(ctx context.Context, moduleName string) error {
 	// Clean up scheduled update entry
+	um.mu.Lock()
 	delete(um.scheduledUpdates, moduleName)
+	um.mu.Unlock()
 
 	// Get image name from module config
 	moduleConfig, _ := um.configManager.NewModuleConfig(moduleName)
+	moduleConfig.RemoveKey("pending_update")
 
 	image, _ := moduleConfig.GetString("image", "")
 	if image == "" {
@@ -653,7 +1069,7 @@ func (um *UpdateManager) updateModule(moduleName string) error {
 	}
 
 	// Use findLocalVersions to find all local versions
-	localVersions, err := um.findLocalVersions(image)
+	localVersions, err := um.findLocalVersions(ctx, image)
 	if err != nil {
 		return fmt.Errorf("failed to find local versions for %s: %w", image, err)
 	}
@@ -692,37 +1108,144 @@ func (um *UpdateManager) updateModule(moduleName string) error {
 		return nil
 	}
 
+	return um.applyUpdate(ctx, moduleName, moduleConfig, image, currentVersion, newestVersion)
+}
+
+// applyRequestedUpdates applies the updates requested by apply_update files, which contain the
+// version to apply; each file is removed, whether or not the update succeeds
+func (um *UpdateManager) applyRequestedUpdates(ctx context.Context) {
+	moduleNames, _ := um.configManager.ListModules()
+	for _, moduleName := range moduleNames {
+		moduleConfig, _ := um.configManager.NewModuleConfig(moduleName)
+		if !moduleConfig.KeyExists("apply_update") {
+			continue
+		}
+		version, _ := moduleConfig.GetString("apply_update", "")
+		moduleConfig.RemoveKey("apply_update")
+		if err := um.ApplyUpdateNow(ctx, moduleName, version); err != nil {
+			um.logger.Error("requested update of module %s to version %q failed: %v", moduleName, version, err)
+		}
+	}
+}
+
+// ApplyUpdateNow verifies, pulls and applies the given version of a module right away, without
+// the random delay of scheduled updates (see the apply_update file in modules.md)
+// The version must be newer than the current one and not blacklisted, and the module must have a
+// public key, as the signature is verified just like for scheduled updates. While Run is active,
+// ApplyUpdateNow must only be called from its goroutine.
+func (um *UpdateManager) ApplyUpdateNow(ctx context.Context, moduleName, version string) error {
+	moduleConfig, err := um.configManager.NewModuleConfig(moduleName)
+	if err != nil {
+		return err
+	}
+	if _, _, _, err := parseVersion(version); err != nil {
+		return err
+	}
+
+	image, _ := moduleConfig.GetString("image", "")
+	if image == "" {
+		return fmt.Errorf("no image configured for module %s", moduleName)
+	}
+	publicKeys, err := moduleConfig.GetPublicKeys()
+	if err != nil {
+		return err
+	}
+	if len(publicKeys) == 0 {
+		return fmt.Errorf("module %s has no public key, cannot verify version %s", moduleName, version)
+	}
+	if blacklisted, _ := moduleConfig.IsVersionBlacklisted(version); blacklisted {
+		return fmt.Errorf("version %s of module %s is blacklisted", version, moduleName)
+	}
+	currentVersion := um.currentModuleVersion(moduleName)
+	if currentVersion != "" && compareVersions(version, currentVersion) <= 0 {
+		return fmt.Errorf("version %s is not newer than current version %s of module %s", version, currentVersion, moduleName)
+	}
+
+	um.logger.Info("applying update for module %s to version %s now", moduleName, version)
+	if err := um.verifyAndPull(ctx, image, version+"-"+runtime.GOARCH, publicKeys); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("update of module %s to version %s aborted: %w", moduleName, version, ctx.Err())
+		}
+		um.notify(UpdateEvent{
+			Type:           UpdateEventVerificationFailed,
+			Module:         moduleName,
+			CurrentVersion: currentVersion,
+			NewVersion:     version,
+			Outcome:        "failure",
+			Details:        err.Error(),
+		})
+		return fmt.Errorf("verification failed for module %s version %s: %w", moduleName, version, err)
+	}
+
+	// A scheduled update to this or an older version is superseded
+	um.mu.Lock()
+	if scheduled, ok := um.scheduledUpdates[moduleName]; ok && compareVersions(scheduled.Version, version) <= 0 {
+		delete(um.scheduledUpdates, moduleName)
+		moduleConfig.RemoveKey("pending_update")
+	}
+	um.mu.Unlock()
+
+	return um.applyUpdate(ctx, moduleName, moduleConfig, image, currentVersion, version)
+}
+
+// applyUpdate switches a module to newVersion, which must have been pulled already
+// Other modules are restarted by the module manager; the orchestrator extracts its new binary and
+// restarts itself.
+func (um *UpdateManager) applyUpdate(ctx context.Context, moduleName string, moduleConfig *ModuleConfig, image, currentVersion, newestVersion string) error {
 	if moduleName != "orchestrator" {
 		// For non-orchestrator modules: update config to trigger module-manager restart
-		// Write fallback_version only if it doesn't exist (preserve last confirmed version)
-		existingFallback, _ := moduleConfig.GetString("fallback_version", "")
-		if existingFallback == "" && currentVersion != "" {
-			if err := moduleConfig.SetString("fallback_version", currentVersion); err != nil {
-				return fmt.Errorf("failed to write fallback_version for %s: %w", moduleName, err)
-			}
-		}
-		// Write new current_version — module-manager will detect the change and restart
-		if err := moduleConfig.SetString("current_version", newestVersion); err != nil {
-			return fmt.Errorf("failed to write current_version for %s: %w", moduleName, err)
+		if err := moduleConfig.ApplyVersion(newestVersion); err != nil {
+			return fmt.Errorf("failed to apply version %s to module %s: %w", newestVersion, moduleName, err)
 		}
 		um.logger.Info("updated module %s: %s -> %s", moduleName, currentVersion, newestVersion)
+		um.notifyApplied(moduleName, currentVersion, newestVersion)
 		um.scheduleConfirmation(moduleName)
 		return nil
 	}
 
 	// Extract the orchestrator binary from the image directly to target location
 	targetPath := filepath.Join(um.shemHome, "bin", "shem-orchestrator-"+newestVersion)
-	err = um.extractBinaryFromImage(image, newestVersion+"-"+runtime.GOARCH, targetPath)
+	err := um.extractBinaryFromImage(ctx, image, newestVersion+"-"+runtime.GOARCH, targetPath)
 	if err != nil {
 		return fmt.Errorf("failed to extract binary from image %s:%s: %w", image, newestVersion, err)
 	}
 
+	if err := verifyExecutable(targetPath); err != nil {
+		os.Remove(targetPath)
+		if blacklistErr := moduleConfig.AddToBlacklist(newestVersion); blacklistErr != nil {
+			um.logger.Error("failed to blacklist orchestrator version %s: %v", newestVersion, blacklistErr)
+		}
+		return fmt.Errorf("extracted binary for version %s is not usable, blacklisted it: %w", newestVersion, err)
+	}
+
 	um.logger.Info("successfully extracted orchestrator binary for version %s", newestVersion)
+	um.notifyApplied(moduleName, currentVersion, newestVersion)
 
 	// Trigger restart of orchestrator
 	return um.triggerOrchestratorRestart(newestVersion)
 }
 
+// notifyApplied reports a successfully applied update
+func (um *UpdateManager) notifyApplied(moduleName, currentVersion, newVersion string) {
+	um.mu.Lock()
+	um.applied++
+	um.mu.Unlock()
+	um.notify(UpdateEvent{
+		Type:           UpdateEventApplied,
+		Module:         moduleName,
+		CurrentVersion: currentVersion,
+		NewVersion:     newVersion,
+		Outcome:        "success",
+	})
+}
+
+// AppliedUpdates returns the number of updates applied since the start
+func (um *UpdateManager) AppliedUpdates() int {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	return um.applied
+}
+
 // scheduleConfirmation sets a confirmation time for a module update (10 minutes from now)
 func (um *UpdateManager) scheduleConfirmation(moduleName string) {
 	um.confirmationTimes[moduleName] = time.Now().Add(10 * time.Minute)
@@ -741,33 +1264,150 @@ func (um *UpdateManager) confirmUpdate(moduleName string) {
 }
 
 // extractBinaryFromImage extracts the /shem-orchestrator binary from a container image to targetPath
-func (um *UpdateManager) extractBinaryFromImage(image, tag, targetPath string) error {
+// The copy fails after extractTimeout, so that a stuck copy cannot block updates forever.
+// While copying, the number of bytes written so far is logged every extractProgressInterval.
+// The container and the temporary copy get unique names, so that concurrent or retried extractions
+// of the same tag cannot remove each other's container or overwrite each other's file; targetPath
+// only appears once the binary has been copied completely.
+func (um *UpdateManager) extractBinaryFromImage(ctx context.Context, image, tag, targetPath string) error {
 	// Create a temporary container from the image
 	imageAndTag := image + ":" + tag
-	containerName := "shem-orchestrator-extract-" + tag
+	suffix := extractSuffix()
+	containerName := "shem-orchestrator-extract-" + tag + "-" + suffix
+	tmpPath := targetPath + ".tmp-" + suffix
 
 	// Create container without starting it
-	cmd := exec.Command("podman", "create", "--replace", "--name", containerName, imageAndTag, "/bin/true")
-	if err := cmd.Run(); err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			return fmt.Errorf("failed to create container from image %s: %w, %s", imageAndTag, err, ee.Stderr)
-		} else {
-			return fmt.Errorf("failed to create container from image %s: %w", imageAndTag, err)
+	cmd := um.podman(ctx, "create", "--name", containerName, imageAndTag, "/bin/true")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("creating container from image %s aborted: %w", imageAndTag, ctx.Err())
 		}
+		return fmt.Errorf("failed to create container from image %s: %w, %s", imageAndTag, err, bytes.TrimSpace(output))
 	}
 
-	// Ensure container is removed on exit
+	// Ensure container is removed on exit, even if the extraction timed out
 	defer func() {
-		exec.Command("podman", "rm", containerName).Run()
+		rmCtx, rmCancel := context.WithTimeout(context.Background(), notificationTimeout)
+		defer rmCancel()
+		um.podman(rmCtx, "rm", containerName).Run()
 	}()
 
-	// Copy the binary directly to the target path
-	cmd = exec.Command("podman", "cp", containerName+":/shem-orchestrator", targetPath)
-	if err := cmd.Run(); err != nil {
+	// Copy the binary to a temporary file next to the target path
+	ctx, cancel := context.WithTimeout(ctx, um.extractTimeout)
+	defer cancel()
+	cmd = um.podman(ctx, "cp", containerName+":/shem-orchestrator", tmpPath)
+	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to copy binary from container: %w", err)
 	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	start := time.Now()
+	ticker := time.NewTicker(um.extractProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				os.Remove(tmpPath)
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return fmt.Errorf("copying binary from container timed out after %v", um.extractTimeout)
+				}
+				if ctx.Err() != nil {
+					return fmt.Errorf("copying binary from container aborted: %w", ctx.Err())
+				}
+				return fmt.Errorf("failed to copy binary from container: %w", err)
+			}
+			size := fileSize(tmpPath)
+			if err := os.Rename(tmpPath, targetPath); err != nil {
+				os.Remove(tmpPath)
+				return fmt.Errorf("failed to move extracted binary to %s: %w", targetPath, err)
+			}
+			um.logger.Debug("extracted binary from %s to %s (%d bytes in %v)", imageAndTag, targetPath,
+				size, time.Since(start).Round(time.Millisecond))
+			return nil
+		case <-ticker.C:
+			um.logger.Info("extracting binary from %s: %d bytes copied after %v", imageAndTag,
+				fileSize(tmpPath), time.Since(start).Round(time.Second))
+		}
+	}
+}
+
+// removeStaleExtractContainers removes the containers of extractions by other processes, i.e.
+// those left over by an orchestrator that was killed while it extracted a binary. Extractions of
+// this process are not touched, as they remove their container themselves.
+func (um *UpdateManager) removeStaleExtractContainers(ctx context.Context) {
+	output, err := um.podman(ctx, "ps", "-a", "--filter", "name=shem-orchestrator-extract-", "--format", "{{.Names}}").Output()
+	if err != nil {
+		um.logger.Warn("failed to list extraction containers: %v", err)
+		return
+	}
+	own := fmt.Sprintf("-%d", os.Getpid())
+	for name := range strings.FieldsSeq(string(output)) {
+		// the name ends with the suffix of extractSuffix, i.e. the process id and a random number
+		if !strings.HasPrefix(name, "shem-orchestrator-extract-") || strings.HasSuffix(name[:strings.LastIndex(name, "-")], own) {
+			continue
+		}
+		um.logger.Info("removing stale extraction container %s", name)
+		if output, err := um.podman(ctx, "rm", "-f", name).CombinedOutput(); err != nil {
+			um.logger.Warn("failed to remove container %s: %v, %s", name, err, bytes.TrimSpace(output))
+		}
+	}
+}
+
+// extractSuffix returns a suffix for the names of an extraction's container and temporary file that
+// differs between processes and between extractions within a process
+func extractSuffix() string {
+	return fmt.Sprintf("%d-%08x", os.Getpid(), rand.Uint32())
+}
 
-	um.logger.Debug("extracted binary from %s to %s", imageAndTag, targetPath)
+// fileSize returns the size of the file at path, or 0 if it does not exist (yet)
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// elfMachines maps GOARCH values to the ELF machine type of their binaries
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"riscv64": elf.EM_RISCV,
+}
+
+// verifyExecutable checks that path is an ELF executable for the current architecture and sets
+// the executable bits if they are missing
+func verifyExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return fmt.Errorf("%s is not a regular, non-empty file", path)
+	}
+
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s is not an ELF binary: %w", path, err)
+	}
+	defer f.Close()
+
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return fmt.Errorf("%s is not executable (ELF type %s)", path, f.Type)
+	}
+	if machine, known := elfMachines[runtime.GOARCH]; known && f.Machine != machine {
+		return fmt.Errorf("%s is built for %s, expected %s", path, f.Machine, machine)
+	}
+
+	if info.Mode().Perm()&0111 != 0111 {
+		if err := os.Chmod(path, info.Mode().Perm()|0755); err != nil {
+			return fmt.Errorf("failed to make %s executable: %w", path, err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,957 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"debug/elf"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	key := "cQyjQftwIlSGYvWjfDMzpr0B5/Lr/S8jDFfVW3hOBk0="
+
+	if got := keyFingerprint(key); got != "e1529054" {
+		t.Errorf("expected fingerprint e1529054, got %s", got)
+	}
+	if keyFingerprint(key) != keyFingerprint(key) {
+		t.Error("fingerprint is not stable")
+	}
+	if keyFingerprint(key) == keyFingerprint("AAAAQftwIlSGYvWjfDMzpr0B5/Lr/S8jDFfVW3hOBk0=") {
+		t.Error("different keys have the same fingerprint")
+	}
+	if got := keyFingerprint("not base64!"); len(got) != 8 {
+		t.Errorf("expected 8 hex digits for invalid key, got %q", got)
+	}
+}
+
+// testPublicKey is a valid Ed25519 public key for modules that are checked for updates
+const testPublicKey = "cQyjQftwIlSGYvWjfDMzpr0B5/Lr/S8jDFfVW3hOBk0="
+
+func TestVerifySignatureKeyMismatch(t *testing.T) {
+	um := &UpdateManager{logger: NewLogger("test")}
+	sigData := &SignatureData{PublicKey: "AAAAQftwIlSGYvWjfDMzpr0B5/Lr/S8jDFfVW3hOBk0="}
+
+	err := um.verifySignature("quay.io/shem/test", "0.0.1-amd64", sigData, []string{testPublicKey})
+	if err == nil {
+		t.Fatal("expected key mismatch error")
+	}
+	if !strings.Contains(err.Error(), keyFingerprint(sigData.PublicKey)) || !strings.Contains(err.Error(), "e1529054") {
+		t.Errorf("expected both fingerprints in error, got %v", err)
+	}
+	if strings.Contains(err.Error(), sigData.PublicKey) {
+		t.Errorf("expected full key to be omitted from error, got %v", err)
+	}
+
+	// any of the module's keys is accepted
+	err = um.verifySignature("quay.io/shem/test", "0.0.1-amd64", sigData, []string{testPublicKey, sigData.PublicKey})
+	if err == nil || strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("expected second key to match and the invalid signature to be rejected, got %v", err)
+	}
+}
+
+func TestSignatureImage(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string // empty if the image must be rejected
+	}{
+		{"quay.io/shem/meter", "quay.io/shem/meter-sig"},
+		{"localhost/meter", "localhost/meter-sig"},
+		{"localhost:5000/shem/meter", "localhost:5000/shem/meter-sig"},
+		{"shem/meter", ""},             // podman may resolve image and signature to different registries
+		{"meter", ""},                  // same
+		{"quay.io/", ""},               // no repository
+		{"quay.io/shem/..", ""},        // signature image would be in another namespace
+		{"quay.io/shem/meter:1", ""},   // signature image would be a tag of the image
+		{"quay.io/shem/meter@sha", ""}, // same for a digest
+	}
+	for _, tt := range tests {
+		sigImage, err := signatureImage(tt.image)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got signature image %s", tt.image, sigImage)
+			}
+		} else if err != nil || sigImage != tt.expected {
+			t.Errorf("%s: expected signature image %s, got %q, %v", tt.image, tt.expected, sigImage, err)
+		}
+	}
+}
+
+// newTestUpdateManager creates an update manager for a temporary SHEM_HOME with an orchestrator
+// config directory containing the given files
+func newTestUpdateManager(t *testing.T, orchestratorFiles map[string]string) *UpdateManager {
+	t.Helper()
+	cm := newTestModule(t, "orchestrator", orchestratorFiles)
+	return NewUpdateManager(cm, false)
+}
+
+func TestUpdateManagerWithoutOrchestratorConfig(t *testing.T) {
+	cm := newTestModule(t, "meter", map[string]string{"image": "localhost/meter", "current_version": "1.0.0"})
+	um := NewUpdateManager(cm, false)
+	if config := um.currentConfig(); config != DefaultOrchestratorConfig() {
+		t.Errorf("expected default options, got %+v", config)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		um.Run(ctx, cancel)
+	}()
+
+	um.ReloadConfig()
+	if err := um.checkAndScheduleUpdates(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if result, _ := um.LastUpdateCheck("orchestrator"); result.Reason != "" {
+		t.Errorf("expected the missing orchestrator not to be checked, got %+v", result)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update manager did not stop")
+	}
+}
+
+func TestScheduledUpdatesConcurrentAccess(t *testing.T) {
+	// run with -race to detect unsynchronized access
+	um := newTestUpdateManager(t, map[string]string{"UpdateDelayMaxHours": "0"})
+	if err := os.MkdirAll(filepath.Join(um.shemHome, "modules", "meter"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 50 {
+			um.scheduleUpdate("meter", fmt.Sprintf("0.0.%d", i))
+		}
+	})
+	wg.Go(func() {
+		for range 50 {
+			// fails because no image is configured, but removes the scheduled update first
+			um.updateModule(context.Background(), "meter")
+		}
+	})
+	wg.Wait()
+}
+
+func TestUpdateDelay(t *testing.T) {
+	for _, maxDelayHours := range []float64{0, -1, -1000} {
+		if delay := updateDelay(maxDelayHours); delay != 0 {
+			t.Errorf("UpdateDelayMaxHours=%v: expected immediate update, got delay %v", maxDelayHours, delay)
+		}
+	}
+	for range 100 {
+		if delay := updateDelay(2); delay < 0 || delay > 2*time.Hour {
+			t.Fatalf("expected delay between 0 and 2 hours, got %v", delay)
+		}
+	}
+}
+
+func TestScheduleUpdateNegativeDelay(t *testing.T) {
+	um := newTestUpdateManager(t, map[string]string{"UpdateDelayMaxHours": "-3"})
+	if delay := um.currentConfig().UpdateDelayMaxHours; delay != 0 {
+		t.Fatalf("expected UpdateDelayMaxHours to be clamped to 0, got %v", delay)
+	}
+
+	um.scheduleUpdate("meter", "1.0.1")
+	select {
+	case moduleName := <-um.updateChannel:
+		if moduleName != "meter" {
+			t.Errorf("expected update for meter, got %s", moduleName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected update to be applied immediately")
+	}
+}
+
+func TestPendingUpdate(t *testing.T) {
+	um := newTestUpdateManager(t, map[string]string{"UpdateDelayMaxHours": "96"})
+	setConfig(t, um.configManager, "meter", "image", "localhost/meter")
+	setConfig(t, um.configManager, "meter", "current_version", "1.0.0")
+	moduleConfig, _ := um.configManager.NewModuleConfig("meter")
+
+	if _, ok := um.PendingUpdate("meter"); ok {
+		t.Fatal("expected no pending update before scheduling")
+	}
+	before := time.Now()
+	um.scheduleUpdate("meter", "1.1.0")
+	pending, ok := um.PendingUpdate("meter")
+	if !ok || pending.Version != "1.1.0" || pending.Due.Before(before) || pending.Due.After(time.Now().Add(96*time.Hour)) {
+		t.Fatalf("expected update to 1.1.0 within 96 hours to be pending, got %+v, %v", pending, ok)
+	}
+	recorded, ok, err := moduleConfig.GetPendingUpdate()
+	if err != nil || !ok || recorded.Version != "1.1.0" || !recorded.Due.Equal(pending.Due.Truncate(time.Second)) {
+		t.Errorf("expected pending_update file to match %+v, got %+v, %v, %v", pending, recorded, ok, err)
+	}
+
+	var out bytes.Buffer
+	if err := listPendingUpdates(&out, um.configManager); err != nil {
+		t.Fatal(err)
+	}
+	expected := "MODULE  CURRENT  PENDING  DUE\n" +
+		"meter   1.0.0    1.1.0    " + recorded.Due.Format(time.RFC3339) + "\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	// applying the update ends it, whether or not it succeeds
+	um.updateModule(context.Background(), "meter")
+	if _, ok := um.PendingUpdate("meter"); ok || moduleConfig.KeyExists("pending_update") {
+		t.Error("expected no pending update once it has been applied")
+	}
+
+	// scheduled updates do not survive a restart
+	moduleConfig.SetPendingUpdate(pending)
+	NewUpdateManager(um.configManager, false).clearPendingUpdates()
+	if moduleConfig.KeyExists("pending_update") {
+		t.Error("expected pending_update file of the previous run to be removed")
+	}
+}
+
+func TestScheduleUpdateModuleDelay(t *testing.T) {
+	um := newTestUpdateManager(t, map[string]string{"UpdateDelayMaxHours": "96"})
+	setConfig(t, um.configManager, "meter", "update_delay_max_hours", "0")
+	setConfig(t, um.configManager, "optimizer", "update_delay_max_hours", "") // empty file is ignored
+	setConfig(t, um.configManager, "gui", "update_delay_max_hours", "a week")
+
+	for _, moduleName := range []string{"optimizer", "gui", "meter"} {
+		um.scheduleUpdate(moduleName, "1.0.1")
+	}
+	select {
+	case moduleName := <-um.updateChannel:
+		if moduleName != "meter" {
+			t.Errorf("expected immediate update for meter only, got %s", moduleName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected update of meter to be applied immediately")
+	}
+	select {
+	case moduleName := <-um.updateChannel:
+		t.Errorf("expected update of %s to be delayed", moduleName)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mc, _ := um.configManager.NewModuleConfig("gui")
+	if hours, err := mc.GetUpdateDelayMaxHours(96); err == nil || hours != 96 {
+		t.Errorf("expected invalid override to be reported and replaced by the default, got %v, %v", hours, err)
+	}
+	setConfig(t, um.configManager, "gui", "update_delay_max_hours", "-2")
+	if hours, err := mc.GetUpdateDelayMaxHours(96); err == nil || hours != 0 {
+		t.Errorf("expected negative override to be clamped to 0 like UpdateDelayMaxHours, got %v, %v", hours, err)
+	}
+}
+
+// copyTestBinary copies the running test binary, which is a valid executable for this
+// architecture, to a temporary file with the given permissions
+func copyTestBinary(t *testing.T, perm os.FileMode) string {
+	t.Helper()
+	data, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "shem-orchestrator-1.0.0")
+	if err := os.WriteFile(path, data, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyExecutable(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		path := copyTestBinary(t, 0644)
+		if err := verifyExecutable(path); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info, _ := os.Stat(path); info.Mode().Perm()&0111 != 0111 {
+			t.Errorf("expected executable bits to be set, got %v", info.Mode())
+		}
+	})
+
+	t.Run("wrong architecture", func(t *testing.T) {
+		path := copyTestBinary(t, 0755)
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// e_machine is at offset 18; EM_S390 is not a supported architecture
+		if _, err := f.WriteAt([]byte{byte(elf.EM_S390), 0}, 18); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if err := verifyExecutable(path); err == nil {
+			t.Error("expected error for binary of another architecture")
+		}
+	})
+
+	invalid := map[string][]byte{
+		"empty":   {},
+		"corrupt": []byte("\x7fELF but not really"),
+		"script":  []byte("#!/bin/sh\necho hello\n"),
+	}
+	for name, content := range invalid {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "shem-orchestrator-1.0.0")
+			if err := os.WriteFile(path, content, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyExecutable(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		if err := verifyExecutable(filepath.Join(t.TempDir(), "missing")); err == nil {
+			t.Error("expected error for missing file")
+		}
+	})
+}
+
+func TestRemoteVersionsForArch(t *testing.T) {
+	um := newTestUpdateManager(t, nil)
+	tags := []string{"1.0.0-amd64", "1.0.0-arm64", "1.1.0-arm64", "latest-amd64", "latest-arm64"}
+	// 1.2.0 is missing from the list of tags, which might be incomplete
+	tagExists := func(tag string) bool {
+		return tag == "1.2.0-amd64"
+	}
+
+	tests := []struct {
+		name          string
+		latestVersion string
+		expected      []string
+		expectError   bool
+	}{
+		{"latest has a tag for the arch", "1.0.0", []string{"1.0.0"}, false},
+		{"latest has an unlisted tag for the arch", "1.2.0", []string{"1.0.0", "1.2.0"}, false},
+		{"no latest version", "", []string{"1.0.0"}, false},
+		{"latest exists only for another arch", "1.1.0", []string{"1.0.0"}, true},
+		{"invalid latest version", "next", []string{"1.0.0"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions, err := um.remoteVersionsForArch(tags, tt.latestVersion, "amd64", tagExists)
+			if (err != nil) != tt.expectError {
+				t.Errorf("expected error: %v, got %v", tt.expectError, err)
+			}
+			if got := slices.Sorted(maps.Keys(versions)); !slices.Equal(got, tt.expected) {
+				t.Errorf("expected versions %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestLastUpdateCheck(t *testing.T) {
+	registryErr := errors.New("connection refused")
+	tests := []struct {
+		name           string
+		files          map[string]string
+		remoteVersions []string
+		remoteErr      error
+		verifyFails    map[string]bool
+		want           UpdateCheckReason
+		wantVersion    string
+	}{
+		{name: "disabled", files: map[string]string{"image": "localhost/meter", "disabled": ""}, want: UpdateCheckDisabled},
+		{name: "no image", files: map[string]string{"image": ""}, want: UpdateCheckNoImage},
+		{name: "no public key", files: map[string]string{"public_key": ""}, want: UpdateCheckNoPublicKey},
+		{name: "invalid public key", files: map[string]string{"public_key": testPublicKey + "\nkey"}, want: UpdateCheckInvalidPublicKey},
+		{name: "registry error", remoteErr: registryErr, want: UpdateCheckRegistryError},
+		{name: "no versions", want: UpdateCheckNoVersions},
+		{name: "up to date", remoteVersions: []string{"0.9.0", "1.0.0"}, want: UpdateCheckUpToDate},
+		{name: "blacklisted", files: map[string]string{"blacklist": "1.1.0\n"}, remoteVersions: []string{"1.0.0", "1.1.0"}, want: UpdateCheckBlacklisted},
+		{
+			name:           "verification failed",
+			remoteVersions: []string{"1.1.0", "1.2.0"},
+			verifyFails:    map[string]bool{"1.1.0": true, "1.2.0": true},
+			want:           UpdateCheckVerificationFailed,
+			wantVersion:    "1.1.0",
+		},
+		{
+			name:           "scheduled after failed verification",
+			remoteVersions: []string{"1.1.0", "1.2.0"},
+			verifyFails:    map[string]bool{"1.2.0": true},
+			want:           UpdateCheckScheduled,
+			wantVersion:    "1.1.0",
+		},
+		{name: "scheduled", remoteVersions: []string{"1.0.0", "1.2.0"}, want: UpdateCheckScheduled, wantVersion: "1.2.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			um := newTestUpdateManager(t, map[string]string{"UpdateDelayMaxHours": "0"})
+			files := map[string]string{
+				"image":           "localhost/meter",
+				"public_key":      testPublicKey,
+				"current_version": "1.0.0",
+			}
+			maps.Copy(files, tt.files)
+			for key, value := range files {
+				setConfig(t, um.configManager, "meter", key, value)
+			}
+			um.remoteVersions = func(ctx context.Context, image string) (map[string]struct{}, error) {
+				versions := make(map[string]struct{})
+				for _, v := range tt.remoteVersions {
+					versions[v] = struct{}{}
+				}
+				return versions, tt.remoteErr
+			}
+			um.verifyAndPull = func(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error {
+				if tt.verifyFails[strings.TrimSuffix(tag, "-"+runtime.GOARCH)] {
+					return errors.New("invalid signature")
+				}
+				return nil
+			}
+
+			if err := um.checkAndScheduleUpdates(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			result, ok := um.LastUpdateCheck("meter")
+			if !ok {
+				t.Fatal("no update check recorded")
+			}
+			if result.Reason != tt.want || result.Version != tt.wantVersion {
+				t.Errorf("got reason %q version %q, want %q version %q", result.Reason, result.Version, tt.want, tt.wantVersion)
+			}
+			if tt.want == UpdateCheckRegistryError && !strings.Contains(result.Details, registryErr.Error()) {
+				t.Errorf("details %q do not contain the registry error", result.Details)
+			}
+		})
+	}
+}
+
+func TestVerificationFailureBlacklisted(t *testing.T) {
+	for _, expiry := range []string{"", "24"} {
+		um := newTestUpdateManager(t, map[string]string{"UpdateDelayMaxHours": "0", "BlacklistExpiryHours": expiry})
+		for key, value := range map[string]string{
+			"image":           "localhost/meter",
+			"public_key":      testPublicKey,
+			"current_version": "1.0.0",
+		} {
+			setConfig(t, um.configManager, "meter", key, value)
+		}
+		um.remoteVersions = func(ctx context.Context, image string) (map[string]struct{}, error) {
+			return map[string]struct{}{"1.1.0": {}}, nil
+		}
+		var verified int
+		um.verifyAndPull = func(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error {
+			verified++
+			return errors.New("connection reset")
+		}
+
+		for range 2 {
+			if err := um.checkAndScheduleUpdates(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		moduleConfig, _ := um.configManager.NewModuleConfig("meter")
+		blacklist, _ := moduleConfig.GetLines("blacklist")
+		if expiry == "" {
+			// without the option, the version is tried again by the next check
+			if verified != 2 || len(blacklist) != 0 {
+				t.Errorf("expected two verifications and no blacklist, got %d and %q", verified, blacklist)
+			}
+			continue
+		}
+		// with the option, the version is skipped until the entry expires
+		if verified != 1 || len(blacklist) != 1 || !strings.HasPrefix(blacklist[0], "1.1.0 ") {
+			t.Fatalf("expected one verification and a blacklist entry with a time, got %d and %q", verified, blacklist)
+		}
+		until, err := time.Parse(time.RFC3339, strings.Fields(blacklist[0])[1])
+		if err != nil || until.Before(time.Now().Add(23*time.Hour)) || until.After(time.Now().Add(24*time.Hour)) {
+			t.Errorf("expected the entry to expire in 24 hours, got %q", blacklist[0])
+		}
+	}
+}
+
+func TestLastUpdateCheckVerificationRun(t *testing.T) {
+	um := newTestUpdateManager(t, map[string]string{
+		"image":      "localhost/shem-orchestrator",
+		"public_key": testPublicKey,
+	})
+	um.verificationRun = true
+	um.remoteVersions = func(ctx context.Context, image string) (map[string]struct{}, error) {
+		return map[string]struct{}{"999.0.0": {}}, nil
+	}
+	um.verifyAndPull = func(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error { return nil }
+
+	if err := um.checkAndScheduleUpdates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	result, _ := um.LastUpdateCheck("orchestrator")
+	if result.Reason != UpdateCheckVerificationRun || result.Version != "999.0.0" {
+		t.Errorf("got reason %q version %q, want %q version 999.0.0", result.Reason, result.Version, UpdateCheckVerificationRun)
+	}
+	if _, scheduled := um.scheduledUpdates["orchestrator"]; scheduled {
+		t.Error("orchestrator update scheduled during verification run")
+	}
+}
+
+// helperCommand returns a fake podman command that exits with code after sleeping for delay
+func helperCommand(ctx context.Context, code int, delay time.Duration) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestHelperProcess$", "--", strconv.Itoa(code), delay.String())
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
+func TestStagedRollout(t *testing.T) {
+	tests := []struct {
+		name       string
+		cohort     string // content of update_cohort, "" for no file
+		rollout    int
+		rolloutErr error
+		want       UpdateCheckReason
+	}{
+		{name: "in cohort", cohort: "5", rollout: 10, want: UpdateCheckScheduled},
+		{name: "outside cohort", cohort: "10", rollout: 10, want: UpdateCheckOutsideRollout},
+		{name: "first cohort waits for canary", cohort: "0", rollout: 0, want: UpdateCheckOutsideRollout},
+		{name: "complete rollout", cohort: "100", rollout: 100, want: UpdateCheckScheduled},
+		{name: "without cohort", rollout: 99, want: UpdateCheckOutsideRollout},
+		{name: "invalid cohort", cohort: "-1", rollout: 50, want: UpdateCheckOutsideRollout},
+		{name: "invalid rollout", cohort: "0", rolloutErr: errors.New("invalid rollout"), want: UpdateCheckOutsideRollout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{
+				"image":               "localhost/shem-orchestrator",
+				"public_key":          testPublicKey,
+				"UpdateDelayMaxHours": "0",
+			}
+			if tt.cohort != "" {
+				files["update_cohort"] = tt.cohort
+			}
+			um := newTestUpdateManager(t, files)
+			um.remoteVersions = func(ctx context.Context, image string) (map[string]struct{}, error) {
+				return map[string]struct{}{"999.0.0": {}}, nil
+			}
+			um.verifyAndPull = func(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error { return nil }
+			um.rollout = func(ctx context.Context, baseImage, tag string) (int, error) {
+				if tag != "999.0.0-"+runtime.GOARCH {
+					t.Errorf("rollout requested for unexpected tag %s", tag)
+				}
+				return tt.rollout, tt.rolloutErr
+			}
+
+			if err := um.checkAndScheduleUpdates(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			result, _ := um.LastUpdateCheck("orchestrator")
+			if result.Reason != tt.want || result.Version != "999.0.0" {
+				t.Errorf("got reason %q version %q, want %q version 999.0.0", result.Reason, result.Version, tt.want)
+			}
+			if _, scheduled := um.PendingUpdate("orchestrator"); scheduled != (tt.want == UpdateCheckScheduled) {
+				t.Errorf("expected update to be scheduled: %v", !scheduled)
+			}
+		})
+	}
+}
+
+func TestStagedRolloutOnlyForOrchestrator(t *testing.T) {
+	um := newTestUpdateManager(t, map[string]string{"update_cohort": "50", "UpdateDelayMaxHours": "0"})
+	for key, value := range map[string]string{"image": "localhost/meter", "public_key": testPublicKey, "current_version": "1.0.0", "update_cohort": "50"} {
+		setConfig(t, um.configManager, "meter", key, value)
+	}
+	um.remoteVersions = func(ctx context.Context, image string) (map[string]struct{}, error) {
+		return map[string]struct{}{"1.1.0": {}}, nil
+	}
+	um.verifyAndPull = func(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error { return nil }
+	um.rollout = func(ctx context.Context, baseImage, tag string) (int, error) { return 0, nil }
+
+	if err := um.checkAndScheduleUpdates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := um.LastUpdateCheck("meter"); result.Reason != UpdateCheckScheduled {
+		t.Errorf("expected module update to ignore the rollout, got %q", result.Reason)
+	}
+}
+
+func TestRolloutPercentage(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	tests := []struct {
+		label   string
+		want    int
+		wantErr bool
+	}{
+		{"<no value>", 100, false},
+		{"", 100, false},
+		{"25", 25, false},
+		{"0", 0, false},
+		{"101", 0, true},
+		{"half", 0, true},
+	}
+	for _, tt := range tests {
+		um := newTestUpdateManager(t, nil)
+		um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+			if !slices.Contains(args, "localhost/shem-orchestrator-sig:1.0.0-amd64") || !strings.Contains(strings.Join(args, " "), labelRollout) {
+				t.Errorf("unexpected podman call %v", args)
+			}
+			return exec.CommandContext(ctx, "echo", tt.label)
+		}
+		got, err := um.rolloutPercentage(context.Background(), "localhost/shem-orchestrator", "1.0.0-amd64")
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("label %q: got %d, %v, want %d (error: %v)", tt.label, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExtractBinaryFromImageTimeout(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	um := newTestUpdateManager(t, nil)
+	um.extractTimeout = 500 * time.Millisecond
+	um.extractProgressInterval = 50 * time.Millisecond
+	var commands []string
+	um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+		commands = append(commands, args[0])
+		if args[0] == "cp" {
+			return helperCommand(ctx, 0, time.Minute) // wedged copy
+		}
+		return helperCommand(ctx, 0, 0)
+	}
+
+	start := time.Now()
+	err := um.extractBinaryFromImage(context.Background(), "localhost/shem-orchestrator", "1.0.0-amd64", filepath.Join(t.TempDir(), "shem-orchestrator"))
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("extraction took %v despite the timeout", elapsed)
+	}
+	if !slices.Equal(commands, []string{"create", "cp", "rm"}) {
+		t.Errorf("expected create, cp and rm, got %v", commands)
+	}
+}
+
+func TestExtractBinaryFromImage(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	um := newTestUpdateManager(t, nil)
+	um.extractProgressInterval = 10 * time.Millisecond
+	um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+		if args[0] == "cp" {
+			os.WriteFile(args[2], []byte("binary"), 0755)
+			return helperCommand(ctx, 0, 100*time.Millisecond) // slow but progressing copy
+		}
+		return helperCommand(ctx, 0, 0)
+	}
+
+	dir := t.TempDir()
+	targetPath := filepath.Join(dir, "shem-orchestrator")
+	if err := um.extractBinaryFromImage(context.Background(), "localhost/shem-orchestrator", "1.0.0-amd64", targetPath); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(targetPath); err != nil || string(content) != "binary" {
+		t.Errorf("expected extracted binary at target path, got %q, %v", content, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the binary to be left, got %d files", len(entries))
+	}
+
+	um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+		return helperCommand(ctx, 1, 0)
+	}
+	if err := um.extractBinaryFromImage(context.Background(), "localhost/shem-orchestrator", "1.0.0-amd64", filepath.Join(t.TempDir(), "shem-orchestrator")); err == nil {
+		t.Error("expected error when podman create fails")
+	}
+}
+
+func TestRemoveStaleExtractContainers(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	um := newTestUpdateManager(t, nil)
+	own := "shem-orchestrator-extract-1.0.0-amd64-" + extractSuffix()
+	var removed []string
+	um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+		cmd := helperCommand(ctx, 0, 0)
+		switch args[0] {
+		case "ps":
+			cmd.Env = append(os.Environ(), "HELPER_OUTPUT=shem-orchestrator-extract-1.0.0-amd64-1-0000abcd\n"+own+"\n")
+		case "rm":
+			removed = append(removed, args[len(args)-1])
+		}
+		return cmd
+	}
+
+	um.removeStaleExtractContainers(context.Background())
+	if !slices.Equal(removed, []string{"shem-orchestrator-extract-1.0.0-amd64-1-0000abcd"}) {
+		t.Errorf("expected only the container of the other process to be removed, got %v", removed)
+	}
+}
+
+func TestExtractBinaryFromImageConcurrent(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	um := newTestUpdateManager(t, nil)
+
+	// fake podman that keeps track of the containers, like podman does
+	var mu sync.Mutex
+	containers := map[string]bool{}
+	var problems []string
+	um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "create":
+			name := args[slices.Index(args, "--name")+1]
+			if containers[name] {
+				problems = append(problems, "container "+name+" created twice")
+			}
+			containers[name] = true
+		case "cp":
+			name, _, _ := strings.Cut(args[1], ":")
+			if !containers[name] {
+				problems = append(problems, "copy from removed container "+name)
+			}
+			os.WriteFile(args[2], []byte(name), 0755)
+			return helperCommand(ctx, 0, 100*time.Millisecond)
+		case "rm":
+			if !containers[args[1]] {
+				problems = append(problems, "container "+args[1]+" removed twice")
+			}
+			delete(containers, args[1])
+		}
+		return helperCommand(ctx, 0, 0)
+	}
+
+	// a retried extraction of the same tag while the first one is still copying
+	targetPath := filepath.Join(t.TempDir(), "shem-orchestrator")
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = um.extractBinaryFromImage(context.Background(), "localhost/shem-orchestrator", "1.0.0-amd64", targetPath)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if len(problems) > 0 {
+		t.Errorf("extractions interfered: %v", problems)
+	}
+	if len(containers) != 0 {
+		t.Errorf("expected all containers to be removed, got %v", containers)
+	}
+	content, err := os.ReadFile(targetPath)
+	if err != nil || !strings.HasPrefix(string(content), "shem-orchestrator-extract-1.0.0-amd64-") {
+		t.Errorf("expected a complete binary at the target path, got %q, %v", content, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(targetPath)); len(entries) != 1 {
+		t.Errorf("expected temporary files to be gone, got %d files", len(entries))
+	}
+}
+
+func TestCancelAbortsPull(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	um := newTestUpdateManager(t, map[string]string{
+		"image":      "localhost/shem-orchestrator",
+		"public_key": testPublicKey,
+	})
+	um.remoteVersions = func(ctx context.Context, image string) (map[string]struct{}, error) {
+		return map[string]struct{}{"999.0.0": {}}, nil
+	}
+	var pulls atomic.Int32
+	um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+		if args[0] == "pull" {
+			pulls.Add(1)
+			return helperCommand(ctx, 0, time.Minute) // slow registry
+		}
+		return helperCommand(ctx, 0, 0)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	err := um.checkAndScheduleUpdates(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the update check to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("pull was not aborted, took %v", elapsed)
+	}
+	if pulls.Load() != 1 {
+		t.Errorf("expected one aborted pull, got %d", pulls.Load())
+	}
+	// an aborted pull is not a failed verification
+	if result, ok := um.LastUpdateCheck("orchestrator"); ok {
+		t.Errorf("expected no outcome to be recorded, got %+v", result)
+	}
+}
+
+// helperOutputCommand returns a fake podman command that writes output and exits with code
+func helperOutputCommand(ctx context.Context, code int, output string) *exec.Cmd {
+	cmd := helperCommand(ctx, code, 0)
+	cmd.Env = append(os.Environ(), "HELPER_OUTPUT="+output)
+	return cmd
+}
+
+func TestOfflineUpdates(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	um := newTestUpdateManager(t, map[string]string{"OfflineUpdates": "true"})
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const digest = "sha256:0123456789abcdef"
+	tag := "1.1.0-" + runtime.GOARCH
+	signature := ed25519.Sign(privateKey, []byte("localhost/meter:"+tag+" "+digest))
+	labels := map[string]string{
+		"energy.shem.digest":    digest,
+		"energy.shem.pubkey":    base64.StdEncoding.EncodeToString(publicKey),
+		"energy.shem.signature": base64.StdEncoding.EncodeToString(signature),
+	}
+	moduleKeys := []string{labels["energy.shem.pubkey"]}
+
+	// a local registry: staged signature containers, and binary containers by digest
+	binaryStaged := true
+	var commands []string
+	um.podman = func(ctx context.Context, args ...string) *exec.Cmd {
+		commands = append(commands, args[0])
+		switch args[0] {
+		case "images":
+			return helperOutputCommand(ctx, 0, "1.0.0-"+runtime.GOARCH+"\n"+tag+"\n1.2.0-other\nlatest-"+runtime.GOARCH+"\n")
+		case "inspect":
+			for label, value := range labels {
+				if strings.Contains(args[2], label) {
+					return helperOutputCommand(ctx, 0, value+"\n")
+				}
+			}
+		case "image":
+			if !binaryStaged {
+				return helperCommand(ctx, 1, 0)
+			}
+		case "pull", "search", "manifest":
+			t.Errorf("podman %s needs the registry", args[0])
+			return helperCommand(ctx, 125, 0)
+		}
+		return helperCommand(ctx, 0, 0)
+	}
+
+	versions, err := um.remoteVersions(context.Background(), "localhost/meter")
+	if err != nil || !slices.Equal(slices.Sorted(maps.Keys(versions)), []string{"1.0.0", "1.1.0"}) {
+		t.Fatalf("expected staged versions 1.0.0 and 1.1.0, got %v, %v", versions, err)
+	}
+
+	if err := um.verifyAndPull(context.Background(), "localhost/meter", tag, moduleKeys); err != nil {
+		t.Fatalf("expected staged version to be verified, got %v", err)
+	}
+	if !slices.Contains(commands, "tag") {
+		t.Errorf("expected verified image to be tagged, got %v", commands)
+	}
+
+	// a signature that does not match the staged signature container
+	if err := um.verifyAndPull(context.Background(), "localhost/meter", "1.0.0-"+runtime.GOARCH, moduleKeys); err == nil || !strings.Contains(err.Error(), "signature verification failed") {
+		t.Errorf("expected signature verification to fail, got %v", err)
+	}
+	if err := um.verifyAndPull(context.Background(), "localhost/meter", tag, []string{testPublicKey}); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("expected key mismatch, got %v", err)
+	}
+
+	binaryStaged = false
+	if err := um.verifyAndPull(context.Background(), "localhost/meter", tag, moduleKeys); err == nil || !strings.Contains(err.Error(), "not in local storage") {
+		t.Errorf("expected error for missing binary container, got %v", err)
+	}
+}
+
+func TestApplyUpdateNow(t *testing.T) {
+	um := newTestUpdateManager(t, map[string]string{"UpdateDelayMaxHours": "96"})
+	for key, value := range map[string]string{
+		"image":           "localhost/meter",
+		"public_key":      testPublicKey,
+		"current_version": "1.0.0",
+		"blacklist":       "1.3.0\n",
+	} {
+		setConfig(t, um.configManager, "meter", key, value)
+	}
+	var verified []string
+	var verifyErr error
+	um.verifyAndPull = func(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error {
+		verified = append(verified, baseImage+":"+tag)
+		return verifyErr
+	}
+	moduleConfig, _ := um.configManager.NewModuleConfig("meter")
+
+	// refused without verification
+	for _, version := range []string{"1.0.0", "0.9.0", "1.3.0", "latest"} {
+		if err := um.ApplyUpdateNow(context.Background(), "meter", version); err == nil {
+			t.Errorf("expected version %s to be refused", version)
+		}
+	}
+	if len(verified) != 0 {
+		t.Fatalf("expected no verification for refused versions, got %v", verified)
+	}
+
+	// failed verification leaves the module unchanged
+	verifyErr = errors.New("invalid signature")
+	if err := um.ApplyUpdateNow(context.Background(), "meter", "1.1.0"); err == nil {
+		t.Fatal("expected verification error")
+	}
+	if version, _ := moduleConfig.GetString("current_version", ""); version != "1.0.0" {
+		t.Fatalf("expected current_version 1.0.0 after failed verification, got %s", version)
+	}
+
+	// applied right away, even though an update with a long delay is scheduled
+	verifyErr = nil
+	um.scheduleUpdate("meter", "1.1.0")
+	if err := um.ApplyUpdateNow(context.Background(), "meter", "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "localhost/meter:1.1.0-" + runtime.GOARCH; verified[len(verified)-1] != want {
+		t.Errorf("expected %s to be verified, got %v", want, verified)
+	}
+	if version, _ := moduleConfig.GetString("current_version", ""); version != "1.1.0" {
+		t.Errorf("expected current_version 1.1.0, got %s", version)
+	}
+	if fallback, _ := moduleConfig.GetString("fallback_version", ""); fallback != "1.0.0" {
+		t.Errorf("expected fallback_version 1.0.0, got %s", fallback)
+	}
+	um.mu.Lock()
+	_, scheduled := um.scheduledUpdates["meter"]
+	um.mu.Unlock()
+	if scheduled {
+		t.Error("expected the scheduled update to be superseded")
+	}
+	if _, ok := um.confirmationTimes["meter"]; !ok {
+		t.Error("expected confirmation timer to be started")
+	}
+}
+
+func TestApplyRequestedUpdates(t *testing.T) {
+	um := newTestUpdateManager(t, nil)
+	for key, value := range map[string]string{
+		"image":           "localhost/meter",
+		"public_key":      testPublicKey,
+		"current_version": "1.0.0",
+		"apply_update":    "1.2.0\n",
+	} {
+		setConfig(t, um.configManager, "meter", key, value)
+	}
+	um.verifyAndPull = func(ctx context.Context, baseImage, tag string, modulePublicKeys []string) error { return nil }
+
+	um.applyRequestedUpdates(context.Background())
+
+	moduleConfig, _ := um.configManager.NewModuleConfig("meter")
+	if version, _ := moduleConfig.GetString("current_version", ""); version != "1.2.0" {
+		t.Errorf("expected current_version 1.2.0, got %s", version)
+	}
+	if moduleConfig.KeyExists("apply_update") {
+		t.Error("expected apply_update file to be removed")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+)
+
+// ValueStore holds the last known value of each qualified name for the router
+// The orchestrator keeps them in memory (see memoryValueStore); a persistent implementation, e.g.
+// backed by SQLite, lets the values survive a restart. The router calls the store with its own
+// lock held, so implementations should not block for long.
+type ValueStore interface {
+	// Get returns the last value of a qualified name; ok is false if there is none
+	Get(name string) (value CachedValue, ok bool, err error)
+	// Put replaces the last value of the qualified name of value.Message
+	Put(value CachedValue) error
+	// List returns the last values of all qualified names, sorted by name
+	List() ([]CachedValue, error)
+}
+
+// memoryValueStore keeps the last values in memory, so they are lost when the orchestrator stops
+type memoryValueStore struct {
+	values map[string]CachedValue
+	mu     sync.Mutex
+}
+
+// NewMemoryValueStore returns an empty ValueStore that keeps the values in memory
+func NewMemoryValueStore() ValueStore {
+	return &memoryValueStore{values: make(map[string]CachedValue)}
+}
+
+func (s *memoryValueStore) Get(name string) (CachedValue, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[name]
+	return value, ok, nil
+}
+
+func (s *memoryValueStore) Put(value CachedValue) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[value.Message.Name] = value
+	return nil
+}
+
+func (s *memoryValueStore) List() ([]CachedValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]CachedValue, 0, len(s.values))
+	for _, name := range slices.Sorted(maps.Keys(s.values)) {
+		values = append(values, s.values[name])
+	}
+	return values, nil
+}
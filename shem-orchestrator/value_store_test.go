@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMemoryValueStore(t *testing.T) {
+	store := NewMemoryValueStore()
+	if values, err := store.List(); err != nil || len(values) != 0 {
+		t.Fatalf("expected empty store, got %v, %v", values, err)
+	}
+	if _, ok, err := store.Get("meter.power"); ok || err != nil {
+		t.Errorf("expected no value, got %v, %v", ok, err)
+	}
+
+	received := time.Date(2025, 12, 6, 8, 0, 0, 0, time.UTC)
+	for i, name := range []string{"meter.power", "forecast.pv", "meter.power"} {
+		if err := store.Put(CachedValue{Message: testMessage(t, name, float64(i)), Received: received}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, ok, err := store.Get("meter.power")
+	if !ok || err != nil || value.Message.Payload != testMessage(t, "meter.power", 2).Payload || !value.Received.Equal(received) {
+		t.Errorf("expected the value that was put last, got %+v, %v, %v", value, ok, err)
+	}
+	values, err := store.List()
+	if err != nil || len(values) != 2 || values[0].Message.Name != "forecast.pv" || values[1].Message.Name != "meter.power" {
+		t.Errorf("expected values sorted by name, got %+v, %v", values, err)
+	}
+}
+
+func TestRouterWithStore(t *testing.T) {
+	// values kept by the store, e.g. from before a restart, are delivered to new subscribers
+	store := NewMemoryValueStore()
+	store.Put(CachedValue{Message: testMessage(t, "meter.power", 42), Received: time.Now()})
+	router := NewRouterWithStore(store)
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	router.AddSubscriber("optimizer", mustParseSubscriptions(t, "meter.*"), pw, NewLogger("test"))
+	defer router.RemoveSubscriber("optimizer")
+	if messages := readMessages(t, pr, 1); messages[0].Name != "meter.power" {
+		t.Errorf("expected stored value to be delivered, got %s", messages[0].Name)
+	}
+
+	router.Route(testMessage(t, "meter.energy", 1))
+	router.flush()
+	readMessages(t, pr, 1)
+	if _, ok, _ := store.Get("meter.energy"); !ok {
+		t.Error("expected routed value to be put into the store")
+	}
+}
@@ -67,6 +67,13 @@ func monitorStdin(shutdownChan chan<- struct{}) {
 			log(LogWarning, fmt.Sprintf("Error reading message: %v", err))
 			continue
 		}
+		// the orchestrator announces the shutdown before closing stdin; this is the time to save
+		// state (the command is "shem_shutdown", available as shemmsg.ShutdownCommand in newer
+		// versions of the library)
+		if msg.Type() == "command" && msg.Name == "shem_shutdown" {
+			log(LogInfo, "Shutdown announced, nothing to save")
+			continue
+		}
 		log(LogDebug, fmt.Sprintf("Received message: %s %s", msg.Type(), msg.Name))
 	}
 
@@ -103,9 +110,15 @@ func sendPeriodicValues(shutdownChan <-chan struct{}) {
 	}
 }
 
+// broken makes this version exit right away, to test the rollback of failed updates; the
+// integration test of the orchestrator builds a working module with -ldflags "-X main.broken=false"
+var broken = "true"
+
 func main() {
-	log(LogErr, "This is an intentionally broken version for testing purposes.")
-	os.Exit(1)
+	if broken == "true" {
+		log(LogErr, "This is an intentionally broken version for testing purposes.")
+		os.Exit(1)
+	}
 
 	log(LogInfo, "Test module starting")
 
@@ -0,0 +1,111 @@
+package shemmsg
+
+import (
+	"fmt"
+	"maps"
+	"time"
+)
+
+// AggregateFunc selects how an Aggregator combines the values within one 5-minute interval.
+type AggregateFunc int
+
+const (
+	AggregateMean AggregateFunc = iota // arithmetic mean of the values
+	AggregateMin                       // smallest value
+	AggregateMax                       // largest value
+	AggregateLast                      // value with the latest timestamp
+)
+
+// Aggregator collects timestamped point values, e.g. as received by a logging module, and
+// combines them into a timeseries with one value per 5-minute interval. Each value belongs to the
+// interval that contains its timestamp, in line with the left-labeled timeseries format. Intervals
+// without values are Missing. An Aggregator is not safe for concurrent use.
+type Aggregator struct {
+	fn      AggregateFunc
+	buckets map[time.Time]*bucket // by start of the interval, in UTC
+}
+
+// bucket holds the values of one interval
+type bucket struct {
+	n        int
+	sum      float64
+	min, max float64
+	last     float64
+	lastTime time.Time
+}
+
+// NewAggregator returns an empty Aggregator that combines values with fn.
+func NewAggregator(fn AggregateFunc) *Aggregator {
+	return &Aggregator{fn: fn, buckets: make(map[time.Time]*bucket)}
+}
+
+// Add records the value v with timestamp t. Missing values are ignored, so they do not hide the
+// values received in the same interval.
+func (a *Aggregator) Add(t time.Time, v Value) {
+	if v.IsMissing() {
+		return
+	}
+	start := t.UTC().Truncate(timeStep)
+	b := a.buckets[start]
+	if b == nil {
+		b = &bucket{min: v.value, max: v.value}
+		a.buckets[start] = b
+	}
+	b.n++
+	b.sum += v.value
+	b.min = min(b.min, v.value)
+	b.max = max(b.max, v.value)
+	if !t.Before(b.lastTime) {
+		b.last, b.lastTime = v.value, t
+	}
+}
+
+// TimeSeries returns the combined values of all intervals from the one containing start up to
+// the one containing end, exclusive; an end on an interval boundary is not included. Returns
+// ErrTooManyValues if the result would exceed MaxTimeSeriesValues.
+func (a *Aggregator) TimeSeries(start, end time.Time) (TimeSeries, error) {
+	start = start.UTC().Truncate(timeStep)
+	end = AlignTime(end, timeStep)
+	ts := TimeSeries{StartTime: start}
+	if !end.After(start) {
+		return ts, nil
+	}
+	n := int(end.Sub(start) / timeStep)
+	if n > MaxTimeSeriesValues {
+		return TimeSeries{}, fmt.Errorf("%w: %d intervals, limit is %d", ErrTooManyValues, n, MaxTimeSeriesValues)
+	}
+
+	ts.Values = make([]Value, n)
+	for i := range ts.Values {
+		b := a.buckets[start.Add(time.Duration(i)*timeStep)]
+		if b == nil {
+			ts.Values[i] = Missing()
+			continue
+		}
+		// the result lies within the range of the values, so it is as valid as they are
+		ts.Values[i] = Value{value: positiveZero(b.value(a.fn))}
+	}
+	return ts, nil
+}
+
+// DiscardBefore removes the values of all intervals that end at or before t, e.g. once they have
+// been stored.
+func (a *Aggregator) DiscardBefore(t time.Time) {
+	maps.DeleteFunc(a.buckets, func(start time.Time, _ *bucket) bool {
+		return !start.Add(timeStep).After(t)
+	})
+}
+
+// value returns the combined value of the bucket
+func (b *bucket) value(fn AggregateFunc) float64 {
+	switch fn {
+	case AggregateMin:
+		return b.min
+	case AggregateMax:
+		return b.max
+	case AggregateLast:
+		return b.last
+	default:
+		return b.sum / float64(b.n)
+	}
+}
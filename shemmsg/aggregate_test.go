@@ -0,0 +1,82 @@
+package shemmsg
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAggregator(t *testing.T) {
+	at := func(hour, min, sec int) time.Time {
+		return time.Date(2025, 12, 6, hour, min, sec, 0, time.UTC)
+	}
+	format := func(ts TimeSeries) []string {
+		values := make([]string, len(ts.Values))
+		for i, v := range ts.Values {
+			values[i] = v.String()
+		}
+		return values
+	}
+
+	newAggregator := func(fn AggregateFunc) *Aggregator {
+		a := NewAggregator(fn)
+		// added out of order; 08:05:00 belongs to the second interval
+		a.Add(at(8, 4, 59), mustNumber(20))
+		a.Add(at(8, 5, 0), mustNumber(30))
+		a.Add(at(8, 3, 0), mustNumber(10))
+		a.Add(at(8, 9, 0), mustNumber(50))
+		a.Add(at(8, 6, 0), Missing())
+		// nothing from 08:10 to 08:15
+		a.Add(at(8, 17, 30), mustNumber(-1.5))
+		return a
+	}
+
+	tests := []struct {
+		fn       AggregateFunc
+		expected []string
+	}{
+		{AggregateMean, []string{"15.000", "40.000", "missing", "-1.500"}},
+		{AggregateMin, []string{"10.000", "30.000", "missing", "-1.500"}},
+		{AggregateMax, []string{"20.000", "50.000", "missing", "-1.500"}},
+		{AggregateLast, []string{"20.000", "50.000", "missing", "-1.500"}},
+	}
+	for _, tt := range tests {
+		ts, err := newAggregator(tt.fn).TimeSeries(at(8, 0, 0), at(8, 20, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ts.StartTime.Equal(at(8, 0, 0)) || !slices.Equal(format(ts), tt.expected) {
+			t.Errorf("function %d: expected %v from 08:00, got %v from %s", tt.fn, tt.expected, format(ts), ts.StartTime)
+		}
+	}
+
+	a := newAggregator(AggregateMean)
+
+	// start and end within an interval, in another time zone
+	cet := time.FixedZone("CET", 3600)
+	ts, err := a.TimeSeries(time.Date(2025, 12, 6, 9, 7, 0, 0, cet), time.Date(2025, 12, 6, 9, 12, 0, 0, cet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.StartTime.Equal(at(8, 5, 0)) || ts.StartTime.Location() != time.UTC || !slices.Equal(format(ts), []string{"40.000", "missing"}) {
+		t.Errorf("unexpected timeseries %v from %s", format(ts), ts.StartTime)
+	}
+	if _, err := Parse(Message{Name: "power", Payload: ts}.Encode()); err != nil {
+		t.Errorf("aggregated timeseries rejected: %v", err)
+	}
+
+	// values of intervals that have ended are discarded
+	a.DiscardBefore(at(8, 9, 0))
+	ts, _ = a.TimeSeries(at(8, 0, 0), at(8, 10, 0))
+	if !slices.Equal(format(ts), []string{"missing", "40.000"}) {
+		t.Errorf("expected only the first interval to be discarded, got %v", format(ts))
+	}
+
+	if ts, err := a.TimeSeries(at(8, 0, 0), at(8, 0, 0)); err != nil || len(ts.Values) != 0 {
+		t.Errorf("expected empty timeseries, got %v, %v", format(ts), err)
+	}
+	if _, err := a.TimeSeries(at(8, 0, 0), at(8, 0, 0).Add(MaxTimeSeriesValues*timeStep+time.Second)); !errors.Is(err, ErrTooManyValues) {
+		t.Errorf("expected ErrTooManyValues, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package shemmsg
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// ReplayStream reads recorded messages from r and writes them to w, e.g. to feed a captured stdout
+// stream into a module under test.
+//
+// The timing is derived from the start times of timeseries messages: when a timeseries starts
+// later than the latest start time seen so far, ReplayStream waits for the difference divided by
+// speed before writing it. Point values carry no timestamp and are written right after the
+// preceding message. A speed of 1 replays at the original pace, 2 twice as fast; a speed of 0 or
+// +Inf writes all messages without waiting.
+//
+// Returns nil when r is exhausted, or the first read or write error.
+func ReplayStream(r io.Reader, w *Writer, speed float64) error {
+	return replayStream(r, w, speed, time.Sleep)
+}
+
+// replayStream implements ReplayStream with a replaceable sleep function
+func replayStream(r io.Reader, w *Writer, speed float64, sleep func(time.Duration)) error {
+	if speed < 0 || math.IsNaN(speed) {
+		return fmt.Errorf("invalid replay speed %g", speed)
+	}
+	instantaneous := speed == 0 || math.IsInf(speed, 1)
+
+	reader := NewReader(r)
+	var clock time.Time
+	for n := 1; ; n++ {
+		msg, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("message %d: %w", n, err)
+		}
+
+		if ts, ok := msg.Payload.(TimeSeries); ok {
+			if !clock.IsZero() && ts.StartTime.After(clock) && !instantaneous {
+				sleep(time.Duration(float64(ts.StartTime.Sub(clock)) / speed))
+			}
+			if clock.IsZero() || ts.StartTime.After(clock) {
+				clock = ts.StartTime
+			}
+		}
+
+		if err := w.Write(msg); err != nil {
+			return fmt.Errorf("message %d: %w", n, err)
+		}
+	}
+}
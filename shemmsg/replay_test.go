@@ -0,0 +1,93 @@
+package shemmsg
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const recordedStream = "pointvalue net_power\n-802.1\n\n" +
+	"timeseries pv_forecast\n2025-12-06T08:00\n120\n\n" +
+	"pointvalue net_power\n-750\n\n" +
+	"timeseries pv_forecast\n2025-12-06T08:10\n130\nmissing\n\n" +
+	"timeseries pv_forecast\n2025-12-06T08:05\n125\n\n" + // earlier than the previous one
+	"timeseries pv_forecast\n2025-12-06T08:20\n140\n"
+
+// readAll parses all messages written to buf
+func readAll(t *testing.T, buf *bytes.Buffer) []Message {
+	t.Helper()
+	var messages []Message
+	reader := NewReader(buf)
+	for {
+		msg, err := reader.Read()
+		if err != nil {
+			break
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestReplayStreamInstantaneous(t *testing.T) {
+	for _, speed := range []float64{0, math.Inf(1)} {
+		var out bytes.Buffer
+		sleep := func(d time.Duration) {
+			t.Errorf("speed %g: unexpected sleep for %v", speed, d)
+		}
+		if err := replayStream(strings.NewReader(recordedStream), NewWriter(&out), speed, sleep); err != nil {
+			t.Fatalf("speed %g: unexpected error: %v", speed, err)
+		}
+
+		expected := readAll(t, bytes.NewBufferString(recordedStream))
+		got := readAll(t, &out)
+		if len(got) != len(expected) {
+			t.Fatalf("speed %g: expected %d messages, got %d", speed, len(expected), len(got))
+		}
+		for i := range got {
+			if !bytes.Equal(got[i].Encode(), expected[i].Encode()) {
+				t.Errorf("speed %g, message %d: expected %q, got %q", speed, i, expected[i].Encode(), got[i].Encode())
+			}
+		}
+	}
+}
+
+func TestReplayStreamPublicAPI(t *testing.T) {
+	var out bytes.Buffer
+	if err := ReplayStream(strings.NewReader(recordedStream), NewWriter(&out), 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(readAll(t, &out)); got != 6 {
+		t.Errorf("expected 6 messages, got %d", got)
+	}
+}
+
+func TestReplayStreamTiming(t *testing.T) {
+	var sleeps []time.Duration
+	sleep := func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+	var out bytes.Buffer
+	if err := replayStream(strings.NewReader(recordedStream), NewWriter(&out), 60, sleep); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 08:00 -> 08:10 and 08:10 -> 08:20 at 60 times the original pace; 08:05 does not wait
+	expected := []time.Duration{10 * time.Second, 10 * time.Second}
+	if len(sleeps) != len(expected) || sleeps[0] != expected[0] || sleeps[1] != expected[1] {
+		t.Errorf("expected sleeps %v, got %v", expected, sleeps)
+	}
+}
+
+func TestReplayStreamErrors(t *testing.T) {
+	var out bytes.Buffer
+	if err := ReplayStream(strings.NewReader(recordedStream), NewWriter(&out), -1); err == nil {
+		t.Error("expected an error for a negative speed")
+	}
+
+	err := ReplayStream(strings.NewReader("pointvalue a\n1\n\nbogus\n"), NewWriter(&out), 0)
+	if err == nil || !strings.Contains(err.Error(), "message 2") {
+		t.Errorf("expected an error for message 2, got %v", err)
+	}
+}
@@ -9,30 +9,79 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	MaxNameLength   = 100
-	MaxMessageBytes = 10000
-	TimeStepMinutes = 5
+	MaxNameLength        = 100
+	MaxMessageBytes      = 10000
+	MaxTimeSeriesValues  = 5000
+	MaxUnitLength        = 20
+	MaxIntegerDigits     = 8  // digits before the decimal point of a number
+	MaxWideIntegerDigits = 12 // digits before the decimal point with ParseOptions.WideNumbers
+	ProtocolVersion      = 1  // highest protocol version understood by this package
+	TimeStepMinutes      = 5
+	ShutdownCommand      = "shem_shutdown" // name of the command sent by the orchestrator before stdin is closed
+	HandshakeName        = "shem_hello"    // name of handshake messages
+	QueryPrefix          = "shem_query"    // module part of the names of queries and their responses
 )
 
 var (
-	ErrInvalidName       = errors.New("invalid variable name")
-	ErrInvalidValue      = errors.New("invalid numeric value")
-	ErrValueOutOfRange   = errors.New("value outside allowed range")
-	ErrInvalidTimestamp  = errors.New("invalid or misaligned timestamp")
-	ErrUnknownType       = errors.New("unknown message type")
-	ErrMessageTooLarge   = errors.New("message exceeds maximum size")
-	ErrEmptyMessage      = errors.New("empty message")
-	ErrMissingValue      = errors.New("pointvalue requires exactly one value line")
-	ErrMissingTimestamp  = errors.New("timeseries requires timestamp and at least one value")
-	ErrInvalidCharacters = errors.New("message contains invalid characters")
+	ErrInvalidName        = errors.New("invalid variable name")
+	ErrInvalidValue       = errors.New("invalid numeric value")
+	ErrValueOutOfRange    = errors.New("value outside allowed range")
+	ErrInvalidTimestamp   = errors.New("invalid or misaligned timestamp")
+	ErrUnknownType        = errors.New("unknown message type")
+	ErrMessageTooLarge    = errors.New("message exceeds maximum size")
+	ErrEmptyMessage       = errors.New("empty message")
+	ErrMissingValue       = errors.New("pointvalue requires exactly one value line")
+	ErrMissingTimestamp   = errors.New("timeseries requires timestamp and at least one value")
+	ErrCommandBody        = errors.New("command must not have a body")
+	ErrInvalidCharacters  = errors.New("message contains invalid characters")
+	ErrTooManyValues      = errors.New("timeseries exceeds maximum number of values")
+	ErrInvalidUnit        = errors.New("invalid unit")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrConflict           = errors.New("conflicting timeseries values")
+	ErrInvalidHandshake   = errors.New("invalid handshake")
+	ErrInvalidQuery       = errors.New("invalid query")
 )
 
+// ParseOptions controls the limits that are enforced while parsing. A zero field selects the
+// package default.
+type ParseOptions struct {
+	MaxMessageBytes     int // maximum size of a message in bytes (default MaxMessageBytes)
+	MaxTimeSeriesValues int // maximum number of values in a timeseries (default MaxTimeSeriesValues)
+
+	// WideNumbers accepts numbers with up to MaxWideIntegerDigits digits before the decimal point
+	// (see WideNumber). Only receivers that expect e.g. lifetime energy counters should enable it.
+	WideNumbers bool
+}
+
+func (o ParseOptions) maxMessageBytes() int {
+	if o.MaxMessageBytes > 0 {
+		return o.MaxMessageBytes
+	}
+	return MaxMessageBytes
+}
+
+func (o ParseOptions) integerDigits() int {
+	if o.WideNumbers {
+		return MaxWideIntegerDigits
+	}
+	return MaxIntegerDigits
+}
+
+func (o ParseOptions) maxTimeSeriesValues() int {
+	if o.MaxTimeSeriesValues > 0 {
+		return o.MaxTimeSeriesValues
+	}
+	return MaxTimeSeriesValues
+}
+
 // Value represents a numeric value that may be missing.
 type Value struct {
 	value   float64
@@ -47,8 +96,19 @@ func Missing() Value {
 // Number creates a Value from a float64. Its validity is checked by encoding it and then
 // validating the encoded value. Too large numbers, NaN, Inf etc. are rejected with an error.
 func Number(f float64) (Value, error) {
-	v := Value{value: f, missing: false}
-	if !isValidNumberFormat(v.String()) {
+	return number(f, MaxIntegerDigits)
+}
+
+// WideNumber creates a Value like Number, but allows up to MaxWideIntegerDigits digits before the
+// decimal point, as needed e.g. for lifetime energy counters in Wh. Receivers only accept such
+// values if they parse with ParseOptions.WideNumbers.
+func WideNumber(f float64) (Value, error) {
+	return number(f, MaxWideIntegerDigits)
+}
+
+func number(f float64, integerDigits int) (Value, error) {
+	v := Value{value: positiveZero(f), missing: false}
+	if !isValidNumber(v.String(), integerDigits) {
 		return Missing(), ErrValueOutOfRange
 	}
 	return v, nil
@@ -69,22 +129,39 @@ func (v Value) Float64() float64 {
 }
 
 // String returns the string representation of the value. Numeric values are always formatted with
-// 3 decimal digits.
+// 3 decimal digits. Zero has the single representation "0.000", also for negative values that
+// round to zero.
 func (v Value) String() string {
 	if v.missing {
 		return "missing"
 	}
-	return strconv.FormatFloat(v.value, 'f', 3, 64)
+	s := strconv.FormatFloat(v.value, 'f', 3, 64)
+	if s == "-0.000" {
+		return "0.000"
+	}
+	return s
+}
+
+// positiveZero returns f, with negative zero replaced by zero, so that all zero Values are equal.
+func positiveZero(f float64) float64 {
+	if f == 0 {
+		return 0
+	}
+	return f
 }
 
-func parseValue(s string) (Value, error) {
+func parseValue(s string, integerDigits int) (Value, error) {
 	s = strings.TrimSpace(s)
 
 	if s == "missing" {
 		return Missing(), nil
 	}
 
-	if !isValidNumberFormat(s) {
+	if !isValidNumber(s, integerDigits) {
+		// A common mistake of modules that format numbers according to their locale
+		if strings.Count(s, ",") == 1 && isValidNumber(strings.Replace(s, ",", ".", 1), integerDigits) {
+			return Missing(), fmt.Errorf("%w: decimal separator must be '.', not ','", ErrInvalidValue)
+		}
 		return Missing(), ErrInvalidValue
 	}
 
@@ -93,13 +170,19 @@ func parseValue(s string) (Value, error) {
 		return Missing(), ErrInvalidValue
 	}
 
-	return Value{value: f, missing: false}, nil
+	return Value{value: positiveZero(f), missing: false}, nil
 }
 
 // isValidNumberFormat checks that the string matches the expected format:
 // optional sign, up to 8 digits before the decimal point, optional decimal
 // point with up to 3 digits after it.
 func isValidNumberFormat(s string) bool {
+	return isValidNumber(s, MaxIntegerDigits)
+}
+
+// isValidNumber checks the number format like isValidNumberFormat, allowing integerDigits digits
+// before the decimal point.
+func isValidNumber(s string, integerDigits int) bool {
 	if len(s) == 0 {
 		return false
 	}
@@ -142,7 +225,7 @@ func isValidNumberFormat(s string) bool {
 	}
 
 	// Enforce digit count limits
-	if digitsBefore > 8 || digitsAfter > 3 {
+	if digitsBefore > integerDigits || digitsAfter > 3 {
 		return false
 	}
 
@@ -153,6 +236,7 @@ func isValidNumberFormat(s string) bool {
 type ParseError struct {
 	Message string
 	Content string // the offending line
+	Err     error  // underlying sentinel error, if any
 }
 
 func (e *ParseError) Error() string {
@@ -163,9 +247,14 @@ func (e *ParseError) Error() string {
 	return fmt.Sprintf("%s: %q", e.Message, content)
 }
 
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 // Message represents a parsed message with a name and payload.
 type Message struct {
 	Name    string
+	Unit    string // optional unit of the values, e.g. "kW"; empty if not given
 	Payload Payload
 }
 
@@ -175,24 +264,47 @@ type Payload interface {
 	encodePayload() []byte
 }
 
-// Type returns the message type identifier ("pointvalue" or "timeseries").
+// Type returns the message type identifier ("pointvalue", "timeseries", "command", "handshake" or
+// "response").
 func (m Message) Type() string {
 	return m.Payload.payloadType()
 }
 
 // WithName returns a copy of the message with a different name.
 func (m Message) WithName(name string) Message {
-	return Message{Name: name, Payload: m.Payload}
+	m.Name = name
+	return m
 }
 
 // Encode returns the message in canonical format (without surrounding newlines).
 func (m Message) Encode() []byte {
+	return m.encode(0)
+}
+
+// encode returns the message in canonical format. A version greater than zero is written as
+// version line after the header.
+func (m Message) encode(version int) []byte {
 	var buf bytes.Buffer
 	buf.WriteString(m.Payload.payloadType())
 	buf.WriteByte(' ')
 	buf.WriteString(m.Name)
 	buf.WriteByte('\n')
-	buf.Write(m.Payload.encodePayload())
+	if version > 0 {
+		buf.WriteString("version ")
+		buf.WriteString(strconv.Itoa(version))
+		buf.WriteByte('\n')
+	}
+	if m.Unit != "" {
+		buf.WriteString("unit ")
+		buf.WriteString(m.Unit)
+		buf.WriteByte('\n')
+	}
+	payload := m.Payload.encodePayload()
+	if len(payload) == 0 {
+		// commands consist of the header only
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
+	buf.Write(payload)
 	return buf.Bytes()
 }
 
@@ -211,10 +323,136 @@ func (p PointValue) encodePayload() []byte {
 
 // TimeSeries represents a sequence of values at 5-minute intervals.
 type TimeSeries struct {
-	StartTime time.Time // must be aligned to 5-minute boundary, UTC
+	StartTime time.Time // must be aligned to 5-minute boundary, UTC; see AlignTime
 	Values    []Value
 }
 
+// timeStep is the interval between two values of a timeseries
+const timeStep = TimeStepMinutes * time.Minute
+
+// AlignTime returns the first multiple of interval at or after t, in UTC; t itself if it is
+// aligned. interval should divide a day.
+func AlignTime(t time.Time, interval time.Duration) time.Time {
+	t = t.UTC()
+	if interval <= 0 {
+		return t
+	}
+	aligned := t.Truncate(interval)
+	if aligned.Before(t) {
+		aligned = aligned.Add(interval)
+	}
+	return aligned
+}
+
+// Duration returns the time span covered by the values. Each value covers one 5-minute interval.
+func (t TimeSeries) Duration() time.Duration {
+	return time.Duration(len(t.Values)) * timeStep
+}
+
+// EndTime returns the end of the interval covered by the last value, which is the start time of the
+// value that would follow. For an empty timeseries, this is the start time.
+func (t TimeSeries) EndTime() time.Time {
+	return t.StartTime.Add(t.Duration())
+}
+
+// Covers reports whether tm lies within the time span covered by the values, i.e. whether
+// StartTime <= tm < EndTime. An empty timeseries covers nothing.
+func (t TimeSeries) Covers(tm time.Time) bool {
+	return !tm.Before(t.StartTime) && tm.Before(t.EndTime())
+}
+
+// TrimTrailingMissing returns t without the missing values at its end, e.g. padding that fills a
+// forecast up to a fixed length. Leading and internal missing values are kept, and so is the first
+// value, as a timeseries message needs at least one value.
+func (t TimeSeries) TrimTrailingMissing() TimeSeries {
+	n := len(t.Values)
+	for n > 1 && t.Values[n-1].IsMissing() {
+		n--
+	}
+	return TimeSeries{StartTime: t.StartTime, Values: t.Values[:n:n]}
+}
+
+// Merge combines t with the newer timeseries other, e.g. to keep a rolling forecast: where both
+// have values, the values of other win; a gap between the two is filled with missing values. The
+// result covers both series. Returns ErrInvalidTimestamp if the values of the two series are not
+// on the same 5-minute grid, and ErrTooManyValues if the result would exceed MaxTimeSeriesValues.
+// An empty series is ignored.
+func (t TimeSeries) Merge(other TimeSeries) (TimeSeries, error) {
+	return t.MergeWithPolicy(other, MergeNewerWins)
+}
+
+// MergePolicy decides which value a merged timeseries gets where both series have one.
+type MergePolicy string
+
+const (
+	// MergeNewerWins takes the values of the newer series, including missing ones.
+	MergeNewerWins MergePolicy = "newer-wins"
+	// MergeErrorOnConflict fails with ErrConflict if the two series have different values for the
+	// same interval; where one of them is missing, the other one is taken.
+	MergeErrorOnConflict MergePolicy = "error-on-conflict"
+	// MergeKeepExisting keeps the values of the older series; the newer series only fills its
+	// missing values and extends it.
+	MergeKeepExisting MergePolicy = "keep-existing"
+)
+
+// ParseMergePolicy returns the MergePolicy with the given name, e.g. "newer-wins".
+func ParseMergePolicy(name string) (MergePolicy, error) {
+	switch policy := MergePolicy(name); policy {
+	case MergeNewerWins, MergeErrorOnConflict, MergeKeepExisting:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown merge policy %q, must be %s, %s or %s", name, MergeNewerWins, MergeErrorOnConflict, MergeKeepExisting)
+}
+
+// MergeWithPolicy is like Merge, but policy decides which values win where both series have
+// one. Returns ErrConflict for conflicting values with MergeErrorOnConflict.
+func (t TimeSeries) MergeWithPolicy(other TimeSeries, policy MergePolicy) (TimeSeries, error) {
+	if _, err := ParseMergePolicy(string(policy)); err != nil {
+		return TimeSeries{}, err
+	}
+	if len(other.Values) == 0 {
+		return TimeSeries{StartTime: t.StartTime, Values: slices.Clone(t.Values)}, nil
+	}
+	if len(t.Values) == 0 {
+		return TimeSeries{StartTime: other.StartTime, Values: slices.Clone(other.Values)}, nil
+	}
+	if other.StartTime.Sub(t.StartTime)%timeStep != 0 {
+		return TimeSeries{}, fmt.Errorf("%w: start times %s and %s are not a multiple of %d minutes apart",
+			ErrInvalidTimestamp, t.StartTime.Format(time.RFC3339), other.StartTime.Format(time.RFC3339), TimeStepMinutes)
+	}
+
+	start := t.StartTime
+	if other.StartTime.Before(start) {
+		start = other.StartTime
+	}
+	end := t.EndTime()
+	if other.EndTime().After(end) {
+		end = other.EndTime()
+	}
+	n := int(end.Sub(start) / timeStep)
+	if n > MaxTimeSeriesValues {
+		return TimeSeries{}, fmt.Errorf("%w: merged series has %d values, limit is %d", ErrTooManyValues, n, MaxTimeSeriesValues)
+	}
+
+	values := make([]Value, n)
+	for i := range values {
+		values[i] = Missing()
+	}
+	copy(values[t.StartTime.Sub(start)/timeStep:], t.Values)
+	offset := int(other.StartTime.Sub(start) / timeStep)
+	for i, v := range other.Values {
+		existing := &values[offset+i]
+		switch {
+		case policy == MergeNewerWins || existing.IsMissing():
+			*existing = v
+		case policy == MergeErrorOnConflict && !v.IsMissing() && v != *existing:
+			return TimeSeries{}, fmt.Errorf("%w at %s: %s and %s", ErrConflict,
+				other.StartTime.Add(time.Duration(i)*timeStep).Format(time.RFC3339), existing, v)
+		}
+	}
+	return TimeSeries{StartTime: start, Values: values}, nil
+}
+
 func (t TimeSeries) payloadType() string {
 	return "timeseries"
 }
@@ -229,14 +467,172 @@ func (t TimeSeries) encodePayload() []byte {
 	return buf.Bytes()
 }
 
+// Command is a Payload for messages that ask the receiver to do something instead of carrying a
+// value. The message name identifies the command, e.g. ShutdownCommand. Commands have no body and
+// are only sent by the orchestrator; modules send queries instead (see Query).
+type Command struct{}
+
+func (c Command) payloadType() string {
+	return "command"
+}
+
+func (c Command) encodePayload() []byte {
+	return nil
+}
+
+// Query is a Payload for commands a module sends to ask the orchestrator for information. The
+// message name is QueryPrefix and the topic, e.g.
+//
+//	command shem_query.config
+//	id 7
+//	arg max_power
+//
+// The orchestrator answers on stdin with a Response of the same name and ID. The ID is chosen by
+// the module and must be a valid name part, so that a module can have several queries pending.
+// Lines with other keys are ignored.
+type Query struct {
+	ID   string   // correlates the response with the query
+	Args []string // arguments of the topic, in order; may be empty
+}
+
+func (q Query) payloadType() string {
+	return "command"
+}
+
+func (q Query) encodePayload() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("id ")
+	buf.WriteString(q.ID)
+	for _, arg := range q.Args {
+		buf.WriteString("\narg ")
+		buf.WriteString(arg)
+	}
+	return buf.Bytes()
+}
+
+// QueryTopic returns the topic of a query or response name, e.g. "peers" for
+// "shem_query.peers". Returns false if name is not the name of a query.
+func QueryTopic(name string) (string, bool) {
+	module, topic := SplitName(name)
+	if module != QueryPrefix {
+		return "", false
+	}
+	return topic, true
+}
+
+// Response is a Payload that answers a Query, e.g.
+//
+//	response shem_query.config
+//	id 7
+//	value 11
+//
+// It has the name and ID of the query and either any number of values or an error:
+//
+//	response shem_query.config
+//	id 7
+//	error unknown key max_power
+type Response struct {
+	ID     string   // ID of the query
+	Values []string // result, one entry per value line; may be empty
+	Error  string   // why the query failed, empty on success
+}
+
+func (r Response) payloadType() string {
+	return "response"
+}
+
+func (r Response) encodePayload() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("id ")
+	buf.WriteString(r.ID)
+	if r.Error != "" {
+		buf.WriteString("\nerror ")
+		buf.WriteString(r.Error)
+		return buf.Bytes()
+	}
+	for _, value := range r.Values {
+		buf.WriteString("\nvalue ")
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
+
+// messageTypes are the message types understood by this package
+var messageTypes = []string{"pointvalue", "timeseries", "command", "handshake", "response"}
+
+// Handshake is a Payload that advertises the protocol capabilities of its sender, so that the peer
+// can avoid messages the sender does not understand. It is sent as the first message, e.g.
+//
+//	handshake shem_hello
+//	protocol 1
+//	types pointvalue timeseries command handshake response
+//
+// Lines with other keys are ignored, so that later versions can add capabilities. A peer that has
+// not sent a handshake is assumed to understand protocol version 1 with the types of version 1.
+type Handshake struct {
+	Protocol int      // highest protocol version the sender understands
+	Types    []string // message types the sender understands
+}
+
+// NewHandshake returns the handshake advertising the capabilities of this package.
+func NewHandshake() Handshake {
+	return Handshake{Protocol: ProtocolVersion, Types: slices.Clone(messageTypes)}
+}
+
+// Supports reports whether the sender of the handshake understands messages of type msgType.
+func (h Handshake) Supports(msgType string) bool {
+	return slices.Contains(h.Types, msgType)
+}
+
+// CommonProtocol returns the highest protocol version understood by both the sender of the
+// handshake and this package.
+func (h Handshake) CommonProtocol() int {
+	return min(h.Protocol, ProtocolVersion)
+}
+
+func (h Handshake) payloadType() string {
+	return "handshake"
+}
+
+func (h Handshake) encodePayload() []byte {
+	return []byte("protocol " + strconv.Itoa(h.Protocol) + "\ntypes " + strings.Join(h.Types, " "))
+}
+
 // Parse parses a single message. The input should not include the surrounding blank lines.
 func Parse(data []byte) (Message, error) {
-	if len(data) > MaxMessageBytes {
+	return ParseWithOptions(data, ParseOptions{})
+}
+
+// ParseFramed parses a single message as it appears on the wire, e.g. in a captured output file.
+// Leading and trailing empty lines are removed as Reader does; empty lines within the message are
+// an error, as they would separate two messages.
+func ParseFramed(data []byte) (Message, error) {
+	data = bytes.TrimLeft(data, "\n")
+	data = bytes.TrimRight(data, "\n")
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		line := data[bytes.LastIndexByte(data[:i], '\n')+1 : i]
+		return Message{}, &ParseError{Content: string(line), Message: "unexpected empty line within message"}
+	}
+	return Parse(data)
+}
+
+// ParseWithOptions parses a single message like Parse, but enforces the limits given in opts.
+func ParseWithOptions(data []byte, opts ParseOptions) (Message, error) {
+	if len(data) > opts.maxMessageBytes() {
 		return Message{}, ErrMessageTooLarge
 	}
 
-	if !isPrintableASCII(data) {
-		return Message{}, ErrInvalidCharacters
+	if i := invalidCharacter(data); i >= 0 {
+		start := bytes.LastIndexByte(data[:i], '\n') + 1
+		end := len(data)
+		if j := bytes.IndexByte(data[i:], '\n'); j >= 0 {
+			end = i + j
+		}
+		return Message{}, &ParseError{
+			Content: string(data[start:end]),
+			Message: fmt.Sprintf("%v: byte 0x%02x at offset %d", ErrInvalidCharacters, data[i], i),
+			Err:     ErrInvalidCharacters,
+		}
 	}
 
 	text := string(data)
@@ -251,6 +647,16 @@ func Parse(data []byte) (Message, error) {
 		return Message{}, ErrEmptyMessage
 	}
 
+	// Optional version line directly after the header. It is checked first, as messages of a
+	// newer protocol version may not follow the rules below.
+	body := lines[1:]
+	if len(body) > 0 && strings.HasPrefix(body[0], "version ") {
+		if err := checkVersion(strings.TrimPrefix(body[0], "version ")); err != nil {
+			return Message{}, &ParseError{Content: body[0], Message: err.Error(), Err: ErrUnsupportedVersion}
+		}
+		body = body[1:]
+	}
+
 	// Parse header line: "type name"
 	header := strings.Fields(lines[0])
 	if len(header) != 2 {
@@ -264,14 +670,34 @@ func Parse(data []byte) (Message, error) {
 		return Message{}, &ParseError{Content: lines[0], Message: err.Error()}
 	}
 
+	// Optional unit line after the header and version
+	unit := ""
+	if len(body) > 0 && strings.HasPrefix(body[0], "unit ") {
+		unit = strings.TrimPrefix(body[0], "unit ")
+		if err := ValidateUnit(unit); err != nil {
+			return Message{}, &ParseError{Content: body[0], Message: err.Error()}
+		}
+		body = body[1:]
+	}
+
 	var payload Payload
 	var err error
 
 	switch msgType {
 	case "pointvalue":
-		payload, err = parsePointValue(lines[1:])
+		payload, err = parsePointValue(body, opts.integerDigits())
 	case "timeseries":
-		payload, err = parseTimeSeries(lines[1:])
+		payload, err = parseTimeSeries(body, opts.maxTimeSeriesValues(), opts.integerDigits())
+	case "command":
+		if _, ok := QueryTopic(name); ok {
+			payload, err = parseQuery(body)
+		} else {
+			payload, err = parseCommand(body)
+		}
+	case "handshake":
+		payload, err = parseHandshake(body)
+	case "response":
+		payload, err = parseResponse(body)
 	default:
 		return Message{}, &ParseError{Content: lines[0], Message: ErrUnknownType.Error()}
 	}
@@ -280,18 +706,19 @@ func Parse(data []byte) (Message, error) {
 		return Message{}, err
 	}
 
-	return Message{Name: name, Payload: payload}, nil
+	return Message{Name: name, Unit: unit, Payload: payload}, nil
 }
 
-// isPrintableASCII checks if all bytes are printable ASCII (0x20-0x7E) or newline (0x0A).
-func isPrintableASCII(data []byte) bool {
-	for _, b := range data {
+// invalidCharacter returns the offset of the first byte that is neither printable ASCII (0x20-0x7E)
+// nor newline (0x0A), or -1 if all bytes are valid.
+func invalidCharacter(data []byte) int {
+	for i, b := range data {
 		if b == '\n' || (b >= 0x20 && b <= 0x7E) {
 			continue
 		}
-		return false
+		return i
 	}
-	return true
+	return -1
 }
 
 // SplitName splits "module.variable" into components. It does not validate the name.
@@ -346,6 +773,38 @@ func ValidateName(name string) error {
 	return ValidateNamePart(module)
 }
 
+// checkVersion checks that a protocol version is a number between 1 and ProtocolVersion
+func checkVersion(s string) error {
+	version, err := strconv.Atoi(s)
+	if err != nil || version < 1 {
+		return fmt.Errorf("%w: invalid version", ErrUnsupportedVersion)
+	}
+	if version > ProtocolVersion {
+		return fmt.Errorf("%w: version %d, supported up to %d", ErrUnsupportedVersion, version, ProtocolVersion)
+	}
+	return nil
+}
+
+// ValidateUnit checks if a unit is valid. Units are free-form, but must be 1-20 printable ASCII
+// characters without spaces, e.g. "kW", "kWh", "degC" or "EUR/kWh".
+func ValidateUnit(unit string) error {
+	if len(unit) == 0 {
+		return fmt.Errorf("%w: empty unit", ErrInvalidUnit)
+	}
+
+	if len(unit) > MaxUnitLength {
+		return fmt.Errorf("%w: exceeds %d characters", ErrInvalidUnit, MaxUnitLength)
+	}
+
+	for _, c := range unit {
+		if c <= ' ' || c > '~' {
+			return fmt.Errorf("%w: invalid character %q", ErrInvalidUnit, c)
+		}
+	}
+
+	return nil
+}
+
 func isNameChar(c rune) bool {
 	return (c >= 'a' && c <= 'z') ||
 		(c >= 'A' && c <= 'Z') ||
@@ -353,24 +812,102 @@ func isNameChar(c rune) bool {
 		c == '_'
 }
 
-func parsePointValue(lines []string) (PointValue, error) {
+func parsePointValue(lines []string, integerDigits int) (PointValue, error) {
 	if len(lines) != 1 {
 		return PointValue{}, ErrMissingValue
 	}
 
-	val, err := parseValue(lines[0])
+	val, err := parseValue(lines[0], integerDigits)
 	if err != nil {
-		return PointValue{}, &ParseError{Message: err.Error(), Content: lines[0]}
+		return PointValue{}, &ParseError{Message: err.Error(), Content: lines[0], Err: err}
 	}
 
 	return PointValue{Value: val}, nil
 }
 
-func parseTimeSeries(lines []string) (TimeSeries, error) {
+func parseCommand(lines []string) (Command, error) {
+	if len(lines) != 0 {
+		return Command{}, &ParseError{Content: lines[0], Message: ErrCommandBody.Error(), Err: ErrCommandBody}
+	}
+	return Command{}, nil
+}
+
+func parseHandshake(lines []string) (Handshake, error) {
+	var h Handshake
+	for _, line := range lines {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "protocol":
+			version, err := strconv.Atoi(value)
+			if err != nil || version < 1 {
+				return Handshake{}, &ParseError{Content: line, Message: ErrInvalidHandshake.Error() + ": invalid protocol version", Err: ErrInvalidHandshake}
+			}
+			h.Protocol = version
+		case "types":
+			h.Types = strings.Fields(value)
+		}
+	}
+	if h.Protocol == 0 {
+		return Handshake{}, fmt.Errorf("%w: missing protocol version", ErrInvalidHandshake)
+	}
+	if h.Types == nil {
+		return Handshake{}, fmt.Errorf("%w: missing message types", ErrInvalidHandshake)
+	}
+	return h, nil
+}
+
+func parseQuery(lines []string) (Query, error) {
+	var q Query
+	for _, line := range lines {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "id":
+			if err := ValidateNamePart(value); err != nil {
+				return Query{}, &ParseError{Content: line, Message: ErrInvalidQuery.Error() + ": invalid id", Err: ErrInvalidQuery}
+			}
+			q.ID = value
+		case "arg":
+			q.Args = append(q.Args, value)
+		}
+	}
+	if q.ID == "" {
+		return Query{}, fmt.Errorf("%w: missing id", ErrInvalidQuery)
+	}
+	return q, nil
+}
+
+func parseResponse(lines []string) (Response, error) {
+	var r Response
+	for _, line := range lines {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "id":
+			if err := ValidateNamePart(value); err != nil {
+				return Response{}, &ParseError{Content: line, Message: ErrInvalidQuery.Error() + ": invalid id", Err: ErrInvalidQuery}
+			}
+			r.ID = value
+		case "value":
+			r.Values = append(r.Values, value)
+		case "error":
+			r.Error = value
+		}
+	}
+	if r.ID == "" {
+		return Response{}, fmt.Errorf("%w: missing id", ErrInvalidQuery)
+	}
+	return r, nil
+}
+
+func parseTimeSeries(lines []string, maxValues, integerDigits int) (TimeSeries, error) {
 	if len(lines) < 2 {
 		return TimeSeries{}, ErrMissingTimestamp
 	}
 
+	// Check the value count before anything is allocated for the values
+	if len(lines)-1 > maxValues {
+		return TimeSeries{}, fmt.Errorf("%w: %d values, limit is %d", ErrTooManyValues, len(lines)-1, maxValues)
+	}
+
 	// Parse timestamp
 	ts, err := time.Parse("2006-01-02T15:04", lines[0])
 	if err != nil {
@@ -385,9 +922,9 @@ func parseTimeSeries(lines []string) (TimeSeries, error) {
 	// Parse values
 	values := make([]Value, 0, len(lines)-1)
 	for _, line := range lines[1:] {
-		val, err := parseValue(line)
+		val, err := parseValue(line, integerDigits)
 		if err != nil {
-			return TimeSeries{}, &ParseError{Message: err.Error(), Content: line}
+			return TimeSeries{}, &ParseError{Message: err.Error(), Content: line, Err: err}
 		}
 		values = append(values, val)
 	}
@@ -399,6 +936,10 @@ func parseTimeSeries(lines []string) (TimeSeries, error) {
 type Reader struct {
 	scanner *bufio.Scanner
 	buf     bytes.Buffer
+	opts    ParseOptions
+
+	mu           sync.Mutex
+	pendingSince time.Time // when the first line of an incomplete message was read, zero if none
 }
 
 // scanNewlines is a split function that splits on \n only, unlike bufio.ScanLines
@@ -418,14 +959,57 @@ func scanNewlines(data []byte, atEOF bool) (advance int, token []byte, err error
 
 // NewReader creates a Reader that reads messages from r.
 func NewReader(r io.Reader) *Reader {
+	return NewReaderWithOptions(r, ParseOptions{})
+}
+
+// NewReaderWithOptions creates a Reader that parses messages read from r with the given options.
+func NewReaderWithOptions(r io.Reader, opts ParseOptions) *Reader {
 	scanner := bufio.NewScanner(r)
 	scanner.Split(scanNewlines)
-	return &Reader{scanner: scanner}
+	// A single line may be as long as the whole message
+	if limit := opts.maxMessageBytes() + 1; limit > bufio.MaxScanTokenSize {
+		scanner.Buffer(nil, limit)
+	}
+	return &Reader{scanner: scanner, opts: opts}
 }
 
 // Read returns the next message from the stream.
 // Returns io.EOF when the stream is closed cleanly.
 func (r *Reader) Read() (Message, error) {
+	if err := r.readBlock(); err != nil {
+		return Message{}, err
+	}
+	return ParseWithOptions(r.buf.Bytes(), r.opts)
+}
+
+// ReadRaw returns the bytes of the next message without parsing it, so that it can be forwarded
+// unchanged. The bytes are the lines of the message, each ending with a newline, without the
+// surrounding empty lines. The size limit is enforced as for Read.
+// Returns io.EOF when the stream is closed cleanly.
+func (r *Reader) ReadRaw() ([]byte, error) {
+	if err := r.readBlock(); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(r.buf.Bytes()), nil
+}
+
+// PendingSince reports whether part of a message has been read, but not its end, and when its first
+// line arrived. This distinguishes a producer that is idle from one that stopped in the middle of a
+// message. PendingSince may be called while another goroutine is blocked in Read.
+func (r *Reader) PendingSince() (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pendingSince, !r.pendingSince.IsZero()
+}
+
+func (r *Reader) setPendingSince(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pendingSince = t
+}
+
+// readBlock reads the lines of the next message into r.buf
+func (r *Reader) readBlock() error {
 	r.buf.Reset()
 
 	// Skip leading empty lines
@@ -434,17 +1018,19 @@ func (r *Reader) Read() (Message, error) {
 		if line != "" {
 			r.buf.WriteString(line)
 			r.buf.WriteByte('\n')
+			r.setPendingSince(time.Now())
+			defer r.setPendingSince(time.Time{})
 			break
 		}
 	}
 
 	if err := r.scanner.Err(); err != nil {
-		return Message{}, err
+		return err
 	}
 
 	// If we got nothing, we've reached EOF
 	if r.buf.Len() == 0 {
-		return Message{}, io.EOF
+		return io.EOF
 	}
 
 	// Read until empty line or EOF
@@ -456,21 +1042,18 @@ func (r *Reader) Read() (Message, error) {
 		r.buf.WriteString(line)
 		r.buf.WriteByte('\n')
 
-		if r.buf.Len() > MaxMessageBytes {
-			return Message{}, ErrMessageTooLarge
+		if r.buf.Len() > r.opts.maxMessageBytes() {
+			return ErrMessageTooLarge
 		}
 	}
 
-	if err := r.scanner.Err(); err != nil {
-		return Message{}, err
-	}
-
-	return Parse(r.buf.Bytes())
+	return r.scanner.Err()
 }
 
 // Writer writes messages to a stream with proper separation.
 type Writer struct {
-	w io.Writer
+	w           io.Writer
+	emitVersion bool
 }
 
 // NewWriter creates a Writer that writes messages to w.
@@ -478,12 +1061,23 @@ func NewWriter(w io.Writer) *Writer {
 	return &Writer{w: w}
 }
 
+// EmitVersion controls whether messages are written with an explicit version line. Readers treat
+// messages without a version line as version 1, so this is only needed for newer versions.
+func (w *Writer) EmitVersion(enable bool) {
+	w.emitVersion = enable
+}
+
 // Write encodes and writes a message with surrounding newlines.
 func (w *Writer) Write(m Message) error {
+	version := 0
+	if w.emitVersion {
+		version = ProtocolVersion
+	}
+
 	var buf bytes.Buffer
 	buf.WriteByte('\n')
 	buf.WriteByte('\n')
-	buf.Write(m.Encode())
+	buf.Write(m.encode(version))
 	buf.WriteByte('\n')
 	buf.WriteByte('\n')
 
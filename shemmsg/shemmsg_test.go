@@ -2,8 +2,11 @@ package shemmsg
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"math"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -108,6 +111,8 @@ func TestValueEncode(t *testing.T) {
 		{"positive integer", mustNumber(123), "123.000"},
 		{"negative integer", mustNumber(-456), "-456.000"},
 		{"zero", mustNumber(0), "0.000"},
+		{"negative zero", mustNumber(math.Copysign(0, -1)), "0.000"},
+		{"negative rounding to zero", mustNumber(-0.0004), "0.000"},
 		{"decimal", mustNumber(123.456), "123.456"},
 		{"negative decimal", mustNumber(-802.10), "-802.100"},
 		{"small decimal", mustNumber(0.5), "0.500"},
@@ -124,6 +129,19 @@ func TestValueEncode(t *testing.T) {
 	}
 }
 
+func TestNegativeZero(t *testing.T) {
+	if negZero := mustNumber(math.Copysign(0, -1)); negZero != mustNumber(0) || math.Signbit(negZero.Float64()) {
+		t.Errorf("expected negative zero to equal zero, got %v", negZero.Float64())
+	}
+	msg, err := Parse([]byte("pointvalue meter.power\n-0.000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := msg.Payload.(PointValue).Value; value != mustNumber(0) {
+		t.Errorf("expected parsed -0.000 to equal zero, got %v", value)
+	}
+}
+
 func TestParsePointValue(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -323,6 +341,476 @@ func TestParseTimeSeries(t *testing.T) {
 	}
 }
 
+func TestTimeSeriesTrimTrailingMissing(t *testing.T) {
+	start := time.Date(2025, 12, 6, 8, 0, 0, 0, time.UTC)
+	m := Missing()
+	tests := []struct {
+		name     string
+		values   []Value
+		expected []Value
+	}{
+		{"no missing values", []Value{mustNumber(1), mustNumber(2)}, []Value{mustNumber(1), mustNumber(2)}},
+		{"trailing", []Value{mustNumber(1), mustNumber(2), m, m}, []Value{mustNumber(1), mustNumber(2)}},
+		{"leading and internal", []Value{m, mustNumber(1), m, mustNumber(2), m}, []Value{m, mustNumber(1), m, mustNumber(2)}},
+		{"all missing", []Value{m, m, m}, []Value{m}},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := TimeSeries{StartTime: start, Values: tt.values}
+			trimmed := ts.TrimTrailingMissing()
+			if !trimmed.StartTime.Equal(start) || len(trimmed.Values) != len(tt.expected) {
+				t.Fatalf("expected %d values from %v, got %d from %v", len(tt.expected), start, len(trimmed.Values), trimmed.StartTime)
+			}
+			for i, v := range trimmed.Values {
+				if v != tt.expected[i] {
+					t.Errorf("value %d: expected %v, got %v", i, tt.expected[i], v)
+				}
+			}
+			if len(tt.values) > 0 {
+				if _, err := Parse(Message{Name: "forecast", Payload: trimmed}.Encode()); err != nil {
+					t.Errorf("trimmed timeseries cannot be parsed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeSeriesTimeSpan(t *testing.T) {
+	start := time.Date(2025, 12, 6, 8, 0, 0, 0, time.UTC)
+	one := mustNumber(1)
+
+	t.Run("empty", func(t *testing.T) {
+		ts := TimeSeries{StartTime: start}
+		if ts.Duration() != 0 {
+			t.Errorf("expected zero duration, got %v", ts.Duration())
+		}
+		if !ts.EndTime().Equal(start) {
+			t.Errorf("expected end time %v, got %v", start, ts.EndTime())
+		}
+		if ts.Covers(start) {
+			t.Error("expected empty timeseries to cover nothing")
+		}
+	})
+
+	t.Run("24 hours", func(t *testing.T) {
+		values := make([]Value, 24*12)
+		for i := range values {
+			values[i] = one
+		}
+		ts := TimeSeries{StartTime: start, Values: values}
+		if ts.Duration() != 24*time.Hour {
+			t.Errorf("expected 24h, got %v", ts.Duration())
+		}
+		end := start.Add(24 * time.Hour)
+		if !ts.EndTime().Equal(end) {
+			t.Errorf("expected end time %v, got %v", end, ts.EndTime())
+		}
+
+		tests := []struct {
+			tm       time.Time
+			expected bool
+		}{
+			{start.Add(-time.Nanosecond), false},
+			{start, true},
+			{start.Add(12 * time.Hour), true},
+			{end.Add(-time.Nanosecond), true},
+			{end, false},
+		}
+		for _, tt := range tests {
+			if got := ts.Covers(tt.tm); got != tt.expected {
+				t.Errorf("Covers(%v) = %v, expected %v", tt.tm, got, tt.expected)
+			}
+		}
+	})
+
+	t.Run("single value", func(t *testing.T) {
+		ts := TimeSeries{StartTime: start, Values: []Value{one}}
+		if !ts.EndTime().Equal(start.Add(5 * time.Minute)) {
+			t.Errorf("expected end time 5 minutes after start, got %v", ts.EndTime())
+		}
+		if !ts.Covers(start.Add(4*time.Minute + 59*time.Second)) {
+			t.Error("expected last second of the interval to be covered")
+		}
+	})
+}
+
+func TestAlignTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	utc := func(hour, min, sec, nsec int) time.Time {
+		return time.Date(2025, 3, 30, hour, min, sec, nsec, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		t        time.Time
+		interval time.Duration
+		expected time.Time
+	}{
+		{"already aligned", utc(12, 5, 0, 0), 5 * time.Minute, utc(12, 5, 0, 0)},
+		{"mid-interval", utc(12, 7, 30, 0), 5 * time.Minute, utc(12, 10, 0, 0)},
+		{"zero seconds", utc(12, 7, 0, 0), 5 * time.Minute, utc(12, 10, 0, 0)},
+		{"just after boundary", utc(12, 5, 0, 1), 5 * time.Minute, utc(12, 5, 0, 0).Add(5 * time.Minute)},
+		{"end of day", utc(23, 58, 0, 0), 5 * time.Minute, time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"hourly", utc(12, 5, 0, 0), time.Hour, utc(13, 0, 0, 0)},
+		// daylight saving time starts in Berlin at 01:00 UTC on this day
+		{"local time before DST change", time.Date(2025, 3, 30, 1, 58, 0, 0, berlin), 5 * time.Minute, utc(1, 0, 0, 0)},
+		{"local time after DST change", time.Date(2025, 3, 30, 3, 2, 0, 0, berlin), 5 * time.Minute, utc(1, 5, 0, 0)},
+		{"no interval", time.Date(2025, 3, 30, 14, 7, 30, 0, berlin), 0, utc(12, 7, 30, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AlignTime(tt.t, tt.interval)
+			if !got.Equal(tt.expected) || got.Location() != time.UTC {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	// an aligned start time is accepted by the parser
+	msg := Message{Name: "forecast", Payload: TimeSeries{StartTime: AlignTime(utc(12, 7, 30, 0), 5*time.Minute), Values: []Value{mustNumber(1)}}}
+	if _, err := Parse(msg.Encode()); err != nil {
+		t.Errorf("aligned timeseries rejected: %v", err)
+	}
+}
+
+func TestTimeSeriesMerge(t *testing.T) {
+	start := time.Date(2025, 12, 6, 8, 0, 0, 0, time.UTC)
+	series := func(offsetSteps int, values ...float64) TimeSeries {
+		ts := TimeSeries{StartTime: start.Add(time.Duration(offsetSteps) * 5 * time.Minute)}
+		for _, v := range values {
+			ts.Values = append(ts.Values, mustNumber(v))
+		}
+		return ts
+	}
+	format := func(ts TimeSeries) string {
+		var values []string
+		for _, v := range ts.Values {
+			if v.IsMissing() {
+				values = append(values, "-")
+			} else {
+				values = append(values, fmt.Sprint(v.Float64()))
+			}
+		}
+		return ts.StartTime.Format("15:04") + " " + strings.Join(values, ",")
+	}
+
+	tests := []struct {
+		name         string
+		older, newer TimeSeries
+		expected     string
+	}{
+		{"overlap", series(0, 1, 2, 3), series(1, 20, 30, 40), "08:00 1,20,30,40"},
+		{"newer starts earlier", series(2, 3, 4), series(0, 10, 20, 30), "08:00 10,20,30,4"},
+		{"newer inside older", series(0, 1, 2, 3, 4), series(1, 20, 30), "08:00 1,20,30,4"},
+		{"adjacent", series(0, 1, 2), series(2, 3), "08:00 1,2,3"},
+		{"gap", series(0, 1), series(3, 4), "08:00 1,-,-,4"},
+		{"disjoint, newer before older", series(4, 5), series(0, 1), "08:00 1,-,-,-,5"},
+		{"empty newer", series(0, 1, 2), series(5), "08:00 1,2"},
+		{"empty older", series(5), series(1, 2), "08:05 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, err := tt.older.Merge(tt.newer)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := format(merged); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+
+	t.Run("missing values of newer win", func(t *testing.T) {
+		newer := TimeSeries{StartTime: start, Values: []Value{Missing()}}
+		merged, err := series(0, 1, 2).Merge(newer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := format(merged); got != "08:00 -,2" {
+			t.Errorf("expected 08:00 -,2, got %s", got)
+		}
+	})
+
+	t.Run("inputs unchanged", func(t *testing.T) {
+		older := series(0, 1, 2)
+		if _, err := older.Merge(series(1, 20)); err != nil {
+			t.Fatal(err)
+		}
+		if got := format(older); got != "08:00 1,2" {
+			t.Errorf("older series changed to %s", got)
+		}
+	})
+
+	t.Run("interval mismatch", func(t *testing.T) {
+		misaligned := TimeSeries{StartTime: start.Add(2 * time.Minute), Values: []Value{mustNumber(1)}}
+		if _, err := series(0, 1).Merge(misaligned); !errors.Is(err, ErrInvalidTimestamp) {
+			t.Errorf("expected ErrInvalidTimestamp, got %v", err)
+		}
+	})
+
+	t.Run("too many values", func(t *testing.T) {
+		if _, err := series(0, 1).Merge(series(MaxTimeSeriesValues, 1)); !errors.Is(err, ErrTooManyValues) {
+			t.Errorf("expected ErrTooManyValues, got %v", err)
+		}
+	})
+}
+
+func TestTimeSeriesMergeWithPolicy(t *testing.T) {
+	start := time.Date(2025, 12, 6, 8, 0, 0, 0, time.UTC)
+	m := Missing()
+	older := TimeSeries{StartTime: start, Values: []Value{mustNumber(1), mustNumber(2), m}}
+	format := func(ts TimeSeries) string {
+		var values []string
+		for _, v := range ts.Values {
+			values = append(values, v.String())
+		}
+		return strings.Join(values, ",")
+	}
+
+	tests := []struct {
+		policy   MergePolicy
+		newer    []Value // from 08:05
+		expected string  // empty if ErrConflict is expected
+	}{
+		{MergeNewerWins, []Value{mustNumber(20), mustNumber(30), mustNumber(40)}, "1.000,20.000,30.000,40.000"},
+		{MergeNewerWins, []Value{m, mustNumber(30)}, "1.000,missing,30.000"},
+		{MergeKeepExisting, []Value{mustNumber(20), mustNumber(30), mustNumber(40)}, "1.000,2.000,30.000,40.000"},
+		{MergeKeepExisting, []Value{m, mustNumber(30)}, "1.000,2.000,30.000"},
+		{MergeErrorOnConflict, []Value{mustNumber(20), mustNumber(30)}, ""},
+		{MergeErrorOnConflict, []Value{mustNumber(2), mustNumber(30), mustNumber(40)}, "1.000,2.000,30.000,40.000"}, // same value
+		{MergeErrorOnConflict, []Value{m, mustNumber(30)}, "1.000,2.000,30.000"},
+	}
+	for _, tt := range tests {
+		newer := TimeSeries{StartTime: start.Add(5 * time.Minute), Values: tt.newer}
+		merged, err := older.MergeWithPolicy(newer, tt.policy)
+		if tt.expected == "" {
+			if !errors.Is(err, ErrConflict) || !strings.Contains(err.Error(), "2025-12-06T08:05:00Z") {
+				t.Errorf("%s %s: expected conflict at 08:05, got %v", tt.policy, format(newer), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", tt.policy, format(newer), err)
+		} else if got := format(merged); got != tt.expected || !merged.StartTime.Equal(start) {
+			t.Errorf("%s %s: expected %s, got %s", tt.policy, format(newer), tt.expected, got)
+		}
+	}
+
+	if _, err := older.MergeWithPolicy(older, "oldest-wins"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+	for _, name := range []string{"newer-wins", "error-on-conflict", "keep-existing"} {
+		if policy, err := ParseMergePolicy(name); err != nil || string(policy) != name {
+			t.Errorf("ParseMergePolicy(%q) = %q, %v", name, policy, err)
+		}
+	}
+}
+
+func TestTimeSeriesValueLimit(t *testing.T) {
+	input := "timeseries foo\n2025-12-06T08:00" + strings.Repeat("\n1", 11)
+
+	t.Run("over limit", func(t *testing.T) {
+		_, err := ParseWithOptions([]byte(input), ParseOptions{MaxTimeSeriesValues: 10})
+		if !errors.Is(err, ErrTooManyValues) {
+			t.Fatalf("expected ErrTooManyValues, got %v", err)
+		}
+	})
+
+	t.Run("at limit", func(t *testing.T) {
+		m, err := ParseWithOptions([]byte(input), ParseOptions{MaxTimeSeriesValues: 11})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := len(m.Payload.(TimeSeries).Values); n != 11 {
+			t.Fatalf("expected 11 values, got %d", n)
+		}
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		reader := NewReaderWithOptions(strings.NewReader(input+"\n\n"), ParseOptions{MaxTimeSeriesValues: 10})
+		_, err := reader.Read()
+		if !errors.Is(err, ErrTooManyValues) {
+			t.Fatalf("expected ErrTooManyValues, got %v", err)
+		}
+	})
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	// a timeseries with 3000 values needs about 15000 bytes
+	input := "timeseries forecast\n2025-12-06T08:00" + strings.Repeat("\n1.234", 3000)
+
+	if _, err := Parse([]byte(input)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge with default limit, got %v", err)
+	}
+	if _, err := ParseWithOptions([]byte(input), ParseOptions{MaxMessageBytes: 20000}); err != nil {
+		t.Fatalf("unexpected error with raised limit: %v", err)
+	}
+
+	t.Run("reader", func(t *testing.T) {
+		stream := input + "\n\npointvalue small\n1\n\n"
+		reader := NewReaderWithOptions(strings.NewReader(stream), ParseOptions{MaxMessageBytes: 20000})
+		if _, err := reader.Read(); err != nil {
+			t.Fatalf("unexpected error with raised limit: %v", err)
+		}
+
+		reader = NewReaderWithOptions(strings.NewReader(stream), ParseOptions{MaxMessageBytes: 100})
+		if _, err := reader.Read(); !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("expected ErrMessageTooLarge with lowered limit, got %v", err)
+		}
+	})
+
+	t.Run("long line", func(t *testing.T) {
+		// lines longer than the default bufio.Scanner buffer are accepted if the limit allows it
+		long := "pointvalue " + strings.Repeat("a", 70000) + "\n1\n\n"
+		reader := NewReaderWithOptions(strings.NewReader(long), ParseOptions{MaxMessageBytes: 100000})
+		var parseErr *ParseError
+		if _, err := reader.Read(); !errors.As(err, &parseErr) {
+			t.Fatalf("expected a ParseError for the name, got %v", err)
+		}
+	})
+}
+
+func TestUnits(t *testing.T) {
+	t.Run("pointvalue with unit", func(t *testing.T) {
+		m, err := Parse([]byte("pointvalue net_power\nunit kW\n-802.10"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if m.Unit != "kW" {
+			t.Errorf("expected unit 'kW', got %q", m.Unit)
+		}
+		if m.Payload.(PointValue).Value.Float64() != -802.10 {
+			t.Errorf("expected -802.10, got %v", m.Payload.(PointValue).Value)
+		}
+	})
+
+	t.Run("timeseries with unit", func(t *testing.T) {
+		m, err := Parse([]byte("timeseries price\nunit EUR/kWh\n2025-12-06T08:00\n0.25\n0.3"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if m.Unit != "EUR/kWh" {
+			t.Errorf("expected unit 'EUR/kWh', got %q", m.Unit)
+		}
+		if len(m.Payload.(TimeSeries).Values) != 2 {
+			t.Errorf("expected 2 values, got %d", len(m.Payload.(TimeSeries).Values))
+		}
+	})
+
+	t.Run("without unit", func(t *testing.T) {
+		m, err := Parse([]byte("pointvalue net_power\n-802.10"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if m.Unit != "" {
+			t.Errorf("expected no unit, got %q", m.Unit)
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		original := Message{Name: "energy", Unit: "kWh", Payload: PointValue{Value: mustNumber(12.5)}}
+		encoded := original.Encode()
+		if string(encoded) != "pointvalue energy\nunit kWh\n12.500" {
+			t.Errorf("unexpected encoding %q", encoded)
+		}
+		decoded, err := Parse(encoded)
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		if decoded.Unit != "kWh" {
+			t.Errorf("expected unit 'kWh', got %q", decoded.Unit)
+		}
+		if renamed := decoded.WithName("meter.energy"); renamed.Unit != "kWh" {
+			t.Errorf("WithName dropped the unit")
+		}
+	})
+
+	t.Run("invalid units", func(t *testing.T) {
+		invalid := []string{
+			"pointvalue foo\nunit \n1",
+			"pointvalue foo\nunit k W\n1",
+			"pointvalue foo\nunit " + strings.Repeat("x", MaxUnitLength+1) + "\n1",
+			"pointvalue foo\nunit kW",
+		}
+		for _, input := range invalid {
+			if _, err := Parse([]byte(input)); err == nil {
+				t.Errorf("expected error for %q", input)
+			}
+		}
+	})
+}
+
+func TestProtocolVersion(t *testing.T) {
+	t.Run("future version rejected", func(t *testing.T) {
+		_, err := Parse([]byte("pointvalue foo\nversion 2\nsomething new"))
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+		}
+	})
+
+	t.Run("future version rejected before type check", func(t *testing.T) {
+		_, err := Parse([]byte("newtype foo\nversion 7\n1"))
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+		}
+	})
+
+	t.Run("invalid versions rejected", func(t *testing.T) {
+		for _, version := range []string{"0", "-1", "x", ""} {
+			_, err := Parse([]byte("pointvalue foo\nversion " + version + "\n1"))
+			if !errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("version %q: expected ErrUnsupportedVersion, got %v", version, err)
+			}
+		}
+	})
+
+	t.Run("explicit version 1", func(t *testing.T) {
+		m, err := Parse([]byte("timeseries foo\nversion 1\nunit kW\n2025-12-06T08:00\n1"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if m.Unit != "kW" {
+			t.Errorf("expected unit 'kW', got %q", m.Unit)
+		}
+	})
+
+	t.Run("writer emits version", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.EmitVersion(true)
+		m := Message{Name: "power", Payload: PointValue{Value: mustNumber(1)}}
+		if err := writer.Write(m); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		if !strings.Contains(buf.String(), "pointvalue power\nversion 1\n1.000") {
+			t.Errorf("expected version line in %q", buf.String())
+		}
+		got, err := NewReader(&buf).Read()
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if !bytes.Equal(got.Encode(), m.Encode()) {
+			t.Errorf("expected %q, got %q", m.Encode(), got.Encode())
+		}
+	})
+
+	t.Run("reader continues after unsupported version", func(t *testing.T) {
+		input := "\n\npointvalue foo\nversion 99\n1\n\npointvalue bar\n2\n\n"
+		reader := NewReader(strings.NewReader(input))
+		if _, err := reader.Read(); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+		}
+		m, err := reader.Read()
+		if err != nil || m.Name != "bar" {
+			t.Fatalf("expected message bar, got %v (%v)", m.Name, err)
+		}
+	})
+}
+
 func TestMessageEncode(t *testing.T) {
 	t.Run("pointvalue", func(t *testing.T) {
 		m := Message{
@@ -352,6 +840,29 @@ func TestMessageEncode(t *testing.T) {
 	})
 }
 
+func TestCommand(t *testing.T) {
+	m := Message{Name: ShutdownCommand, Payload: Command{}}
+	if got, expected := string(m.Encode()), "command shem_shutdown"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := NewReader(&buf).Read()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parsed.Type() != "command" || parsed.Name != ShutdownCommand {
+		t.Errorf("unexpected message %+v", parsed)
+	}
+
+	if _, err := Parse([]byte("command shem_shutdown\n5")); !errors.Is(err, ErrCommandBody) {
+		t.Errorf("expected ErrCommandBody for a command with a body, got %v", err)
+	}
+}
+
 func TestMessageWithName(t *testing.T) {
 	original := Message{
 		Name:    "original_name",
@@ -414,6 +925,29 @@ func TestRoundTrip(t *testing.T) {
 	}
 }
 
+func TestMissingStateRoundTrip(t *testing.T) {
+	// a state is a point value, so an unknown state is encoded like an unknown number
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).Write(Message{Name: "heat_pump.state", Payload: PointValue{Value: Missing()}}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "pointvalue heat_pump.state\nmissing\n") {
+		t.Errorf("expected missing state to be encoded as missing, got %q", buf.String())
+	}
+
+	got, err := NewReader(&buf).Read()
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	pv, ok := got.Payload.(PointValue)
+	if !ok || got.Name != "heat_pump.state" {
+		t.Fatalf("expected point value heat_pump.state, got %+v", got)
+	}
+	if !pv.Value.IsMissing() {
+		t.Errorf("expected missing state, got %v", pv.Value)
+	}
+}
+
 func TestReaderWriter(t *testing.T) {
 	var buf bytes.Buffer
 	writer := NewWriter(&buf)
@@ -451,6 +985,116 @@ func TestReaderWriter(t *testing.T) {
 	}
 }
 
+func TestReaderReadRaw(t *testing.T) {
+	// formatting that is normalized by re-encoding: leading zeros, few decimals, version line
+	input := "\n\n\npointvalue net_power\nversion 1\nunit kW\n-0802.1\n\n\n" +
+		"timeseries pv_forecast\n2025-12-06T08:00\n120\nmissing\n\n" +
+		"pointvalue irradiance\n12" // no trailing newline at EOF
+	reader := NewReader(strings.NewReader(input))
+
+	expected := []string{
+		"pointvalue net_power\nversion 1\nunit kW\n-0802.1\n",
+		"timeseries pv_forecast\n2025-12-06T08:00\n120\nmissing\n",
+		"pointvalue irradiance\n12\n",
+	}
+	reparse := NewReader(strings.NewReader(input))
+	for _, exp := range expected {
+		raw, err := reader.ReadRaw()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(raw) != exp {
+			t.Errorf("expected raw bytes %q, got %q", exp, raw)
+		}
+
+		fromRaw, err := Parse(raw)
+		if err != nil {
+			t.Fatalf("raw bytes do not parse: %v", err)
+		}
+		parsed, err := reparse.Read()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(fromRaw.Encode(), parsed.Encode()) || fromRaw.Unit != parsed.Unit {
+			t.Errorf("raw bytes parse to %q, expected %q", fromRaw.Encode(), parsed.Encode())
+		}
+	}
+	if _, err := reader.ReadRaw(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	// the size limit applies to raw messages as well
+	large := "pointvalue x\n" + strings.Repeat("1", 100) + "\n"
+	reader = NewReaderWithOptions(strings.NewReader(large), ParseOptions{MaxMessageBytes: 50})
+	if _, err := reader.ReadRaw(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestReaderPendingSince(t *testing.T) {
+	pr, pw := io.Pipe()
+	reader := NewReader(pr)
+	if _, pending := reader.PendingSince(); pending {
+		t.Fatal("expected nothing pending before the first read")
+	}
+
+	type result struct {
+		msg Message
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		for {
+			msg, err := reader.Read()
+			results <- result{msg, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// idle: the reader only skips empty lines
+	before := time.Now()
+	pw.Write([]byte("\n\n"))
+	time.Sleep(10 * time.Millisecond)
+	if _, pending := reader.PendingSince(); pending {
+		t.Error("expected nothing pending while only empty lines have been read")
+	}
+
+	// a partial message followed by a pause
+	pw.Write([]byte("pointvalue foo\n"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if since, pending := reader.PendingSince(); pending {
+			if since.Before(before) || since.After(time.Now()) {
+				t.Errorf("unexpected pending time %v", since)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the partial message to be pending")
+		}
+	}
+	select {
+	case r := <-results:
+		t.Fatalf("Read returned before the message was complete: %+v", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// completing the message clears the pending state
+	pw.Write([]byte("123\n\n"))
+	if r := <-results; r.err != nil || r.msg.Name != "foo" {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if _, pending := reader.PendingSince(); pending {
+		t.Error("expected nothing pending after the message was read")
+	}
+
+	pw.Close()
+	if r := <-results; r.err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", r.err)
+	}
+}
+
 func TestReaderSkipsEmptyLines(t *testing.T) {
 	input := "\n\n\npointvalue foo\n123\n\n\n\npointvalue bar\n456\n\n"
 	reader := NewReader(strings.NewReader(input))
@@ -472,17 +1116,87 @@ func TestReaderSkipsEmptyLines(t *testing.T) {
 	}
 }
 
+func TestParseFramed(t *testing.T) {
+	valid := []string{
+		"pointvalue foo\n123",
+		"pointvalue foo\n123\n",
+		"\n\npointvalue foo\n123\n\n",
+		"\n\n\n\npointvalue foo\n123",
+		"pointvalue foo\n123\n\n\n\n",
+	}
+	for _, input := range valid {
+		m, err := ParseFramed([]byte(input))
+		if err != nil {
+			t.Errorf("ParseFramed(%q) error: %v", input, err)
+			continue
+		}
+		if m.Name != "foo" || m.Payload.(PointValue).Value.Float64() != 123 {
+			t.Errorf("ParseFramed(%q) = %+v", input, m)
+		}
+	}
+
+	// Framed messages match what Writer produces
+	var buf bytes.Buffer
+	ts := TimeSeries{StartTime: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Values: []Value{Missing()}}
+	if err := NewWriter(&buf).Write(Message{Name: "bar", Unit: "W", Payload: ts}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := ParseFramed(buf.Bytes()); err != nil || m.Name != "bar" || m.Unit != "W" {
+		t.Errorf("ParseFramed(%q) = %+v, %v", buf.String(), m, err)
+	}
+
+	for _, input := range []string{"", "\n\n\n", "pointvalue foo\n\n123", "\npointvalue foo\n123\n\npointvalue bar\n456\n"} {
+		if _, err := ParseFramed([]byte(input)); err == nil {
+			t.Errorf("ParseFramed(%q) should fail", input)
+		}
+	}
+	if _, err := ParseFramed(nil); err != ErrEmptyMessage {
+		t.Errorf("expected ErrEmptyMessage, got %v", err)
+	}
+}
+
 func TestReaderRejectsCRLF(t *testing.T) {
 	// Carriage return should be rejected, not silently stripped
 	input := "pointvalue foo\r\n123\n\n"
 	reader := NewReader(strings.NewReader(input))
 
 	_, err := reader.Read()
-	if err != ErrInvalidCharacters {
+	if !errors.Is(err, ErrInvalidCharacters) {
 		t.Errorf("expected ErrInvalidCharacters, got %v", err)
 	}
 }
 
+func TestInvalidCharacterDetail(t *testing.T) {
+	tests := []struct {
+		input   string
+		detail  string
+		content string
+	}{
+		{"pointvalue foo\r\n123\n", "byte 0x0d at offset 14", "pointvalue foo\r"},
+		{"pointvalue foo\n12\x003\n", "byte 0x00 at offset 17", "12\x003"},
+		{"pointvalue foo\n123 \xc2\xb0C", "byte 0xc2 at offset 19", "123 \xc2\xb0C"},
+		{"\tpointvalue foo\n123\n", "byte 0x09 at offset 0", "\tpointvalue foo"},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.input))
+		if !errors.Is(err, ErrInvalidCharacters) {
+			t.Errorf("Parse(%q): expected ErrInvalidCharacters, got %v", tt.input, err)
+			continue
+		}
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Parse(%q): expected ParseError, got %T", tt.input, err)
+			continue
+		}
+		if !strings.Contains(parseErr.Message, tt.detail) {
+			t.Errorf("Parse(%q): expected %q in error, got %q", tt.input, tt.detail, parseErr.Message)
+		}
+		if parseErr.Content != tt.content {
+			t.Errorf("Parse(%q): expected offending line %q, got %q", tt.input, tt.content, parseErr.Content)
+		}
+	}
+}
+
 func TestNameHandling(t *testing.T) {
 	t.Run("SplitName qualified", func(t *testing.T) {
 		module, variable := SplitName("meter.net_power")
@@ -551,6 +1265,61 @@ func TestNumberFormatValidation(t *testing.T) {
 	}
 }
 
+func TestDecimalComma(t *testing.T) {
+	for _, input := range []string{"pointvalue power\n12,5", "timeseries power\n2025-12-06T08:00\n1.5\n-12,5"} {
+		_, err := Parse([]byte(input))
+		if !errors.Is(err, ErrInvalidValue) || !strings.Contains(err.Error(), "decimal separator must be '.'") {
+			t.Errorf("%q: expected hint about the decimal separator, got %v", input, err)
+		}
+	}
+
+	// only numbers that would be valid with a decimal point get the hint
+	for _, s := range []string{"1,234.5", "1,2,3", "12,5x", "123456789,5"} {
+		_, err := Parse([]byte("pointvalue power\n" + s))
+		if !errors.Is(err, ErrInvalidValue) || strings.Contains(err.Error(), "decimal separator") {
+			t.Errorf("%q: expected plain invalid value error, got %v", s, err)
+		}
+	}
+}
+
+func TestWideNumbers(t *testing.T) {
+	if _, err := Number(123456789); !errors.Is(err, ErrValueOutOfRange) {
+		t.Errorf("expected Number to reject 9 integer digits, got %v", err)
+	}
+	v, err := WideNumber(123456789012.345)
+	if err != nil {
+		t.Fatalf("expected WideNumber to accept 12 integer digits, got %v", err)
+	}
+	if v.String() != "123456789012.345" {
+		t.Errorf("expected 123456789012.345, got %s", v)
+	}
+	if _, err := WideNumber(1234567890123); !errors.Is(err, ErrValueOutOfRange) {
+		t.Errorf("expected WideNumber to reject 13 integer digits, got %v", err)
+	}
+
+	messages := []string{
+		"pointvalue total_energy\n123456789012.345",
+		"timeseries total_energy\n2025-12-06T08:00\n-999999999999.999\nmissing",
+	}
+	for _, input := range messages {
+		if _, err := Parse([]byte(input)); err == nil {
+			t.Errorf("expected wide number to be rejected by default: %q", input)
+		}
+		msg, err := ParseWithOptions([]byte(input), ParseOptions{WideNumbers: true})
+		if err != nil {
+			t.Errorf("expected wide number to be accepted with WideNumbers: %v", err)
+			continue
+		}
+		if string(msg.Encode()) != input {
+			t.Errorf("expected %q to round-trip, got %q", input, msg.Encode())
+		}
+	}
+
+	if _, err := ParseWithOptions([]byte("pointvalue x\n1234567890123"), ParseOptions{WideNumbers: true}); err == nil {
+		t.Error("expected 13 integer digits to be rejected with WideNumbers")
+	}
+}
+
 // Helper function for tests
 func mustNumber(f float64) Value {
 	v, err := Number(f)
@@ -559,3 +1328,116 @@ func mustNumber(f float64) Value {
 	}
 	return v
 }
+
+func TestHandshake(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).Write(Message{Name: HandshakeName, Payload: NewHandshake()}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "\n\nhandshake shem_hello\nprotocol 1\ntypes pointvalue timeseries command handshake response\n\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	msg, err := NewReader(&buf).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := msg.Payload.(Handshake)
+	if !ok || msg.Type() != "handshake" || msg.Name != HandshakeName {
+		t.Fatalf("expected handshake, got %+v", msg)
+	}
+	if h.Protocol != ProtocolVersion || !h.Supports("timeseries") || h.Supports("status") {
+		t.Errorf("unexpected capabilities %+v", h)
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	// a newer peer: higher protocol version, more types and unknown keys
+	msg, err := Parse([]byte("handshake shem_hello\nprotocol 3\ntypes pointvalue status\ncompression gzip\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := msg.Payload.(Handshake)
+	if h.Protocol != 3 || h.CommonProtocol() != ProtocolVersion || !h.Supports("status") || h.Supports("command") {
+		t.Errorf("unexpected capabilities %+v", h)
+	}
+
+	for _, input := range []string{
+		"handshake shem_hello\ntypes pointvalue",
+		"handshake shem_hello\nprotocol 1",
+		"handshake shem_hello\nprotocol 0\ntypes pointvalue",
+		"handshake shem_hello\nprotocol one\ntypes pointvalue",
+	} {
+		if _, err := Parse([]byte(input)); !errors.Is(err, ErrInvalidHandshake) {
+			t.Errorf("Parse(%q): expected ErrInvalidHandshake, got %v", input, err)
+		}
+	}
+}
+
+func TestQueryRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	query := Message{Name: QueryPrefix + ".config", Payload: Query{ID: "7", Args: []string{"max_power", "two words"}}}
+	if err := NewWriter(&buf).Write(query); err != nil {
+		t.Fatal(err)
+	}
+	expected := "\n\ncommand shem_query.config\nid 7\narg max_power\narg two words\n\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+	msg, err := NewReader(&buf).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, ok := msg.Payload.(Query)
+	if topic, _ := QueryTopic(msg.Name); !ok || msg.Type() != "command" || topic != "config" {
+		t.Fatalf("expected config query, got %+v", msg)
+	}
+	if q.ID != "7" || !slices.Equal(q.Args, []string{"max_power", "two words"}) {
+		t.Errorf("unexpected query %+v", q)
+	}
+
+	for _, response := range []Response{
+		{ID: q.ID, Values: []string{"11"}},
+		{ID: q.ID, Error: "unknown key max_power"},
+		{ID: q.ID},
+	} {
+		buf.Reset()
+		if err := NewWriter(&buf).Write(Message{Name: msg.Name, Payload: response}); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := NewReader(&buf).Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, ok := reply.Payload.(Response)
+		if !ok || reply.Type() != "response" || reply.Name != "shem_query.config" {
+			t.Fatalf("expected response, got %+v", reply)
+		}
+		if r.ID != response.ID || r.Error != response.Error || !slices.Equal(r.Values, response.Values) {
+			t.Errorf("expected %+v, got %+v", response, r)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	// other commands still must not have a body
+	if _, err := Parse([]byte("command peers\nid 7")); !errors.Is(err, ErrCommandBody) {
+		t.Errorf("expected ErrCommandBody, got %v", err)
+	}
+	if _, ok := QueryTopic("meter.peers"); ok {
+		t.Error("expected meter.peers not to be a query")
+	}
+
+	for _, input := range []string{
+		"command shem_query.peers",
+		"command shem_query.peers\narg x",
+		"command shem_query.peers\nid 7.1",
+		"response shem_query.peers\nvalue x",
+		"response shem_query.peers\nid \nvalue x",
+	} {
+		if _, err := Parse([]byte(input)); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("Parse(%q): expected ErrInvalidQuery, got %v", input, err)
+		}
+	}
+}